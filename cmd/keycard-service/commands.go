@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"keycard-service/keycard"
+)
+
+// commands lists the subcommands with a one-line summary, in the order
+// they are shown in the usage
+var commands = []struct{ name, summary string }{
+	{"run", "Run the service (default)"},
+	{"list", "List the enrolled cards"},
+	{"add", "Enroll cards"},
+	{"remove", "Remove enrolled cards"},
+	{"provision", "Enroll the master and first rider cards step by step"},
+	{"selftest", "Check the reader, LED and data directory without Redis"},
+	{"check", "Check the running service, or the hardware with -standalone"},
+	{"export", "Export the enrolled cards as CSV or JSON"},
+	{"import", "Import cards from CSV or JSON"},
+	{"backup", "Write the data directory to a tar.gz"},
+	{"restore", "Restore the data directory from a backup"},
+	{"revoke", "Add UIDs to the denylist, or remove or list them"},
+	{"seal-key", "Seal keys to the TPM"},
+	{"derive-key", "Print keys derived from the fleet secret"},
+	{"help", "Show this list"},
+}
+
+// printCommands writes the list of subcommands
+func printCommands(w io.Writer) {
+	fmt.Fprintf(w, "Commands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun 'keycard-service <command> -h' for the options of a command.\n")
+}
+
+// runCommand handles the subcommands operating on the data directory.
+// It returns false if args do not name a subcommand, i.e. the service is
+// run.
+func runCommand(args []string) bool {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = listCommand(args[1:])
+	case "add":
+		err = addCommand(args[1:])
+	case "remove":
+		err = removeCommand(args[1:])
+	case "provision":
+		err = provisionCommand(args[1:])
+	case "selftest":
+		err = selftestCommand(args[1:])
+	case "export":
+		err = exportCommand(args[1:])
+	case "import":
+		err = importCommand(args[1:])
+	case "backup":
+		err = backupCommand(args[1:])
+	case "restore":
+		err = restoreCommand(args[1:])
+	case "revoke":
+		err = revokeCommand(args[1:])
+	case "seal-key":
+		err = sealKeyCommand(args[1:])
+	case "derive-key":
+		err = deriveKeyCommand(args[1:])
+	case "check":
+		err = checkCommand(args[1:])
+	case "help":
+		fmt.Printf("Usage: keycard-service [command] [options]\n\n")
+		printCommands(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "keycard-service: unknown command %q\n\n", args[0])
+		printCommands(os.Stderr)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+func listCommand(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	secureElement := fs.String("secure-element", "", "Backend holding the key of a sealed card store, as given to the service")
+	deriveKeys := fs.String("derive-keys", "", "Device ID source the service derives keys from, as given to it")
+	role := fs.String("role", "", "Only list cards with this role")
+	fs.Parse(args)
+
+	am, err := openReadOnly(*dataDir, *secureElement, *deriveKeys)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UID\tROLE\tUSES\tGROUP\tEXPIRY\tLABEL")
+	for _, r := range am.Records() {
+		if *role != "" && r.Role != *role {
+			continue
+		}
+		uses := "-"
+		if r.Role == keycard.RoleGuest {
+			uses = strconv.Itoa(r.Uses)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.UID, r.Role, uses, orDash(r.Group), orDash(r.Expiry), r.Label)
+	}
+	return tw.Flush()
+}
+
+// openAuthManager opens the card store to change it. Changes take the
+// store lock, so they neither overwrite nor get overwritten by those of a
+// running service.
+func openAuthManager(dataDir, secureElement, deriveKeys string) (*keycard.AuthManager, error) {
+	return openStore(dataDir, secureElement, deriveKeys, keycard.NewSealedAuthManager)
+}
+
+// openReadOnly opens the card store without writing to the data directory
+func openReadOnly(dataDir, secureElement, deriveKeys string) (*keycard.AuthManager, error) {
+	return openStore(dataDir, secureElement, deriveKeys, keycard.NewReadOnlyAuthManager)
+}
+
+// openStore opens the card store with open, unsealing it with the key of
+// the secure element if the service seals it, derived like the service
+// does if deriveKeys is set
+func openStore(dataDir, secureElement, deriveKeys string, open func(string, []byte) (*keycard.AuthManager, error)) (*keycard.AuthManager, error) {
+	am, err := open(dataDir, nil)
+	if !errors.Is(err, keycard.ErrStoreSealed) {
+		return am, err
+	}
+	se, err := keycard.OpenSecureElement(secureElement, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer se.Close()
+	if deriveKeys != "" {
+		var r *keycard.RedisClient
+		if deriveKeys == keycard.DeviceIDVIN {
+			if r, err = keycard.NewRedisClient(keycard.DefaultRedisAddr, slog.Default()); err != nil {
+				return nil, err
+			}
+			defer r.Close()
+		}
+		deviceID, err := keycard.ReadDeviceID(deriveKeys, r)
+		if err != nil {
+			return nil, err
+		}
+		se = keycard.NewDerivedElement(se, deviceID)
+	}
+	key, err := keycard.StoreKey(se)
+	if err != nil {
+		return nil, err
+	}
+	return open(dataDir, key)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func addCommand(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	secureElement := fs.String("secure-element", "", "Backend holding the key of a sealed card store, as given to the service")
+	deriveKeys := fs.String("derive-keys", "", "Device ID source the service derives keys from, as given to it")
+	role := fs.String("role", keycard.RoleAuthorized, "Role of the cards: authorized, guest, onetime, override, or service")
+	uses := fs.Int("uses", 0, "Number of uses of guest cards")
+	label := fs.String("label", "", "Label of the cards")
+	group := fs.String("group", "", "Group of the cards")
+	expiry := fs.Duration("expires", 0, "Expire the cards after this long (0 for never)")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: keycard-service add [options] <uid>...")
+	}
+
+	am, err := openAuthManager(*dataDir, *secureElement, *deriveKeys)
+	if err != nil {
+		return err
+	}
+
+	card := keycard.Card{Role: *role, Uses: *uses, Label: *label, Group: *group}
+	if *expiry > 0 {
+		t := time.Now().Add(*expiry).UTC()
+		card.Expiry = &t
+	}
+	for _, uid := range fs.Args() {
+		card.UID = uid
+		added, err := am.AddCard(card)
+		if err != nil {
+			return err
+		}
+		if added {
+			fmt.Printf("Added %s\n", uid)
+		} else {
+			fmt.Printf("%s is already enrolled\n", uid)
+		}
+	}
+	return nil
+}
+
+func removeCommand(args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	secureElement := fs.String("secure-element", "", "Backend holding the key of a sealed card store, as given to the service")
+	deriveKeys := fs.String("derive-keys", "", "Device ID source the service derives keys from, as given to it")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: keycard-service remove [options] <uid>...")
+	}
+
+	am, err := openAuthManager(*dataDir, *secureElement, *deriveKeys)
+	if err != nil {
+		return err
+	}
+
+	missing := 0
+	for _, uid := range fs.Args() {
+		removed, err := am.Remove(uid)
+		if err != nil {
+			return err
+		}
+		if removed {
+			fmt.Printf("Removed %s\n", uid)
+		} else {
+			fmt.Printf("%s is not enrolled\n", uid)
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d cards were not enrolled", missing, fs.NArg())
+	}
+	return nil
+}
+
+// provisionCommand runs the provisioning wizard on the reader, which the
+// service must not be using
+func provisionCommand(args []string) error {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	device := fs.String("device", keycard.DefaultDevice, "NFC device path")
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	secureElement := fs.String("secure-element", "", "Backend holding the key of a sealed card store, as given to the service")
+	deriveKeys := fs.String("derive-keys", "", "Device ID source the service derives keys from, as given to it")
+	ledDevice := fs.String("led-device", "", "I2C device for LP5662 RGB LED (empty for shell scripts)")
+	ledAddress := fs.Uint("led-address", 0x30, "I2C address for LP5662 RGB LED")
+	role := fs.String("role", keycard.RoleAuthorized, "Role of the rider cards: authorized, guest, onetime, override, or service")
+	uses := fs.Int("uses", 0, "Number of uses of guest cards")
+	group := fs.String("group", "", "Group of the rider cards")
+	reset := fs.Bool("reset", false, "Enroll a new master card even if one is enrolled, removing all cards")
+	fs.Parse(args)
+
+	am, err := openAuthManager(*dataDir, *secureElement, *deriveKeys)
+	if err != nil {
+		return err
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var led keycard.RGBLed = keycard.NewLEDController(logger)
+	if *ledDevice != "" {
+		if led, err = keycard.NewLP5662(*ledDevice, uint8(*ledAddress), logger); err != nil {
+			return err
+		}
+	}
+
+	reader, err := keycard.OpenTagReader(*device)
+	if err != nil {
+		led.Close()
+		return err
+	}
+	defer reader.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	wizard := keycard.NewWizard(am, led, os.Stdin, os.Stdout, keycard.WizardOptions{
+		Role:  *role,
+		Uses:  *uses,
+		Group: *group,
+		Reset: *reset,
+	})
+	defer wizard.Close()
+
+	sum, err := wizard.Run(ctx, reader.UIDs())
+	sum.Print(os.Stdout)
+	return err
+}
+
+// selftestCommand checks the hardware like check -standalone, without
+// Redis unless an address is given
+func selftestCommand(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	device := fs.String("device", keycard.DefaultDevice, "NFC device path")
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	redisAddr := fs.String("redis", "", "Redis server address to check as well (empty to skip)")
+	ledDevice := fs.String("led-device", "", "I2C device for LP5662 RGB LED (empty for shell scripts)")
+	ledAddress := fs.Uint("led-address", 0x30, "I2C address for LP5662 RGB LED")
+	fs.Parse(args)
+
+	return printResults(keycard.CheckHardware(keycard.HardwareCheck{
+		Device:     *device,
+		DataDir:    *dataDir,
+		RedisAddr:  *redisAddr,
+		LEDDevice:  *ledDevice,
+		LEDAddress: uint8(*ledAddress),
+	}))
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	secureElement := fs.String("secure-element", "", "Backend holding the key of a sealed card store, as given to the service")
+	deriveKeys := fs.String("derive-keys", "", "Device ID source the service derives keys from, as given to it")
+	format := fs.String("format", "", "Output format: csv or json (default: from file extension, else csv)")
+	output := fs.String("o", "", "Output file (default: stdout)")
+	fs.Parse(args)
+
+	am, err := openReadOnly(*dataDir, *secureElement, *deriveKeys)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return keycard.WriteRecords(w, recordFormat(*format, *output), am.Records())
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	secureElement := fs.String("secure-element", "", "Backend holding the key of a sealed card store, as given to the service")
+	deriveKeys := fs.String("derive-keys", "", "Device ID source the service derives keys from, as given to it")
+	format := fs.String("format", "", "Input format: csv or json (default: from file extension, else csv)")
+	replace := fs.Bool("replace", false, "Replace all enrolled cards instead of merging")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: keycard-service import [options] <file>")
+	}
+	path := fs.Arg(0)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, err := keycard.ReadRecords(f, recordFormat(*format, path))
+	if err != nil {
+		return err
+	}
+
+	am, err := openAuthManager(*dataDir, *secureElement, *deriveKeys)
+	if err != nil {
+		return err
+	}
+	if err := am.Import(records, *replace); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d records\n", len(records))
+	return nil
+}
+
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	output := fs.String("o", "", "Output file (default: stdout)")
+	fs.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return keycard.Backup(*dataDir, w)
+}
+
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: keycard-service restore [options] <backup.tar.gz>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	release, err := keycard.LockStore(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer release()
+	names, err := keycard.Restore(f, *dataDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s\n", strings.Join(names, ", "))
+	return nil
+}
+
+func revokeCommand(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	secureElement := fs.String("secure-element", "", "Backend holding the key of a sealed card store, as given to the service")
+	deriveKeys := fs.String("derive-keys", "", "Device ID source the service derives keys from, as given to it")
+	remove := fs.Bool("remove", false, "Remove the UIDs from the denylist instead")
+	list := fs.Bool("list", false, "List revoked UIDs")
+	fs.Parse(args)
+
+	if !*list && fs.NArg() == 0 {
+		return fmt.Errorf("usage: keycard-service revoke [options] <uid>...")
+	}
+
+	open := openAuthManager
+	if *list {
+		open = openReadOnly
+	}
+	am, err := open(*dataDir, *secureElement, *deriveKeys)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *list:
+		for _, uid := range am.RevokedUIDs() {
+			fmt.Println(uid)
+		}
+		return nil
+	case *remove:
+		return am.Unrevoke(fs.Args()...)
+	default:
+		return am.Revoke(fs.Args()...)
+	}
+}
+
+func sealKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("seal-key", flag.ExitOnError)
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files")
+	pcrs := fs.String("pcrs", "", "PCR selection to seal to (default: sha256:0,7)")
+	keep := fs.Bool("keep", false, "Keep the plain key file after sealing")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: keycard-service seal-key [options] <key id>...")
+	}
+
+	dir := filepath.Join(*dataDir, "keys")
+	for _, id := range fs.Args() {
+		if err := keycard.SealKey(dir, id, *pcrs, *keep); err != nil {
+			return err
+		}
+		fmt.Printf("Sealed %s\n", id)
+	}
+	return nil
+}
+
+func deriveKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("derive-key", flag.ExitOnError)
+	fleetKeyFile := fs.String("fleet-key", "", "File holding the fleet secret (hex or base64)")
+	deviceID := fs.String("device-id", "", "Device ID of the scooter")
+	fs.Parse(args)
+
+	if *fleetKeyFile == "" || *deviceID == "" || fs.NArg() == 0 {
+		return fmt.Errorf("usage: keycard-service derive-key -fleet-key <file> -device-id <id> <key id>...")
+	}
+
+	fleet, err := keycard.LoadSecretKey(*fleetKeyFile)
+	if err != nil {
+		return err
+	}
+	for _, id := range fs.Args() {
+		key := keycard.DeriveKey(fleet, id, strings.ToLower(*deviceID))
+		fmt.Printf("%s %x\n", id, key)
+	}
+	return nil
+}
+
+func checkCommand(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	redisAddr := fs.String("redis", keycard.DefaultRedisAddr, "Redis server address")
+	standalone := fs.Bool("standalone", false, "Check the hardware directly instead of the running service, which must be stopped")
+	device := fs.String("device", keycard.DefaultDevice, "NFC device path (with -standalone)")
+	dataDir := fs.String("data-dir", keycard.DefaultDataDir, "Data directory for UID files (with -standalone)")
+	ledDevice := fs.String("led-device", "", "I2C device for LP5662 RGB LED (with -standalone, empty for shell scripts)")
+	ledAddress := fs.Uint("led-address", 0x30, "I2C address for LP5662 RGB LED (with -standalone)")
+	fs.Parse(args)
+
+	var results []keycard.SelfTestResult
+	if *standalone {
+		results = keycard.CheckHardware(keycard.HardwareCheck{
+			Device:     *device,
+			DataDir:    *dataDir,
+			RedisAddr:  *redisAddr,
+			LEDDevice:  *ledDevice,
+			LEDAddress: uint8(*ledAddress),
+		})
+	} else {
+		var err error
+		results, err = keycard.CheckService(*redisAddr)
+		if err != nil {
+			return err
+		}
+	}
+	return printResults(results)
+}
+
+// printResults prints self-test results and fails if a mandatory check did
+func printResults(results []keycard.SelfTestResult) error {
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Err == nil:
+			fmt.Printf("PASS %s\n", r.Name)
+		case r.Mandatory:
+			fmt.Printf("FAIL %s: %v\n", r.Name, r.Err)
+			failed++
+		default:
+			fmt.Printf("WARN %s: %v\n", r.Name, r.Err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d mandatory checks failed", failed)
+	}
+	return nil
+}
+
+func recordFormat(format, path string) string {
+	if format != "" {
+		return format
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return "json"
+	}
+	return "csv"
+}
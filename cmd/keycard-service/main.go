@@ -6,7 +6,9 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"keycard-service/keycard"
 )
@@ -14,25 +16,174 @@ import (
 var version = "dev"
 
 func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "run" {
+		args = args[1:]
+	} else if runCommand(args) {
+		return
+	}
+	runService(args)
+}
+
+// runService runs the service until it receives SIGINT or SIGTERM. Flags
+// without a subcommand run it as well.
+func runService(args []string) {
 	var (
-		device     string
-		dataDir    string
-		redisAddr  string
-		debug      bool
-		logLevel   int
-		ledDevice  string
-		ledAddress uint
+		device       string
+		dataDir      string
+		redisAddr    string
+		debug        bool
+		logLevel     int
+		ledDevice    string
+		ledAddress   uint
+		runAs        string
+		sandbox      bool
+		sandboxAllow []string
+		lockFile     string
+		dryRun       bool
+
+		replay      string
+		replaySpeed float64
+		record      string
+
+		capture       string
+		captureRedact bool
+
+		requireParked bool
+		toggleLock    bool
+		guestUses     int
+		tokenKeyFile  string
+		learnOneTime  bool
+		randomUIDs    string
+		cloneAction   string
+		cardMACPage   int
+		denyTech      []keycard.TagType
+
+		pollPeriod      uint
+		feedback        string
+		lockoutAttempts int
+		lockoutDuration time.Duration
+		debounceWindow  time.Duration
+		rearmAfter      time.Duration
+		grantCooldown   time.Duration
+		hibernateTaps   int
+		hibernateWindow time.Duration
+
+		syncURL      string
+		syncKeyFile  string
+		syncDeviceID string
+		syncInterval time.Duration
+		bloomFilter  bool
+
+		revocationURL      string
+		revocationInterval time.Duration
+		revocationKeyFile  string
+
+		secureElement string
+		sealStore     bool
+		deriveKeys    string
+		authMAC       bool
+		signAuth      bool
+
+		authExpiry time.Duration
+		authType   string
+		authFields = fieldsFlag{}
+
+		remoteCommands bool
+
+		telemetryURL      string
+		webhookURL        string
+		telemetryInterval time.Duration
+		httpListen        string
+		latencyBudget     time.Duration
+		stageTimeouts     keycard.StageTimeouts
+		intakeSize        int
+		shutdownTimeout   time.Duration
+
+		provisionDir     string
+		provisionKeyFile string
 	)
 
-	flag.StringVar(&device, "device", "/dev/pn5xx_i2c2", "NFC device path")
-	flag.StringVar(&dataDir, "data-dir", "/data/keycard", "Data directory for UID files")
-	flag.StringVar(&redisAddr, "redis", "localhost:6379", "Redis server address")
-	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
-	flag.IntVar(&logLevel, "log", 2, "Log level (0=error, 1=warn, 2=info, 3=debug)")
-	flag.StringVar(&ledDevice, "led-device", "", "I2C device for LP5662 RGB LED (empty for shell scripts)")
-	flag.UintVar(&ledAddress, "led-address", 0x30, "I2C address for LP5662 RGB LED")
-	showVersion := flag.Bool("version", false, "Print version and exit")
-	flag.Parse()
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	defaults := keycard.DefaultConfig()
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: keycard-service [run] [options]\n\nOptions:\n")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output())
+		printCommands(fs.Output())
+	}
+	fs.StringVar(&device, "device", defaults.Device, "NFC device path")
+	fs.StringVar(&dataDir, "data-dir", defaults.DataDir, "Data directory for UID files")
+	fs.StringVar(&redisAddr, "redis", defaults.RedisAddr, "Redis server address")
+	fs.BoolVar(&debug, "debug", false, "Enable debug logging")
+	fs.IntVar(&logLevel, "log", defaults.LogLevel, "Log level (0=error, 1=warn, 2=info, 3=debug)")
+	fs.StringVar(&ledDevice, "led-device", "", "I2C device for LP5662 RGB LED (empty for shell scripts)")
+	fs.UintVar(&ledAddress, "led-address", uint(defaults.LEDAddress), "I2C address for LP5662 RGB LED")
+	fs.StringVar(&runAs, "user", "", "User to switch to from root once the NFC and I2C devices are open (empty to keep running as started)")
+	fs.BoolVar(&sandbox, "sandbox", false, "Confine the service with Landlock and seccomp once initialized")
+	fs.Func("sandbox-allow", "Comma-separated further files or directories the LED scripts may read and write with --sandbox", func(s string) error {
+		sandboxAllow = strings.Split(s, ",")
+		return nil
+	})
+	fs.StringVar(&lockFile, "lock-file", "", "Lock file keeping a second instance from using the reader (default: /run/lock/keycard-service.<device>.lock)")
+	fs.BoolVar(&dryRun, "dry-run", false, "Evaluate taps and show them on the LED without publishing to Redis or persisting anything")
+	fs.StringVar(&replay, "replay", "", "Play back tag events recorded with --record instead of using the reader")
+	fs.Float64Var(&replaySpeed, "replay-speed", defaults.ReplaySpeed, "Speed-up of --replay, 1 for the recorded timing, 0 for no pauses")
+	fs.StringVar(&record, "record", "", "File the tag events from the reader are appended to, for --replay (empty to disable)")
+	fs.StringVar(&capture, "capture", "", "File the NCI packets and tag events of the reader are appended to (empty to disable)")
+	fs.BoolVar(&captureRedact, "capture-redact", false, "Replace UIDs in the --capture file by pseudonyms")
+	fs.BoolVar(&requireParked, "require-parked", false, "Only grant access while the scooter is parked")
+	fs.BoolVar(&toggleLock, "toggle-lock", false, "Request a lock when an authorized card is presented while unlocked")
+	fs.IntVar(&guestUses, "guest-uses", 0, "Enroll cards learned in learn mode as guest cards with this many uses (0 = unlimited)")
+	fs.StringVar(&tokenKeyFile, "token-key", "", "Ed25519 public key file for NDEF access tokens (empty to disable)")
+	fs.BoolVar(&learnOneTime, "learn-onetime", false, "Enroll cards learned in learn mode as one-time cards")
+	fs.StringVar(&randomUIDs, "random-uids", defaults.RandomUIDs, "Handling of random UIDs (phones, some clones): ignore, token, or allow")
+	fs.Func("deny-tech", "Comma-separated card types always denied, e.g. mifare-classic", func(s string) (err error) {
+		denyTech, err = keycard.ParseTagTypes(s)
+		return err
+	})
+	fs.StringVar(&cloneAction, "clone-action", defaults.CloneAction, "Action for cards from a known clone range: warn or deny")
+	fs.IntVar(&cardMACPage, "card-mac-page", 0, "First of four NTAG/Ultralight pages the card MAC is written to at enrollment (0 to disable)")
+	fs.UintVar(&pollPeriod, "poll-period", defaults.PollPeriod, "Discovery poll period in milliseconds")
+	fs.StringVar(&feedback, "feedback", defaults.Feedback, "LED feedback profile for taps: normal, short, or silent")
+	fs.IntVar(&lockoutAttempts, "lockout-attempts", 0, "Ignore taps after this many unknown cards in a row (0 to disable)")
+	fs.DurationVar(&lockoutDuration, "lockout-duration", defaults.LockoutDuration, "How long taps are ignored after a lockout")
+	fs.DurationVar(&debounceWindow, "debounce-window", 0, "Treat a card leaving and returning within this as the same tap")
+	fs.DurationVar(&rearmAfter, "rearm-after", 0, "Look up a card again after it was present this long (0 to disable)")
+	fs.DurationVar(&grantCooldown, "grant-cooldown", defaults.GrantCooldown, "Ignore taps for this long after a grant (0 to disable)")
+	fs.IntVar(&hibernateTaps, "hibernate-taps", 0, "Request hibernation after this many master card taps within --hibernate-window (0 to disable)")
+	fs.DurationVar(&hibernateWindow, "hibernate-window", defaults.HibernateWindow, "Time window for the hibernation gesture")
+	fs.StringVar(&syncURL, "sync-url", "", "Fleet backend URL for the authorized UID list (empty to disable)")
+	fs.StringVar(&syncKeyFile, "sync-key", "", "Ed25519 public key file verifying the fleet backend")
+	fs.StringVar(&syncDeviceID, "sync-device-id", defaults.SyncDeviceID, "Device ID the authorized list must be signed for: soc, machine-id, or vin")
+	fs.DurationVar(&syncInterval, "sync-interval", defaults.SyncInterval, "Authorized list sync interval (0 to sync only at startup)")
+	fs.BoolVar(&bloomFilter, "bloom-filter", false, "Pre-check UIDs with a Bloom filter, for synced lists of hundreds of thousands of UIDs")
+	fs.StringVar(&revocationURL, "revocation-url", "", "URL or redis:<key> serving the fleet revocation list (empty to disable)")
+	fs.DurationVar(&revocationInterval, "revocation-interval", defaults.RevocationInterval, "Revocation list fetch interval (0 to fetch only at startup)")
+	fs.StringVar(&revocationKeyFile, "revocation-key", "", "Ed25519 public key file verifying revocation deltas pushed via Redis (empty to disable)")
+	fs.StringVar(&secureElement, "secure-element", "", "Backend for secret keys: file:<dir> (default: <data-dir>/keys), or tpm2[:<pcrs>]")
+	fs.BoolVar(&sealStore, "seal-store", false, "Encrypt the card store under the \"store\" key of the secure element")
+	fs.StringVar(&deriveKeys, "derive-keys", "", "Derive keys from the fleet secret and the device ID: soc, machine-id, or vin (empty to use keys as stored)")
+	fs.BoolVar(&authMAC, "auth-mac", false, "MAC auth payloads published to Redis with the shared key \"redis\"")
+	fs.BoolVar(&signAuth, "sign-auth", false, "Sign auth payloads published to Redis with the Ed25519 key \"device\"")
+	fs.DurationVar(&authExpiry, "auth-expiry", defaults.AuthExpiry, "Expiry of the keycard hash in Redis")
+	fs.StringVar(&authType, "auth-type", defaults.AuthType, "Vehicle type published with every authentication")
+	fs.Var(authFields, "auth-field", "Static field added to every authentication as key=value (repeatable)")
+	fs.BoolVar(&remoteCommands, "remote-commands", false, "Accept commands on scooter:keycard authenticated with the shared key \"command\"")
+	fs.StringVar(&telemetryURL, "telemetry-url", "", "HTTPS endpoint receiving anonymized event batches (empty to disable)")
+	fs.StringVar(&webhookURL, "webhook-url", "", "URL receiving signed grant, denial and learn notifications (empty to disable)")
+	fs.DurationVar(&telemetryInterval, "telemetry-interval", defaults.TelemetryInterval, "Telemetry upload interval")
+	fs.StringVar(&httpListen, "http-listen", "", "Address for the HTTP listener serving /healthz, /readyz and /metrics, e.g. 127.0.0.1:8080 (empty to disable)")
+	fs.DurationVar(&latencyBudget, "latency-budget", defaults.LatencyBudget, "Log grants taking longer from tag arrival to publish (0 to disable)")
+	fs.DurationVar(&stageTimeouts.Identify, "identify-timeout", defaults.StageTimeouts.Identify, "Deadline for reading the card type and credentials of a tap")
+	fs.DurationVar(&stageTimeouts.Authorize, "authorize-timeout", defaults.StageTimeouts.Authorize, "Deadline for the access decision on a tap")
+	fs.DurationVar(&stageTimeouts.Publish, "publish-timeout", defaults.StageTimeouts.Publish, "Deadline for publishing an auth or event to Redis")
+	fs.IntVar(&intakeSize, "intake-size", defaults.IntakeSize, "Tag events buffered while the event loop is busy, the oldest are dropped beyond")
+	fs.DurationVar(&shutdownTimeout, "shutdown-timeout", defaults.ShutdownTimeout, "How long shutdown waits for publishes and LED animations to finish")
+	fs.StringVar(&provisionDir, "provision-dir", "", "Directory watched for signed provisioning bundles (empty to disable)")
+	fs.StringVar(&provisionKeyFile, "provision-key", "", "Ed25519 public key file of the operator signing bundles")
+	showVersion := fs.Bool("version", false, "Print version and exit")
+	fs.Parse(args)
 
 	if *showVersion {
 		fmt.Printf("keycard-service %s\n", version)
@@ -56,13 +207,79 @@ func main() {
 	}))
 
 	config := &keycard.Config{
-		Device:     device,
-		DataDir:    dataDir,
-		RedisAddr:  redisAddr,
-		Debug:      debug,
-		LogLevel:   logLevel,
-		LEDDevice:  ledDevice,
-		LEDAddress: uint8(ledAddress),
+		Device:       device,
+		DataDir:      dataDir,
+		RedisAddr:    redisAddr,
+		Debug:        debug,
+		LogLevel:     logLevel,
+		LEDDevice:    ledDevice,
+		LEDAddress:   uint8(ledAddress),
+		User:         runAs,
+		Sandbox:      sandbox,
+		SandboxAllow: sandboxAllow,
+		LockFile:     lockFile,
+		DryRun:       dryRun,
+
+		Replay:      replay,
+		ReplaySpeed: replaySpeed,
+		Record:      record,
+
+		Capture:       capture,
+		CaptureRedact: captureRedact,
+
+		RequireParked: requireParked,
+		ToggleLock:    toggleLock,
+		GuestUses:     guestUses,
+		TokenKeyFile:  tokenKeyFile,
+		LearnOneTime:  learnOneTime,
+		RandomUIDs:    randomUIDs,
+		CloneAction:   cloneAction,
+		CardMACPage:   cardMACPage,
+		DenyTech:      denyTech,
+
+		PollPeriod:      pollPeriod,
+		Feedback:        feedback,
+		LockoutAttempts: lockoutAttempts,
+		LockoutDuration: lockoutDuration,
+		DebounceWindow:  debounceWindow,
+		RearmAfter:      rearmAfter,
+		GrantCooldown:   grantCooldown,
+		HibernateTaps:   hibernateTaps,
+		HibernateWindow: hibernateWindow,
+
+		SyncURL:      syncURL,
+		SyncKeyFile:  syncKeyFile,
+		SyncDeviceID: syncDeviceID,
+		SyncInterval: syncInterval,
+		BloomFilter:  bloomFilter,
+
+		RevocationURL:      revocationURL,
+		RevocationInterval: revocationInterval,
+		RevocationKeyFile:  revocationKeyFile,
+
+		SecureElement: secureElement,
+		SealStore:     sealStore,
+		DeriveKeys:    deriveKeys,
+		AuthMAC:       authMAC,
+		SignAuth:      signAuth,
+
+		AuthExpiry: authExpiry,
+		AuthType:   authType,
+		AuthFields: authFields,
+
+		RemoteCommands: remoteCommands,
+
+		TelemetryURL:      telemetryURL,
+		WebhookURL:        webhookURL,
+		TelemetryInterval: telemetryInterval,
+		HTTPListen:        httpListen,
+		LatencyBudget:     latencyBudget,
+		StageTimeouts:     stageTimeouts,
+		IntakeSize:        intakeSize,
+		ShutdownTimeout:   shutdownTimeout,
+
+		ProvisionDir:     provisionDir,
+		ProvisionKeyFile: provisionKeyFile,
 	}
 
 	service, err := keycard.NewService(config, logger)
@@ -74,12 +291,6 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		<-sigChan
-		logger.Info("Received shutdown signal")
-		service.Stop()
-	}()
-
 	ledInfo := "shell scripts"
 	if ledDevice != "" {
 		ledInfo = fmt.Sprintf("LP5662 at %s:0x%02X", ledDevice, ledAddress)
@@ -90,8 +301,39 @@ func main() {
 		"redis", redisAddr,
 		"led", ledInfo)
 
-	if err := service.Run(); err != nil {
+	if err := service.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Service error: %v\n", err)
+		os.Exit(1)
+	}
+	select {
+	case <-sigChan:
+		logger.Info("Received shutdown signal")
+	case <-service.Done():
+		// A replay ended, or the event loop failed
+	}
+	service.Stop()
+	if err := service.Wait(); err != nil {
 		fmt.Fprintf(os.Stderr, "Service error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// fieldsFlag collects repeated key=value flags
+type fieldsFlag map[string]string
+
+func (f fieldsFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f fieldsFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	f[k] = v
+	return nil
+}
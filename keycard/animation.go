@@ -0,0 +1,243 @@
+package keycard
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Frame shows a color for a while, or until the next animation if For is
+// 0. A nil Show turns the LED off.
+type Frame struct {
+	Show func() error
+	For  time.Duration
+}
+
+// Animation plays its frames in order. It holds its last frame, or starts
+// over if it loops.
+type Animation struct {
+	Frames []Frame
+	Loop   bool
+}
+
+// SolidAnimation shows a color until the next animation
+func SolidAnimation(show func() error) Animation {
+	return Animation{Frames: []Frame{{Show: show}}}
+}
+
+// FlashAnimation shows a color for the duration
+func FlashAnimation(show func() error, duration time.Duration) Animation {
+	return Animation{Frames: []Frame{{Show: show, For: duration}, {}}}
+}
+
+// BlinkAnimation blinks a color count times, or until the next animation
+// if count is 0
+func BlinkAnimation(show func() error, count int, interval time.Duration) Animation {
+	on, off := Frame{Show: show, For: interval}, Frame{For: interval}
+	if count == 0 {
+		return Animation{Frames: []Frame{on, off}, Loop: true}
+	}
+	frames := make([]Frame, 0, 2*count)
+	for i := 0; i < count; i++ {
+		frames = append(frames, on, off)
+	}
+	frames[len(frames)-1] = Frame{}
+	return Animation{Frames: frames}
+}
+
+// Animator is the only writer of an RGB LED. It plays one animation at a
+// time from a dedicated goroutine; a new animation replaces the current
+// one, so the end of a flash can never turn off what was shown after it.
+// Animations started faster than the LED is written are coalesced, only
+// the latest one plays, and callers never wait for the LED.
+type Animator struct {
+	led     RGBLed
+	clock   Clock
+	mu      sync.Mutex
+	pending *animatorRequest // latest request not picked up yet
+	wake    chan struct{}
+	refresh chan chan error
+	settle  chan chan struct{}
+	done    chan struct{}
+}
+
+type animatorRequest struct {
+	anim     Animation
+	stopLoop bool // only ends a looping animation
+	close    bool
+}
+
+// NewAnimator plays animations on the LED with frame durations taken by
+// the clock
+func NewAnimator(led RGBLed, clock Clock) *Animator {
+	a := &Animator{
+		led:     led,
+		clock:   clock,
+		wake:    make(chan struct{}, 1),
+		refresh: make(chan chan error),
+		settle:  make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Play replaces the current animation
+func (a *Animator) Play(anim Animation) {
+	a.send(animatorRequest{anim: anim})
+}
+
+// Off turns the LED off
+func (a *Animator) Off() {
+	a.send(animatorRequest{})
+}
+
+// StopLoop turns the LED off if a looping animation plays, and leaves
+// anything shown since it started alone
+func (a *Animator) StopLoop() {
+	a.send(animatorRequest{stopLoop: true})
+}
+
+// Refresh writes the current frame again and returns the LED's error
+func (a *Animator) Refresh() error {
+	errc := make(chan error, 1)
+	select {
+	case a.refresh <- errc:
+		return <-errc
+	case <-a.done:
+		return nil
+	}
+}
+
+// Settle waits until the current animation holds its last frame, e.g. for
+// a flash to end, and reports whether it did before ctx was done. Looping
+// animations never end and count as settled.
+func (a *Animator) Settle(ctx context.Context) bool {
+	done := make(chan struct{})
+	select {
+	case a.settle <- done:
+	case <-a.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-a.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Close turns the LED off and closes it
+func (a *Animator) Close() error {
+	a.send(animatorRequest{close: true})
+	<-a.done
+	return nil
+}
+
+func (a *Animator) send(req animatorRequest) {
+	a.mu.Lock()
+	if a.pending == nil || !a.pending.close {
+		a.pending = &req
+	}
+	a.mu.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Animator) take() *animatorRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	req := a.pending
+	a.pending = nil
+	return req
+}
+
+func (a *Animator) run() {
+	defer close(a.done)
+
+	cur, frame := Animation{Frames: []Frame{{}}}, 0
+	timer := a.clock.NewTimer(time.Hour)
+	timer.Stop()
+	armed := false // a timed frame is showing
+	var settling []chan struct{}
+	settled := func() {
+		if armed && !cur.Loop {
+			return
+		}
+		for _, done := range settling {
+			close(done)
+		}
+		settling = nil
+	}
+	stop := func() {
+		armed = false
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+	}
+	show := func() error {
+		if f := cur.Frames[frame]; f.Show != nil {
+			return f.Show()
+		}
+		return a.led.Off()
+	}
+
+	for {
+		select {
+		case <-a.wake:
+			req := a.take()
+			if req == nil || req.stopLoop && !cur.Loop {
+				continue
+			}
+			stop()
+			if req.close {
+				a.led.Off()
+				a.led.Close()
+				settled()
+				return
+			}
+			cur, frame = req.anim, 0
+			if len(cur.Frames) == 0 || req.stopLoop {
+				cur = Animation{Frames: []Frame{{}}}
+			}
+
+		case <-timer.C():
+			armed = false
+			frame++
+			if frame == len(cur.Frames) {
+				if !cur.Loop {
+					frame--
+					settled()
+					continue
+				}
+				frame = 0
+			}
+
+		case errc := <-a.refresh:
+			errc <- show()
+			continue
+
+		case done := <-a.settle:
+			settling = append(settling, done)
+			settled()
+			continue
+		}
+
+		show()
+		if d := cur.Frames[frame].For; d > 0 {
+			timer.Reset(d)
+			armed = true
+		}
+		settled()
+	}
+}
@@ -0,0 +1,174 @@
+package keycard
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordLED records the colors it is set to. Writes wait for gate if set.
+type recordLED struct {
+	mu    sync.Mutex
+	calls []string
+	gate  chan struct{}
+}
+
+func (l *recordLED) record(call string) error {
+	if l.gate != nil {
+		<-l.gate
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+	return nil
+}
+
+func (l *recordLED) log() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.calls)
+}
+
+func (l *recordLED) last() string {
+	calls := l.log()
+	if len(calls) == 0 {
+		return ""
+	}
+	return calls[len(calls)-1]
+}
+
+func (l *recordLED) On() error    { return l.record("on") }
+func (l *recordLED) Off() error   { return l.record("off") }
+func (l *recordLED) Close() error { return l.record("close") }
+func (l *recordLED) Red() error   { return l.record("red") }
+func (l *recordLED) Green() error { return l.record("green") }
+func (l *recordLED) Amber() error { return l.record("amber") }
+
+// waitFor polls until the LED was last set to want
+func waitFor(t *testing.T, led *recordLED, want string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for led.last() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected LED to be %s, calls %v", want, led.log())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBlinkAnimation(t *testing.T) {
+	anim := BlinkAnimation(func() error { return nil }, 3, time.Second)
+	if len(anim.Frames) != 6 || anim.Loop {
+		t.Fatalf("expected 6 frames without loop, got %d frames, loop %v", len(anim.Frames), anim.Loop)
+	}
+	if last := anim.Frames[5]; last.Show != nil || last.For != 0 {
+		t.Error("expected blinks to end off")
+	}
+	if anim := BlinkAnimation(nil, 0, time.Second); !anim.Loop || len(anim.Frames) != 2 {
+		t.Error("expected endless blink to loop on and off")
+	}
+}
+
+func TestAnimator_LookupGrantOff(t *testing.T) {
+	led := &recordLED{}
+	a := NewAnimator(led, SystemClock)
+	defer a.Close()
+
+	a.Play(SolidAnimation(led.Amber))
+	waitFor(t, led, "amber")
+	a.Play(FlashAnimation(led.Green, 20*time.Millisecond))
+	waitFor(t, led, "green")
+	waitFor(t, led, "off")
+	if calls := led.log(); !slices.Equal(calls, []string{"amber", "green", "off"}) {
+		t.Errorf("expected amber, green, off, got %v", calls)
+	}
+}
+
+func TestAnimator_FlashDoesNotEndLaterBlink(t *testing.T) {
+	led := &recordLED{}
+	a := NewAnimator(led, SystemClock)
+	defer a.Close()
+
+	a.Play(FlashAnimation(led.Green, 30*time.Millisecond))
+	waitFor(t, led, "green")
+	a.Play(BlinkAnimation(led.On, 0, 200*time.Millisecond))
+	waitFor(t, led, "on")
+
+	// The flash would have turned the LED off by now
+	time.Sleep(60 * time.Millisecond)
+	if last := led.last(); last != "on" {
+		t.Errorf("expected blink to go on, LED is %s", last)
+	}
+
+	a.StopLoop()
+	waitFor(t, led, "off")
+}
+
+func TestAnimator_StopLoopKeepsLaterFeedback(t *testing.T) {
+	led := &recordLED{}
+	a := NewAnimator(led, SystemClock)
+	defer a.Close()
+
+	a.Play(BlinkAnimation(led.On, 0, 20*time.Millisecond))
+	waitFor(t, led, "on")
+	a.Play(SolidAnimation(led.Red))
+	waitFor(t, led, "red")
+	a.StopLoop()
+	time.Sleep(30 * time.Millisecond)
+	if last := led.last(); last != "red" {
+		t.Errorf("expected StopLoop to leave red alone, LED is %s", last)
+	}
+}
+
+func TestAnimator_Coalesces(t *testing.T) {
+	led := &recordLED{gate: make(chan struct{})}
+	a := NewAnimator(led, SystemClock)
+
+	// The animator waits for the LED to show amber, the rest piles up
+	a.Play(SolidAnimation(led.Amber))
+	time.Sleep(10 * time.Millisecond)
+	a.Play(SolidAnimation(led.Red))
+	a.Play(SolidAnimation(led.Amber))
+	a.Play(SolidAnimation(led.Green))
+	close(led.gate)
+
+	waitFor(t, led, "green")
+	a.Close()
+	if calls := led.log(); !slices.Equal(calls, []string{"amber", "green", "off", "close"}) {
+		t.Errorf("expected intermediate colors to be skipped, got %v", calls)
+	}
+}
+
+func TestAnimator_Settle(t *testing.T) {
+	led := &recordLED{}
+	a := NewAnimator(led, SystemClock)
+	defer a.Close()
+
+	a.Play(FlashAnimation(led.Green, 50*time.Millisecond))
+	waitFor(t, led, "green")
+	start := time.Now()
+	if !a.Settle(context.Background()) {
+		t.Fatal("expected the flash to settle")
+	}
+	if time.Since(start) < 20*time.Millisecond || led.last() != "off" {
+		t.Errorf("expected Settle to wait for the flash to end, calls %v", led.log())
+	}
+
+	a.Play(BlinkAnimation(led.Red, 0, time.Hour))
+	waitFor(t, led, "red")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !a.Settle(ctx) {
+		t.Error("expected a looping animation to count as settled")
+	}
+
+	a.Play(FlashAnimation(led.Amber, time.Hour))
+	waitFor(t, led, "amber")
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if a.Settle(ctx) {
+		t.Error("expected Settle to give up at the deadline")
+	}
+}
@@ -0,0 +1,24 @@
+package keycard
+
+import (
+	"fmt"
+)
+
+// Transceiver exchanges raw ISO 7816-4 APDUs with an ISO-DEP card
+type Transceiver interface {
+	Transceive(apdu []byte) ([]byte, error)
+}
+
+// transceive sends a raw APDU and splits the response into data and
+// status word
+func transceive(t Transceiver, raw []byte) ([]byte, uint16, error) {
+	resp, err := t.Transceive(raw)
+	if err != nil {
+		return nil, 0, fmt.Errorf("APDU exchange failed: %w", err)
+	}
+	if len(resp) < 2 {
+		return nil, 0, fmt.Errorf("response too short")
+	}
+	n := len(resp) - 2
+	return resp[:n], uint16(resp[n])<<8 | uint16(resp[n+1]), nil
+}
@@ -1,197 +1,764 @@
 package keycard
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Card roles
+const (
+	RoleMaster     = "master"
+	RoleAuthorized = "authorized"
+	RoleGuest      = "guest"
+	RoleOneTime    = "onetime"
+	RoleConsumed   = "consumed"
+	RoleOverride   = "override" // emergency access, granted even during a lockout
+	RoleService    = "service"  // mechanics, grants put the scooter into diagnostics mode
+)
+
+// Card is an enrolled card as stored in the data directory
+type Card struct {
+	UID    string     `json:"uid"`
+	Role   string     `json:"role"`
+	Label  string     `json:"label,omitempty"`
+	Group  string     `json:"group,omitempty"` // see Group
+	MAC    bool       `json:"mac,omitempty"`   // the card carries its CardMAC
+	Expiry *time.Time `json:"expiry,omitempty"`
+	Uses   int        `json:"uses,omitempty"`   // remaining uses of guest cards
+	Synced bool       `json:"synced,omitempty"` // added by a fleet sync, removed when the list drops it
+}
+
+func (c *Card) expired(now time.Time) bool {
+	return c.Expiry != nil && !now.Before(*c.Expiry)
+}
+
+// AuthManager holds the enrolled cards and denylists. Taps read an
+// immutable snapshot without locking; changes are made to a copy that
+// replaces the snapshot when it is saved, so a fleet sync rewriting
+// thousands of cards never blocks a tap.
 type AuthManager struct {
-	mu             sync.RWMutex
-	dataDir        string
-	masterUIDs     []string
-	authorizedUIDs []string
+	mu        sync.Mutex // serializes changes
+	snap      atomic.Pointer[authSnapshot]
+	dataDir   string
+	recovered []string // files restored from their last-known-good copy
+	bloom     bool     // snapshots get a Bloom filter, see EnableBloomFilter
+	inMemory  bool     // changes are not written, see KeepInMemory
+	clock     Clock    // tells whether cards expired
+	storeKey  []byte   // key of a sealed card store, see NewSealedAuthManager
+	sealed    bool     // the card store on disk is sealed
+	readOnly  bool     // changes are refused, see NewReadOnlyAuthManager
 }
 
+// authSnapshot is the state of an AuthManager at one point in time. Once
+// published it is never modified.
+type authSnapshot struct {
+	cards   []Card
+	index   cardIndex
+	revoked map[string]bool // denylist overriding all roles but master
+
+	remote        *RevocationList // fleet revocation list, see RevocationFetcher
+	remoteRevoked map[string]bool
+}
+
+// ErrStoreReadOnly is returned when changing the cards of an AuthManager
+// opened with NewReadOnlyAuthManager
+var ErrStoreReadOnly = errors.New("card store is opened read-only")
+
 func NewAuthManager(dataDir string) (*AuthManager, error) {
+	return openAuthManager(dataDir, nil, false)
+}
+
+// NewReadOnlyAuthManager opens the card store without writing to the data
+// directory: files failing their checksum are read from their copy but not
+// repaired, a data directory in an older format is refused rather than
+// migrated, and changes fail with ErrStoreReadOnly. storeKey opens a sealed
+// store, see NewSealedAuthManager.
+func NewReadOnlyAuthManager(dataDir string, storeKey []byte) (*AuthManager, error) {
+	return openAuthManager(dataDir, storeKey, true)
+}
+
+func openAuthManager(dataDir string, storeKey []byte, readOnly bool) (*AuthManager, error) {
 	am := &AuthManager{
-		dataDir: dataDir,
+		dataDir:  dataDir,
+		clock:    SystemClock,
+		storeKey: storeKey,
+		readOnly: readOnly,
 	}
+	s := &authSnapshot{}
 
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	if readOnly {
+		if _, err := os.Stat(filepath.Join(dataDir, storeFileName)); os.IsNotExist(err) && hasV1Files(dataDir) {
+			return nil, fmt.Errorf("data directory %s is in the v1 format and is only migrated when opened for writing", dataDir)
+		}
+	} else {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %w", err)
+		}
+		// Migration and repairs write, like changes
+		lock, err := lockStore(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+
+		recovered, err := migrateStore(dataDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate data directory: %w", err)
+		}
+		am.recovered = recovered
 	}
 
-	if err := am.loadMasterUIDs(); err != nil {
-		return nil, fmt.Errorf("failed to load master UIDs: %w", err)
+	repair := !readOnly
+	cards, sealed, wasRecovered, err := readStore(dataDir, storeKey, repair)
+	am.sealed = sealed
+	if wasRecovered {
+		am.recovered = append(am.recovered, storeFileName)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cards: %w", err)
+	}
+	s.setCards(cards)
+
+	revoked, wasRecovered, err := readRevoked(dataDir, repair)
+	if wasRecovered {
+		am.recovered = append(am.recovered, revokedFileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load revoked UIDs: %w", err)
+	}
+	s.revoked = revoked
 
-	if err := am.loadAuthorizedUIDs(); err != nil {
-		return nil, fmt.Errorf("failed to load authorized UIDs: %w", err)
+	remote, wasRecovered, err := readRemoteRevoked(dataDir, repair)
+	if wasRecovered {
+		am.recovered = append(am.recovered, remoteRevokedFileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load revocation list: %w", err)
 	}
+	s.remote = remote
+	s.remoteRevoked = uidSet(remote.UIDs)
 
+	am.publish(s)
 	return am, nil
 }
 
-func (am *AuthManager) masterFilePath() string {
-	return filepath.Join(am.dataDir, "master_uids.txt")
+// Reload rereads the card store after it was changed by another process.
+// It reports whether the cards differ from the ones in memory; on error the
+// current cards are kept.
+func (am *AuthManager) Reload() (bool, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	return am.reload()
 }
 
-func (am *AuthManager) authorizedFilePath() string {
-	return filepath.Join(am.dataDir, "authorized_uids.txt")
+// reload is Reload. The caller holds mu.
+func (am *AuthManager) reload() (bool, error) {
+	cards, _, _, err := readStore(am.dataDir, am.storeKey, !am.readOnly)
+	if err != nil {
+		return false, err
+	}
+	revoked, _, err := readRevoked(am.dataDir, !am.readOnly)
+	if err != nil {
+		return false, err
+	}
+	cur := am.snap.Load()
+	if reflect.DeepEqual(cards, cur.cards) && reflect.DeepEqual(revoked, cur.revoked) {
+		return false, nil
+	}
+	s := *cur
+	s.setCards(cards)
+	s.revoked = revoked
+	am.publish(&s)
+	return true, nil
 }
 
-func (am *AuthManager) loadMasterUIDs() error {
-	am.masterUIDs = nil
-
-	data, err := os.ReadFile(am.masterFilePath())
-	if os.IsNotExist(err) {
-		return nil
+// lock is taken for a change and returns the function releasing it. Unless
+// changes are kept in memory, it also takes the store lock and rereads the
+// store, so a change made by another process meanwhile, e.g. by the add
+// command while the service runs, is built on instead of overwritten.
+func (am *AuthManager) lock() (unlock func(), err error) {
+	am.mu.Lock()
+	if am.readOnly {
+		am.mu.Unlock()
+		return nil, ErrStoreReadOnly
+	}
+	if am.inMemory {
+		return am.mu.Unlock, nil
 	}
+	l, err := lockStore(am.dataDir)
 	if err != nil {
-		return err
+		am.mu.Unlock()
+		return nil, err
 	}
+	// If the store fails to load, the change is made to the cards in
+	// memory and replaces it
+	am.reload()
+	return func() {
+		l.Release()
+		am.mu.Unlock()
+	}, nil
+}
 
-	scanner := bufio.NewScanner(strings.NewReader(string(data)))
-	for scanner.Scan() {
-		uid := strings.TrimSpace(scanner.Text())
-		if uid != "" {
-			// Normalize: remove spaces and uppercase
-			uid = strings.ToUpper(strings.ReplaceAll(uid, " ", ""))
-			am.masterUIDs = append(am.masterUIDs, uid)
+// publish makes a snapshot the one taps read. The caller holds mu.
+func (am *AuthManager) publish(s *authSnapshot) {
+	if am.bloom && s.index.bloom == nil {
+		s.index.bloom = newBloomFilter(len(s.index.uids))
+		for k := range s.index.uids {
+			s.index.bloom.add(k)
 		}
 	}
-	return scanner.Err()
+	am.snap.Store(s)
 }
 
-func (am *AuthManager) loadAuthorizedUIDs() error {
-	am.authorizedUIDs = nil
+// EnableBloomFilter puts a Bloom filter in front of the card index, so
+// taps of cards that are definitely not enrolled do not touch it. It pays
+// off with lists of hundreds of thousands of UIDs; the filter is rebuilt
+// on every change.
+func (am *AuthManager) EnableBloomFilter() {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.bloom = true
+	s := *am.snap.Load()
+	am.publish(&s)
+}
+
+// UseClock makes card expiries follow the clock. Call it before the
+// AuthManager is shared.
+func (am *AuthManager) UseClock(clock Clock) {
+	am.clock = clock
+}
+
+// KeepInMemory makes changes take effect without writing them to the data
+// directory, so they are gone after a restart
+func (am *AuthManager) KeepInMemory() {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.inMemory = true
+}
+
+// edit returns a copy of the current snapshot to change and save. The
+// caller holds mu.
+func (am *AuthManager) edit() *authSnapshot {
+	cur := am.snap.Load()
+	s := *cur
+	s.setCards(slices.Clone(cur.cards))
+	s.revoked = maps.Clone(cur.revoked)
+	return &s
+}
 
-	data, err := os.ReadFile(am.authorizedFilePath())
-	if os.IsNotExist(err) {
+// save publishes a changed snapshot and writes its cards to the store.
+// The snapshot is published even if writing fails, like the cards were
+// kept in memory before.
+func (am *AuthManager) save(s *authSnapshot) error {
+	am.publish(s)
+	if am.inMemory {
 		return nil
 	}
-	if err != nil {
-		return err
+	return writeStore(am.dataDir, s.cards, am.storeKey)
+}
+
+// cardIndex maps the identifiers of enrolled cards to their position in
+// AuthManager.cards, so taps do not scan lists synced with thousands of
+// UIDs. Where a list edited by hand has duplicates, the first card wins.
+type cardIndex struct {
+	uids     map[uidKey]int    // UIDs
+	rules    map[string]int    // prefix rules and other entries that are no UID, as stored
+	prefixes map[string]int    // authorized prefix rules without the wildcard
+	strs     map[string]string // interned labels and groups
+	bloom    *bloomFilter      // UIDs, built when a snapshot is published
+}
+
+// setCards replaces the cards and rebuilds the index
+func (s *authSnapshot) setCards(cards []Card) {
+	s.cards = cards
+	s.index = cardIndex{
+		uids:     make(map[uidKey]int, len(cards)),
+		rules:    make(map[string]int),
+		prefixes: make(map[string]int),
+		strs:     make(map[string]string),
+	}
+	for i := range cards {
+		s.indexCard(i)
+	}
+}
+
+// appendCard enrolls a card at the end of the list
+func (s *authSnapshot) appendCard(card Card) {
+	s.cards = append(s.cards, card)
+	s.indexCard(len(s.cards) - 1)
+}
+
+// intern returns the copy of str shared by all cards of the snapshot.
+// Synced lists label thousands of cards alike, which would otherwise each
+// keep their own copy decoded from the store.
+func (s *authSnapshot) intern(str string) string {
+	if str == "" {
+		return ""
+	}
+	if v, ok := s.index.strs[str]; ok {
+		return v
 	}
+	s.index.strs[str] = str
+	return str
+}
+
+// removeCard drops the card at position i
+func (s *authSnapshot) removeCard(i int) {
+	s.setCards(append(s.cards[:i], s.cards[i+1:]...))
+}
 
-	scanner := bufio.NewScanner(strings.NewReader(string(data)))
-	for scanner.Scan() {
-		uid := strings.TrimSpace(scanner.Text())
-		if uid != "" {
-			// Normalize: remove spaces and uppercase
-			uid = strings.ToUpper(strings.ReplaceAll(uid, " ", ""))
-			am.authorizedUIDs = append(am.authorizedUIDs, uid)
+func (s *authSnapshot) indexCard(i int) {
+	add := func(m map[string]int, k string) {
+		if _, ok := m[k]; k != "" && !ok {
+			m[k] = i
 		}
 	}
-	return scanner.Err()
+	c := &s.cards[i]
+	c.Label, c.Group = s.intern(c.Label), s.intern(c.Group)
+	if k, ok := makeUIDKey(c.UID); ok {
+		if _, dup := s.index.uids[k]; !dup {
+			s.index.uids[k] = i
+		}
+	} else {
+		add(s.index.rules, c.UID)
+	}
+	if prefix, ok := strings.CutSuffix(c.UID, UIDWildcard); ok && c.Role == RoleAuthorized {
+		add(s.index.prefixes, prefix)
+	}
 }
 
-func (am *AuthManager) HasMaster() bool {
-	am.mu.RLock()
-	defer am.mu.RUnlock()
-	return len(am.masterUIDs) > 0
+// find returns the index of the card with the given normalized UID, or -1
+func (s *authSnapshot) find(uid string) int {
+	k, ok := makeUIDKey(uid)
+	if !ok {
+		return indexOf(s.index.rules, uid)
+	}
+	if s.index.bloom != nil && !s.index.bloom.mayContain(k) {
+		return -1
+	}
+	if i, ok := s.index.uids[k]; ok {
+		return i
+	}
+	return -1
 }
 
-func (am *AuthManager) IsMaster(uid string) bool {
-	am.mu.RLock()
-	defer am.mu.RUnlock()
-	uid = strings.ToUpper(uid)
-	for _, m := range am.masterUIDs {
-		if m == uid {
+func indexOf(m map[string]int, k string) int {
+	if i, ok := m[k]; ok && k != "" {
+		return i
+	}
+	return -1
+}
+
+// UIDWildcard ends a prefix rule: "04AABB*" authorizes every UID starting with 04AABB
+const UIDWildcard = "*"
+
+// matchPrefix returns the index of the longest authorized prefix rule
+// matching uid, or -1
+func (s *authSnapshot) matchPrefix(uid string) int {
+	if len(s.index.prefixes) == 0 {
+		return -1
+	}
+	for n := len(uid); n > 0; n-- {
+		if i, ok := s.index.prefixes[uid[:n]]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup returns the card with the given UID if it has the role
+func (s *authSnapshot) lookup(uid, role string) *Card {
+	i := s.find(canonicalUID(uid))
+	if i < 0 || s.cards[i].Role != role {
+		return nil
+	}
+	return &s.cards[i]
+}
+
+// Recovered returns the files that failed verification at load and were
+// restored from their last-known-good copy
+func (am *AuthManager) Recovered() []string {
+	return append([]string(nil), am.recovered...)
+}
+
+func (am *AuthManager) HasMaster() bool {
+	s := am.snap.Load()
+	for _, c := range s.cards {
+		if c.Role == RoleMaster {
 			return true
 		}
 	}
 	return false
 }
 
+func (am *AuthManager) IsMaster(uid string) bool {
+	s := am.snap.Load()
+	return s.lookup(uid, RoleMaster) != nil
+}
+
 func (am *AuthManager) IsAuthorized(uid string) bool {
-	am.mu.RLock()
-	defer am.mu.RUnlock()
-	uid = strings.ToUpper(uid)
+	s := am.snap.Load()
 
-	for _, m := range am.masterUIDs {
-		if m == uid {
-			return true
-		}
+	uid = canonicalUID(uid)
+	i := s.find(uid)
+	if i < 0 {
+		// Cards enrolled individually take precedence over prefix rules
+		i = s.matchPrefix(uid)
+	}
+	if i < 0 {
+		return false
 	}
 
-	for _, a := range am.authorizedUIDs {
-		if a == uid {
-			return true
-		}
+	c := &s.cards[i]
+	if c.expired(am.clock.Now()) {
+		return false
+	}
+
+	switch c.Role {
+	case RoleMaster, RoleAuthorized, RoleOneTime, RoleOverride, RoleService:
+		return true
+	case RoleGuest:
+		return c.Uses > 0
 	}
 	return false
 }
 
-func (am *AuthManager) SetMaster(uid string) error {
-	am.mu.Lock()
-	defer am.mu.Unlock()
+// IsExpired reports whether the UID is enrolled but past its expiry
+func (am *AuthManager) IsExpired(uid string) bool {
+	s := am.snap.Load()
 
-	uid = strings.ToUpper(uid)
-	am.masterUIDs = []string{uid}
+	uid = canonicalUID(uid)
+	i := s.find(uid)
+	if i < 0 {
+		i = s.matchPrefix(uid)
+	}
+	return i >= 0 && s.cards[i].expired(am.clock.Now())
+}
 
-	am.authorizedUIDs = nil
+func (am *AuthManager) SetMaster(uid string) error {
+	uid, err := NormalizeUID(uid)
+	if err != nil {
+		return err
+	}
 
-	if err := am.saveMasterUIDs(); err != nil {
+	unlock, err := am.lock()
+	if err != nil {
 		return err
 	}
-	return am.saveAuthorizedUIDs()
+	defer unlock()
+	s := am.edit()
+
+	s.setCards([]Card{{UID: uid, Role: RoleMaster}})
+	return am.save(s)
 }
 
 func (am *AuthManager) AddAuthorized(uid string) (bool, error) {
-	am.mu.Lock()
-	defer am.mu.Unlock()
+	return am.add(Card{UID: uid, Role: RoleAuthorized})
+}
 
-	uid = strings.ToUpper(uid)
+// AddGuest enrolls a UID that is valid for a limited number of grants
+func (am *AuthManager) AddGuest(uid string, uses int) (bool, error) {
+	if uses <= 0 {
+		return false, fmt.Errorf("invalid use count %d", uses)
+	}
+	return am.add(Card{UID: uid, Role: RoleGuest, Uses: uses})
+}
 
-	for _, m := range am.masterUIDs {
-		if m == uid {
-			return false, nil
+// AddOneTime enrolls a UID that is valid for exactly one grant
+func (am *AuthManager) AddOneTime(uid string) (bool, error) {
+	return am.add(Card{UID: uid, Role: RoleOneTime})
+}
+
+// AddCard enrolls a card with a label, see add
+func (am *AuthManager) AddCard(card Card) (bool, error) {
+	if err := checkEnrollable(card); err != nil {
+		return false, err
+	}
+	return am.add(card)
+}
+
+// checkEnrollable validates the role of a card enrolled with AddCard
+func checkEnrollable(card Card) error {
+	switch card.Role {
+	case RoleAuthorized, RoleOneTime, RoleOverride, RoleService:
+	case RoleGuest:
+		if card.Uses <= 0 {
+			return fmt.Errorf("invalid use count %d", card.Uses)
 		}
+	default:
+		return fmt.Errorf("cannot enroll a card with role %q", card.Role)
+	}
+	return nil
+}
+
+// add enrolls a card unless its UID is already enrolled. A consumed
+// one-time card may be enrolled again.
+func (am *AuthManager) add(card Card) (bool, error) {
+	uid, err := NormalizeUID(card.UID)
+	if err != nil {
+		return false, err
 	}
+	card.UID = uid
 
-	for _, a := range am.authorizedUIDs {
-		if a == uid {
+	unlock, err := am.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	s := am.edit()
+
+	if i := s.find(card.UID); i >= 0 {
+		if s.cards[i].Role != RoleConsumed {
 			return false, nil
 		}
+		s.removeCard(i)
 	}
 
-	am.authorizedUIDs = append(am.authorizedUIDs, uid)
-	return true, am.saveAuthorizedUIDs()
+	s.appendCard(card)
+	return true, am.save(s)
 }
 
-func (am *AuthManager) GetAuthorizedCount() int {
-	am.mu.RLock()
-	defer am.mu.RUnlock()
-	return len(am.authorizedUIDs)
+// Remove drops the card enrolled under uid, or the prefix rule uid. The
+// master card cannot be removed. It reports whether a card was removed.
+func (am *AuthManager) Remove(uid string) (bool, error) {
+	uid, err := normalizeUIDRule(uid)
+	if err != nil {
+		return false, err
+	}
+
+	unlock, err := am.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	s := am.edit()
+
+	i := s.find(uid)
+	if i < 0 {
+		return false, nil
+	}
+	if s.cards[i].Role == RoleMaster {
+		return false, fmt.Errorf("cannot remove the master card")
+	}
+	s.removeCard(i)
+	return true, am.save(s)
 }
 
-func (am *AuthManager) saveMasterUIDs() error {
-	f, err := os.Create(am.masterFilePath())
+// ApplySync merges the authorized list pulled from the fleet backend into
+// the cards, removes revoked UIDs from all other card lists and adds them to
+// the denylist. Cards already enrolled keep their entry with its label,
+// group, expiry and clone protection. Cards added by a sync are removed
+// once the fleet list drops them; cards enrolled locally stay, even if the
+// list named them too. Master UIDs are never changed by a sync. Invalid
+// UIDs are skipped.
+func (am *AuthManager) ApplySync(authorized, revoked []string) error {
+	unlock, err := am.lock()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer unlock()
+	s := am.edit()
+
+	revokedSet := make(map[string]bool, len(revoked))
+	for _, uid := range revoked {
+		uid, err := NormalizeUID(uid)
+		if err != nil {
+			continue
+		}
+		revokedSet[uid] = true
+		s.revoked[uid] = true
+	}
 
-	for _, uid := range am.masterUIDs {
-		fmt.Fprintln(f, uid)
+	listed := make(map[string]bool, len(authorized))
+	for _, uid := range authorized {
+		if uid, err := normalizeUIDRule(uid); err == nil && !revokedSet[uid] {
+			listed[uid] = true
+		}
 	}
-	return nil
+
+	var cards []Card
+	for _, c := range s.cards {
+		if c.Role != RoleMaster && revokedSet[c.UID] || c.Synced && !listed[c.UID] {
+			continue
+		}
+		cards = append(cards, c)
+	}
+	s.setCards(cards)
+
+	for _, uid := range authorized {
+		uid, err := normalizeUIDRule(uid)
+		if err != nil || !listed[uid] || s.find(uid) >= 0 {
+			continue
+		}
+		s.appendCard(Card{UID: uid, Role: RoleAuthorized, Synced: true})
+	}
+
+	if len(revoked) > 0 {
+		if err := am.saveRevoked(s); err != nil {
+			return err
+		}
+	}
+	return am.save(s)
 }
 
-func (am *AuthManager) saveAuthorizedUIDs() error {
-	f, err := os.Create(am.authorizedFilePath())
+// IsGuest reports whether the UID is a guest card with uses left
+func (am *AuthManager) IsGuest(uid string) bool {
+	s := am.snap.Load()
+	c := s.lookup(uid, RoleGuest)
+	return c != nil && c.Uses > 0
+}
+
+// GuestUses returns the uses left on a guest card, 0 for other cards
+func (am *AuthManager) GuestUses(uid string) int {
+	s := am.snap.Load()
+	if c := s.lookup(uid, RoleGuest); c != nil {
+		return c.Uses
+	}
+	return 0
+}
+
+// ConsumeGuestUse decrements the remaining uses of a guest card and revokes
+// it once exhausted. It returns the number of uses left after this grant.
+func (am *AuthManager) ConsumeGuestUse(uid string) (int, error) {
+	unlock, err := am.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	s := am.edit()
+
+	uid = canonicalUID(uid)
+	i := s.find(uid)
+	if i < 0 || s.cards[i].Role != RoleGuest || s.cards[i].Uses <= 0 {
+		return 0, fmt.Errorf("UID %s is not a guest card", uid)
+	}
+
+	s.cards[i].Uses--
+	uses := s.cards[i].Uses
+	if uses == 0 {
+		s.removeCard(i)
+	}
+	return uses, am.save(s)
+}
+
+// IsOverride reports whether the UID is an emergency override card
+func (am *AuthManager) IsOverride(uid string) bool {
+	s := am.snap.Load()
+	c := s.lookup(uid, RoleOverride)
+	return c != nil && !c.expired(am.clock.Now())
+}
+
+// IsOneTime reports whether the UID is an unused one-time card
+func (am *AuthManager) IsOneTime(uid string) bool {
+	s := am.snap.Load()
+	return s.lookup(uid, RoleOneTime) != nil
+}
+
+// IsConsumed reports whether the UID is a one-time card that has been used
+func (am *AuthManager) IsConsumed(uid string) bool {
+	s := am.snap.Load()
+	return s.lookup(uid, RoleConsumed) != nil
+}
+
+// ConsumeOneTime moves a one-time UID to the consumed list
+func (am *AuthManager) ConsumeOneTime(uid string) error {
+	unlock, err := am.lock()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer unlock()
+	s := am.edit()
 
-	for _, uid := range am.authorizedUIDs {
-		fmt.Fprintln(f, uid)
+	c := s.lookup(uid, RoleOneTime)
+	if c == nil {
+		return fmt.Errorf("UID %s is not a one-time card", uid)
 	}
-	return nil
+
+	c.Role = RoleConsumed
+	return am.save(s)
+}
+
+func (am *AuthManager) GetGuestCount() int {
+	return am.count(RoleGuest)
+}
+
+func (am *AuthManager) GetAuthorizedCount() int {
+	return am.count(RoleAuthorized)
+}
+
+func (am *AuthManager) count(role string) int {
+	s := am.snap.Load()
+
+	n := 0
+	for _, c := range s.cards {
+		if c.Role == role {
+			n++
+		}
+	}
+	return n
+}
+
+// Role returns the role of an enrolled card, or "" for unknown cards.
+// Cards matching a prefix rule are authorized.
+func (am *AuthManager) Role(uid string) string {
+	s := am.snap.Load()
+
+	uid = canonicalUID(uid)
+	if i := s.find(uid); i >= 0 {
+		return s.cards[i].Role
+	}
+	if s.matchPrefix(uid) >= 0 {
+		return RoleAuthorized
+	}
+	return ""
+}
+
+// Group returns the group of an enrolled card or of the prefix rule
+// matching it, or ""
+func (am *AuthManager) Group(uid string) string {
+	s := am.snap.Load()
+
+	uid = canonicalUID(uid)
+	if i := s.find(uid); i >= 0 {
+		return s.cards[i].Group
+	}
+	if i := s.matchPrefix(uid); i >= 0 {
+		return s.cards[i].Group
+	}
+	return ""
+}
+
+// HasMAC reports whether an enrolled card carries its CardMAC
+func (am *AuthManager) HasMAC(uid string) bool {
+	s := am.snap.Load()
+
+	i := s.find(canonicalUID(uid))
+	return i >= 0 && s.cards[i].MAC
+}
+
+// SetMAC marks an enrolled card as carrying its CardMAC
+func (am *AuthManager) SetMAC(uid string) error {
+	unlock, err := am.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s := am.edit()
+
+	i := s.find(canonicalUID(uid))
+	if i < 0 {
+		return fmt.Errorf("card %s not enrolled", uid)
+	}
+	s.cards[i].MAC = true
+	return am.save(s)
 }
@@ -1,9 +1,15 @@
 package keycard
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func TestAuthManager_MasterUID(t *testing.T) {
@@ -50,12 +56,12 @@ func TestAuthManager_AuthorizedUIDs(t *testing.T) {
 	}
 
 	// Set master first
-	if err := am.SetMaster("MASTER01"); err != nil {
+	if err := am.SetMaster("AA000001"); err != nil {
 		t.Fatalf("SetMaster failed: %v", err)
 	}
 
 	// Add authorized UID
-	added, err := am.AddAuthorized("USER0001")
+	added, err := am.AddAuthorized("BB000001")
 	if err != nil {
 		t.Fatalf("AddAuthorized failed: %v", err)
 	}
@@ -64,26 +70,26 @@ func TestAuthManager_AuthorizedUIDs(t *testing.T) {
 	}
 
 	// Check authorization
-	if !am.IsAuthorized("USER0001") {
+	if !am.IsAuthorized("BB000001") {
 		t.Error("expected IsAuthorized to return true for authorized UID")
 	}
 
-	if !am.IsAuthorized("user0001") {
+	if !am.IsAuthorized("bb000001") {
 		t.Error("expected IsAuthorized to be case-insensitive")
 	}
 
 	// Master should also be authorized
-	if !am.IsAuthorized("MASTER01") {
+	if !am.IsAuthorized("AA000001") {
 		t.Error("expected master to be authorized")
 	}
 
 	// Unknown UID should not be authorized
-	if am.IsAuthorized("UNKNOWN1") {
+	if am.IsAuthorized("FF000001") {
 		t.Error("expected IsAuthorized to return false for unknown UID")
 	}
 
 	// Adding same UID again should return false
-	added, err = am.AddAuthorized("USER0001")
+	added, err = am.AddAuthorized("BB000001")
 	if err != nil {
 		t.Fatalf("AddAuthorized failed: %v", err)
 	}
@@ -92,7 +98,7 @@ func TestAuthManager_AuthorizedUIDs(t *testing.T) {
 	}
 
 	// Adding master as authorized should return false
-	added, err = am.AddAuthorized("MASTER01")
+	added, err = am.AddAuthorized("AA000001")
 	if err != nil {
 		t.Fatalf("AddAuthorized failed: %v", err)
 	}
@@ -105,6 +111,39 @@ func TestAuthManager_AuthorizedUIDs(t *testing.T) {
 	}
 }
 
+func TestAuthManager_Remove(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.SetMaster("AA000001")
+	am.AddAuthorized("BB000001")
+
+	removed, err := am.Remove("bb:00:00:01")
+	if err != nil || !removed {
+		t.Fatalf("Remove = %v, %v", removed, err)
+	}
+	if am.IsAuthorized("BB000001") {
+		t.Error("expected removed UID to be unauthorized")
+	}
+
+	removed, err = am.Remove("BB000001")
+	if err != nil || removed {
+		t.Errorf("expected removing an unknown UID to be a no-op, got %v, %v", removed, err)
+	}
+
+	if _, err := am.Remove("AA000001"); err == nil {
+		t.Error("expected removing the master to fail")
+	}
+
+	am2, _ := NewAuthManager(dir)
+	if am2.IsAuthorized("BB000001") {
+		t.Error("expected removal to be persisted")
+	}
+}
+
 func TestAuthManager_SetMasterClearsAuthorized(t *testing.T) {
 	dir := t.TempDir()
 
@@ -114,26 +153,26 @@ func TestAuthManager_SetMasterClearsAuthorized(t *testing.T) {
 	}
 
 	// Set master and add authorized
-	am.SetMaster("MASTER01")
-	am.AddAuthorized("USER0001")
-	am.AddAuthorized("USER0002")
+	am.SetMaster("AA000001")
+	am.AddAuthorized("BB000001")
+	am.AddAuthorized("BB000002")
 
 	if am.GetAuthorizedCount() != 2 {
 		t.Errorf("expected 2 authorized UIDs, got %d", am.GetAuthorizedCount())
 	}
 
 	// Setting new master should clear authorized
-	am.SetMaster("MASTER02")
+	am.SetMaster("AA000002")
 
 	if am.GetAuthorizedCount() != 0 {
 		t.Errorf("expected 0 authorized UIDs after new master, got %d", am.GetAuthorizedCount())
 	}
 
-	if am.IsMaster("MASTER01") {
+	if am.IsMaster("AA000001") {
 		t.Error("old master should no longer be master")
 	}
 
-	if !am.IsMaster("MASTER02") {
+	if !am.IsMaster("AA000002") {
 		t.Error("new master should be master")
 	}
 }
@@ -147,9 +186,9 @@ func TestAuthManager_Persistence(t *testing.T) {
 		t.Fatalf("NewAuthManager failed: %v", err)
 	}
 
-	am1.SetMaster("MASTER01")
-	am1.AddAuthorized("USER0001")
-	am1.AddAuthorized("USER0002")
+	am1.SetMaster("AA000001")
+	am1.AddAuthorized("BB000001")
+	am1.AddAuthorized("BB000002")
 
 	// Create new instance from same directory
 	am2, err := NewAuthManager(dir)
@@ -161,15 +200,15 @@ func TestAuthManager_Persistence(t *testing.T) {
 		t.Error("expected master to persist")
 	}
 
-	if !am2.IsMaster("MASTER01") {
+	if !am2.IsMaster("AA000001") {
 		t.Error("expected master UID to persist")
 	}
 
-	if !am2.IsAuthorized("USER0001") {
+	if !am2.IsAuthorized("BB000001") {
 		t.Error("expected authorized UID to persist")
 	}
 
-	if !am2.IsAuthorized("USER0002") {
+	if !am2.IsAuthorized("BB000002") {
 		t.Error("expected authorized UID to persist")
 	}
 
@@ -178,6 +217,36 @@ func TestAuthManager_Persistence(t *testing.T) {
 	}
 }
 
+func TestAuthManager_KeepInMemory(t *testing.T) {
+	dir := t.TempDir()
+
+	am1, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am1.SetMaster("AA000001")
+	am1.AddGuest("BB000001", 2)
+
+	am1.KeepInMemory()
+	am1.AddAuthorized("BB000002")
+	am1.ConsumeGuestUse("BB000001")
+	am1.Revoke("BB000003")
+	if !am1.IsAuthorized("BB000002") || !am1.IsRevoked("BB000003") {
+		t.Error("expected changes to take effect in memory")
+	}
+
+	am2, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager (reload) failed: %v", err)
+	}
+	if am2.IsAuthorized("BB000002") || am2.IsRevoked("BB000003") {
+		t.Error("expected changes kept in memory not to persist")
+	}
+	if records := am2.Records(); len(records) != 2 || records[1].Uses != 2 {
+		t.Errorf("expected the guest card to keep its uses on disk, got %+v", records)
+	}
+}
+
 func TestAuthManager_NormalizesUIDs(t *testing.T) {
 	dir := t.TempDir()
 
@@ -202,3 +271,684 @@ func TestAuthManager_NormalizesUIDs(t *testing.T) {
 		t.Error("expected authorized to match after normalizing spaces")
 	}
 }
+
+func TestAuthManager_GuestUses(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	am.SetMaster("AA000001")
+
+	added, err := am.AddGuest("CC000001", 2)
+	if err != nil {
+		t.Fatalf("AddGuest failed: %v", err)
+	}
+	if !added {
+		t.Error("expected AddGuest to return true for new UID")
+	}
+
+	if !am.IsAuthorized("cc:00:00:01") || !am.IsGuest("CC000001") {
+		t.Error("expected guest to be authorized")
+	}
+
+	remaining, err := am.ConsumeGuestUse("CC000001")
+	if err != nil {
+		t.Fatalf("ConsumeGuestUse failed: %v", err)
+	}
+	if remaining != 1 {
+		t.Errorf("expected 1 remaining use, got %d", remaining)
+	}
+
+	// Remaining count should persist
+	am2, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager (reload) failed: %v", err)
+	}
+
+	remaining, err = am2.ConsumeGuestUse("CC000001")
+	if err != nil {
+		t.Fatalf("ConsumeGuestUse failed: %v", err)
+	}
+	if remaining != 0 {
+		t.Errorf("expected 0 remaining uses, got %d", remaining)
+	}
+
+	if am2.IsAuthorized("CC000001") {
+		t.Error("expected exhausted guest to be revoked")
+	}
+
+	if _, err := am2.ConsumeGuestUse("CC000001"); err == nil {
+		t.Error("expected ConsumeGuestUse to fail for revoked guest")
+	}
+}
+
+func TestAuthManager_OneTime(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	am.SetMaster("AA000001")
+
+	added, err := am.AddOneTime("DD000001")
+	if err != nil {
+		t.Fatalf("AddOneTime failed: %v", err)
+	}
+	if !added {
+		t.Error("expected AddOneTime to return true for new UID")
+	}
+
+	if !am.IsAuthorized("DD000001") || !am.IsOneTime("dd-00-00-01") {
+		t.Error("expected one-time card to be authorized")
+	}
+
+	if err := am.ConsumeOneTime("DD000001"); err != nil {
+		t.Fatalf("ConsumeOneTime failed: %v", err)
+	}
+
+	am2, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager (reload) failed: %v", err)
+	}
+
+	if am2.IsAuthorized("DD000001") {
+		t.Error("expected consumed card to be denied")
+	}
+	if !am2.IsConsumed("DD000001") {
+		t.Error("expected consumed card to be on the consumed list")
+	}
+
+	// Re-enrolling takes the UID off the consumed list
+	if added, _ := am2.AddOneTime("DD000001"); !added {
+		t.Error("expected consumed UID to be re-enrollable")
+	}
+	if am2.IsConsumed("DD000001") {
+		t.Error("expected re-enrolled card to no longer be consumed")
+	}
+}
+
+func TestAuthManager_Override(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.SetMaster("AA000001")
+
+	if _, err := am.AddCard(Card{UID: "EE000001", Role: RoleOverride, Label: "roadside"}); err != nil {
+		t.Fatalf("AddCard failed: %v", err)
+	}
+	if !am.IsOverride("EE000001") || !am.IsAuthorized("EE000001") || am.Role("EE000001") != RoleOverride {
+		t.Error("expected override card to be enrolled and authorized")
+	}
+	if am.IsOverride("AA000001") {
+		t.Error("expected master card not to be an override card")
+	}
+
+	// A synced list does not drop override cards
+	if err := am.ApplySync([]string{"BB000001"}, nil); err != nil {
+		t.Fatalf("ApplySync failed: %v", err)
+	}
+	if !am.IsOverride("EE000001") {
+		t.Error("expected override card to survive sync")
+	}
+}
+
+func TestAuthManager_ApplySync(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	am.SetMaster("AA000001")
+	am.AddAuthorized("EE000001")
+	am.AddGuest("CC000001", 3)
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	am.AddCard(Card{UID: "DD000001", Role: RoleAuthorized, Label: "Alice", Group: "staff", Expiry: &expiry})
+	am.SetMAC("DD000001")
+
+	err = am.ApplySync([]string{"bb000001", "BB000002", "AA000001", "BB000003", "DD000001", "EE000001"}, []string{"BB000003", "CC000001"})
+	if err != nil {
+		t.Fatalf("ApplySync failed: %v", err)
+	}
+
+	if !am.IsAuthorized("BB000001") || !am.IsAuthorized("BB000002") {
+		t.Error("expected synced UIDs to be authorized")
+	}
+	if am.IsAuthorized("BB000003") || am.IsAuthorized("CC000001") {
+		t.Error("expected revoked UIDs to be denied")
+	}
+	if !am.IsMaster("AA000001") {
+		t.Error("expected master to be unaffected by sync")
+	}
+	if am.GetAuthorizedCount() != 4 {
+		t.Errorf("expected 4 authorized UIDs, got %d", am.GetAuthorizedCount())
+	}
+
+	// The fleet drops cards it added, not local ones or their metadata
+	if err := am.ApplySync([]string{"BB000002"}, nil); err != nil {
+		t.Fatalf("ApplySync failed: %v", err)
+	}
+	if am.IsAuthorized("BB000001") || !am.IsAuthorized("BB000002") {
+		t.Error("expected UIDs the fleet list dropped to be removed")
+	}
+	if !am.IsAuthorized("EE000001") || !am.IsAuthorized("DD000001") {
+		t.Error("expected locally enrolled cards to survive the sync")
+	}
+	i := slices.IndexFunc(am.Records(), func(r CardRecord) bool { return r.UID == "DD000001" })
+	if i < 0 {
+		t.Fatal("expected DD000001 to be listed")
+	}
+	rec := am.Records()[i]
+	if rec.Label != "Alice" || rec.Group != "staff" || rec.Expiry == "" || !rec.MAC {
+		t.Errorf("expected the card to keep its metadata, got %+v", rec)
+	}
+}
+
+func TestAuthManager_ImportExport(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	am.SetMaster("AA000001")
+	am.AddAuthorized("BB000001")
+	am.AddGuest("CC000001", 3)
+	am.AddOneTime("DD000001")
+	am.AddCard(Card{UID: "EE000001", Role: RoleAuthorized, Group: "staff"})
+
+	for _, format := range []string{"csv", "json"} {
+		var buf bytes.Buffer
+		if err := WriteRecords(&buf, format, am.Records()); err != nil {
+			t.Fatalf("WriteRecords(%s) failed: %v", format, err)
+		}
+
+		records, err := ReadRecords(&buf, format)
+		if err != nil {
+			t.Fatalf("ReadRecords(%s) failed: %v", format, err)
+		}
+
+		am2, err := NewAuthManager(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewAuthManager failed: %v", err)
+		}
+		if err := am2.Import(records, true); err != nil {
+			t.Fatalf("Import(%s) failed: %v", format, err)
+		}
+
+		if !am2.IsMaster("AA000001") || !am2.IsAuthorized("BB000001") || !am2.IsOneTime("DD000001") {
+			t.Errorf("%s: expected cards to survive a round trip", format)
+		}
+		if remaining, _ := am2.ConsumeGuestUse("CC000001"); remaining != 2 {
+			t.Errorf("%s: expected guest uses to survive a round trip, got %d left", format, remaining)
+		}
+		if group := am2.Group("EE000001"); group != "staff" {
+			t.Errorf("%s: expected group to survive a round trip, got %q", format, group)
+		}
+	}
+}
+
+func TestAuthManager_ImportRejectsUnknownRole(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	err = am.Import([]CardRecord{{UID: "BB000001", Role: "superuser"}}, false)
+	if err == nil {
+		t.Error("expected Import to reject unknown role")
+	}
+}
+
+func TestAuthManager_RecoversFromCorruption(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.SetMaster("AA000001")
+	am.AddAuthorized("BB000001")
+
+	// Simulate a bit flip in the card store
+	authFile := filepath.Join(dir, "cards.json")
+	data, _ := os.ReadFile(authFile)
+	data[0] ^= 0x01
+	os.WriteFile(authFile, data, 0644)
+
+	am2, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager (reload) failed: %v", err)
+	}
+
+	if !am2.IsAuthorized("BB000001") {
+		t.Error("expected card store to be restored from backup")
+	}
+	if recovered := am2.Recovered(); len(recovered) != 1 || recovered[0] != "cards.json" {
+		t.Errorf("expected cards.json to be reported as recovered, got %v", recovered)
+	}
+
+	// Both copies corrupted must fail rather than start empty
+	os.WriteFile(authFile, data, 0644)
+	os.WriteFile(authFile+".bak", data, 0644)
+	if _, err := NewAuthManager(dir); err == nil {
+		t.Error("expected NewAuthManager to fail when file and backup are corrupt")
+	}
+}
+
+func TestAuthManager_MigratesV1Store(t *testing.T) {
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "master_uids.txt"), []byte("AA000001\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "authorized_uids.txt"), []byte("BB000001\nBB000002\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "guest_uids.txt"), []byte("CC000001 3\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "consumed_uids.txt"), []byte("DD000001\n"), 0644)
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	if !am.IsMaster("AA000001") || !am.IsAuthorized("BB000002") || !am.IsGuest("CC000001") || !am.IsConsumed("DD000001") {
+		t.Error("expected all v1 lists to be migrated")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "cards.json")); err != nil {
+		t.Errorf("expected cards.json to be written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "master_uids.txt.v1")); err != nil {
+		t.Errorf("expected v1 files to be kept with .v1 suffix: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "master_uids.txt")); !os.IsNotExist(err) {
+		t.Error("expected v1 files to be moved aside")
+	}
+
+	if version, _, err := storeVersion(dir); err != nil || version != StoreVersion {
+		t.Errorf("expected store version %d, got %d (%v)", StoreVersion, version, err)
+	}
+}
+
+func TestAuthManager_RejectsNewerStore(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "cards.json"), []byte(`{"version": 99, "cards": []}`), 0644)
+
+	if _, err := NewAuthManager(dir); err == nil {
+		t.Error("expected NewAuthManager to reject a newer store version")
+	}
+}
+
+func TestAuthManager_Expiry(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	err = am.Import([]CardRecord{
+		{UID: "BB000001", Role: RoleAuthorized, Expiry: past},
+		{UID: "BB000002", Role: RoleAuthorized, Expiry: future, Label: "Alice"},
+	}, false)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	if am.IsAuthorized("BB000001") || !am.IsExpired("BB000001") {
+		t.Error("expected expired card to be denied")
+	}
+	if !am.IsAuthorized("BB000002") {
+		t.Error("expected card before expiry to be authorized")
+	}
+}
+
+func TestAuthManager_Reload(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.SetMaster("AABBCCDD")
+
+	other, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	other.AddAuthorized("11223344")
+
+	if am.IsAuthorized("11223344") {
+		t.Fatal("expected UID added by another process to be unknown before reload")
+	}
+
+	changed, err := am.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if !changed || !am.IsAuthorized("11223344") {
+		t.Error("expected reload to pick up the new UID")
+	}
+
+	if changed, _ := am.Reload(); changed {
+		t.Error("expected no change on second reload")
+	}
+
+	// A broken edit keeps the current cards
+	os.WriteFile(filepath.Join(dir, storeFileName), []byte("{"), 0644)
+	os.Remove(filepath.Join(dir, storeFileName+backupSuffix))
+	if _, err := am.Reload(); err == nil {
+		t.Error("expected error reloading invalid store")
+	}
+	if !am.IsAuthorized("11223344") {
+		t.Error("expected cards to be kept after failed reload")
+	}
+}
+
+func TestAuthManager_SharedStore(t *testing.T) {
+	dir := t.TempDir()
+
+	service, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	service.AddCard(Card{UID: "CC000001", Role: RoleGuest, Uses: 3})
+
+	command, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	command.AddAuthorized("BB000001")
+
+	// The service's next change starts from what the command wrote
+	if _, err := service.ConsumeGuestUse("CC000001"); err != nil {
+		t.Fatalf("ConsumeGuestUse failed: %v", err)
+	}
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if !am.IsAuthorized("BB000001") || am.GuestUses("CC000001") != 2 {
+		t.Errorf("expected both changes in the store, got %v", am.Records())
+	}
+
+	// Changes wait for the store lock
+	release, err := LockStore(dir)
+	if err != nil {
+		t.Fatalf("LockStore failed: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := service.AddAuthorized("BB000002")
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the change to wait for the store lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("AddAuthorized failed: %v", err)
+	}
+}
+
+func TestNewReadOnlyAuthManager(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.AddAuthorized("BB000001")
+
+	authFile := filepath.Join(dir, storeFileName)
+	data, _ := os.ReadFile(authFile)
+	data[0] ^= 0x01
+	os.WriteFile(authFile, data, 0644)
+
+	ro, err := NewReadOnlyAuthManager(dir, nil)
+	if err != nil {
+		t.Fatalf("NewReadOnlyAuthManager failed: %v", err)
+	}
+	if !ro.IsAuthorized("BB000001") {
+		t.Error("expected the cards to be read from the backup")
+	}
+	if onDisk, _ := os.ReadFile(authFile); !bytes.Equal(onDisk, data) {
+		t.Error("expected the store to be left unrepaired")
+	}
+	if _, err := ro.AddAuthorized("BB000002"); !errors.Is(err, ErrStoreReadOnly) {
+		t.Errorf("expected ErrStoreReadOnly, got %v", err)
+	}
+
+	// A v1 data directory is refused rather than migrated
+	v1 := t.TempDir()
+	os.WriteFile(filepath.Join(v1, "authorized_uids.txt"), []byte("BB000001\n"), 0644)
+	if _, err := NewReadOnlyAuthManager(v1, nil); err == nil {
+		t.Error("expected NewReadOnlyAuthManager to refuse a v1 data directory")
+	}
+	if entries, _ := os.ReadDir(v1); len(entries) != 1 {
+		t.Errorf("expected the v1 data directory to be left as is, got %d files", len(entries))
+	}
+}
+
+func TestAuthManager_Revocation(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.SetMaster("AA000001")
+	am.AddAuthorized("BB000001")
+
+	if err := am.Revoke("bb000001", "AA000001"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if !am.IsRevoked("BB000001") {
+		t.Error("expected authorized UID to be revoked")
+	}
+	if am.IsRevoked("AA000001") {
+		t.Error("expected master UID to be exempt from revocation")
+	}
+
+	// Partial sync re-adding the UID must not lift the revocation
+	am.ApplySync([]string{"BB000001"}, nil)
+	am2, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if !am2.IsRevoked("BB000001") {
+		t.Error("expected revocation to persist")
+	}
+
+	if err := am2.Unrevoke("BB000001"); err != nil {
+		t.Fatalf("Unrevoke failed: %v", err)
+	}
+	if am2.IsRevoked("BB000001") || !am2.IsAuthorized("BB000001") {
+		t.Error("expected unrevoked UID to be authorized again")
+	}
+}
+
+func TestAuthManager_PrefixRules(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	err = am.Import([]CardRecord{
+		{UID: "04AABB*", Role: RoleAuthorized},
+		{UID: "04AABBCC11*", Role: RoleAuthorized, Expiry: "2000-01-01T00:00:00Z"},
+		{UID: "04AABB00010203", Role: RoleConsumed},
+	}, false)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	if !am.IsAuthorized("04aabb12345678") {
+		t.Error("expected UID matching prefix rule to be authorized")
+	}
+	if am.IsAuthorized("04AABC12345678") {
+		t.Error("expected UID outside prefix to be unauthorized")
+	}
+	if am.IsAuthorized("04AABBCC112233") || !am.IsExpired("04AABBCC112233") {
+		t.Error("expected longest matching rule to apply")
+	}
+	if am.IsAuthorized("04AABB00010203") {
+		t.Error("expected individually enrolled card to take precedence over prefix rule")
+	}
+
+	if err := am.Import([]CardRecord{{UID: "04CC*", Role: RoleGuest, Uses: 3}}, false); err == nil {
+		t.Error("expected prefix rule with guest role to be rejected")
+	}
+}
+
+func TestAuthManager_LargeFleet(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.SetMaster("AABBCCDD")
+
+	uids := make([]string, 10000)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("04%012X", i)
+	}
+	if err := am.ApplySync(append(uids, "05AA*"), nil); err != nil {
+		t.Fatalf("ApplySync failed: %v", err)
+	}
+	if !am.IsAuthorized(uids[9999]) || !am.IsAuthorized("05AA0102030405") || !am.IsMaster("AABBCCDD") {
+		t.Error("expected synced UIDs, rules and master to be found")
+	}
+
+	// Removing a card moves the ones behind it
+	if ok, _ := am.Remove(uids[0]); !ok {
+		t.Fatal("expected card to be removed")
+	}
+	am.AddGuest("11223344", 2)
+	if am.IsAuthorized(uids[0]) || !am.IsAuthorized(uids[1]) || !am.IsGuest("11223344") {
+		t.Error("expected lookups to follow the removal")
+	}
+	if ok, _ := am.Remove("05AA*"); !ok || am.IsAuthorized("05AA0102030405") {
+		t.Error("expected removed prefix rule to no longer match")
+	}
+}
+
+func TestAuthManager_SnapshotDuringSync(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.AddAuthorized("04A1B2C3D4E5F6")
+
+	uids := make([]string, 1000)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("04%012X", i)
+	}
+
+	// Taps see either the list before or after a sync, never a partial one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			am.ApplySync(append(uids, "04A1B2C3D4E5F6"), nil)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if !am.IsAuthorized(uids[999]) {
+				t.Error("expected synced UID to be authorized")
+			}
+			return
+		default:
+			if !am.IsAuthorized("04A1B2C3D4E5F6") {
+				t.Fatal("expected card in both lists to stay authorized")
+			}
+		}
+	}
+}
+
+func TestAuthManager_BloomFilter(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.EnableBloomFilter()
+
+	uids := make([]string, 10000)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("04%012X", i)
+	}
+	am.ApplySync(append(uids, "05AA*"), nil)
+	for _, uid := range uids {
+		if !am.IsAuthorized(uid) {
+			t.Fatalf("expected %s to pass the filter", uid)
+		}
+	}
+	if !am.IsAuthorized("05AA0102030405") {
+		t.Error("expected prefix rules to bypass the filter")
+	}
+
+	f := am.snap.Load().index.bloom
+	passed := 0
+	for i := 0; i < 10000; i++ {
+		k, _ := makeUIDKey(fmt.Sprintf("08%06X", i))
+		if f.mayContain(k) {
+			passed++
+		}
+	}
+	if passed > 300 {
+		t.Errorf("expected about 1%% false positives, got %d of 10000", passed)
+	}
+
+	am.AddAuthorized("11223344")
+	if !am.IsAuthorized("11223344") {
+		t.Error("expected card added later to pass the filter")
+	}
+}
+
+func TestAuthManager_CompactIndex(t *testing.T) {
+	dir := t.TempDir()
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	records := make([]CardRecord, 1000)
+	for i := range records {
+		records[i] = CardRecord{UID: fmt.Sprintf("04%012X", i), Role: RoleAuthorized, Label: "fleet", Group: "riders"}
+	}
+	records = append(records, CardRecord{UID: "05AA*", Role: RoleAuthorized})
+	if err := am.Import(records, true); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	// Reload decodes every label from the store separately
+	am, err = NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	s := am.snap.Load()
+	if len(s.index.uids) != 1000 || len(s.index.rules) != 1 {
+		t.Fatalf("expected 1000 UIDs and 1 rule in the index, got %d and %d", len(s.index.uids), len(s.index.rules))
+	}
+	first, last := s.cards[0], s.cards[999]
+	if unsafe.StringData(first.Label) != unsafe.StringData(last.Label) || unsafe.StringData(first.Group) != unsafe.StringData(last.Group) {
+		t.Error("expected labels and groups to be interned")
+	}
+
+	if !am.IsAuthorized("04000000000001") || !am.IsAuthorized("04:00:00:00:00:03:E7") {
+		t.Error("expected UIDs to be found by key")
+	}
+	if !am.IsAuthorized("05AA0102030405") {
+		t.Error("expected prefix rule to match")
+	}
+	if removed, _ := am.Remove("05AA*"); !removed || am.IsAuthorized("05AA0102030405") {
+		t.Error("expected prefix rule to be removed by its stored form")
+	}
+}
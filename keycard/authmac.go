@@ -0,0 +1,105 @@
+package keycard
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	authMACKeyID = "redis"
+
+	authSignKeyID = "device"
+
+	authFieldsField    = "fields"
+	authMACField       = "mac"
+	authSignatureField = "signature"
+)
+
+var (
+	ErrAuthMAC       = errors.New("auth payload MAC mismatch")
+	ErrAuthSignature = errors.New("auth payload signature invalid")
+)
+
+// authPayload returns the canonical encoding of the covered hash fields:
+// compact JSON with sorted keys
+func authPayload(values map[string]string) []byte {
+	data, _ := json.Marshal(values)
+	return data
+}
+
+// coverFields adds the list of covered fields to values and returns the
+// payload to authenticate
+func coverFields(values map[string]any) []byte {
+	names := make([]string, 0, len(values)+1)
+	for name := range values {
+		names = append(names, name)
+	}
+	names = append(names, authFieldsField)
+	sort.Strings(names)
+	values[authFieldsField] = strings.Join(names, ",")
+
+	covered := make(map[string]string, len(values))
+	for name, v := range values {
+		covered[name] = fmt.Sprint(v)
+	}
+	return authPayload(covered)
+}
+
+// coveredPayload rebuilds the payload from a keycard hash as read from Redis
+func coveredPayload(hash map[string]string) ([]byte, error) {
+	list, ok := hash[authFieldsField]
+	if !ok {
+		return nil, fmt.Errorf("%w: no covered fields", ErrAuthMAC)
+	}
+	covered := make(map[string]string)
+	for _, name := range strings.Split(list, ",") {
+		value, ok := hash[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: field %s missing", ErrAuthMAC, name)
+		}
+		covered[name] = value
+	}
+	return authPayload(covered), nil
+}
+
+// VerifyAuthMAC checks the MAC of a keycard hash published with --auth-mac
+// against the shared key. Success vouches only for the fields listed in
+// "fields"; others were written by someone else.
+func VerifyAuthMAC(hash map[string]string, key []byte) error {
+	payload, err := coveredPayload(hash)
+	if err != nil {
+		return err
+	}
+	got, err := hex.DecodeString(hash[authMACField])
+	if err != nil {
+		return fmt.Errorf("%w: malformed MAC", ErrAuthMAC)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrAuthMAC
+	}
+	return nil
+}
+
+// VerifyAuthSignature checks the signature of a keycard hash published with
+// --sign-auth against the device's public key. Like VerifyAuthMAC, it
+// vouches only for the fields listed in "fields".
+func VerifyAuthSignature(hash map[string]string, key ed25519.PublicKey) error {
+	payload, err := coveredPayload(hash)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthSignature, err)
+	}
+	sig, err := hex.DecodeString(hash[authSignatureField])
+	if err != nil || !ed25519.Verify(key, payload, sig) {
+		return ErrAuthSignature
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package keycard
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupManifestName = "MANIFEST.sha256"
+	backupMaxFileSize  = 64 << 20
+)
+
+// Backup writes a gzipped tar of the data directory's files together with a
+// SHA-256 manifest
+func Backup(dataDir string, w io.Writer) error {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	var manifest bytes.Buffer
+	now := time.Now()
+	for _, entry := range entries {
+		// Hidden files are leftovers of interrupted atomic writes
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dataDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, entry.Name(), data, now); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(sum[:]), entry.Name())
+	}
+
+	if err := writeTarFile(tw, backupManifestName, manifest.Bytes(), now); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Restore verifies a backup against its manifest and, only if every file
+// checks out, writes the files into the data directory. It returns the
+// names of the restored files.
+func Restore(r io.Reader, dataDir string) ([]string, error) {
+	files, err := readBackup(r)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, ok := files[backupManifestName]
+	if !ok {
+		return nil, fmt.Errorf("backup has no manifest")
+	}
+	delete(files, backupManifestName)
+
+	sums, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if len(sums) != len(files) {
+		return nil, fmt.Errorf("manifest lists %d files, backup contains %d", len(sums), len(files))
+	}
+	for name, data := range files {
+		want, ok := sums[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not in the manifest", name)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != want {
+			return nil, fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := writeFileAtomic(filepath.Join(dataDir, name), files[name], 0644); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+
+	// A backup taken before the current format has no card store; drop the
+	// existing one so the restored files are migrated at the next start
+	if _, ok := files[storeFileName]; !ok {
+		for _, suffix := range []string{"", backupSuffix} {
+			if err := os.Remove(filepath.Join(dataDir, storeFileName+suffix)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	return names, nil
+}
+
+func readBackup(r io.Reader) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("corrupt backup archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Only flat file names, never paths escaping the data directory
+		if hdr.Name != filepath.Base(hdr.Name) || strings.HasPrefix(hdr.Name, ".") {
+			return nil, fmt.Errorf("invalid file name %q in backup", hdr.Name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, backupMaxFileSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("corrupt backup archive: %w", err)
+		}
+		if len(data) > backupMaxFileSize {
+			return nil, fmt.Errorf("%s is too large", hdr.Name)
+		}
+		files[hdr.Name] = data
+	}
+	return files, nil
+}
+
+func parseManifest(data []byte) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid manifest line %q", line)
+		}
+		sums[name] = sum
+	}
+	return sums, scanner.Err()
+}
@@ -0,0 +1,75 @@
+package keycard
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackup_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.SetMaster("AA000001")
+	am.AddAuthorized("BB000001")
+
+	var buf bytes.Buffer
+	if err := Backup(dir, &buf); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	restoreDir := t.TempDir()
+	if _, err := Restore(&buf, restoreDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	am2, err := NewAuthManager(restoreDir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if !am2.IsMaster("AA000001") || !am2.IsAuthorized("BB000001") {
+		t.Error("expected restored cards to be enrolled")
+	}
+}
+
+func TestRestore_RejectsTamperedBackup(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "master_uids.txt"), []byte("AA000001\n"), 0644)
+
+	var buf bytes.Buffer
+	if err := Backup(dir, &buf); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// Rewrite the archive with a modified master file but the original manifest
+	files, err := readBackup(&buf)
+	if err != nil {
+		t.Fatalf("readBackup failed: %v", err)
+	}
+	files["master_uids.txt"] = []byte("ATTACKER\n")
+
+	var tampered bytes.Buffer
+	gz := gzip.NewWriter(&tampered)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		writeTarFile(tw, name, data, time.Now())
+	}
+	tw.Close()
+	gz.Close()
+
+	restoreDir := t.TempDir()
+	if _, err := Restore(&tampered, restoreDir); err == nil {
+		t.Fatal("expected Restore to reject tampered backup")
+	}
+
+	if _, err := os.Stat(filepath.Join(restoreDir, "master_uids.txt")); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written for a rejected backup")
+	}
+}
@@ -0,0 +1,55 @@
+package keycard
+
+import "math"
+
+// bloomFalsePositives is the share of unknown UIDs the filter passes on to
+// the card index
+const bloomFalsePositives = 0.01
+
+// bloomFilter tells UIDs that are definitely not enrolled from those that
+// may be
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of hashes
+}
+
+// newBloomFilter sizes a filter for n entries
+func newBloomFilter(n int) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(bloomFalsePositives) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// hashes returns the two hashes combined into the k bit positions, taken
+// from the FNV-1a hash of the UID
+func (b *bloomFilter) hashes(k uidKey) (uint64, uint64) {
+	sum := uint64(14695981039346656037)
+	for _, c := range k.bytes() {
+		sum ^= uint64(c)
+		sum *= 1099511628211
+	}
+	return sum, sum>>32 | 1
+}
+
+func (b *bloomFilter) add(k uidKey) {
+	h1, h2 := b.hashes(k)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(k uidKey) bool {
+	h1, h2 := b.hashes(k)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package keycard
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// Bus passes typed messages about taps between the parts of the service,
+// so new consumers can subscribe without changes to the tap handling.
+// Messages are delivered synchronously and in order on the publishing
+// goroutine, which is the event loop for all messages below.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[reflect.Type][]func(any)
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[reflect.Type][]func(any))}
+}
+
+// Subscribe calls fn with every message of type T, after the consumers
+// subscribed before it
+func Subscribe[T any](b *Bus, fn func(T)) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[t] = append(b.subs[t], func(msg any) { fn(msg.(T)) })
+}
+
+// Publish delivers msg to the consumers of its type
+func (b *Bus) Publish(msg any) {
+	b.mu.RLock()
+	subs := b.subs[reflect.TypeOf(msg)]
+	b.mu.RUnlock()
+	for _, fn := range subs {
+		fn(msg)
+	}
+}
+
+// TagArrived is a card entering the field
+type TagArrived struct {
+	UID      string
+	Protocol hal.RFProtocol
+	Tech     TagType
+	Time     time.Time
+}
+
+// TagDeparted is the present card leaving the field
+type TagDeparted struct {
+	UID   string
+	Dwell time.Duration
+}
+
+// AccessGranted is the decision to grant a card access, before the grant
+// is published
+type AccessGranted struct {
+	UID     string
+	Fields  map[string]any
+	Arrived time.Time // when the card arrived
+	Decided time.Time
+}
+
+// AuthPublished is a grant having been published to Redis, or having
+// failed to
+type AuthPublished struct {
+	AccessGranted
+	Published time.Time
+	Err       error
+}
+
+// EventPublished is an event having been published to Redis, or having
+// failed to
+type EventPublished struct {
+	Event  Event
+	Fields map[string]any
+	Err    error
+}
+
+// LearnStateChanged is a learn mode being entered or left, or a card being
+// enrolled in it
+type LearnStateChanged struct {
+	Mode  string // LearnModeOff, LearnModeMaster or LearnModeCards
+	Added int    // cards enrolled in the current or just finished session
+}
+
+// Cue is the LED feedback for the outcome of a tap
+type Cue int
+
+const (
+	CueOff      Cue = iota
+	CueGranted      // green flash
+	CueDenied       // red flash
+	CueLock         // amber flash
+	CueLearned      // plain flash, a card was enrolled
+	CueWarn         // amber blinks, the tap was not acted on
+	CueAlert        // rapid red blinks, revoked or cloned card
+	CueUnlocked     // two green blinks, already granted moments ago
+)
+
+// Feedback asks for a cue to be shown on the LED
+type Feedback struct {
+	Cue   Cue
+	Color *RGB // replaces the cue's color if the LED can show it
+}
@@ -0,0 +1,19 @@
+package keycard
+
+import "testing"
+
+func TestBus(t *testing.T) {
+	b := NewBus()
+	var got []string
+	Subscribe(b, func(a TagArrived) { got = append(got, "first "+a.UID) })
+	Subscribe(b, func(a TagArrived) { got = append(got, "second "+a.UID) })
+	Subscribe(b, func(f Feedback) { got = append(got, "feedback") })
+
+	b.Publish(TagArrived{UID: "04A1B2C3"})
+	b.Publish(TagDeparted{UID: "04A1B2C3"}) // no consumers
+
+	want := []string{"first 04A1B2C3", "second 04A1B2C3"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,224 @@
+package keycard
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// NCI packet types of a capture
+const (
+	CaptureTX = "tx"
+	CaptureRX = "rx"
+)
+
+const (
+	nciRFDiscoverNtf      = 0x03 // RF_DISCOVER_NTF, OID of group RF management
+	nciRFIntfActivatedNtf = 0x05 // RF_INTF_ACTIVATED_NTF
+	nciRFTechAPoll        = 0x00
+)
+
+// captureLine is an NCI packet of a capture
+type captureLine struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	Data string    `json:"data"`
+}
+
+// NCICapture writes the NCI packets exchanged with the reader and the tag
+// events made of them to a file, one JSON object per line with the time:
+// packets as {"type": "tx" or "rx", "data": hex}, tag events as TagRecords,
+// so a capture replays like a recording. With redaction, every UID is
+// replaced by a pseudonym that keeps its manufacturer byte and is the same
+// for a card throughout the capture.
+type NCICapture struct {
+	mu     sync.Mutex
+	f      *os.File
+	err    error
+	redact *uidRedactor
+}
+
+func OpenNCICapture(path string, redact bool) (*NCICapture, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open NCI capture: %w", err)
+	}
+	c := &NCICapture{f: f}
+	if redact {
+		if c.redact, err = newUIDRedactor(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// LogMessage captures the NCI packet a HAL log message in debug mode
+// carries and reports whether it carried one
+func (c *NCICapture) LogMessage(message string) bool {
+	rest, ok := strings.CutPrefix(message, "NCI ")
+	if !ok {
+		return false
+	}
+	dir, data, ok := strings.Cut(rest, ": ")
+	if !ok || (dir != "TX" && dir != "RX") {
+		return false
+	}
+	packet, err := hex.DecodeString(data)
+	if err != nil {
+		return false
+	}
+	c.Packet(strings.ToLower(dir), packet)
+	return true
+}
+
+// Packet captures an NCI packet sent (CaptureTX) or received (CaptureRX)
+func (c *NCICapture) Packet(dir string, packet []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.redact != nil {
+		packet = c.redact.packet(packet)
+	}
+	c.write(captureLine{Time: time.Now().UTC(), Type: dir, Data: hex.EncodeToString(packet)})
+}
+
+// TagEvent captures a tag event from the HAL
+func (c *NCICapture) TagEvent(e hal.TagEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec := newTagRecord(e, time.Now())
+	if c.redact != nil && e.Tag != nil {
+		rec.ID = hex.EncodeToString(c.redact.uid(e.Tag.ID))
+	}
+	c.write(rec)
+}
+
+// write appends a line; the first error stops the capture. The caller
+// holds mu.
+func (c *NCICapture) write(v any) {
+	if c.err != nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err == nil {
+		_, err = c.f.Write(append(data, '\n'))
+	}
+	c.err = err
+}
+
+func (c *NCICapture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = os.ErrClosed
+	}
+	return c.f.Close()
+}
+
+// uidRedactor replaces UIDs in NCI packets by pseudonyms under a key made
+// for one capture
+type uidRedactor struct {
+	key  []byte
+	seen map[string][]byte // pseudonyms by UID
+}
+
+func newUIDRedactor() (*uidRedactor, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to create redaction key: %w", err)
+	}
+	return &uidRedactor{key: key, seen: make(map[string][]byte)}, nil
+}
+
+// uid returns the pseudonym of a UID and remembers it
+func (r *uidRedactor) uid(uid []byte) []byte {
+	if len(uid) < 2 {
+		return uid
+	}
+	if p, ok := r.seen[string(uid)]; ok {
+		return p
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(uid)
+	p := append([]byte{uid[0]}, mac.Sum(nil)[:len(uid)-1]...)
+	r.seen[string(uid)] = p
+	return p
+}
+
+// packet returns a copy of an NCI packet with the UIDs of RF discovery and
+// activation notifications replaced, and any UID replaced before. A 7-byte
+// UID is also replaced where Type 2 Tag memory splits it around a check
+// byte.
+func (r *uidRedactor) packet(packet []byte) []byte {
+	packet = bytes.Clone(packet)
+	if off, n, ok := notificationUID(packet); ok {
+		copy(packet[off:off+n], r.uid(packet[off:off+n]))
+	}
+	for uid, p := range r.seen {
+		packet = bytes.ReplaceAll(packet, []byte(uid), p)
+		if len(uid) == 7 {
+			packet = bytes.ReplaceAll(packet, []byte(uid[:3]), p[:3])
+			packet = bytes.ReplaceAll(packet, []byte(uid[3:]), p[3:])
+		}
+	}
+	return packet
+}
+
+// notificationUID locates the NFCID1 of an NFC-A tag in an RF_DISCOVER_NTF
+// or RF_INTF_ACTIVATED_NTF
+func notificationUID(packet []byte) (off, n int, ok bool) {
+	// Notification (MT 3) of group RF management (GID 1)
+	if len(packet) < 3 || packet[0] != 0x61 {
+		return 0, 0, false
+	}
+	var tech, params int
+	switch packet[1] {
+	case nciRFDiscoverNtf:
+		tech, params = 5, 7
+	case nciRFIntfActivatedNtf:
+		tech, params = 6, 10
+	default:
+		return 0, 0, false
+	}
+	if len(packet) <= params {
+		return 0, 0, false
+	}
+
+	switch packet[tech] {
+	case nciRFTechAPoll:
+		// SENS_RES (2), NFCID1 length, NFCID1
+		if len(packet) <= params+2 {
+			return 0, 0, false
+		}
+		off, n = params+3, int(packet[params+2])
+	default:
+		return 0, 0, false
+	}
+	if n == 0 || off+n > len(packet) {
+		return 0, 0, false
+	}
+	return off, n, true
+}
+
+// recordTagEvent passes a tag event from the HAL to the recording and the
+// capture
+func (s *Service) recordTagEvent(e hal.TagEvent) {
+	if s.recorder != nil {
+		if err := s.recorder.Record(e); err != nil {
+			s.logger.Warn("Tag events are no longer recorded", "error", err)
+		}
+	}
+	if s.capture != nil {
+		s.capture.TagEvent(e)
+	}
+}
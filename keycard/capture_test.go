@@ -0,0 +1,96 @@
+package keycard
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// activatedNtf builds the RF_INTF_ACTIVATED_NTF of an NFC-A Type 2 Tag
+func activatedNtf(uid []byte) []byte {
+	params := append([]byte{0x44, 0x00, byte(len(uid))}, uid...)
+	params = append(params, 0x01, 0x00)
+	payload := append([]byte{0x01, 0x02, byte(hal.RFProtocolT2T), nciRFTechAPoll, 0xFF, 0x01, byte(len(params))}, params...)
+	payload = append(payload, 0x00, 0x00, 0x00, 0x00)
+	return append([]byte{0x61, nciRFIntfActivatedNtf, byte(len(payload))}, payload...)
+}
+
+func TestNCICapture_Redact(t *testing.T) {
+	uid := []byte{0x04, 0xA1, 0xB2, 0xC3, 0xD4, 0xE5, 0xF6}
+	// READ of pages 0-3: UID0-2, BCC0, UID3-6, BCC1, ...
+	page0 := append(append(append([]byte{0x00, 0x00, 0x10}, uid[:3]...), 0x88^0x04^0xA1^0xB2), uid[3:]...)
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c, err := OpenNCICapture(path, true)
+	if err != nil {
+		t.Fatalf("OpenNCICapture failed: %v", err)
+	}
+	if c.LogMessage("Initializing PN7150") {
+		t.Error("expected a message without a packet not to be captured")
+	}
+	if !c.LogMessage("NCI TX: 20000101") {
+		t.Error("expected a TX packet to be captured")
+	}
+	c.LogMessage("NCI RX: " + hex.EncodeToString(activatedNtf(uid)))
+	c.LogMessage("NCI RX: " + hex.EncodeToString(page0))
+	c.TagEvent(hal.TagEvent{Type: hal.TagArrival, Tag: &hal.Tag{RFProtocol: hal.RFProtocolT2T, ID: uid}})
+	c.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	for _, leak := range [][]byte{uid, uid[:3], uid[3:]} {
+		if strings.Contains(string(data), hex.EncodeToString(leak)) {
+			t.Errorf("expected %x to be redacted from the capture:\n%s", leak, data)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %d:\n%s", len(lines), data)
+	}
+	var ntf captureLine
+	if err := json.Unmarshal([]byte(lines[1]), &ntf); err != nil {
+		t.Fatalf("invalid capture line: %v", err)
+	}
+	packet, _ := hex.DecodeString(ntf.Data)
+	off, n, ok := notificationUID(packet)
+	if !ok || n != len(uid) || packet[off] != uid[0] {
+		t.Fatalf("expected the pseudonym to keep the manufacturer byte, got %x", packet)
+	}
+	pseudonym := packet[off : off+n]
+
+	records, err := LoadTagRecords(path)
+	if err != nil {
+		t.Fatalf("expected the capture to replay: %v", err)
+	}
+	if len(records) != 1 || records[0].ID != hex.EncodeToString(pseudonym) {
+		t.Errorf("expected the tag event to carry the pseudonym %x, got %+v", pseudonym, records)
+	}
+	if !bytes.Contains([]byte(lines[2]), []byte(hex.EncodeToString(pseudonym[:3]))) {
+		t.Errorf("expected the UID in tag memory to be replaced by the pseudonym, got %s", lines[2])
+	}
+}
+
+func TestNCICapture_Plain(t *testing.T) {
+	uid := []byte{0x04, 0xA1, 0xB2, 0xC3}
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c, err := OpenNCICapture(path, false)
+	if err != nil {
+		t.Fatalf("OpenNCICapture failed: %v", err)
+	}
+	c.Packet(CaptureRX, activatedNtf(uid))
+	c.Close()
+
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), hex.EncodeToString(uid)) {
+		t.Errorf("expected the UID to be captured as is:\n%s", data)
+	}
+}
@@ -0,0 +1,65 @@
+package keycard
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	cardMACKeyID = "card"
+	cardMACSize  = 16 // four Type 2 Tag pages
+	t2tPageSize  = 4
+	t2tUserStart = 4 // first page of user memory
+)
+
+// TagWriter writes raw memory of the tag currently in the field
+type TagWriter interface {
+	TagMemory
+	WriteBinary(address uint16, data []byte) error
+}
+
+// CardMAC computes the MAC stored on a card: the truncated HMAC-SHA256 of
+// its UID under the shared key "card". A UID copied to another card does
+// not carry it, only a copy of the card memory does.
+func CardMAC(se SecureElement, uid string) ([]byte, error) {
+	raw, err := hex.DecodeString(uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID %q", uid)
+	}
+	mac, err := se.MAC(cardMACKeyID, raw)
+	if err != nil {
+		return nil, err
+	}
+	return mac[:cardMACSize], nil
+}
+
+// WriteCardMAC writes mac to the four pages starting at page and reads it
+// back
+func WriteCardMAC(mem TagWriter, page int, mac []byte) error {
+	for i := 0; i < cardMACSize/t2tPageSize; i++ {
+		addr := uint16((page + i) * t2tPageSize)
+		if err := mem.WriteBinary(addr, mac[i*t2tPageSize:(i+1)*t2tPageSize]); err != nil {
+			return fmt.Errorf("write at page %d failed: %w", page+i, err)
+		}
+	}
+	ok, err := VerifyCardMAC(mem, page, mac)
+	if err == nil && !ok {
+		err = errors.New("MAC not written")
+	}
+	return err
+}
+
+// VerifyCardMAC reads the four pages starting at page and reports whether
+// they hold mac
+func VerifyCardMAC(mem TagMemory, page int, mac []byte) (bool, error) {
+	block, err := mem.ReadBinary(uint16(page * t2tPageSize))
+	if err != nil {
+		return false, fmt.Errorf("read at page %d failed: %w", page, err)
+	}
+	if len(block) < cardMACSize {
+		return false, fmt.Errorf("short read at page %d: %d bytes", page, len(block))
+	}
+	return hmac.Equal(block[:cardMACSize], mac), nil
+}
@@ -0,0 +1,146 @@
+package keycard
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// loopStaleAfter is how long the diagnostics may go without an update before
+// the event loop of the running service counts as hung
+const loopStaleAfter = 3 * diagInterval
+
+// CheckService diagnoses the running service from the self-test report and
+// diagnostics it publishes to Redis
+func CheckService(redisAddr string) ([]SelfTestResult, error) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	r, err := NewRedisClient(redisAddr, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	report, err := r.GetHash(selfTestHashKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(report) == 0 {
+		return []SelfTestResult{{
+			Name:      "service",
+			Mandatory: true,
+			Err:       fmt.Errorf("no self-test report in %s, service not running", selfTestHashKey),
+		}}, nil
+	}
+
+	var results []SelfTestResult
+	for _, name := range []string{"nfc", "led", "redis", "data-dir"} {
+		status, ok := report[name]
+		if !ok {
+			continue
+		}
+		r := SelfTestResult{Name: name, Mandatory: !strings.HasPrefix(status, "warn")}
+		if status != "pass" {
+			_, msg, _ := strings.Cut(status, ": ")
+			r.Err = fmt.Errorf("%s", msg)
+		}
+		results = append(results, r)
+	}
+
+	diag, err := r.GetHash(diagHashKey)
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, SelfTestResult{Name: "loop", Mandatory: true, Err: checkLoopAlive(diag, time.Now())})
+	return results, nil
+}
+
+// checkLoopAlive verifies the running service's event loop published its
+// diagnostics recently
+func checkLoopAlive(diag map[string]string, now time.Time) error {
+	alive, err := strconv.ParseInt(diag["loop-alive"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("no diagnostics in %s", diagHashKey)
+	}
+	if age := now.Sub(time.Unix(alive, 0)); age > loopStaleAfter {
+		return fmt.Errorf("event loop last seen %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+// HardwareCheck configures CheckHardware
+type HardwareCheck struct {
+	Device     string // NFC device
+	DataDir    string
+	RedisAddr  string // checked but not mandatory, empty to skip
+	LEDDevice  string // I2C device of the LP5662, empty to check the LED scripts
+	LEDAddress uint8
+}
+
+// CheckHardware checks the reader, LED, data directory and Redis directly,
+// for a bench without the service running. The reader must not be in use.
+func CheckHardware(c HardwareCheck) []SelfTestResult {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	checks := []selfTestCheck{
+		{name: "nfc", mandatory: true, run: func() error { return checkReader(c.Device) }},
+		{name: "led", run: func() error { return checkLEDDevice(c.LEDDevice, c.LEDAddress, logger) }},
+		{name: "data-dir", mandatory: true, run: func() error { return checkWritable(c.DataDir) }},
+	}
+	if c.RedisAddr != "" {
+		checks = append(checks, selfTestCheck{name: "redis", run: func() error {
+			r, err := NewRedisClient(c.RedisAddr, logger)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			return r.Ping()
+		}})
+	}
+	results, _ := runSelfTest(checks)
+	return results
+}
+
+// checkReader initializes the PN7150 and shuts it down again
+func checkReader(device string) error {
+	nfc, err := hal.NewPN7150(device, nil, nil, true, false, false)
+	if err != nil {
+		return err
+	}
+	defer nfc.Deinitialize()
+	return nfc.Initialize()
+}
+
+func checkLEDDevice(device string, address uint8, logger *slog.Logger) error {
+	if device == "" {
+		_, err := os.Stat(greenLedScript)
+		return err
+	}
+	led, err := NewLP5662(device, address, logger)
+	if err != nil {
+		return err
+	}
+	defer led.Close()
+	return led.Off()
+}
+
+// checkWritable verifies a file can be written to dir
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".selftest*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	return err
+}
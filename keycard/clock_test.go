@@ -0,0 +1,204 @@
+package keycard
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves on Advance
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a timer, or a ticker if period is set
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	at     time.Time
+	period time.Duration
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now().Truncate(time.Second)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d), period: period, active: true}
+	c.timers = append(c.timers, t)
+	c.fire()
+	return t
+}
+
+// Advance moves the clock and fires the timers due, like the runtime
+// dropping ticks nobody received
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// fire sends on the timers due. The caller holds mu.
+func (c *fakeClock) fire() {
+	for _, t := range c.timers {
+		if !t.active || t.at.After(c.now) {
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		if t.period == 0 {
+			t.active = false
+			continue
+		}
+		for !t.at.After(c.now) {
+			t.at = t.at.Add(t.period)
+		}
+	}
+}
+
+// waitArmed waits until a timer runs, e.g. the next frame of an animation
+func (c *fakeClock) waitArmed(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		armed := slices.ContainsFunc(c.timers, func(t *fakeTimer) bool { return t.active })
+		c.mu.Unlock()
+		if armed {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a timer to be armed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.at, t.active = t.clock.now.Add(d), true
+	t.clock.fire()
+	return active
+}
+
+type fakeTicker struct{ t *fakeTimer }
+
+func (t fakeTicker) C() <-chan time.Time { return t.t.c }
+func (t fakeTicker) Stop()               { t.t.Stop() }
+
+func TestAnimator_Clock(t *testing.T) {
+	clock := newFakeClock()
+	led := &recordLED{}
+	a := NewAnimator(led, clock)
+	defer a.Close()
+
+	a.Play(BlinkAnimation(led.Red, 2, time.Second))
+	waitFor(t, led, "red")
+	clock.waitArmed(t)
+	clock.Advance(time.Second - time.Millisecond)
+	if last := led.last(); last != "red" {
+		t.Fatalf("expected the blink to stay on for its interval, LED is %s", last)
+	}
+	clock.Advance(time.Millisecond)
+	waitFor(t, led, "off")
+	clock.waitArmed(t)
+	clock.Advance(time.Second)
+	waitFor(t, led, "red")
+	clock.waitArmed(t)
+	clock.Advance(time.Second)
+	waitFor(t, led, "off")
+
+	if calls := led.log(); !slices.Equal(calls, []string{"red", "off", "red", "off"}) {
+		t.Errorf("expected two blinks, got %v", calls)
+	}
+}
+
+func TestTap_ClockLockoutAndCooldown(t *testing.T) {
+	const stranger, other = "04AABBCCDDEEFF", "04112233445566"
+	s, uids := newTapService(t, 10)
+	clock := newFakeClock()
+	s.clock = clock
+	s.auth.UseClock(clock)
+	s.config.LockoutAttempts = 2
+	s.config.LockoutDuration = time.Minute
+	s.config.GrantCooldown = 3 * time.Second
+
+	s.handleTagDetection(stranger)
+	s.handleTagDetection(other)
+	s.handleTagDetection(uids[0])
+	if s.granted {
+		t.Fatal("expected the tap to be ignored during the lockout")
+	}
+	clock.Advance(time.Minute)
+	s.handleTagDetection(uids[1])
+	if s.granted {
+		t.Fatal("expected the lockout to last until its end")
+	}
+	clock.Advance(time.Millisecond)
+	tap(t, s, uids, 0)
+
+	s.handleTagDetection(uids[1])
+	if s.granted {
+		t.Fatal("expected the tap to be ignored during the cooldown")
+	}
+	clock.Advance(3*time.Second + time.Millisecond)
+	tap(t, s, uids, 0)
+}
+
+func TestAuthManager_ClockExpiry(t *testing.T) {
+	const uid = "04AABBCCDDEEFF"
+	clock := newFakeClock()
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.UseClock(clock)
+	expiry := clock.Now().Add(time.Hour)
+	if _, err := am.AddCard(Card{UID: uid, Role: RoleAuthorized, Expiry: &expiry}); err != nil {
+		t.Fatalf("AddCard failed: %v", err)
+	}
+
+	clock.Advance(time.Hour - time.Second)
+	if !am.IsAuthorized(uid) || am.IsExpired(uid) {
+		t.Error("expected the card to be valid before its expiry")
+	}
+	clock.Advance(time.Second)
+	if am.IsAuthorized(uid) || !am.IsExpired(uid) {
+		t.Error("expected the card to expire at its expiry")
+	}
+}
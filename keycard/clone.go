@@ -0,0 +1,127 @@
+package keycard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cloneRangesFileName = "clone_ranges.txt"
+
+// Actions for cards from a clone range
+const (
+	CloneWarn = "warn" // publish a warning, then handle the card as usual
+	CloneDeny = "deny" // publish a warning and deny the card
+)
+
+// builtinCloneRanges are factory default and placeholder UIDs that are
+// commonly found on UID-changeable ("magic") cards. Operators add their
+// own in clone_ranges.txt.
+var builtinCloneRanges = []string{
+	"00000000",
+	"01020304",
+	"12345678",
+	"FFFFFFFF",
+	"00000000000000",
+	"01020304050607",
+}
+
+// uidRange matches UIDs of the same length between lo and hi inclusive
+type uidRange struct {
+	lo, hi []byte
+}
+
+// CloneRanges is the set of UIDs suspected to belong to cloned cards
+type CloneRanges struct {
+	prefixes []string
+	ranges   []uidRange
+}
+
+// LoadCloneRanges returns the built-in clone ranges plus those listed in the
+// data directory, one per line as a UID, a "START-END" range, or a prefix
+// ending in "*"
+func LoadCloneRanges(dataDir string) (*CloneRanges, error) {
+	c := &CloneRanges{}
+	for _, entry := range builtinCloneRanges {
+		if err := c.add(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dataDir, cloneRangesFileName))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if err := c.add(entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", cloneRangesFileName, line, err)
+		}
+	}
+	return c, scanner.Err()
+}
+
+func (c *CloneRanges) add(entry string) error {
+	if strings.HasSuffix(entry, UIDWildcard) {
+		rule, err := normalizeUIDRule(entry)
+		if err != nil {
+			return err
+		}
+		c.prefixes = append(c.prefixes, strings.TrimSuffix(rule, UIDWildcard))
+		return nil
+	}
+
+	loStr, hiStr, isRange := strings.Cut(entry, "-")
+	if !isRange {
+		hiStr = loStr
+	}
+	lo, err := NormalizeUID(loStr)
+	if err != nil {
+		return err
+	}
+	hi, err := NormalizeUID(hiStr)
+	if err != nil {
+		return err
+	}
+
+	r := uidRange{}
+	r.lo, _ = hex.DecodeString(lo)
+	r.hi, _ = hex.DecodeString(hi)
+	if len(r.lo) != len(r.hi) || bytes.Compare(r.lo, r.hi) > 0 {
+		return fmt.Errorf("invalid range %q", entry)
+	}
+	c.ranges = append(c.ranges, r)
+	return nil
+}
+
+// Contains reports whether the normalized UID lies in a clone range
+func (c *CloneRanges) Contains(uid string) bool {
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(uid, prefix) {
+			return true
+		}
+	}
+
+	b, err := hex.DecodeString(uid)
+	if err != nil {
+		return false
+	}
+	for _, r := range c.ranges {
+		if len(b) == len(r.lo) && bytes.Compare(b, r.lo) >= 0 && bytes.Compare(b, r.hi) <= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package keycard
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Sources of the device identity that keys are derived from
+const (
+	DeviceIDSoC     = "soc"        // SoC unique ID from the fuses
+	DeviceIDMachine = "machine-id" // /etc/machine-id
+	DeviceIDVIN     = "vin"        // VIN published by the vehicle service
+)
+
+const (
+	fleetKeyID    = "fleet"
+	deriveContext = "librescoot-keycard-derive-v1"
+
+	socUIDFile    = "/sys/devices/soc0/soc_uid"
+	machineIDFile = "/etc/machine-id"
+	vinField      = "vin"
+)
+
+// ReadDeviceID reads the device identity from source; r is only needed for
+// DeviceIDVIN
+func ReadDeviceID(source string, r *RedisClient) (string, error) {
+	var id string
+	switch source {
+	case DeviceIDSoC, DeviceIDMachine:
+		file := socUIDFile
+		if source == DeviceIDMachine {
+			file = machineIDFile
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read device ID: %w", err)
+		}
+		id = string(data)
+	case DeviceIDVIN:
+		vin, err := r.client.HGet(vehicleHashKey, vinField)
+		if err != nil {
+			return "", fmt.Errorf("failed to read VIN: %w", err)
+		}
+		id = vin
+	default:
+		return "", fmt.Errorf("unknown device ID source %q", source)
+	}
+
+	id = normalizeDeviceID(id)
+	if id == "" {
+		return "", fmt.Errorf("device ID from %s is empty", source)
+	}
+	return id, nil
+}
+
+func normalizeDeviceID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// DeriveKey derives the key id for one device from the fleet secret. The
+// backend uses it to compute the keys a scooter derives on its own.
+func DeriveKey(fleet []byte, id, deviceID string) []byte {
+	mac := hmac.New(sha256.New, fleet)
+	mac.Write(deriveInfo(id, deviceID))
+	return mac.Sum(nil)
+}
+
+func deriveInfo(id, deviceID string) []byte {
+	return []byte(deriveContext + "\x00" + id + "\x00" + deviceID)
+}
+
+// DerivedElement serves every key as derived from the fleet secret held by
+// base and the device identity, so a key extracted from one scooter is of
+// no use on another. The fleet secret never leaves base.
+type DerivedElement struct {
+	softElement
+	base     SecureElement
+	deviceID string
+}
+
+func NewDerivedElement(base SecureElement, deviceID string) *DerivedElement {
+	d := &DerivedElement{base: base, deviceID: deviceID}
+	d.softElement.load = d.derive
+	return d
+}
+
+func (d *DerivedElement) derive(id string) ([]byte, error) {
+	if err := validKeyID(id); err != nil {
+		return nil, err
+	}
+	if id == fleetKeyID {
+		return nil, fmt.Errorf("fleet key cannot be used directly")
+	}
+	key, err := d.base.MAC(fleetKeyID, deriveInfo(id, d.deviceID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key %s: %w", id, err)
+	}
+	return key, nil
+}
+
+func (d *DerivedElement) Close() error {
+	return d.base.Close()
+}
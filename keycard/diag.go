@@ -0,0 +1,82 @@
+package keycard
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+const (
+	diagHashKey  = "keycard:diagnostics"
+	diagInterval = 30 * time.Second
+)
+
+// Diagnostics collects reader health for remote support. It is only used
+// from the event loop.
+type Diagnostics struct {
+	started   time.Time
+	lastError string
+	errorCode int
+	errorTime time.Time
+	errors    int
+	i2cErrors int
+	reinits   int
+	reported  int // errors and reinits as of the last Changed
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{started: time.Now()}
+}
+
+// RecordError counts an NFC error, keeping its HAL error code if it has one
+func (d *Diagnostics) RecordError(err error) {
+	d.errors++
+	d.lastError = err.Error()
+	d.errorTime = time.Now()
+	d.errorCode = 0
+
+	var nfcErr hal.NFCError
+	if errors.As(err, &nfcErr) {
+		d.errorCode = nfcErr.Code()
+	}
+	var i2cErr hal.I2CError
+	if errors.As(err, &i2cErr) {
+		d.i2cErrors++
+	}
+}
+
+// Reinitialized counts a full reinitialization of the reader
+func (d *Diagnostics) Reinitialized() {
+	d.reinits++
+}
+
+// Changed reports whether errors or reinitializations were recorded since
+// the last call
+func (d *Diagnostics) Changed() bool {
+	n := d.errors + d.reinits
+	changed := n != d.reported
+	d.reported = n
+	return changed
+}
+
+// Fields returns the diagnostics hash. loop-alive is the time of the call,
+// so it stops advancing if the event loop hangs.
+func (d *Diagnostics) Fields(state hal.State) map[string]any {
+	fields := map[string]any{
+		"state":      strings.ToLower(state.String()),
+		"errors":     d.errors,
+		"i2c-errors": d.i2cErrors,
+		"reinits":    d.reinits,
+		"started":    d.started.Unix(),
+		"loop-alive": time.Now().Unix(),
+		"last-error": d.lastError,
+		"error-code": d.errorCode,
+		"error-time": int64(0),
+	}
+	if !d.errorTime.IsZero() {
+		fields["error-time"] = d.errorTime.Unix()
+	}
+	return fields
+}
@@ -0,0 +1,140 @@
+package keycard
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defaults of the keycard-service command
+const (
+	DefaultDevice    = "/dev/pn5xx_i2c2"
+	DefaultDataDir   = "/data/keycard"
+	DefaultRedisAddr = "localhost:6379"
+)
+
+var errStarted = errors.New("service already started")
+
+// DefaultConfig returns the configuration the keycard-service command runs
+// with when no flags are given, for daemons embedding the service to
+// adjust
+func DefaultConfig() *Config {
+	return &Config{
+		Device:      DefaultDevice,
+		DataDir:     DefaultDataDir,
+		RedisAddr:   DefaultRedisAddr,
+		LogLevel:    2,
+		LEDAddress:  0x30,
+		ReplaySpeed: 1,
+
+		RandomUIDs:  RandomUIDToken,
+		CloneAction: CloneWarn,
+
+		PollPeriod:      defaultPollPeriod,
+		Feedback:        FeedbackNormal,
+		LockoutDuration: defaultLockoutDuration,
+		GrantCooldown:   3 * time.Second,
+		HibernateWindow: 5 * time.Second,
+
+		SyncDeviceID:       DeviceIDMachine,
+		SyncInterval:       15 * time.Minute,
+		RevocationInterval: 5 * time.Minute,
+
+		AuthExpiry: keycardExpiry,
+		AuthType:   keycardType,
+
+		TelemetryInterval: time.Hour,
+		LatencyBudget:     300 * time.Millisecond,
+		StageTimeouts:     StageTimeouts{}.withDefaults(),
+		IntakeSize:        defaultIntakeSize,
+		ShutdownTimeout:   defaultShutdownTimeout,
+	}
+}
+
+// Start runs the service in the background, for embedding it in a larger
+// daemon. Stop shuts it down; Done and Wait tell when it has ended.
+func (s *Service) Start() error {
+	if !s.started.CompareAndSwap(false, true) {
+		return errStarted
+	}
+	// Stop waits for the event loop from here on
+	s.running.Store(true)
+	go s.Run()
+	return nil
+}
+
+// Done is closed when Run returns, after Stop or when a replay ended
+func (s *Service) Done() <-chan struct{} {
+	return s.loopDone
+}
+
+// Wait waits for Run to return and returns its error
+func (s *Service) Wait() error {
+	<-s.loopDone
+	return s.runErr
+}
+
+// Events returns a channel receiving the messages of the tap handling:
+// TagArrived, TagDeparted, AuthPublished, EventPublished and
+// LearnStateChanged. The channel buffers size messages and further ones are
+// dropped until the reader catches up, so a slow reader never holds up a
+// tap. Events panics if size is less than 1. The channel is closed when Run
+// returns.
+func (s *Service) Events(size int) <-chan any {
+	if size < 1 {
+		panic("keycard: Events size must be at least 1")
+	}
+	return s.events.add(size)
+}
+
+// eventSinks are the channels returned by Events
+type eventSinks struct {
+	mu     sync.Mutex
+	sinks  []chan any
+	closed bool
+}
+
+// subscribe passes the messages to the sinks. Subscribed before the tap
+// handling, a tap's arrival reaches them before the grant it leads to.
+func (e *eventSinks) subscribe(bus *Bus) {
+	Subscribe(bus, func(m TagArrived) { e.send(m) })
+	Subscribe(bus, func(m TagDeparted) { e.send(m) })
+	Subscribe(bus, func(m AuthPublished) { e.send(m) })
+	Subscribe(bus, func(m EventPublished) { e.send(m) })
+	Subscribe(bus, func(m LearnStateChanged) { e.send(m) })
+}
+
+func (e *eventSinks) add(size int) <-chan any {
+	ch := make(chan any, size)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		close(ch)
+		return ch
+	}
+	e.sinks = append(e.sinks, ch)
+	return ch
+}
+
+func (e *eventSinks) send(msg any) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ch := range e.sinks {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func (e *eventSinks) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	for _, ch := range e.sinks {
+		close(ch)
+	}
+}
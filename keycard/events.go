@@ -0,0 +1,83 @@
+package keycard
+
+import "strconv"
+
+// Event is the stable code of an outcome or notable event, published with
+// its name so consumers need not match log strings. Codes are grouped by
+// their hundreds and never change meaning; new ones are only added.
+type Event int
+
+const (
+	// 1xx: access granted
+	EventGranted       Event = 100
+	EventLockRequested Event = 101
+	EventHibernate     Event = 102
+	EventGesture       Event = 103
+	EventOverride      Event = 104
+
+	// 2xx: tap rejected or not acted on
+	EventUnauthorized    Event = 200
+	EventRevoked         Event = 201
+	EventOneTimeConsumed Event = 202
+	EventNotParked       Event = 203
+	EventCloneSuspected  Event = 204
+	EventLockedOut       Event = 205
+	EventGroupDenied     Event = 206
+	EventTechDenied      Event = 207
+	EventTimedOut        Event = 208
+
+	// 3xx: card presence
+	EventDeparted Event = 300
+
+	// 4xx: card management
+	EventCardRevoked       Event = 400
+	EventRevocationUpdated Event = 401
+	EventLearnAborted      Event = 402
+
+	// 5xx: service health
+	EventStorageDegraded  Event = 500
+	EventSettingsRejected Event = 501
+	EventCrashed          Event = 502
+)
+
+var eventNames = map[Event]string{
+	EventGranted:           "granted",
+	EventLockRequested:     "lock-requested",
+	EventHibernate:         "hibernate-requested",
+	EventGesture:           "gesture",
+	EventOverride:          "override",
+	EventUnauthorized:      "unauthorized",
+	EventRevoked:           "revoked",
+	EventOneTimeConsumed:   "one-time-consumed",
+	EventNotParked:         "not-parked",
+	EventCloneSuspected:    "clone-suspected",
+	EventLockedOut:         "locked-out",
+	EventGroupDenied:       "group-denied",
+	EventTechDenied:        "tech-denied",
+	EventTimedOut:          "timed-out",
+	EventDeparted:          "departed",
+	EventCardRevoked:       "card-revoked",
+	EventRevocationUpdated: "revocation-updated",
+	EventLearnAborted:      "learn-aborted",
+	EventStorageDegraded:   "storage-degraded",
+	EventSettingsRejected:  "settings-rejected",
+	EventCrashed:           "crashed",
+}
+
+// String returns the event name published in the event field
+func (e Event) String() string {
+	if name, ok := eventNames[e]; ok {
+		return name
+	}
+	return "event-" + strconv.Itoa(int(e))
+}
+
+// eventByName returns the event published with the given name
+func eventByName(name string) (Event, bool) {
+	for e, n := range eventNames {
+		if n == name {
+			return e, true
+		}
+	}
+	return 0, false
+}
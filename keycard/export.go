@@ -0,0 +1,181 @@
+package keycard
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var csvHeader = []string{"uid", "label", "role", "expiry", "uses", "group", "mac"}
+
+// CardRecord describes one enrolled card for import/export
+type CardRecord struct {
+	UID    string `json:"uid"`
+	Label  string `json:"label,omitempty"`
+	Role   string `json:"role"`
+	Expiry string `json:"expiry,omitempty"`
+	Uses   int    `json:"uses,omitempty"` // remaining uses of guest cards
+	Group  string `json:"group,omitempty"`
+	MAC    bool   `json:"mac,omitempty"` // the card carries its CardMAC
+}
+
+// Records returns all enrolled cards
+func (am *AuthManager) Records() []CardRecord {
+	s := am.snap.Load()
+
+	records := make([]CardRecord, 0, len(s.cards))
+	for _, c := range s.cards {
+		rec := CardRecord{UID: c.UID, Label: c.Label, Role: c.Role, Uses: c.Uses, Group: c.Group, MAC: c.MAC}
+		if c.Expiry != nil {
+			rec.Expiry = c.Expiry.UTC().Format(time.RFC3339)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// Import enrolls the given cards. With replace, all existing cards are
+// dropped first; otherwise records are merged and cards already enrolled
+// keep their current role.
+func (am *AuthManager) Import(records []CardRecord, replace bool) error {
+	cards := make([]Card, 0, len(records))
+	for i, rec := range records {
+		uid, err := normalizeUIDRule(rec.UID)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", i+1, err)
+		}
+		card := Card{
+			UID:   uid,
+			Role:  rec.Role,
+			Label: rec.Label,
+			Group: rec.Group,
+			Uses:  rec.Uses,
+			MAC:   rec.MAC,
+		}
+		if strings.HasSuffix(card.UID, UIDWildcard) && rec.Role != RoleAuthorized {
+			return fmt.Errorf("record %d: prefix rule %s must have role %s", i+1, card.UID, RoleAuthorized)
+		}
+		switch rec.Role {
+		case RoleMaster, RoleAuthorized, RoleOneTime, RoleConsumed, RoleOverride, RoleService:
+			card.Uses = 0
+		case RoleGuest:
+			if rec.Uses <= 0 {
+				return fmt.Errorf("record %d: guest card %s without uses", i+1, card.UID)
+			}
+		default:
+			return fmt.Errorf("record %d: unknown role %q", i+1, rec.Role)
+		}
+		if rec.Expiry != "" {
+			expiry, err := time.Parse(time.RFC3339, rec.Expiry)
+			if err != nil {
+				return fmt.Errorf("record %d: invalid expiry %q", i+1, rec.Expiry)
+			}
+			card.Expiry = &expiry
+		}
+		cards = append(cards, card)
+	}
+
+	unlock, err := am.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s := am.edit()
+
+	if replace {
+		s.setCards(nil)
+	}
+
+	for _, card := range cards {
+		if s.find(card.UID) >= 0 {
+			continue
+		}
+		s.appendCard(card)
+	}
+
+	return am.save(s)
+}
+
+// WriteRecords encodes records as "csv" or "json"
+func WriteRecords(w io.Writer, format string, records []CardRecord) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if records == nil {
+			records = []CardRecord{}
+		}
+		return enc.Encode(records)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		for _, rec := range records {
+			uses := ""
+			if rec.Uses > 0 {
+				uses = strconv.Itoa(rec.Uses)
+			}
+			mac := ""
+			if rec.MAC {
+				mac = "true"
+			}
+			cw.Write([]string{rec.UID, rec.Label, rec.Role, rec.Expiry, uses, rec.Group, mac})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// ReadRecords decodes records in "csv" or "json" format
+func ReadRecords(r io.Reader, format string) ([]CardRecord, error) {
+	switch format {
+	case "json":
+		var records []CardRecord
+		if err := json.NewDecoder(r).Decode(&records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	case "csv":
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		rows, err := cr.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 && strings.EqualFold(rows[0][0], csvHeader[0]) {
+			rows = rows[1:]
+		}
+
+		var records []CardRecord
+		for i, row := range rows {
+			// Files written before groups and card MACs existed lack their
+			// columns
+			if len(row) < len(csvHeader)-2 || len(row) > len(csvHeader) {
+				return nil, fmt.Errorf("line %d: expected %d columns, got %d", i+2, len(csvHeader), len(row))
+			}
+			rec := CardRecord{UID: row[0], Label: row[1], Role: row[2], Expiry: row[3]}
+			if len(row) > 5 {
+				rec.Group = row[5]
+			}
+			if len(row) > 6 && row[6] != "" {
+				if rec.MAC, err = strconv.ParseBool(row[6]); err != nil {
+					return nil, fmt.Errorf("line %d: invalid mac %q", i+2, row[6])
+				}
+			}
+			if row[4] != "" {
+				if rec.Uses, err = strconv.Atoi(row[4]); err != nil {
+					return nil, fmt.Errorf("line %d: invalid uses %q", i+2, row[4])
+				}
+			}
+			records = append(records, rec)
+		}
+		return records, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
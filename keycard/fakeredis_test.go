@@ -0,0 +1,575 @@
+package keycard
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-memory Redis speaking RESP2, with the commands the
+// service and redis-ipc use: strings, hashes, lists with BRPOP, pub/sub,
+// transactions and expiry, which is recorded but not enforced. Every publish is recorded
+// with the hash of the same name as it was then, so tests can check what a
+// subscriber fetching it would have seen.
+type fakeRedis struct {
+	addr    string
+	done    chan struct{} // closed at cleanup, ending blocked BRPOPs
+	discard bool          // see newDiscardingRedis
+
+	mu        sync.Mutex
+	changed   chan struct{} // closed and replaced on every write
+	strings   map[string]string
+	hashes    map[string]map[string]string
+	lists     map[string][]string
+	ttls      map[string]time.Duration
+	subs      map[string]map[*fakeConn]bool // subscribers by channel
+	published []fakePublish
+}
+
+// fakePublish is a message published to a channel
+type fakePublish struct {
+	Channel string
+	Message string
+	Hash    map[string]string // the hash named like the channel when published
+}
+
+type fakeConn struct {
+	mu   sync.Mutex // serializes replies and pushed messages
+	w    *bufio.Writer
+	subs map[string]bool
+	tx   [][]string // commands queued since MULTI, nil outside a transaction
+}
+
+// newFakeRedis starts a fake Redis that keeps what it is sent
+func newFakeRedis(tb testing.TB) *fakeRedis {
+	return startFakeRedis(tb, false)
+}
+
+// newDiscardingRedis starts a fake Redis that accepts every command without
+// keeping anything. It answers without allocating, so the allocations of
+// the server do not count against a tap.
+func newDiscardingRedis(tb testing.TB) *fakeRedis {
+	return startFakeRedis(tb, true)
+}
+
+func startFakeRedis(tb testing.TB, discard bool) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("failed to listen: %v", err)
+	}
+	m := &fakeRedis{
+		addr:    l.Addr().String(),
+		done:    make(chan struct{}),
+		discard: discard,
+		changed: make(chan struct{}),
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		lists:   make(map[string][]string),
+		ttls:    make(map[string]time.Duration),
+		subs:    make(map[string]map[*fakeConn]bool),
+	}
+
+	var wg sync.WaitGroup
+	conns := make(map[net.Conn]bool)
+	var connsMu sync.Mutex
+	tb.Cleanup(func() {
+		l.Close()
+		close(m.done)
+		connsMu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		connsMu.Unlock()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			connsMu.Lock()
+			conns[conn] = true
+			connsMu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.serve(conn)
+			}()
+		}
+	}()
+	return m
+}
+
+func (m *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	if m.discard {
+		serveDiscarding(conn)
+		return
+	}
+	c := &fakeConn{w: bufio.NewWriter(conn), subs: make(map[string]bool)}
+	defer m.unsubscribe(c, nil)
+
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		reply := m.exec(c, args)
+		c.mu.Lock()
+		c.w.WriteString(reply)
+		err = c.w.Flush()
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serveDiscarding answers commands without keeping them or allocating
+func serveDiscarding(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	name := make([]byte, 0, 16)
+	buf := make([]byte, 0, 64)
+	queued := -1 // commands queued since MULTI
+	for {
+		n, err := readRESPHeader(r, '*')
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			size, err := readRESPHeader(r, '$')
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				arg, err := r.Peek(min(size, cap(name)))
+				if err != nil {
+					return
+				}
+				name = append(name[:0], arg...)
+			}
+			if _, err := r.Discard(size + 2); err != nil {
+				return
+			}
+		}
+
+		reply := ":1\r\n"
+		switch {
+		case bytes.EqualFold(name, []byte("MULTI")):
+			queued, reply = 0, "+OK\r\n"
+		case bytes.EqualFold(name, []byte("EXEC")):
+			buf = append(strconv.AppendInt(append(buf[:0], '*'), int64(queued), 10), "\r\n"...)
+			for ; queued > 0; queued-- {
+				buf = append(buf, ":1\r\n"...)
+			}
+			queued = -1
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+			continue
+		case queued >= 0:
+			queued, reply = queued+1, "+QUEUED\r\n"
+		case bytes.EqualFold(name, []byte("HELLO")):
+			reply = "-ERR unknown command\r\n" // stay on RESP2
+		case bytes.EqualFold(name, []byte("PING")):
+			reply = "+PONG\r\n"
+		case bytes.EqualFold(name, []byte("GET")):
+			reply = "$-1\r\n"
+		case bytes.EqualFold(name, []byte("HGETALL")):
+			reply = "*0\r\n"
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readRESPHeader reads the length of an array or bulk string
+func readRESPHeader(r *bufio.Reader, kind byte) (int, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 4 || line[0] != kind {
+		return 0, fmt.Errorf("unexpected RESP line %q", line)
+	}
+	n := 0
+	for _, c := range line[1 : len(line)-2] {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("unexpected RESP line %q", line)
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, nil
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readRESPHeader(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readRESPHeader(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func array(items ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		b.WriteString(bulk(item))
+	}
+	return b.String()
+}
+
+func integer(n int) string {
+	return ":" + strconv.Itoa(n) + "\r\n"
+}
+
+func (m *fakeRedis) exec(c *fakeConn, args []string) string {
+	name, args := strings.ToUpper(args[0]), args[1:]
+	switch name {
+	case "PING":
+		if len(c.subs) > 0 {
+			return array("pong", "")
+		}
+		return "+PONG\r\n"
+	case "CLIENT", "SELECT":
+		return "+OK\r\n"
+	case "SUBSCRIBE":
+		return m.subscribe(c, args)
+	case "UNSUBSCRIBE":
+		return m.unsubscribe(c, args)
+	case "MULTI":
+		c.tx = [][]string{}
+		return "+OK\r\n"
+	case "DISCARD":
+		c.tx = nil
+		return "+OK\r\n"
+	case "EXEC":
+		if c.tx == nil {
+			return "-ERR EXEC without MULTI\r\n"
+		}
+		// Under one lock, so nobody sees the transaction half done
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		reply := "*" + strconv.Itoa(len(c.tx)) + "\r\n"
+		for _, cmd := range c.tx {
+			reply += m.execLocked(strings.ToUpper(cmd[0]), cmd[1:])
+		}
+		c.tx = nil
+		return reply
+	}
+	if c != nil && c.tx != nil {
+		c.tx = append(c.tx, append([]string{name}, args...))
+		return "+QUEUED\r\n"
+	}
+	switch name {
+	case "BRPOP":
+		if len(args) < 2 {
+			break
+		}
+		timeout, err := strconv.ParseFloat(args[len(args)-1], 64)
+		if err != nil {
+			return "-ERR timeout is not a float\r\n"
+		}
+		return m.brpop(args[:len(args)-1], time.Duration(timeout*float64(time.Second)))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.execLocked(name, args)
+}
+
+// execLocked runs a command on the data. The caller holds mu.
+func (m *fakeRedis) execLocked(name string, args []string) string {
+	switch {
+	case name == "GET" && len(args) == 1:
+		if v, ok := m.strings[args[0]]; ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case name == "SET" && len(args) >= 2:
+		m.strings[args[0]] = args[1]
+		m.notify()
+		return "+OK\r\n"
+	case name == "EXISTS":
+		n := 0
+		for _, key := range args {
+			if m.exists(key) {
+				n++
+			}
+		}
+		return integer(n)
+	case name == "DEL":
+		n := 0
+		for _, key := range args {
+			if m.exists(key) {
+				n++
+			}
+			delete(m.strings, key)
+			delete(m.hashes, key)
+			delete(m.lists, key)
+			delete(m.ttls, key)
+		}
+		m.notify()
+		return integer(n)
+	case (name == "EXPIRE" || name == "PEXPIRE") && len(args) >= 2:
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		if !m.exists(args[0]) {
+			return integer(0)
+		}
+		unit := time.Second
+		if name == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		m.ttls[args[0]] = time.Duration(n) * unit
+		return integer(1)
+	case name == "HSET" && len(args) >= 3 && len(args)%2 == 1:
+		h := m.hashes[args[0]]
+		if h == nil {
+			h = make(map[string]string)
+			m.hashes[args[0]] = h
+		}
+		added := 0
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		m.notify()
+		return integer(added)
+	case name == "HGET" && len(args) == 2:
+		if v, ok := m.hashes[args[0]][args[1]]; ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case name == "HGETALL" && len(args) == 1:
+		var items []string
+		for k, v := range m.hashes[args[0]] {
+			items = append(items, k, v)
+		}
+		return array(items...)
+	case name == "HDEL" && len(args) >= 2:
+		n := 0
+		for _, field := range args[1:] {
+			if _, ok := m.hashes[args[0]][field]; ok {
+				delete(m.hashes[args[0]], field)
+				n++
+			}
+		}
+		m.notify()
+		return integer(n)
+	case (name == "LPUSH" || name == "RPUSH") && len(args) >= 2:
+		for _, v := range args[1:] {
+			if name == "LPUSH" {
+				m.lists[args[0]] = append([]string{v}, m.lists[args[0]]...)
+			} else {
+				m.lists[args[0]] = append(m.lists[args[0]], v)
+			}
+		}
+		m.notify()
+		return integer(len(m.lists[args[0]]))
+	case name == "PUBLISH" && len(args) == 2:
+		m.published = append(m.published, fakePublish{Channel: args[0], Message: args[1], Hash: maps.Clone(m.hashes[args[0]])})
+		for sub := range m.subs[args[0]] {
+			sub.push(array("message", args[0], args[1]))
+		}
+		m.notify()
+		return integer(len(m.subs[args[0]]))
+	}
+	return "-ERR unknown command '" + name + "'\r\n"
+}
+
+// notify wakes up everyone waiting for a change. The caller holds mu.
+func (m *fakeRedis) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// exists reports whether a key is set. The caller holds mu.
+func (m *fakeRedis) exists(key string) bool {
+	_, s := m.strings[key]
+	_, h := m.hashes[key]
+	return s || h || len(m.lists[key]) > 0
+}
+
+// push sends a message to a subscribed connection
+func (c *fakeConn) push(msg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.WriteString(msg)
+	c.w.Flush()
+}
+
+func (m *fakeRedis) subscribe(c *fakeConn, channels []string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var reply strings.Builder
+	for _, ch := range channels {
+		if m.subs[ch] == nil {
+			m.subs[ch] = make(map[*fakeConn]bool)
+		}
+		m.subs[ch][c] = true
+		c.subs[ch] = true
+		reply.WriteString("*3\r\n" + bulk("subscribe") + bulk(ch) + integer(len(c.subs)))
+	}
+	return reply.String()
+}
+
+// unsubscribe removes c from channels, or from all if none are given
+func (m *fakeRedis) unsubscribe(c *fakeConn, channels []string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(channels) == 0 {
+		for ch := range c.subs {
+			channels = append(channels, ch)
+		}
+	}
+	var reply strings.Builder
+	for _, ch := range channels {
+		delete(m.subs[ch], c)
+		delete(c.subs, ch)
+		reply.WriteString("*3\r\n" + bulk("unsubscribe") + bulk(ch) + integer(len(c.subs)))
+	}
+	if reply.Len() == 0 {
+		return "*3\r\n" + bulk("unsubscribe") + "$-1\r\n" + integer(0)
+	}
+	return reply.String()
+}
+
+func (m *fakeRedis) brpop(keys []string, timeout time.Duration) string {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		m.mu.Lock()
+		for _, key := range keys {
+			if list := m.lists[key]; len(list) > 0 {
+				v := list[len(list)-1]
+				m.lists[key] = list[:len(list)-1]
+				m.mu.Unlock()
+				return array(key, v)
+			}
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-expired:
+			return "*-1\r\n"
+		case <-m.done:
+			return "*-1\r\n"
+		}
+	}
+}
+
+// Hash returns a copy of a hash
+func (m *fakeRedis) Hash(key string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.hashes[key])
+}
+
+// TTL returns the expiry last set on a key
+func (m *fakeRedis) TTL(key string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ttls[key]
+}
+
+// List returns a copy of a list, head first
+func (m *fakeRedis) List(key string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.lists[key]...)
+}
+
+// SetHash sets fields of a hash and publishes each field name on the
+// channel named like the hash, as the other services do
+func (m *fakeRedis) SetHash(key string, fields map[string]string) {
+	args := []string{key}
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	m.exec(nil, append([]string{"HSET"}, args...))
+	for k := range fields {
+		m.exec(nil, []string{"PUBLISH", key, k})
+	}
+}
+
+// Published returns the messages published so far, from the given index on
+func (m *fakeRedis) Published(from int) []fakePublish {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if from >= len(m.published) {
+		return nil
+	}
+	return append([]fakePublish(nil), m.published[from:]...)
+}
+
+// WaitPublished waits until a message matching match is published at index
+// from or later, and returns the index after it
+func (m *fakeRedis) WaitPublished(tb testing.TB, from int, timeout time.Duration, match func(fakePublish) bool) (fakePublish, int) {
+	tb.Helper()
+	deadline := time.After(timeout)
+	for {
+		m.mu.Lock()
+		for i := from; i < len(m.published); i++ {
+			if match(m.published[i]) {
+				p := m.published[i]
+				m.mu.Unlock()
+				return p, i + 1
+			}
+		}
+		from = len(m.published)
+		changed := m.changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			tb.Fatalf("no matching message published within %s", timeout)
+			return fakePublish{}, from
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package keycard
+
+import (
+	"fmt"
+	"time"
+)
+
+// GestureHibernate is the action requesting hibernation; other actions are
+// published as gesture events for other services to act on
+const GestureHibernate = "hibernate"
+
+// Gesture maps a tap pattern to a named action: Taps taps within Within, or
+// a card held on the reader for Hold, by a card with the given role
+type Gesture struct {
+	Action string   `json:"action"`
+	Role   string   `json:"role,omitempty"` // card role, any enrolled card if empty
+	Taps   int      `json:"taps,omitempty"`
+	Within Duration `json:"within,omitempty"`
+	Hold   Duration `json:"hold,omitempty"`
+}
+
+func (g *Gesture) validate() error {
+	switch {
+	case g.Action == "":
+		return fmt.Errorf("gesture without action")
+	case g.Hold > 0 && g.Taps > 0:
+		return fmt.Errorf("gesture %s: taps and hold are exclusive", g.Action)
+	case g.Hold == 0 && (g.Taps < 2 || g.Within <= 0):
+		return fmt.Errorf("gesture %s: needs at least 2 taps within a duration, or a hold", g.Action)
+	}
+	return nil
+}
+
+func (g *Gesture) matches(role string) bool {
+	if g.Role == "" {
+		return role != ""
+	}
+	return g.Role == role
+}
+
+// GestureRecognizer matches taps and card presence against gestures. Tap
+// gestures count taps of any matching card; once one completes, its count
+// starts over. A hold gesture completes once per presence. It is not safe
+// for concurrent use.
+type GestureRecognizer struct {
+	gestures []Gesture
+	taps     [][]time.Time // recent taps per gesture
+
+	role    string    // role of the present card
+	arrived time.Time // when it arrived, zero if none is present
+	held    []bool    // hold gestures completed in this presence
+}
+
+func NewGestureRecognizer(gestures []Gesture) *GestureRecognizer {
+	return &GestureRecognizer{
+		gestures: gestures,
+		taps:     make([][]time.Time, len(gestures)),
+		held:     make([]bool, len(gestures)),
+	}
+}
+
+// Tap records the arrival of a card with the given role and returns the
+// action of a tap gesture it completes
+func (r *GestureRecognizer) Tap(role string, at time.Time) (string, bool) {
+	r.role = role
+	r.arrived = at
+	for i := range r.held {
+		r.held[i] = false
+	}
+
+	for i := range r.gestures {
+		g := &r.gestures[i]
+		if g.Taps == 0 || !g.matches(role) {
+			continue
+		}
+		recent := r.taps[i][:0]
+		for _, t := range r.taps[i] {
+			if at.Sub(t) < time.Duration(g.Within) {
+				recent = append(recent, t)
+			}
+		}
+		r.taps[i] = append(recent, at)
+		if len(r.taps[i]) >= g.Taps {
+			r.taps[i] = nil
+			return g.Action, true
+		}
+	}
+	return "", false
+}
+
+// Held returns the action of a hold gesture completed by the present card
+// at now
+func (r *GestureRecognizer) Held(now time.Time) (string, bool) {
+	if r.arrived.IsZero() {
+		return "", false
+	}
+	for i := range r.gestures {
+		g := &r.gestures[i]
+		if g.Hold == 0 || r.held[i] || !g.matches(r.role) || now.Sub(r.arrived) < time.Duration(g.Hold) {
+			continue
+		}
+		r.held[i] = true
+		return g.Action, true
+	}
+	return "", false
+}
+
+// HasHold reports whether any gesture needs Held to be checked
+func (r *GestureRecognizer) HasHold() bool {
+	for _, g := range r.gestures {
+		if g.Hold > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Depart records that the present card left
+func (r *GestureRecognizer) Depart() {
+	r.arrived = time.Time{}
+}
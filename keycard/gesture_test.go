@@ -0,0 +1,148 @@
+package keycard
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGestureRecognizer_Taps(t *testing.T) {
+	r := NewGestureRecognizer([]Gesture{
+		{Action: GestureHibernate, Role: RoleMaster, Taps: 3, Within: Duration(5 * time.Second)},
+		{Action: "horn", Taps: 2, Within: Duration(time.Second)},
+	})
+	now := time.Now()
+
+	// Taps spread too far apart do not complete the gesture
+	r.Tap(RoleMaster, now)
+	r.Tap(RoleMaster, now.Add(3*time.Second))
+	if _, ok := r.Tap(RoleMaster, now.Add(6*time.Second)); ok {
+		t.Error("expected taps outside the window not to count")
+	}
+	if action, ok := r.Tap(RoleMaster, now.Add(7*time.Second)); !ok || action != GestureHibernate {
+		t.Errorf("expected hibernate, got %q, %v", action, ok)
+	}
+	// The count starts over after a gesture completed
+	if _, ok := r.Tap(RoleMaster, now.Add(8*time.Second)); ok {
+		t.Error("expected count to start over")
+	}
+
+	// Gestures without a role match any enrolled card, but not unknown ones
+	if _, ok := r.Tap("", now); ok {
+		t.Error("expected unknown card not to count")
+	}
+	r.Tap(RoleGuest, now.Add(10*time.Second))
+	if action, ok := r.Tap(RoleAuthorized, now.Add(10500*time.Millisecond)); !ok || action != "horn" {
+		t.Errorf("expected horn, got %q, %v", action, ok)
+	}
+}
+
+func TestGestureRecognizer_Hold(t *testing.T) {
+	r := NewGestureRecognizer([]Gesture{
+		{Action: "service-mode", Role: RoleMaster, Hold: Duration(3 * time.Second)},
+	})
+	now := time.Now()
+
+	r.Tap(RoleAuthorized, now)
+	if _, ok := r.Held(now.Add(5 * time.Second)); ok {
+		t.Error("expected other roles not to complete the hold")
+	}
+
+	r.Tap(RoleMaster, now)
+	if _, ok := r.Held(now.Add(2 * time.Second)); ok {
+		t.Error("expected hold not to complete early")
+	}
+	if action, ok := r.Held(now.Add(3 * time.Second)); !ok || action != "service-mode" {
+		t.Errorf("expected service-mode, got %q, %v", action, ok)
+	}
+	if _, ok := r.Held(now.Add(4 * time.Second)); ok {
+		t.Error("expected hold to complete once per presence")
+	}
+
+	r.Depart()
+	if _, ok := r.Held(now.Add(10 * time.Second)); ok {
+		t.Error("expected no hold without a card")
+	}
+}
+
+func TestGesture_Settings(t *testing.T) {
+	var s Settings
+	data := `{"version": "2.0", "gestures": [{"action": "horn", "taps": 2, "within": "1s"}, {"action": "service-mode", "role": "master", "hold": "3s"}]}`
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(s.Gestures) != 2 || time.Duration(s.Gestures[1].Hold) != 3*time.Second {
+		t.Errorf("unexpected gestures %+v", s.Gestures)
+	}
+
+	for _, invalid := range []string{
+		`{"gestures": [{"taps": 2, "within": "1s"}]}`,
+		`{"gestures": [{"action": "horn", "taps": 1, "within": "1s"}]}`,
+		`{"gestures": [{"action": "horn", "taps": 2, "within": "1s", "hold": "1s"}]}`,
+	} {
+		if err := json.Unmarshal([]byte(invalid), &s); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+// FuzzGestureRecognizer plays taps, holds and departures, each event byte
+// holding the operation, the card's role and the time since the last event
+func FuzzGestureRecognizer(f *testing.F) {
+	f.Add(uint8(3), uint16(5000), uint16(3000), []byte{0x14, 0x14, 0x14, 0x31, 0x02})
+	f.Add(uint8(0), uint16(1), uint16(0), []byte{0x00, 0x03, 0x01, 0x02})
+	f.Fuzz(func(t *testing.T, taps uint8, within, hold uint16, events []byte) {
+		roles := []string{"", RoleMaster, RoleAuthorized, RoleGuest}
+		tapGesture := Gesture{Action: "tap", Role: roles[taps>>6], Taps: 2 + int(taps%8), Within: Duration(time.Duration(within) * time.Millisecond)}
+		holdGesture := Gesture{Action: "hold", Hold: Duration(time.Duration(hold) * time.Millisecond)}
+		var gestures []Gesture
+		for _, g := range []Gesture{tapGesture, holdGesture} {
+			if g.validate() == nil {
+				gestures = append(gestures, g)
+			}
+		}
+		r := NewGestureRecognizer(gestures)
+
+		now := time.Unix(1760000000, 0)
+		var tapped []time.Time // matching taps since the tap gesture completed
+		var role string
+		var arrived time.Time
+		var held bool
+		for _, e := range events {
+			now = now.Add(time.Duration(e>>4) * 100 * time.Millisecond)
+			switch e & 0x03 {
+			case 0, 3:
+				role, arrived, held = roles[e>>2&0x03], now, false
+				if tapGesture.matches(role) {
+					tapped = append(tapped, now)
+				}
+				action, ok := r.Tap(role, now)
+				if !ok {
+					continue
+				}
+				recent := 0
+				for _, at := range tapped {
+					if now.Sub(at) < time.Duration(tapGesture.Within) {
+						recent++
+					}
+				}
+				if action != "tap" || recent < tapGesture.Taps {
+					t.Fatalf("tap by %q completed %q after %d taps within %s", role, action, recent, time.Duration(tapGesture.Within))
+				}
+				tapped = nil
+			case 1:
+				action, ok := r.Held(now)
+				if !ok {
+					continue
+				}
+				if action != "hold" || arrived.IsZero() || held || role == "" || now.Sub(arrived) < time.Duration(holdGesture.Hold) {
+					t.Fatalf("hold by %q completed %q after %s", role, action, now.Sub(arrived))
+				}
+				held = true
+			case 2:
+				r.Depart()
+				arrived = time.Time{}
+			}
+		}
+	})
+}
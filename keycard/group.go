@@ -0,0 +1,89 @@
+package keycard
+
+import "fmt"
+
+// Group actions, what a grant to a card of the group does
+const (
+	GroupUnlock  = "unlock"  // unlock the scooter, the default
+	GroupService = "service" // enter diagnostics mode like a service card
+	GroupDeny    = "deny"    // reject the card, e.g. test cards in the field
+)
+
+// Group configures the grants of the cards enrolled in it: the action, the
+// fields added to the Redis payload and the LED feedback
+type Group struct {
+	Action   string         `json:"action,omitempty"`
+	Fields   map[string]any `json:"fields,omitempty"`
+	Feedback string         `json:"feedback,omitempty"` // cue name, "granted" if empty
+	Color    string         `json:"color,omitempty"`    // color of the cue, see ParseColor
+}
+
+// groupCues are the cues a group can acknowledge its grants with
+var groupCues = map[string]Cue{
+	"granted":  CueGranted,
+	"unlocked": CueUnlocked,
+	"learned":  CueLearned,
+	"lock":     CueLock,
+	"silent":   CueOff,
+}
+
+// groupReservedFields are set by the service and cannot be changed by groups
+var groupReservedFields = map[string]bool{
+	"authentication": true,
+	"code":           true,
+	"uid":            true,
+	"group":          true,
+	authSeqField:     true,
+	authBootIDField:  true,
+}
+
+func (g *Group) validate(name string) error {
+	switch g.Action {
+	case "", GroupUnlock, GroupService, GroupDeny:
+	default:
+		return fmt.Errorf("group %s: unknown action %q", name, g.Action)
+	}
+	if _, ok := groupCues[g.Feedback]; g.Feedback != "" && !ok {
+		return fmt.Errorf("group %s: unknown feedback %q", name, g.Feedback)
+	}
+	if g.Color != "" {
+		if _, err := ParseColor(g.Color); err != nil {
+			return fmt.Errorf("group %s: %w", name, err)
+		}
+	}
+	for k := range g.Fields {
+		if groupReservedFields[k] {
+			return fmt.Errorf("group %s: field %s cannot be set", name, k)
+		}
+	}
+	return nil
+}
+
+// feedback returns the LED feedback for a grant
+func (g *Group) feedback() Feedback {
+	f := Feedback{Cue: CueGranted}
+	if cue, ok := groupCues[g.Feedback]; ok {
+		f.Cue = cue
+	}
+	if color, err := ParseColor(g.Color); err == nil {
+		f.Color = &color
+	}
+	return f
+}
+
+// grantFields returns the fields of a grant to a card of the group named
+// name, on top of those the policy decided on
+func (g *Group) grantFields(name string, fields map[string]any) map[string]any {
+	merged := make(map[string]any, len(fields)+len(g.Fields)+2)
+	for k, v := range g.Fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	merged["group"] = name
+	if g.Action == GroupService {
+		merged["type"] = serviceType
+	}
+	return merged
+}
@@ -0,0 +1,135 @@
+package keycard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// healthLoopTimeout is how long the event loop may go without an iteration
+// before it counts as hung; the diagnostics ticker wakes it every 30 seconds
+const healthLoopTimeout = 3 * diagInterval
+
+// httpSocketName is the FileDescriptorName of the HTTP listener's socket
+// under systemd socket activation
+const httpSocketName = "http"
+
+// healthStatus is the body of /healthz and /readyz
+type healthStatus struct {
+	Status   string `json:"status"` // ok or the first failed condition
+	NFC      string `json:"nfc"`
+	Redis    bool   `json:"redis"`
+	SelfTest bool   `json:"selftest"`
+	LoopAge  int64  `json:"loop-age-ms"`
+}
+
+func (s *Service) healthStatus() healthStatus {
+	return healthStatus{
+		Status:   "ok",
+		NFC:      strings.ToLower(s.nfc.GetState().String()),
+		Redis:    s.redis.Connected(),
+		SelfTest: s.ready.Load(),
+		LoopAge:  s.clock.Now().UnixMilli() - s.loopAlive.Load(),
+	}
+}
+
+// healthz reports whether the service is alive: the event loop is running
+// and the reader is initialized. Redis is not required, events are kept in
+// the outbox meanwhile.
+func (s *Service) healthz(w http.ResponseWriter, r *http.Request) {
+	st := s.healthStatus()
+	switch {
+	case time.Duration(st.LoopAge)*time.Millisecond > healthLoopTimeout:
+		st.Status = "event loop hung"
+	case s.nfc.GetState() == hal.StateUninitialized:
+		st.Status = "reader not initialized"
+	}
+	writeHealth(w, st)
+}
+
+// readyz reports whether the service is ready to grant access: the self-test
+// passed, the reader is discovering and Redis is connected
+func (s *Service) readyz(w http.ResponseWriter, r *http.Request) {
+	st := s.healthStatus()
+	switch state := s.nfc.GetState(); {
+	case !st.SelfTest:
+		st.Status = "self-test not passed"
+	case state != hal.StateDiscovering && state != hal.StatePresent:
+		st.Status = "reader not discovering"
+	case !st.Redis:
+		st.Status = "redis disconnected"
+	}
+	writeHealth(w, st)
+}
+
+// metrics serves the latency histograms and event counters in the
+// Prometheus text format
+func (s *Service) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.latency.WritePrometheus(w)
+	writeCounter(w, "keycard_tag_events_dropped_total", "Tag events dropped because the event loop was behind", s.intake.Dropped())
+	writeCounter(w, "keycard_tag_events_coalesced_total", "Tag events merged into others while the event loop was behind", s.intake.Coalesced())
+}
+
+func writeHealth(w http.ResponseWriter, st healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if st.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+// startHTTP serves the health and metrics endpoints on addr, or on the
+// socket passed by systemd, until stopHTTP
+func (s *Service) startHTTP(addr string) error {
+	ln := s.activatedListener(httpSocketName)
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/metrics", s.metrics)
+	s.http = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := s.http.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("HTTP listener failed", "error", err)
+		}
+	}()
+	s.logger.Info("HTTP listener started", "addr", ln.Addr().String())
+	return nil
+}
+
+// activatedListener returns the socket passed by systemd under name, or
+// the only one passed if it has another name, e.g. that of its unit
+func (s *Service) activatedListener(name string) net.Listener {
+	if ln, ok := s.activated[name]; ok {
+		return ln
+	}
+	if len(s.activated) == 1 {
+		for _, ln := range s.activated {
+			return ln
+		}
+	}
+	return nil
+}
+
+func (s *Service) stopHTTP() {
+	if s.http == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.http.Shutdown(ctx)
+}
@@ -0,0 +1,106 @@
+package keycard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	lockDir       = "/run/lock"
+	storeLockName = ".cards.lock"
+)
+
+var ErrAlreadyRunning = errors.New("another instance is running")
+
+// instanceLock is held while the service runs, so a second instance for
+// the same reader fails at startup instead of fighting over the I2C device
+type instanceLock struct {
+	f *os.File
+}
+
+// defaultLockPath returns the lock file of the reader at device, in the
+// temporary directory on systems without /run/lock
+func defaultLockPath(device string) string {
+	dir := lockDir
+	if _, err := os.Stat(dir); err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "keycard-service."+filepath.Base(device)+".lock")
+}
+
+// lockInstance takes the lock file at path, recording the PID of this
+// process in it for the error of the next one
+func lockInstance(path string) (*instanceLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			if pid := readLockPID(f); pid != 0 {
+				return nil, fmt.Errorf("%w (PID %d holds %s)", ErrAlreadyRunning, pid, path)
+			}
+			return nil, fmt.Errorf("%w (%s is held)", ErrAlreadyRunning, path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &instanceLock{f: f}, nil
+}
+
+// lockStore waits for the lock serializing changes to the data directory
+// between processes, e.g. the service consuming a guest use and the add
+// command. The file is hidden so backups leave it out.
+func lockStore(dataDir string) (*instanceLock, error) {
+	path := filepath.Join(dataDir, storeLockName)
+	// Read-only, as the file may belong to root after a command run by it
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store lock: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return &instanceLock{f: f}, nil
+}
+
+// LockStore takes the lock the service and AuthManager hold while writing
+// the data directory, for tools writing it by other means. release gives
+// it up.
+func LockStore(dataDir string) (release func(), err error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	l, err := lockStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return l.Release, nil
+}
+
+func readLockPID(f *os.File) int {
+	buf := make([]byte, 16)
+	n, _ := f.ReadAt(buf, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	return pid
+}
+
+// Release gives up the lock. The file is left in place: removing it could
+// let a third instance lock a new file while the second still waits on the
+// old one.
+func (l *instanceLock) Release() {
+	if l != nil {
+		l.f.Close()
+	}
+}
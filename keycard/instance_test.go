@@ -0,0 +1,39 @@
+package keycard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockInstance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keycard-service.pn5xx_i2c2.lock")
+	first, err := lockInstance(path)
+	if err != nil {
+		t.Fatalf("lockInstance failed: %v", err)
+	}
+
+	_, err = lockInstance(path)
+	if !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("expected a second instance to fail, got %v", err)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("PID %d", os.Getpid())) {
+		t.Errorf("expected the error to name the holder, got %v", err)
+	}
+
+	first.Release()
+	second, err := lockInstance(path)
+	if err != nil {
+		t.Fatalf("expected the lock to be free once released, got %v", err)
+	}
+	second.Release()
+}
+
+func TestDefaultLockPath(t *testing.T) {
+	if got := filepath.Base(defaultLockPath("/dev/pn5xx_i2c2")); got != "keycard-service.pn5xx_i2c2.lock" {
+		t.Errorf("expected the lock file to be named after the device, got %s", got)
+	}
+}
@@ -0,0 +1,141 @@
+package keycard
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+const defaultIntakeSize = 32
+
+// TagIntake buffers tag events between the HAL and the event loop. It
+// takes events off the HAL's small channel as they come, so the HAL never
+// drops them itself, and holds at most size events for the loop. While the
+// loop is behind, e.g. during a storm of events from an unstable field:
+//
+//   - an error following an error is merged into it
+//   - an event repeating the last buffered event of the same tag is merged
+//     into it
+//   - a departure followed by an arrival of the same tag is removed, the
+//     card is still present
+//   - when the buffer is full, the oldest event is dropped, since the
+//     newest ones tell what is on the reader now
+//
+// Merged and dropped events are counted.
+type TagIntake struct {
+	mu     sync.Mutex
+	events []hal.TagEvent
+	size   int
+	closed bool
+	ready  chan struct{}
+	record func(hal.TagEvent)
+
+	dropped   atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+func NewTagIntake(size int) *TagIntake {
+	if size <= 0 {
+		size = defaultIntakeSize
+	}
+	return &TagIntake{size: size, ready: make(chan struct{}, 1)}
+}
+
+// RecordTo makes Run pass every event to record as it comes from the HAL,
+// before it is merged or dropped. Call before Run.
+func (in *TagIntake) RecordTo(record func(hal.TagEvent)) {
+	in.record = record
+}
+
+// Run takes events from the HAL until ctx is done or the channel closes
+func (in *TagIntake) Run(ctx context.Context, events <-chan hal.TagEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				in.mu.Lock()
+				in.closed = true
+				in.mu.Unlock()
+				in.signal()
+				return
+			}
+			if in.record != nil {
+				in.record(e)
+			}
+			in.push(e)
+		}
+	}
+}
+
+func (in *TagIntake) push(e hal.TagEvent) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if n := len(in.events); n > 0 {
+		last := in.events[n-1]
+		switch {
+		case e.Error != nil && last.Error != nil:
+			in.events[n-1] = e
+			in.coalesced.Add(1)
+			return
+		case e.Error == nil && last.Error == nil && sameTag(e, last):
+			if e.Type == last.Type {
+				in.coalesced.Add(1)
+				return
+			}
+			if last.Type == hal.TagDeparture && e.Type == hal.TagArrival {
+				in.events = in.events[:n-1]
+				in.coalesced.Add(2)
+				return
+			}
+		}
+	}
+
+	if len(in.events) >= in.size {
+		in.events = in.events[1:]
+		in.dropped.Add(1)
+	}
+	in.events = append(in.events, e)
+	in.signal()
+}
+
+func (in *TagIntake) signal() {
+	select {
+	case in.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is signalled when events can be taken
+func (in *TagIntake) Ready() <-chan struct{} {
+	return in.ready
+}
+
+// Take returns the buffered events in order, and whether the HAL closed
+// its channel
+func (in *TagIntake) Take() ([]hal.TagEvent, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	events := in.events
+	in.events = nil
+	return events, in.closed
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (in *TagIntake) Dropped() uint64 {
+	return in.dropped.Load()
+}
+
+// Coalesced returns the number of events merged into others
+func (in *TagIntake) Coalesced() uint64 {
+	return in.coalesced.Load()
+}
+
+func sameTag(a, b hal.TagEvent) bool {
+	return a.Tag != nil && b.Tag != nil && bytes.Equal(a.Tag.ID, b.Tag.ID)
+}
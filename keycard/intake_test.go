@@ -0,0 +1,51 @@
+package keycard
+
+import (
+	"errors"
+	"testing"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+func tagEvent(typ hal.TagEventType, id byte) hal.TagEvent {
+	return hal.TagEvent{Type: typ, Tag: &hal.Tag{ID: []byte{0x04, id, 0x00, 0x00}}}
+}
+
+func TestTagIntake_Coalesces(t *testing.T) {
+	in := NewTagIntake(8)
+	in.push(tagEvent(hal.TagArrival, 1))
+	in.push(tagEvent(hal.TagArrival, 1)) // repeat
+	in.push(tagEvent(hal.TagDeparture, 1))
+	in.push(tagEvent(hal.TagArrival, 1)) // flicker, still present
+	in.push(hal.TagEvent{Error: errors.New("first")})
+	in.push(hal.TagEvent{Error: errors.New("second")})
+
+	events, closed := in.Take()
+	if closed || len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0].Type != hal.TagArrival || events[1].Error == nil || events[1].Error.Error() != "second" {
+		t.Errorf("expected the arrival and the last error, got %+v", events)
+	}
+	if in.Coalesced() != 4 || in.Dropped() != 0 {
+		t.Errorf("expected 4 coalesced and none dropped, got %d and %d", in.Coalesced(), in.Dropped())
+	}
+}
+
+func TestTagIntake_DropsOldest(t *testing.T) {
+	in := NewTagIntake(3)
+	for id := byte(1); id <= 5; id++ {
+		in.push(tagEvent(hal.TagArrival, id))
+	}
+
+	events, _ := in.Take()
+	if len(events) != 3 || events[0].Tag.ID[1] != 3 || events[2].Tag.ID[1] != 5 {
+		t.Fatalf("expected the newest 3 events, got %d", len(events))
+	}
+	if in.Dropped() != 2 {
+		t.Errorf("expected 2 dropped events, got %d", in.Dropped())
+	}
+	if events, _ := in.Take(); len(events) != 0 {
+		t.Errorf("expected taken events to be gone, got %d", len(events))
+	}
+}
@@ -0,0 +1,572 @@
+package keycard
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+const integrationTimeout = 5 * time.Second
+
+var errNoTagMemory = errors.New("fake tag has no memory")
+
+// fakeReader is an NFC reader the test puts NFC-A cards on
+type fakeReader struct {
+	events chan hal.TagEvent
+	state  atomic.Int32
+}
+
+func newFakeReader() *fakeReader {
+	return &fakeReader{events: make(chan hal.TagEvent)}
+}
+
+func (r *fakeReader) send(tb testing.TB, e hal.TagEvent) {
+	tb.Helper()
+	select {
+	case r.events <- e:
+	case <-time.After(integrationTimeout):
+		tb.Fatal("the service did not take the tag event")
+	}
+}
+
+func (r *fakeReader) Initialize() error {
+	r.state.Store(int32(hal.StateIdle))
+	return nil
+}
+
+func (r *fakeReader) Deinitialize() {
+	r.state.Store(int32(hal.StateUninitialized))
+}
+
+func (r *fakeReader) FullReinitialize() error {
+	return nil
+}
+
+func (r *fakeReader) StartDiscovery(pollPeriod uint) error {
+	r.state.Store(int32(hal.StateDiscovering))
+	return nil
+}
+
+func (r *fakeReader) StopDiscovery() error {
+	r.state.Store(int32(hal.StateIdle))
+	return nil
+}
+
+func (r *fakeReader) GetState() hal.State {
+	return hal.State(r.state.Load())
+}
+
+func (r *fakeReader) GetTagEventChannel() <-chan hal.TagEvent {
+	return r.events
+}
+
+func (r *fakeReader) SetTagEventReaderEnabled(enabled bool) {}
+
+func (r *fakeReader) ReadBinary(address uint16) ([]byte, error) {
+	return nil, errNoTagMemory
+}
+
+func (r *fakeReader) WriteBinary(address uint16, data []byte) error {
+	return errNoTagMemory
+}
+
+// harness runs the real Service against a fake reader and an in-memory
+// Redis
+type harness struct {
+	t      *testing.T
+	dir    string
+	s      *Service
+	redis  *fakeRedis
+	reader *fakeReader
+	once   sync.Once
+	next   int // index of the first publish not returned by tap yet
+}
+
+// newHarness prepares a fresh data directory and Redis for a service
+func newHarness(t *testing.T) *harness {
+	return &harness{
+		t:      t,
+		dir:    t.TempDir(),
+		redis:  newFakeRedis(t),
+		reader: newFakeReader(),
+	}
+}
+
+// start starts the service; configure may change the config
+func (h *harness) start(configure func(*Config)) {
+	t := h.t
+	config := &Config{
+		DataDir:         h.dir,
+		RedisAddr:       h.redis.addr,
+		LockFile:        filepath.Join(h.dir, "lock"),
+		Reader:          h.reader,
+		ShutdownTimeout: time.Second,
+	}
+	if configure != nil {
+		configure(config)
+	}
+
+	var err error
+	if h.s, err = NewService(config, slog.New(slog.NewTextHandler(io.Discard, nil))); err != nil {
+		t.Fatalf("NewService failed: %v", err)
+	}
+	if err := h.s.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(h.stop)
+
+	// The self-test runs once discovery started
+	_, h.next = h.redis.WaitPublished(t, 0, integrationTimeout, func(p fakePublish) bool {
+		return p.Channel == selfTestHashKey
+	})
+}
+
+// stop stops the service and checks Run returned without error
+func (h *harness) stop() {
+	h.once.Do(func() {
+		h.s.Stop()
+		select {
+		case <-h.s.Done():
+			if err := h.s.Wait(); err != nil {
+				h.t.Errorf("Run failed: %v", err)
+			}
+		case <-time.After(integrationTimeout):
+			h.t.Error("Run did not return after Stop")
+		}
+	})
+}
+
+// tap presents a card and takes it away, waits for its departure to be
+// published and returns what was published before it
+func (h *harness) tap(uid string) []fakePublish {
+	h.t.Helper()
+	id, err := hex.DecodeString(uid)
+	if err != nil {
+		h.t.Fatalf("invalid UID %s", uid)
+	}
+	h.reader.send(h.t, hal.TagEvent{Type: hal.TagArrival, Tag: &hal.Tag{RFProtocol: rfProtocolMifare, ID: id}})
+	h.reader.send(h.t, hal.TagEvent{Type: hal.TagDeparture})
+
+	from := h.next
+	_, h.next = h.redis.WaitPublished(h.t, from, integrationTimeout, func(p fakePublish) bool {
+		return p.Channel == eventHashKey && p.Message == "event" &&
+			p.Hash["event"] == EventDeparted.String() && p.Hash["uid"] == uid
+	})
+	pubs := h.redis.Published(from)
+	return pubs[:h.next-from-1]
+}
+
+// published returns what was published since the last tap or call
+func (h *harness) published() []fakePublish {
+	pubs := h.redis.Published(h.next)
+	h.next += len(pubs)
+	return pubs
+}
+
+// find returns the hash published to channel with message, failing if there
+// is not exactly one
+func find(tb testing.TB, pubs []fakePublish, channel, message string) map[string]string {
+	tb.Helper()
+	var found []map[string]string
+	for _, p := range pubs {
+		if p.Channel == channel && p.Message == message {
+			found = append(found, p.Hash)
+		}
+	}
+	if len(found) != 1 {
+		tb.Fatalf("expected one %q on %s, got %d in %+v", message, channel, len(found), pubs)
+	}
+	return found[0]
+}
+
+// expectEvent checks an event with the given fields was published once
+func expectEvent(tb testing.TB, pubs []fakePublish, event Event, fields map[string]string) {
+	tb.Helper()
+	var hash map[string]string
+	for _, p := range pubs {
+		if p.Channel != eventHashKey || p.Message != "event" || p.Hash["event"] != event.String() {
+			continue
+		}
+		if hash != nil {
+			tb.Fatalf("expected event %s once, got it twice in %+v", event, pubs)
+		}
+		hash = p.Hash
+	}
+	if hash == nil {
+		tb.Fatalf("expected event %s, got %+v", event, pubs)
+	}
+	if hash["code"] != strconv.Itoa(int(event)) {
+		tb.Errorf("event %s: expected code %d, got %s", event, event, hash["code"])
+	}
+	for k, v := range fields {
+		if hash[k] != v {
+			tb.Errorf("event %s: expected %s=%s, got %q", event, k, v, hash[k])
+		}
+	}
+}
+
+// expectNoGrant checks no auth was published
+func expectNoGrant(tb testing.TB, pubs []fakePublish) {
+	tb.Helper()
+	for _, p := range pubs {
+		if p.Channel == keycardHashKey && p.Message == "authentication" {
+			tb.Fatalf("expected no grant, got %v", p.Hash)
+		}
+	}
+}
+
+// writeKey stores a key in the data directory as the file secure element
+// reads it
+func writeKey(tb testing.TB, dir, id string, key []byte) {
+	tb.Helper()
+	keys := filepath.Join(dir, keyDirName)
+	if err := os.MkdirAll(keys, 0700); err != nil {
+		tb.Fatalf("failed to create key directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(keys, id+keyFileExt), []byte(hex.EncodeToString(key)), 0600); err != nil {
+		tb.Fatalf("failed to write key: %v", err)
+	}
+}
+
+// enroll writes a card store with a master card and authorized cards
+func enroll(tb testing.TB, dir, master string, uids ...string) {
+	tb.Helper()
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		tb.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if err := am.SetMaster(master); err != nil {
+		tb.Fatalf("SetMaster failed: %v", err)
+	}
+	for _, uid := range uids {
+		if _, err := am.AddAuthorized(uid); err != nil {
+			tb.Fatalf("AddAuthorized failed: %v", err)
+		}
+	}
+}
+
+func TestIntegration_LearnAndGrant(t *testing.T) {
+	const rider, stranger = "04AABBCCDDEEFF", "11223344"
+	macKey := []byte("redis secret")
+	h := newHarness(t)
+	writeKey(t, h.dir, authMACKeyID, macKey)
+	h.start(func(c *Config) { c.AuthMAC = true })
+
+	if mode := h.redis.Hash(learnHashKey)["mode"]; mode != LearnModeMaster {
+		t.Fatalf("expected to wait for the master card, learn mode is %q", mode)
+	}
+
+	pubs := h.tap(testMasterUID)
+	if learn := find(t, pubs, learnHashKey, "learn"); learn["mode"] != LearnModeOff {
+		t.Errorf("expected master learning to end, got %v", learn)
+	}
+	expectNoGrant(t, pubs)
+
+	// The master card starts a learning session and ends it
+	if learn := find(t, h.tap(testMasterUID), learnHashKey, "learn"); learn["mode"] != LearnModeCards {
+		t.Fatalf("expected learn mode, got %v", learn)
+	}
+	pubs = h.tap(rider)
+	if learn := find(t, pubs, learnHashKey, "learn"); learn["added"] != "1" {
+		t.Errorf("expected the rider card to be added, got %v", learn)
+	}
+	expectNoGrant(t, pubs)
+	if learn := find(t, h.tap(testMasterUID), learnHashKey, "learn"); learn["mode"] != LearnModeOff || learn["added"] != "1" {
+		t.Fatalf("expected learn mode to end with one card added, got %v", learn)
+	}
+
+	pubs = h.tap(rider)
+	auth := find(t, pubs, keycardHashKey, "authentication")
+	for k, v := range map[string]string{"authentication": "passed", "uid": rider, "code": "100", "type": keycardType, "tech": string(TagClassic)} {
+		if auth[k] != v {
+			t.Errorf("auth: expected %s=%s, got %q", k, v, auth[k])
+		}
+	}
+	if err := VerifyAuthMAC(auth, macKey); err != nil {
+		t.Errorf("VerifyAuthMAC failed: %v", err)
+	}
+	// The grant is withdrawn when the card leaves
+	find(t, pubs, keycardHashKey, "cleared")
+	if hash := h.redis.Hash(keycardHashKey); len(hash) != 0 {
+		t.Errorf("expected the keycard hash to be deleted on departure, got %v", hash)
+	}
+
+	pubs = h.tap(stranger)
+	expectNoGrant(t, pubs)
+	expectEvent(t, pubs, EventUnauthorized, map[string]string{"uid": stranger})
+
+	// The learned cards survive a restart
+	h.stop()
+	am, err := NewAuthManager(h.dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if !am.IsMaster(testMasterUID) || !am.IsAuthorized(rider) || am.IsAuthorized(stranger) {
+		t.Errorf("unexpected store: %+v", am.Records())
+	}
+}
+
+func TestIntegration_Events(t *testing.T) {
+	const rider = "04AABBCCDDEEFF"
+	h := newHarness(t)
+	enroll(t, h.dir, testMasterUID, rider)
+	h.start(nil)
+	if err := h.s.Start(); err == nil {
+		t.Error("expected a second Start to fail")
+	}
+
+	events := h.s.Events(16)
+	h.tap(rider)
+	h.stop()
+
+	var got []string
+	for msg := range events {
+		switch m := msg.(type) {
+		case TagArrived:
+			got = append(got, "arrived "+m.UID)
+		case AuthPublished:
+			if m.Err != nil {
+				t.Errorf("grant failed to publish: %v", m.Err)
+			}
+			got = append(got, "granted "+m.UID)
+		case TagDeparted:
+			got = append(got, "departed "+m.UID)
+		}
+	}
+	want := []string{"arrived " + rider, "granted " + rider, "departed " + rider}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if _, ok := <-h.s.Events(1); ok {
+		t.Error("expected Events to be closed after Run returned")
+	}
+}
+
+func TestIntegration_FailedStart(t *testing.T) {
+	h := newHarness(t)
+	config := &Config{
+		DataDir:   h.dir,
+		RedisAddr: h.redis.addr,
+		LockFile:  filepath.Join(h.dir, "lock"),
+		Reader:    h.reader,
+		User:      "no-such-user",
+	}
+	if _, err := NewService(config, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Fatal("expected NewService to fail for an unknown user")
+	}
+
+	// The failed instance released the lock and its connections
+	h.start(nil)
+}
+
+func TestIntegration_DerivedStoreKey(t *testing.T) {
+	const vin = "WLS1234567890"
+	fleet := []byte("fleet secret")
+	h := newHarness(t)
+	writeKey(t, h.dir, fleetKeyID, fleet)
+	h.redis.SetHash(vehicleHashKey, map[string]string{vinField: vin})
+
+	// Only the fleet secret is on disk, the store key is derived from it
+	h.start(func(c *Config) {
+		c.DeriveKeys = DeviceIDVIN
+		c.SealStore = true
+	})
+	h.stop()
+
+	if _, err := os.Stat(filepath.Join(h.dir, keyDirName, storeKeyID+keyFileExt)); !os.IsNotExist(err) {
+		t.Errorf("expected no %s key file, got %v", storeKeyID, err)
+	}
+	if _, err := NewAuthManager(h.dir); !errors.Is(err, ErrStoreSealed) {
+		t.Fatalf("expected the store to be sealed, got %v", err)
+	}
+	key, err := StoreKey(NewDerivedElement(NewFileElement(filepath.Join(h.dir, keyDirName)), normalizeDeviceID(vin)))
+	if err != nil {
+		t.Fatalf("StoreKey failed: %v", err)
+	}
+	if _, err := NewSealedAuthManager(h.dir, key); err != nil {
+		t.Errorf("expected the store to be sealed under the derived key: %v", err)
+	}
+}
+
+func TestIntegration_Lockout(t *testing.T) {
+	const rider, stranger = "04AABBCCDDEEFF", "11223344"
+	h := newHarness(t)
+	enroll(t, h.dir, testMasterUID, rider)
+	h.start(func(c *Config) { c.LockoutAttempts = 2 })
+
+	expectEvent(t, h.tap(stranger), EventUnauthorized, map[string]string{"uid": stranger})
+	expectEvent(t, h.tap(stranger), EventLockedOut, map[string]string{"attempts": "2"})
+
+	// Taps are ignored, but the master card still works
+	if pubs := h.tap(rider); len(pubs) != 0 {
+		t.Errorf("expected the tap to be ignored during the lockout, got %+v", pubs)
+	}
+	if learn := find(t, h.tap(testMasterUID), learnHashKey, "learn"); learn["mode"] != LearnModeCards {
+		t.Errorf("expected the master card to enter learn mode, got %v", learn)
+	}
+}
+
+func TestIntegration_Vehicle(t *testing.T) {
+	const rider = "04AABBCCDDEEFF"
+
+	t.Run("not parked", func(t *testing.T) {
+		h := newHarness(t)
+		enroll(t, h.dir, testMasterUID, rider)
+		h.redis.SetHash(vehicleHashKey, map[string]string{"state": VehicleStateStandBy, "kickstand": KickstandUp})
+		h.start(func(c *Config) { c.RequireParked = true })
+
+		pubs := h.tap(rider)
+		expectNoGrant(t, pubs)
+		expectEvent(t, pubs, EventNotParked, map[string]string{"uid": rider})
+	})
+
+	// Unlocked when the service starts; a lock is only requested while parked
+	for _, tc := range []struct {
+		state, kickstand string
+		lock             bool
+	}{
+		{state: VehicleStateParked, lock: true},
+		{state: VehicleStateParked, kickstand: KickstandDown, lock: true},
+		{state: VehicleStateParked, kickstand: KickstandUp},
+		{state: VehicleStateReadyToDrive, kickstand: KickstandDown, lock: true},
+		{state: VehicleStateReadyToDrive, kickstand: KickstandUp},
+		{state: VehicleStateReadyToDrive},
+	} {
+		t.Run("lock by tap "+tc.state+" "+tc.kickstand, func(t *testing.T) {
+			h := newHarness(t)
+			enroll(t, h.dir, testMasterUID, rider)
+			vehicle := map[string]string{"state": tc.state}
+			if tc.kickstand != "" {
+				vehicle["kickstand"] = tc.kickstand
+			}
+			h.redis.SetHash(vehicleHashKey, vehicle)
+			h.start(func(c *Config) { c.ToggleLock = true })
+
+			pubs := h.tap(rider)
+			expectNoGrant(t, pubs)
+			cmds := h.redis.List(vehicleCommandQueue)
+			if !tc.lock {
+				expectEvent(t, pubs, EventNotParked, map[string]string{"uid": rider})
+				if len(cmds) != 0 {
+					t.Errorf("expected no lock request, got %v", cmds)
+				}
+				return
+			}
+			expectEvent(t, pubs, EventLockRequested, map[string]string{"uid": rider})
+			if len(cmds) != 1 || cmds[0] != "lock" {
+				t.Errorf("expected a lock request, got %v", cmds)
+			}
+		})
+	}
+}
+
+func TestIntegration_RemoteCommands(t *testing.T) {
+	const rider, guest = "04AABBCCDDEEFF", "11223344"
+	key := []byte("command secret")
+	h := newHarness(t)
+	enroll(t, h.dir, testMasterUID, rider)
+	writeKey(t, h.dir, commandKeyID, key)
+	h.start(func(c *Config) { c.RemoteCommands = true })
+	client, err := NewRedisClient(h.redis.addr, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewRedisClient failed: %v", err)
+	}
+	defer client.Close()
+
+	var list CardList
+	if err := client.Call(Command{Command: CommandListCards}, key, integrationTimeout, &list); err != nil {
+		t.Fatalf("list-cards failed: %v", err)
+	}
+	if len(list.Cards) != 2 {
+		t.Errorf("expected the master and rider cards, got %+v", list.Cards)
+	}
+
+	// Learn mode entered remotely ends remotely
+	if err := client.Call(Command{Command: CommandLearnStart}, key, integrationTimeout, nil); err != nil {
+		t.Fatalf("learn-start failed: %v", err)
+	}
+	if learn := find(t, h.published(), learnHashKey, "learn"); learn["mode"] != LearnModeCards {
+		t.Fatalf("expected learn mode, got %v", learn)
+	}
+	if learn := find(t, h.tap(guest), learnHashKey, "learn"); learn["mode"] != LearnModeCards || learn["added"] != "1" {
+		t.Errorf("expected the card to be learned, got %v", learn)
+	}
+	if err := client.Call(Command{Command: CommandLearnStop}, key, integrationTimeout, nil); err != nil {
+		t.Fatalf("learn-stop failed: %v", err)
+	}
+	if learn := find(t, h.published(), learnHashKey, "learn"); learn["mode"] != LearnModeOff || learn["cards"] != guest {
+		t.Errorf("expected learn mode to end with the card added, got %v", learn)
+	}
+
+	var removed RemoveResult
+	params, _ := json.Marshal(UIDParams{UID: rider})
+	if err := client.Call(Command{Command: CommandRevoke, Params: params}, key, integrationTimeout, &removed); err != nil {
+		t.Fatalf("revoke failed: %v", err)
+	}
+	if !removed.Removed {
+		t.Errorf("expected the rider card to be removed, got %+v", removed)
+	}
+	expectEvent(t, h.published(), EventCardRevoked, map[string]string{"uid": rider})
+	pubs := h.tap(rider)
+	expectNoGrant(t, pubs)
+	expectEvent(t, pubs, EventUnauthorized, map[string]string{"uid": rider})
+
+	// A command with a wrong token is refused
+	if err := client.Call(Command{Command: CommandListCards}, []byte("wrong"), integrationTimeout, nil); err == nil {
+		t.Error("expected a command with a wrong token to fail")
+	}
+}
+
+func TestRedisClient_AuthHash(t *testing.T) {
+	m := newFakeRedis(t)
+	r, err := NewRedisClient(m.addr, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewRedisClient failed: %v", err)
+	}
+	defer r.Close()
+
+	if err := r.PublishAuth("11223344", map[string]any{"override": true, "remaining": 2}); err != nil {
+		t.Fatalf("PublishAuth failed: %v", err)
+	}
+	if err := r.PublishAuth("04AABBCCDDEEFF", nil); err != nil {
+		t.Fatalf("PublishAuth failed: %v", err)
+	}
+	auth := m.Hash(keycardHashKey)
+	if auth["uid"] != "04AABBCCDDEEFF" || auth["override"] != "" || auth["remaining"] != "" {
+		t.Errorf("expected the fields of the earlier grant to be cleared, got %v", auth)
+	}
+	if ttl := m.TTL(keycardHashKey); ttl != keycardExpiry {
+		t.Errorf("expected the keycard hash to expire after %s, got %s", keycardExpiry, ttl)
+	}
+
+	// Events neither touch the grant nor extend it
+	m.exec(nil, []string{"EXPIRE", keycardHashKey, "3"})
+	if err := r.PublishEvent(EventDeparted, map[string]any{"uid": "04AABBCCDDEEFF"}); err != nil {
+		t.Fatalf("PublishEvent failed: %v", err)
+	}
+	if ttl := m.TTL(keycardHashKey); ttl != 3*time.Second {
+		t.Errorf("expected an event to leave the expiry of the grant, got %s", ttl)
+	}
+	if event := m.Hash(eventHashKey); event["event"] != EventDeparted.String() || event["authentication"] != "" {
+		t.Errorf("expected the event in %s, got %v", eventHashKey, event)
+	}
+
+	if err := r.ClearAuth(); err != nil {
+		t.Fatalf("ClearAuth failed: %v", err)
+	}
+	if auth := m.Hash(keycardHashKey); len(auth) != 0 {
+		t.Errorf("expected ClearAuth to delete the keycard hash, got %v", auth)
+	}
+}
@@ -0,0 +1,86 @@
+package keycard
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// Histogram counts durations in latencyBuckets
+type Histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket, the last one for durations above all bounds
+	sum    time.Duration
+	count  uint64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += d
+	h.count++
+}
+
+// writePrometheus writes h as a Prometheus histogram in seconds
+func (h *Histogram) writePrometheus(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound.Seconds(), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum.Seconds(), name, h.count)
+}
+
+// writeCounter writes a Prometheus counter
+func writeCounter(w io.Writer, name, help string, v uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+// LatencyMetrics times the grant path: from tag arrival to the access
+// decision (lookup, including card reads), the Redis publish, and in total
+type LatencyMetrics struct {
+	Lookup  *Histogram
+	Publish *Histogram
+	Total   *Histogram
+}
+
+func NewLatencyMetrics() *LatencyMetrics {
+	return &LatencyMetrics{
+		Lookup:  NewHistogram(),
+		Publish: NewHistogram(),
+		Total:   NewHistogram(),
+	}
+}
+
+// WritePrometheus writes the histograms in the Prometheus text format
+func (m *LatencyMetrics) WritePrometheus(w io.Writer) {
+	m.Lookup.writePrometheus(w, "keycard_lookup_seconds", "Time from tag arrival to the access decision")
+	m.Publish.writePrometheus(w, "keycard_publish_seconds", "Time to publish a grant to Redis")
+	m.Total.writePrometheus(w, "keycard_grant_seconds", "Time from tag arrival to the grant being published")
+}
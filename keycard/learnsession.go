@@ -0,0 +1,143 @@
+package keycard
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	learnSessionFileName = "learn.json"
+
+	// learnResumeWindow is how long after it started a learning session is
+	// resumed after a restart; older ones are reported as aborted
+	learnResumeWindow = 10 * time.Minute
+)
+
+// LearnSession is a learning session in progress, persisted with every card
+// added so it survives a crash or power cycle and its summary is complete
+type LearnSession struct {
+	Since  time.Time `json:"since"`
+	Master string    `json:"master,omitempty"` // master card that started it, empty if started remotely
+	Added  []string  `json:"added,omitempty"`  // cards enrolled in the session
+}
+
+// fields returns the summary of the session published in the learn hash.
+// ended is zero while the session is in progress.
+func (l *LearnSession) fields(ended time.Time, aborted bool) map[string]any {
+	var endedMs int64
+	if !ended.IsZero() {
+		endedMs = ended.UnixMilli()
+	}
+	return map[string]any{
+		"started": l.Since.UnixMilli(),
+		"ended":   endedMs,
+		"master":  l.Master,
+		"cards":   strings.Join(l.Added, ","),
+		"aborted": aborted,
+	}
+}
+
+func learnSessionFilePath(dataDir string) string {
+	return filepath.Join(dataDir, learnSessionFileName)
+}
+
+// LoadLearnSession returns the persisted learning session, or nil if none
+// was in progress
+func LoadLearnSession(dataDir string) (*LearnSession, error) {
+	data, err := os.ReadFile(learnSessionFilePath(dataDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := &LearnSession{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, fmt.Errorf("invalid learn session: %w", err)
+	}
+	return session, nil
+}
+
+// SaveLearnSession persists a learning session in progress
+func SaveLearnSession(dataDir string, session *LearnSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(learnSessionFilePath(dataDir), append(data, '\n'), 0644)
+}
+
+// ClearLearnSession removes the persisted learning session
+func ClearLearnSession(dataDir string) error {
+	if err := os.Remove(learnSessionFilePath(dataDir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// saveLearnSession persists the current learning session, logging
+// failures: learning goes on, it just would not resume after a restart
+func (s *Service) saveLearnSession() {
+	if s.config.DryRun {
+		return
+	}
+	if err := SaveLearnSession(s.config.DataDir, s.learnSession); err != nil {
+		s.logger.Warn("Failed to persist learn session", "error", err)
+	}
+}
+
+func (s *Service) clearLearnSession() {
+	if s.config.DryRun {
+		return
+	}
+	if err := ClearLearnSession(s.config.DataDir); err != nil {
+		s.logger.Warn("Failed to clear persisted learn session", "error", err)
+	}
+}
+
+// resumeLearnMode picks up a learning session interrupted by a restart. A
+// recent one is resumed where it stopped; an older one, or one made moot
+// by a missing master card, is published as aborted. Returns whether the
+// session was resumed.
+func (s *Service) resumeLearnMode() bool {
+	session, err := LoadLearnSession(s.config.DataDir)
+	if err != nil {
+		s.logger.Warn("Ignoring persisted learn session", "error", err)
+		s.clearLearnSession()
+		return false
+	}
+	if session == nil {
+		return false
+	}
+
+	age := s.clock.Now().Sub(session.Since)
+	if !s.auth.HasMaster() || age < 0 || age > learnResumeWindow {
+		s.logger.Info("Learn mode was interrupted by a restart, not resuming",
+			"since", session.Since,
+			"added", len(session.Added))
+		// The summary goes out before the session is cleared, so a crash in
+		// between publishes it again rather than losing it
+		s.publishLearnState(len(session.Added), session.fields(s.clock.Now(), true))
+		s.publishEvent(EventLearnAborted, map[string]any{
+			"since": session.Since.UnixMilli(),
+			"added": len(session.Added),
+		})
+		s.clearLearnSession()
+		return false
+	}
+
+	s.logger.Info("Resuming learn mode interrupted by a restart",
+		"since", session.Since,
+		"added", len(session.Added))
+	s.learnMode = true
+	s.learnSession = session
+	s.linearLed.LedLinearOn(Led3)
+	s.linearLed.LedLinearOn(Led7)
+	s.publishLearnState(len(session.Added), session.fields(time.Time{}, false))
+	return true
+}
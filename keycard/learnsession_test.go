@@ -0,0 +1,106 @@
+package keycard
+
+import (
+	"testing"
+	"time"
+)
+
+const testMasterUID = "04A1B2C3D4E5F6"
+
+func TestResumeLearnMode(t *testing.T) {
+	s, _ := newTapService(t, 10)
+	if err := s.auth.SetMaster(testMasterUID); err != nil {
+		t.Fatalf("SetMaster failed: %v", err)
+	}
+	if s.resumeLearnMode() {
+		t.Fatal("expected nothing to resume without a persisted session")
+	}
+
+	s.enterLearnMode(testMasterUID)
+	s.addToLearnSession("04112233445566")
+	since := s.learnSession.Since
+
+	// Restart
+	s.learnMode, s.learnSession = false, nil
+	if !s.resumeLearnMode() {
+		t.Fatal("expected a recent session to resume")
+	}
+	if !s.learnMode || !s.learnSession.Since.Equal(since) || s.learnSession.Master != testMasterUID || len(s.learnSession.Added) != 1 {
+		t.Errorf("expected the session to resume where it stopped, got %+v", s.learnSession)
+	}
+
+	s.exitLearnMode()
+	if session, err := LoadLearnSession(s.config.DataDir); err != nil || session != nil {
+		t.Errorf("expected the session to be cleared on exit, got %+v, %v", session, err)
+	}
+}
+
+func TestResumeLearnMode_Stale(t *testing.T) {
+	s, _ := newTapService(t, 10)
+	if err := s.auth.SetMaster(testMasterUID); err != nil {
+		t.Fatalf("SetMaster failed: %v", err)
+	}
+	session := &LearnSession{Since: time.Now().Add(-learnResumeWindow - time.Minute)}
+	if err := SaveLearnSession(s.config.DataDir, session); err != nil {
+		t.Fatalf("SaveLearnSession failed: %v", err)
+	}
+
+	var aborted bool
+	Subscribe(s.bus, func(e EventPublished) { aborted = aborted || e.Event == EventLearnAborted })
+	if s.resumeLearnMode() || s.learnMode {
+		t.Fatal("expected a stale session not to resume")
+	}
+	if !aborted {
+		t.Error("expected the stale session to be published as aborted")
+	}
+	if session, _ := LoadLearnSession(s.config.DataDir); session != nil {
+		t.Error("expected the stale session to be cleared")
+	}
+}
+
+func TestLearnSession_Fields(t *testing.T) {
+	since := time.UnixMilli(1700000000000)
+	session := &LearnSession{Since: since, Master: testMasterUID, Added: []string{"04112233445566", "11223344"}}
+
+	fields := session.fields(time.Time{}, false)
+	if fields["started"] != since.UnixMilli() || fields["ended"] != int64(0) || fields["master"] != testMasterUID {
+		t.Errorf("unexpected fields of a session in progress: %v", fields)
+	}
+	if fields["cards"] != "04112233445566,11223344" {
+		t.Errorf("expected the cards added, got %v", fields["cards"])
+	}
+
+	ended := since.Add(time.Minute)
+	if fields := session.fields(ended, true); fields["ended"] != ended.UnixMilli() || fields["aborted"] != true {
+		t.Errorf("unexpected fields of an aborted session: %v", fields)
+	}
+}
+
+func TestLearnMode_DryRun(t *testing.T) {
+	s, _ := newTapService(t, 10)
+	if err := s.auth.SetMaster(testMasterUID); err != nil {
+		t.Fatalf("SetMaster failed: %v", err)
+	}
+	s.config.DryRun = true
+	s.auth.KeepInMemory()
+	s.redis.SetDryRun()
+
+	s.handleTagDetection(testMasterUID)
+	s.handleTagDeparture()
+	s.handleTagDetection("04112233445566")
+	s.handleTagDeparture()
+	if !s.learnMode || !s.auth.IsAuthorized("04112233445566") {
+		t.Fatal("expected the card to be learned in memory")
+	}
+	if session, err := LoadLearnSession(s.config.DataDir); err != nil || session != nil {
+		t.Errorf("expected the learn session not to be persisted, got %+v, %v", session, err)
+	}
+
+	am, err := NewAuthManager(s.config.DataDir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if am.IsAuthorized("04112233445566") {
+		t.Error("expected the learned card not to be persisted")
+	}
+}
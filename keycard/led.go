@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"log/slog"
 	"os/exec"
-	"sync"
-	"time"
 )
 
 const (
@@ -20,13 +18,11 @@ const (
 	Led7 = 7
 )
 
-// RGBLed interface for RGB LED control (can be LP5662 or script-based)
+// RGBLed interface for RGB LED control (can be LP5662 or script-based).
+// Drivers only set colors; flashing and blinking is up to the Animator.
 type RGBLed interface {
 	On() error
 	Off() error
-	Flash(duration time.Duration)
-	StartBlink(interval time.Duration)
-	StopBlink()
 	Close() error
 	// Color control (may be no-op for script-based)
 	Red() error
@@ -35,10 +31,7 @@ type RGBLed interface {
 }
 
 type LEDController struct {
-	mu        sync.Mutex
-	logger    *slog.Logger
-	blinkStop chan struct{}
-	blinking  bool
+	logger *slog.Logger
 }
 
 func NewLEDController(logger *slog.Logger) *LEDController {
@@ -57,64 +50,11 @@ func (l *LEDController) Off() error {
 	return nil
 }
 
-func (l *LEDController) Flash(duration time.Duration) {
-	l.On()
-	time.AfterFunc(duration, func() {
-		l.Off()
-	})
-}
-
 func (l *LEDController) Close() error {
-	l.StopBlink()
 	l.Off()
 	return nil
 }
 
-func (l *LEDController) StartBlink(interval time.Duration) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	if l.blinking {
-		return
-	}
-
-	l.blinking = true
-	l.blinkStop = make(chan struct{})
-
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-
-		state := false
-		for {
-			select {
-			case <-l.blinkStop:
-				l.Off()
-				return
-			case <-ticker.C:
-				if state {
-					l.Off()
-				} else {
-					l.On()
-				}
-				state = !state
-			}
-		}
-	}()
-}
-
-func (l *LEDController) StopBlink() {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	if !l.blinking {
-		return
-	}
-
-	close(l.blinkStop)
-	l.blinking = false
-}
-
 func (l *LEDController) Pattern(led, mode int) {
 	l.execScript(ledControlScript, fmt.Sprintf("%d", led), fmt.Sprintf("%d", mode))
 }
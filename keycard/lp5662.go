@@ -1,10 +1,11 @@
 package keycard
 
 import (
+	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
-	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -48,15 +49,35 @@ var (
 	ColorWhite  = RGB{255, 255, 255}
 )
 
+var colorNames = map[string]RGB{
+	"red":    ColorRed,
+	"green":  ColorGreen,
+	"blue":   ColorBlue,
+	"yellow": ColorYellow,
+	"amber":  ColorAmber,
+	"white":  ColorWhite,
+}
+
+// ParseColor parses a color name like "blue" or a hex color like "#0080FF"
+func ParseColor(s string) (RGB, error) {
+	if c, ok := colorNames[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+	hexColor, ok := strings.CutPrefix(s, "#")
+	b, err := hex.DecodeString(hexColor)
+	if !ok || err != nil || len(b) != 3 {
+		return RGB{}, fmt.Errorf("invalid color %q", s)
+	}
+	return RGB{b[0], b[1], b[2]}, nil
+}
+
 // LP5662 controls the LP5662 RGB LED driver via I2C
 type LP5662 struct {
-	mu        sync.Mutex
-	fd        int
-	logger    *slog.Logger
-	address   uint8
-	color     RGB // current color for On()
-	blinkStop chan struct{}
-	blinking  bool
+	mu      sync.Mutex
+	fd      int
+	logger  *slog.Logger
+	address uint8
+	color   RGB // current color for On()
 }
 
 // NewLP5662 creates a new LP5662 controller
@@ -103,12 +124,18 @@ func (l *LP5662) setSlaveAddress() error {
 }
 
 func (l *LP5662) writeReg(reg, value uint8) error {
-	buf := []byte{reg, value}
+	return l.writeRegs(reg, value)
+}
+
+// writeRegs writes consecutive registers starting at reg in a single I2C
+// transaction, relying on the chip's register address auto-increment
+func (l *LP5662) writeRegs(reg uint8, values ...uint8) error {
+	buf := append([]byte{reg}, values...)
 	n, err := unix.Write(l.fd, buf)
 	if err != nil {
 		return err
 	}
-	if n != 2 {
+	if n != len(buf) {
 		return fmt.Errorf("short write: %d", n)
 	}
 	return nil
@@ -144,10 +171,8 @@ func (l *LP5662) init() error {
 	}
 
 	// Set default current for all channels
-	for i := uint8(0); i < 3; i++ {
-		if err := l.writeReg(lp5662RegCurrentBase+i, lp5662DefaultCurrent); err != nil {
-			return fmt.Errorf("current config failed: %w", err)
-		}
+	if err := l.writeRegs(lp5662RegCurrentBase, lp5662DefaultCurrent, lp5662DefaultCurrent, lp5662DefaultCurrent); err != nil {
+		return fmt.Errorf("current config failed: %w", err)
 	}
 
 	// Turn off all LEDs initially
@@ -164,17 +189,10 @@ func (l *LP5662) init() error {
 
 func (l *LP5662) setColorLocked(color RGB) error {
 	// LP5662 PWM register order: Yellow(unused), Green, Red
-	// We map: R->Red, G->Green, B->Yellow channel (or adjust as needed)
-	if err := l.writeReg(lp5662RegPWMBase, color.B); err != nil { // Yellow/Blue channel
-		return err
-	}
-	if err := l.writeReg(lp5662RegPWMBase+1, color.G); err != nil { // Green channel
-		return err
-	}
-	if err := l.writeReg(lp5662RegPWMBase+2, color.R); err != nil { // Red channel
-		return err
-	}
-	return nil
+	// We map: R->Red, G->Green, B->Yellow channel (or adjust as needed).
+	// All three are written at once so the LED never shows a mix of the
+	// old and new color.
+	return l.writeRegs(lp5662RegPWMBase, color.B, color.G, color.R)
 }
 
 // SetColor sets the RGB LED color
@@ -219,61 +237,6 @@ func (l *LP5662) On() error {
 	return l.SetColor(l.color)
 }
 
-// Flash turns on the LED briefly
-func (l *LP5662) Flash(duration time.Duration) {
-	l.On()
-	time.AfterFunc(duration, func() {
-		l.Off()
-	})
-}
-
-// StartBlink starts blinking the LED
-func (l *LP5662) StartBlink(interval time.Duration) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	if l.blinking {
-		return
-	}
-
-	l.blinking = true
-	l.blinkStop = make(chan struct{})
-
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-
-		state := false
-		for {
-			select {
-			case <-l.blinkStop:
-				l.Off()
-				return
-			case <-ticker.C:
-				if state {
-					l.Off()
-				} else {
-					l.On()
-				}
-				state = !state
-			}
-		}
-	}()
-}
-
-// StopBlink stops blinking the LED
-func (l *LP5662) StopBlink() {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
-	if !l.blinking {
-		return
-	}
-
-	close(l.blinkStop)
-	l.blinking = false
-}
-
 // Close releases the I2C device
 func (l *LP5662) Close() error {
 	l.mu.Lock()
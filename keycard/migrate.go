@@ -0,0 +1,247 @@
+package keycard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	storeFileName = "cards.json"
+
+	// StoreVersion is the on-disk format written by this build
+	StoreVersion = 2
+
+	migratedSuffix = ".v1"
+)
+
+// storeFile is the v2+ on-disk format
+type storeFile struct {
+	Version int    `json:"version"`
+	Cards   []Card `json:"cards,omitempty"`
+	Sealed  []byte `json:"sealed,omitempty"` // the cards encrypted, see sealCards
+}
+
+// migration upgrades the data directory from one format version to the next
+type migration struct {
+	from    int
+	migrate func(dataDir string) (recovered []string, err error)
+}
+
+var migrations = []migration{
+	{from: 1, migrate: migrateV1},
+}
+
+// v1 stored one text file per card list
+var v1Files = []string{
+	"master_uids.txt",
+	"authorized_uids.txt",
+	"guest_uids.txt",
+	"onetime_uids.txt",
+	"consumed_uids.txt",
+}
+
+// storeVersion detects the format of the data directory. An empty directory
+// reports the current version. recovered is true if the card store had to
+// be restored from its last-known-good copy to read the version.
+func storeVersion(dataDir string) (version int, recovered bool, err error) {
+	content, recovered, err := readStoreFile(filepath.Join(dataDir, storeFileName))
+	if err != nil {
+		return 0, recovered, err
+	}
+	if content != nil {
+		var header struct {
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal(content, &header); err != nil {
+			return 0, recovered, fmt.Errorf("invalid %s: %w", storeFileName, err)
+		}
+		return header.Version, recovered, nil
+	}
+
+	if hasV1Files(dataDir) {
+		return 1, false, nil
+	}
+	return StoreVersion, false, nil
+}
+
+// hasV1Files reports whether dataDir holds files of the v1 format
+func hasV1Files(dataDir string) bool {
+	for _, name := range v1Files {
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateStore upgrades the data directory to StoreVersion, returning the
+// files that had to be restored from a last-known-good copy along the way
+func migrateStore(dataDir string) ([]string, error) {
+	var recovered []string
+
+	version, wasRecovered, err := storeVersion(dataDir)
+	if wasRecovered {
+		recovered = append(recovered, storeFileName)
+	}
+	if err != nil {
+		return recovered, err
+	}
+	if version > StoreVersion {
+		return recovered, fmt.Errorf("data directory format v%d is newer than supported v%d", version, StoreVersion)
+	}
+
+	for _, m := range migrations {
+		if m.from != version {
+			continue
+		}
+		files, err := m.migrate(dataDir)
+		if err != nil {
+			return recovered, fmt.Errorf("migration from v%d failed: %w", m.from, err)
+		}
+		recovered = append(recovered, files...)
+		version++
+	}
+	return recovered, nil
+}
+
+// migrateV1 converts the text files to cards.json and keeps the originals
+// with a .v1 suffix
+func migrateV1(dataDir string) ([]string, error) {
+	var cards []Card
+	var recovered []string
+
+	read := func(name string) ([]byte, error) {
+		data, wasRecovered, err := readStoreFile(filepath.Join(dataDir, name))
+		if wasRecovered {
+			recovered = append(recovered, name)
+		}
+		return data, err
+	}
+
+	roles := map[string]string{
+		"master_uids.txt":     RoleMaster,
+		"authorized_uids.txt": RoleAuthorized,
+		"onetime_uids.txt":    RoleOneTime,
+		"consumed_uids.txt":   RoleConsumed,
+	}
+	for _, name := range v1Files {
+		data, err := read(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "guest_uids.txt" {
+			guests, err := parseV1Guests(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			cards = append(cards, guests...)
+			continue
+		}
+
+		for _, uid := range parseV1List(data) {
+			cards = append(cards, Card{UID: uid, Role: roles[name]})
+		}
+	}
+
+	if err := writeStore(dataDir, cards, nil); err != nil {
+		return nil, err
+	}
+
+	for _, name := range v1Files {
+		for _, suffix := range []string{"", backupSuffix} {
+			path := filepath.Join(dataDir, name+suffix)
+			if err := os.Rename(path, path+migratedSuffix); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	return recovered, nil
+}
+
+// parseV1List reads one UID per line
+func parseV1List(data []byte) []string {
+	var uids []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		uid := strings.TrimSpace(scanner.Text())
+		if uid != "" && !strings.HasPrefix(uid, "#") {
+			// Normalize: remove spaces and uppercase
+			uid = strings.ToUpper(strings.ReplaceAll(uid, " ", ""))
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// parseV1Guests reads "UID USES" lines; entries without uses left are dropped
+func parseV1Guests(data []byte) ([]Card, error) {
+	var cards []Card
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// The last field is the use count, everything before it the (possibly spaced) UID
+		uses, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid use count %q", fields[len(fields)-1])
+		}
+		if uses <= 0 {
+			continue
+		}
+		uid := strings.ToUpper(strings.Join(fields[:len(fields)-1], ""))
+		cards = append(cards, Card{UID: uid, Role: RoleGuest, Uses: uses})
+	}
+	return cards, scanner.Err()
+}
+
+// readStore loads the cards from a current-format data directory. Sealed
+// stores need their key; sealed tells whether the store was sealed.
+func readStore(dataDir string, key []byte, repair bool) (cards []Card, sealed, recovered bool, err error) {
+	content, recovered, err := loadStoreFile(filepath.Join(dataDir, storeFileName), repair)
+	if err != nil || content == nil {
+		return nil, false, recovered, err
+	}
+
+	var store storeFile
+	if err := json.Unmarshal(content, &store); err != nil {
+		return nil, false, recovered, fmt.Errorf("invalid %s: %w", storeFileName, err)
+	}
+	if store.Version != StoreVersion {
+		return nil, false, recovered, fmt.Errorf("unexpected %s version %d", storeFileName, store.Version)
+	}
+	if store.Sealed != nil {
+		cards, err := openCards(store.Sealed, key)
+		return cards, true, recovered, err
+	}
+	return store.Cards, false, recovered, nil
+}
+
+// writeStore persists the cards in the current format, sealed if key is
+// given
+func writeStore(dataDir string, cards []Card, key []byte) error {
+	if cards == nil {
+		cards = []Card{}
+	}
+	store := storeFile{Version: StoreVersion, Cards: cards}
+	if key != nil {
+		sealed, err := sealCards(cards, key)
+		if err != nil {
+			return fmt.Errorf("failed to seal cards: %w", err)
+		}
+		store = storeFile{Version: StoreVersion, Sealed: sealed}
+	}
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStoreFile(filepath.Join(dataDir, storeFileName), append(data, '\n'))
+}
@@ -0,0 +1,162 @@
+package keycard
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// Type 2 Tag memory layout
+	t2tDataStart = 16 // NDEF area starts at page 4
+	t2tReadSize  = 16 // READ returns four pages
+	t2tMaxRead   = 512
+
+	tlvNull       = 0x00
+	tlvNDEF       = 0x03
+	tlvTerminator = 0xFE
+
+	ndefTNFExternal = 0x04
+)
+
+var errNoNDEF = errors.New("no NDEF message on tag")
+
+// TagMemory reads raw memory from the tag currently in the field
+type TagMemory interface {
+	ReadBinary(address uint16) ([]byte, error)
+}
+
+// NDEFRecord is a single record of an NDEF message
+type NDEFRecord struct {
+	TNF     uint8
+	Type    []byte
+	ID      []byte
+	Payload []byte
+}
+
+// ReadNDEF reads the NDEF message from a Type 2 Tag (NTAG/Ultralight)
+func ReadNDEF(mem TagMemory) ([]byte, error) {
+	var data []byte
+	for addr := t2tDataStart; addr < t2tDataStart+t2tMaxRead; addr += t2tReadSize {
+		block, err := mem.ReadBinary(uint16(addr))
+		if err != nil {
+			return nil, fmt.Errorf("read at %d failed: %w", addr, err)
+		}
+		if len(block) < t2tReadSize {
+			return nil, fmt.Errorf("short read at %d: %d bytes", addr, len(block))
+		}
+		// Drop the trailing NCI status byte
+		data = append(data, block[:t2tReadSize]...)
+
+		msg, complete, err := findNDEFTLV(data)
+		if err != nil {
+			return nil, err
+		}
+		if complete {
+			return msg, nil
+		}
+	}
+	return nil, errNoNDEF
+}
+
+// findNDEFTLV locates the NDEF TLV in tag memory. complete is false when more
+// memory has to be read before the TLV can be decoded.
+func findNDEFTLV(data []byte) (msg []byte, complete bool, err error) {
+	i := 0
+	for i < len(data) {
+		tag := data[i]
+		switch tag {
+		case tlvNull:
+			i++
+			continue
+		case tlvTerminator:
+			return nil, true, errNoNDEF
+		}
+
+		if i+1 >= len(data) {
+			return nil, false, nil
+		}
+		length := int(data[i+1])
+		header := 2
+		if length == 0xFF {
+			if i+3 >= len(data) {
+				return nil, false, nil
+			}
+			length = int(data[i+2])<<8 | int(data[i+3])
+			header = 4
+		}
+
+		start := i + header
+		if start+length > len(data) {
+			return nil, false, nil
+		}
+		if tag == tlvNDEF {
+			return data[start : start+length], true, nil
+		}
+		i = start + length
+	}
+	return nil, false, nil
+}
+
+// ParseNDEF splits an NDEF message into its records
+func ParseNDEF(msg []byte) ([]NDEFRecord, error) {
+	var records []NDEFRecord
+	i := 0
+	for i < len(msg) {
+		flags := msg[i]
+		i++
+		mb, me, sr, il := flags&0x80 != 0, flags&0x40 != 0, flags&0x10 != 0, flags&0x08 != 0
+		if flags&0x20 != 0 {
+			return nil, errors.New("chunked NDEF records are not supported")
+		}
+		if len(records) == 0 && !mb {
+			return nil, errors.New("first record lacks message begin flag")
+		}
+
+		if i >= len(msg) {
+			return nil, errors.New("truncated record header")
+		}
+		typeLen := int(msg[i])
+		i++
+
+		var payloadLen int
+		if sr {
+			if i >= len(msg) {
+				return nil, errors.New("truncated record header")
+			}
+			payloadLen = int(msg[i])
+			i++
+		} else {
+			if i+4 > len(msg) {
+				return nil, errors.New("truncated record header")
+			}
+			payloadLen = int(msg[i])<<24 | int(msg[i+1])<<16 | int(msg[i+2])<<8 | int(msg[i+3])
+			i += 4
+		}
+
+		idLen := 0
+		if il {
+			if i >= len(msg) {
+				return nil, errors.New("truncated record header")
+			}
+			idLen = int(msg[i])
+			i++
+		}
+
+		if payloadLen < 0 || i+typeLen+idLen+payloadLen > len(msg) {
+			return nil, errors.New("truncated record")
+		}
+		rec := NDEFRecord{TNF: flags & 0x07}
+		rec.Type = msg[i : i+typeLen]
+		i += typeLen
+		rec.ID = msg[i : i+idLen]
+		i += idLen
+		rec.Payload = msg[i : i+payloadLen]
+		i += payloadLen
+
+		records = append(records, rec)
+		if me {
+			return records, nil
+		}
+	}
+	return nil, errors.New("missing message end record")
+}
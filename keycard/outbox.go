@@ -0,0 +1,237 @@
+package keycard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	outboxFileName       = "outbox.jsonl"
+	outboxMaxEvents      = 1000 // the oldest pending events are dropped beyond this
+	outboxReplayInterval = 10 * time.Second
+)
+
+// OutboxEvent is an event on its way to Redis
+type OutboxEvent struct {
+	ID     uint64         `json:"id"`
+	Time   int64          `json:"time"` // Unix milliseconds when it happened
+	Code   Event          `json:"code"`
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+// outboxAck is written once the event with ID Ack was published
+type outboxAck struct {
+	Ack uint64 `json:"ack"`
+}
+
+// outboxLine is one line of the outbox file, an event or an acknowledgement
+type outboxLine struct {
+	OutboxEvent
+	outboxAck
+}
+
+// Outbox records events in the data directory before they are published to
+// Redis, so neither a crash nor a Redis outage loses them. Events that were
+// not acknowledged are replayed later. The file is an append-only log of
+// events and acknowledgements, one JSON object per line, compacted whenever
+// events are replayed and removed once nothing is pending.
+type Outbox struct {
+	mu       sync.Mutex
+	path     string
+	nextID   uint64
+	pending  map[uint64]bool // IDs of events in the file that were not acknowledged
+	inflight map[uint64]bool // added but not yet done, not to be replayed
+}
+
+// NewOutbox opens the outbox, keeping events left unpublished before a
+// restart for replay
+func NewOutbox(dataDir string) (*Outbox, error) {
+	o := &Outbox{
+		path:     filepath.Join(dataDir, outboxFileName),
+		nextID:   1,
+		inflight: make(map[uint64]bool),
+	}
+	events, last, err := o.read()
+	if err != nil {
+		return nil, err
+	}
+	o.setPending(events)
+	o.nextID = last + 1
+	return o, nil
+}
+
+// Pending returns the number of events that were not published yet
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+func (o *Outbox) setPending(events []OutboxEvent) {
+	o.pending = make(map[uint64]bool, len(events))
+	for _, e := range events {
+		o.pending[e.ID] = true
+	}
+}
+
+// Add records an event about to be published and returns its ID for Done.
+// Once the outbox is full, the oldest pending events are dropped.
+func (o *Outbox) Add(event Event, fields map[string]any) (uint64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e := OutboxEvent{ID: o.nextID, Time: time.Now().UnixMilli(), Code: event, Fields: fields}
+	o.nextID++
+
+	if len(o.pending) >= outboxMaxEvents {
+		events, _, err := o.read()
+		if err != nil {
+			return 0, err
+		}
+		events = events[len(events)-outboxMaxEvents+1:]
+		if err := o.write(events); err != nil {
+			return 0, err
+		}
+		o.setPending(events)
+	}
+
+	if err := o.append(e); err != nil {
+		return 0, err
+	}
+	o.pending[e.ID] = true
+	o.inflight[e.ID] = true
+	return e.ID, nil
+}
+
+// Done acknowledges a published event. An event that failed to publish
+// stays pending and is replayed later.
+func (o *Outbox) Done(id uint64, published bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.inflight, id)
+	if !published || !o.pending[id] {
+		return nil
+	}
+	delete(o.pending, id)
+	if len(o.pending) == 0 {
+		return o.write(nil)
+	}
+	return o.append(outboxAck{Ack: id})
+}
+
+// Replay publishes the pending events in order, stopping at the first one
+// that fails, and returns how many were published
+func (o *Outbox) Replay(publish func(OutboxEvent) error) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	events, _, err := o.read()
+	if err != nil {
+		return 0, err
+	}
+
+	var sent int
+	var pubErr error
+	kept := events[:0]
+	for _, e := range events {
+		if pubErr == nil && !o.inflight[e.ID] {
+			if pubErr = publish(e); pubErr == nil {
+				sent++
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	if sent == 0 {
+		return 0, pubErr
+	}
+
+	if err := o.write(kept); err != nil {
+		return sent, err
+	}
+	o.setPending(kept)
+	return sent, pubErr
+}
+
+// read returns the pending events and the highest ID in the file, skipping
+// lines torn by a crash
+func (o *Outbox) read() ([]OutboxEvent, uint64, error) {
+	data, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read outbox: %w", err)
+	}
+
+	var events []OutboxEvent
+	acked := make(map[uint64]bool)
+	var last uint64
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var line outboxLine
+		if json.Unmarshal(scanner.Bytes(), &line) != nil {
+			continue
+		}
+		if line.Ack != 0 {
+			acked[line.Ack] = true
+			continue
+		}
+		events = append(events, line.OutboxEvent)
+		last = max(last, line.ID)
+	}
+
+	pending := events[:0]
+	for _, e := range events {
+		if !acked[e.ID] {
+			pending = append(pending, e)
+		}
+	}
+	return pending, last, nil
+}
+
+func (o *Outbox) append(line any) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open outbox: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	return nil
+}
+
+// write replaces the file with the given events, removing it if there are
+// none
+func (o *Outbox) write(events []OutboxEvent) error {
+	if len(events) == 0 {
+		if err := os.Remove(o.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(o.path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,111 @@
+package keycard
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOutbox(dir)
+	if err != nil {
+		t.Fatalf("NewOutbox failed: %v", err)
+	}
+
+	// A published event leaves nothing behind
+	id, err := o.Add(EventGranted, map[string]any{"uid": "04aabbccddeeff"})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := o.Done(id, true); err != nil {
+		t.Fatalf("Done failed: %v", err)
+	}
+	if o.Pending() != 0 {
+		t.Fatalf("expected empty outbox, got %d pending", o.Pending())
+	}
+
+	// Failed publications and those cut short by a crash survive a restart
+	for i := 0; i < 3; i++ {
+		id, err := o.Add(EventGranted, map[string]any{"uid": "04aabbccddeeff"})
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		if i == 0 {
+			o.Done(id, false)
+		}
+	}
+	o, err = NewOutbox(dir)
+	if err != nil {
+		t.Fatalf("NewOutbox failed: %v", err)
+	}
+	if o.Pending() != 3 {
+		t.Fatalf("expected 3 pending events, got %d", o.Pending())
+	}
+
+	// A failed replay keeps the remaining events in order
+	var ids []uint64
+	down := errors.New("redis down")
+	n, err := o.Replay(func(e OutboxEvent) error {
+		if len(ids) == 1 {
+			return down
+		}
+		ids = append(ids, e.ID)
+		return nil
+	})
+	if n != 1 || !errors.Is(err, down) || o.Pending() != 2 {
+		t.Fatalf("expected 1 replayed and 2 pending, got %d, %d, %v", n, o.Pending(), err)
+	}
+
+	n, err = o.Replay(func(e OutboxEvent) error {
+		ids = append(ids, e.ID)
+		if e.Code != EventGranted || e.Fields["uid"] != "04aabbccddeeff" {
+			t.Errorf("unexpected event %+v", e)
+		}
+		return nil
+	})
+	if err != nil || n != 2 || o.Pending() != 0 {
+		t.Fatalf("expected 2 replayed, got %d, %v", n, err)
+	}
+	if len(ids) != 3 || ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Errorf("expected events in order, got %v", ids)
+	}
+
+	// Events being published are not replayed
+	id, _ = o.Add(EventUnauthorized, nil)
+	if n, _ := o.Replay(func(OutboxEvent) error { return nil }); n != 0 {
+		t.Errorf("expected in-flight event not to be replayed, got %d", n)
+	}
+	o.Done(id, true)
+}
+
+func TestOutbox_Bounded(t *testing.T) {
+	o, err := NewOutbox(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewOutbox failed: %v", err)
+	}
+	var first uint64
+	for i := 0; i < outboxMaxEvents+5; i++ {
+		id, err := o.Add(EventUnauthorized, nil)
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		o.Done(id, false)
+		if i == 5 {
+			first = id
+		}
+	}
+	if o.Pending() != outboxMaxEvents {
+		t.Fatalf("expected %d pending events, got %d", outboxMaxEvents, o.Pending())
+	}
+
+	var replayed uint64
+	o.Replay(func(e OutboxEvent) error {
+		if replayed == 0 {
+			replayed = e.ID
+		}
+		return nil
+	})
+	if replayed != first {
+		t.Errorf("expected the oldest events to be dropped, first is %d, want %d", replayed, first)
+	}
+}
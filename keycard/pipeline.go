@@ -0,0 +1,189 @@
+package keycard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// Stage is a step of the tap pipeline. Every tap is identified, authorized,
+// acted on and published; the stages waiting for the card, the policy or
+// Redis run under a deadline, so a hung call cannot stall the tag events
+// queued behind it.
+type Stage string
+
+const (
+	StageIdentify  Stage = "identify"  // reading the card's type and credentials
+	StageAuthorize Stage = "authorize" // the policy's decision, including a policy script
+	StageAct       Stage = "act"       // lock state, guest uses and LED cues; local, without deadline
+	StagePublish   Stage = "publish"   // auths and events sent to Redis
+)
+
+const (
+	defaultIdentifyTimeout  = time.Second
+	defaultAuthorizeTimeout = 2 * time.Second
+	defaultPublishTimeout   = time.Second
+)
+
+// StageTimeouts are the deadlines of the pipeline stages
+type StageTimeouts struct {
+	Identify  time.Duration
+	Authorize time.Duration
+	Publish   time.Duration
+}
+
+// withDefaults fills in the default of every unset deadline
+func (t StageTimeouts) withDefaults() StageTimeouts {
+	if t.Identify <= 0 {
+		t.Identify = defaultIdentifyTimeout
+	}
+	if t.Authorize <= 0 {
+		t.Authorize = defaultAuthorizeTimeout
+	}
+	if t.Publish <= 0 {
+		t.Publish = defaultPublishTimeout
+	}
+	return t
+}
+
+var ErrStageTimeout = errors.New("stage timed out")
+
+// runStage runs fn under a deadline. fn runs on its own goroutine and is
+// abandoned when the deadline passes: the HAL and the Redis client take no
+// context, so a hung call finishes in the background. fn must therefore
+// neither read nor change state of the event loop other than through its
+// result.
+func runStage[T any](parent context.Context, stage Stage, timeout time.Duration, fn func(ctx context.Context) (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := fn(ctx)
+		done <- result{v, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, fmt.Errorf("%s after %s: %w", stage, timeout, ErrStageTimeout)
+	}
+}
+
+// presentCard is the present card as a read of the identify stage sees
+// it. It is taken on the event loop before the read starts, so a read
+// abandoned at its deadline never looks at state the loop has since moved
+// on from.
+type presentCard struct {
+	uid   string
+	proto hal.RFProtocol
+	mem   TagWriter   // the card's memory, nil without a reader
+	t     Transceiver // frames to the card, nil if the reader cannot exchange them
+}
+
+// card takes the present card for a read
+func (s *Service) card(uid string) presentCard {
+	c := presentCard{uid: uid, proto: s.currentProto}
+	if s.nfc != nil {
+		c.mem = s.nfc
+	}
+	c.t, _ = any(s.nfc).(Transceiver)
+	return c
+}
+
+// apdu returns the APDU channel to the card if it speaks ISO-DEP, or nil
+func (c presentCard) apdu() Transceiver {
+	if c.proto != hal.RFProtocolISODEP {
+		return nil
+	}
+	return c.t
+}
+
+// withContext makes the card's reads and writes fail once ctx is done, so
+// a read of several exchanges stops at the first one past its deadline
+func (c presentCard) withContext(ctx context.Context) presentCard {
+	if c.mem != nil {
+		c.mem = ctxMemory{ctx, c.mem}
+	}
+	if c.t != nil {
+		c.t = ctxTransceiver{ctx, c.t}
+	}
+	return c
+}
+
+type ctxMemory struct {
+	ctx context.Context
+	mem TagWriter
+}
+
+func (m ctxMemory) ReadBinary(address uint16) ([]byte, error) {
+	if err := m.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.mem.ReadBinary(address)
+}
+
+func (m ctxMemory) WriteBinary(address uint16, data []byte) error {
+	if err := m.ctx.Err(); err != nil {
+		return err
+	}
+	return m.mem.WriteBinary(address, data)
+}
+
+type ctxTransceiver struct {
+	ctx context.Context
+	t   Transceiver
+}
+
+func (t ctxTransceiver) Transceive(apdu []byte) ([]byte, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.t.Transceive(apdu)
+}
+
+// identify reads from the card under the identify deadline, returning the
+// zero value if the card does not answer in time. Reads hold the reader
+// one at a time: a read abandoned at its deadline keeps it until its
+// current exchange returns, and reads meanwhile fail at once instead of
+// using the reader concurrently.
+func identify[T any](s *Service, c presentCard, read func(c presentCard) T) T {
+	if !s.cardIO.TryLock() {
+		s.logger.Warn("Card not read, reader busy with a read past its deadline", "uid", c.uid)
+		var zero T
+		return zero
+	}
+	v, err := runStage(s.ctx, StageIdentify, s.config.StageTimeouts.Identify, func(ctx context.Context) (T, error) {
+		defer s.cardIO.Unlock()
+		return read(c.withContext(ctx)), nil
+	})
+	if err != nil {
+		// Possibly called from the authorize stage, so not recorded in the
+		// diagnostics of the event loop
+		s.logger.Warn("Card did not answer in time", "uid", c.uid, "error", err)
+	}
+	return v
+}
+
+// publish sends to Redis under the publish deadline. Stop waits for sends
+// past their deadline before closing Redis.
+func (s *Service) publish(send func() error) error {
+	s.inflight.Add(1)
+	_, err := runStage(s.ctx, StagePublish, s.config.StageTimeouts.Publish, func(context.Context) (struct{}, error) {
+		defer s.inflight.Done()
+		return struct{}{}, send()
+	})
+	if errors.Is(err, ErrStageTimeout) {
+		s.diag.RecordError(err)
+	}
+	return err
+}
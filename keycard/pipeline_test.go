@@ -0,0 +1,113 @@
+package keycard
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunStage(t *testing.T) {
+	v, err := runStage(context.Background(), StageIdentify, time.Second, func(context.Context) (string, error) {
+		return "ok", nil
+	})
+	if v != "ok" || err != nil {
+		t.Fatalf("expected result of stage, got %q, %v", v, err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	v, err = runStage(context.Background(), StagePublish, 20*time.Millisecond, func(context.Context) (string, error) {
+		<-release // a Redis call that hangs
+		return "late", nil
+	})
+	if !errors.Is(err, ErrStageTimeout) || v != "" {
+		t.Errorf("expected stage to time out, got %q, %v", v, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expected hung stage to be abandoned at its deadline, took %s", d)
+	}
+}
+
+func TestTap_HungRedisDoesNotStall(t *testing.T) {
+	s, uids := newTapService(t, 10)
+	s.config.StageTimeouts.Publish = 20 * time.Millisecond
+
+	hang := make(chan struct{})
+	defer close(hang)
+	s.redis.SetAuthTag("hang", func([]byte) ([]byte, error) {
+		<-hang
+		return nil, nil
+	})
+
+	start := time.Now()
+	s.handleTagDetection(uids[0])
+	if s.granted {
+		t.Error("expected grant not to count as published")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expected tap to finish at the publish deadline, took %s", d)
+	}
+}
+
+// hangingCard blocks its first exchange until release is closed
+type hangingCard struct {
+	release   chan struct{}
+	exchanges atomic.Int32
+}
+
+func (c *hangingCard) Transceive(apdu []byte) ([]byte, error) {
+	if c.exchanges.Add(1) == 1 {
+		<-c.release
+	}
+	return []byte{0x90, 0x00}, nil
+}
+
+func TestIdentify_AbandonedReadHoldsReader(t *testing.T) {
+	s, _ := newTapService(t, 1)
+	s.config.StageTimeouts.Identify = 20 * time.Millisecond
+	card := &hangingCard{release: make(chan struct{})}
+	returned := make(chan struct{})
+
+	v := identify(s, presentCard{uid: "04AABBCCDDEEFF", t: card}, func(c presentCard) string {
+		defer close(returned)
+		for i := 0; i < 2; i++ {
+			if _, err := c.t.Transceive(nil); err != nil {
+				return ""
+			}
+		}
+		return "late"
+	})
+	if v != "" {
+		t.Fatalf("expected the read to be abandoned, got %q", v)
+	}
+
+	// The next card is not read while the abandoned read holds the reader
+	read := false
+	identify(s, presentCard{uid: "04112233445566", t: card}, func(c presentCard) string {
+		read = true
+		return ""
+	})
+	if read {
+		t.Error("expected no read while an abandoned one holds the reader")
+	}
+
+	close(card.release)
+	<-returned
+	if n := card.exchanges.Load(); n != 1 {
+		t.Errorf("expected the abandoned read to stop at its deadline, %d exchanges", n)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !s.cardIO.TryLock() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the reader to be released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.cardIO.Unlock()
+	if v := identify(s, presentCard{uid: "04112233445566"}, func(presentCard) string { return "ok" }); v != "ok" {
+		t.Errorf("expected reads once the reader is released, got %q", v)
+	}
+}
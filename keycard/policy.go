@@ -0,0 +1,127 @@
+package keycard
+
+import (
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// Action is what a policy decides to do with a tap
+type Action int
+
+const (
+	ActionNone  Action = iota // no opinion, the next policy decides
+	ActionGrant               // publish the grant
+	ActionDeny                // reject with the decision's event
+)
+
+// Decision is the outcome of an AuthPolicy
+type Decision struct {
+	Action Action
+	Event  Event          // why a tap was denied
+	Fields map[string]any // published with a grant
+}
+
+// TapContext is what a policy knows about a tap. Credentials that need
+// reading the card are only read when a policy asks for them, and once.
+type TapContext struct {
+	UID          string
+	Protocol     hal.RFProtocol
+	Tech         TagType
+	Time         time.Time
+	VehicleState string
+	RandomUID    bool // the UID changes on every tap, only credentials identify the card
+
+	token   func() *AccessToken
+	tok     *AccessToken
+	tokRead bool
+}
+
+// Token returns a valid NDEF access token from the card, or nil
+func (c *TapContext) Token() *AccessToken {
+	if c.token != nil && !c.tokRead {
+		c.tok, c.tokRead = c.token(), true
+	}
+	return c.tok
+}
+
+// AuthPolicy decides whether a tap grants access
+type AuthPolicy interface {
+	Decide(tap *TapContext) Decision
+}
+
+// Policies asks each policy in turn; the first with an opinion decides.
+// Taps no policy has an opinion on are unauthorized.
+type Policies []AuthPolicy
+
+func (p Policies) Decide(tap *TapContext) Decision {
+	for _, policy := range p {
+		if d := policy.Decide(tap); d.Action != ActionNone {
+			return d
+		}
+	}
+	return Decision{Action: ActionDeny, Event: EventUnauthorized}
+}
+
+// DefaultPolicy checks the enrolled UIDs, then access tokens
+func DefaultPolicy(auth *AuthManager) AuthPolicy {
+	return Policies{
+		UIDPolicy{Auth: auth},
+		TokenPolicy{},
+	}
+}
+
+// randomUIDPolicy checks the credentials of a tag with a random UID, which
+// cannot be enrolled
+func randomUIDPolicy(auth *AuthManager) AuthPolicy {
+	return Policies{
+		TokenPolicy{},
+	}
+}
+
+// UIDPolicy grants enrolled UIDs and denies used up one-time cards. Grants
+// to service cards are published with type service rather than as an
+// unlock.
+type UIDPolicy struct {
+	Auth *AuthManager
+}
+
+func (p UIDPolicy) Decide(tap *TapContext) Decision {
+	switch {
+	case p.Auth.IsAuthorized(tap.UID):
+		if p.Auth.Role(tap.UID) == RoleService {
+			return Decision{Action: ActionGrant, Fields: map[string]any{"type": serviceType}}
+		}
+		return Decision{Action: ActionGrant}
+	case p.Auth.IsConsumed(tap.UID):
+		return Decision{Action: ActionDeny, Event: EventOneTimeConsumed}
+	}
+	return Decision{}
+}
+
+// TokenPolicy grants cards carrying a valid access token
+type TokenPolicy struct{}
+
+func (TokenPolicy) Decide(tap *TapContext) Decision {
+	if token := tap.Token(); token != nil {
+		return Decision{Action: ActionGrant, Fields: map[string]any{
+			"token":   "temporary",
+			"expires": token.NotAfter.Unix(),
+		}}
+	}
+	return Decision{}
+}
+
+// TechPolicy denies cards of the given types, whatever else they carry
+type TechPolicy struct {
+	Deny []TagType
+}
+
+func (p TechPolicy) Decide(tap *TapContext) Decision {
+	for _, t := range p.Deny {
+		if tap.Tech == t {
+			return Decision{Action: ActionDeny, Event: EventTechDenied}
+		}
+	}
+	return Decision{}
+}
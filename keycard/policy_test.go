@@ -0,0 +1,211 @@
+package keycard
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.AddAuthorized("BB000001")
+	am.AddOneTime("DD000001")
+	am.ConsumeOneTime("DD000001")
+	am.AddCard(Card{UID: "CC000001", Role: RoleService})
+	policy := DefaultPolicy(am)
+
+	if d := policy.Decide(&TapContext{UID: "BB000001"}); d.Action != ActionGrant {
+		t.Errorf("expected enrolled UID to be granted, got %+v", d)
+	}
+	if d := policy.Decide(&TapContext{UID: "CC000001"}); d.Action != ActionGrant || d.Fields["type"] != "service" {
+		t.Errorf("expected service card to be granted as type service, got %+v", d)
+	}
+	if d := policy.Decide(&TapContext{UID: "DD000001"}); d.Action != ActionDeny || d.Event != EventOneTimeConsumed {
+		t.Errorf("expected used one-time card to be denied, got %+v", d)
+	}
+	if d := policy.Decide(&TapContext{UID: "EE000001"}); d.Action != ActionDeny || d.Event != EventUnauthorized {
+		t.Errorf("expected unknown card to be unauthorized, got %+v", d)
+	}
+
+	// Credentials are read from the card only when the UID is not enough,
+	// and only once
+	reads := 0
+	tap := &TapContext{
+		UID: "EE000001",
+		token: func() *AccessToken {
+			reads++
+			return &AccessToken{NotAfter: time.Now().Add(time.Hour)}
+		},
+	}
+	if d := policy.Decide(tap); d.Action != ActionGrant || d.Fields["token"] == nil {
+		t.Errorf("expected token card to be granted, got %+v", d)
+	}
+	tap.Token()
+	if reads != 1 {
+		t.Errorf("expected token to be read once, got %d", reads)
+	}
+
+	tap = &TapContext{UID: "BB000001", token: func() *AccessToken {
+		t.Error("enrolled UID should not need a token read")
+		return nil
+	}}
+	policy.Decide(tap)
+}
+
+func TestScriptPolicy(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.AddAuthorized("BB000001")
+	dir := t.TempDir()
+	script := LoadPolicyScript(dir, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	policy := NewScriptPolicy(DefaultPolicy(am), script)
+
+	// Without a script the built-in decision stands
+	if d := policy.Decide(&TapContext{UID: "BB000001"}); d.Action != ActionGrant {
+		t.Errorf("expected grant without script, got %+v", d)
+	}
+
+	writeScript := func(src string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, policyScriptName), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		script.Reload()
+	}
+	writeScript(`
+def decide(tap):
+    if tap.uid == "BB000001" and time.now().hour < 5:
+        return {"decision": "deny", "event": "not-parked", "fields": {"rule": "curfew"}}
+    if tap.uid == "EE000001":
+        return {"decision": "grant", "fields": {"fleet": "depot", "zone": 3}}
+    if tap.uid == "FF000001":
+        return "grant"
+    if tap.uid == "FF000002":
+        for i in range(10000000):
+            pass
+`)
+
+	night := time.Date(2024, 5, 1, 2, 0, 0, 0, time.Local)
+	d := policy.Decide(&TapContext{UID: "BB000001", Time: night})
+	if d.Action != ActionDeny || d.Event != EventNotParked || d.Fields["rule"] != "curfew" {
+		t.Errorf("expected script to deny, got %+v", d)
+	}
+	if d := policy.Decide(&TapContext{UID: "BB000001", Time: night.Add(8 * time.Hour)}); d.Action != ActionGrant {
+		t.Errorf("expected script to keep the grant by day, got %+v", d)
+	}
+	d = policy.Decide(&TapContext{UID: "EE000001"})
+	if d.Action != ActionGrant || d.Fields["fleet"] != "depot" || d.Fields["zone"] != int64(3) {
+		t.Errorf("expected script to grant, got %+v", d)
+	}
+	for _, uid := range []string{"FF000001", "FF000002"} {
+		d = policy.Decide(&TapContext{UID: uid})
+		if d.Action != ActionDeny || d.Event != EventUnauthorized {
+			t.Errorf("%s: expected invalid output to keep the decision, got %+v", uid, d)
+		}
+	}
+
+	// A script that fails to load keeps the one loaded before
+	writeScript("def decide(tap):\n    return {")
+	if d := policy.Decide(&TapContext{UID: "EE000001"}); d.Action != ActionGrant {
+		t.Errorf("expected the previous script to stay in effect, got %+v", d)
+	}
+
+	if err := os.Remove(filepath.Join(dir, policyScriptName)); err != nil {
+		t.Fatal(err)
+	}
+	script.Reload()
+	if d := policy.Decide(&TapContext{UID: "EE000001"}); d.Action != ActionDeny {
+		t.Errorf("expected the built-in decision once the script is removed, got %+v", d)
+	}
+}
+
+func TestScriptPolicy_RandomUID(t *testing.T) {
+	const random = "08A1B2C3"
+	s, _ := newTapService(t, 2)
+	script := `
+def decide(tap):
+    if tap.random_uid:
+        return {"decision": "grant", "fields": {"rule": "depot"}}
+`
+	if err := os.WriteFile(filepath.Join(s.config.DataDir, policyScriptName), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.script.Reload()
+
+	// Random UIDs are decided by their credentials, which the script reviews
+	s.handleTagDetection(random)
+	if !s.granted {
+		t.Fatal("expected the script to grant the random UID")
+	}
+}
+
+// transceiverFunc answers APDUs with a function
+type transceiverFunc func(apdu []byte) ([]byte, error)
+
+func (f transceiverFunc) Transceive(apdu []byte) ([]byte, error) {
+	return f(apdu)
+}
+
+func TestDetectTagType(t *testing.T) {
+	ntag215 := make(memoryTag, 64)
+	copy(ntag215[t2tCCOffset:], []byte{t2tCCMagic, 0x10, 0x3E, 0x00})
+	desfire := transceiverFunc(func(apdu []byte) ([]byte, error) {
+		if apdu[0] == 0x90 && apdu[1] == 0x60 {
+			return []byte{0x04, 0x01, 0x01, 0x91, 0xAF}, nil
+		}
+		return []byte{0x91, 0x1C}, nil
+	})
+	javaCard := transceiverFunc(func(apdu []byte) ([]byte, error) {
+		return []byte{0x6E, 0x00}, nil
+	})
+
+	tests := []struct {
+		name     string
+		protocol hal.RFProtocol
+		uid      string
+		mem      TagMemory
+		t        Transceiver
+		want     TagType
+	}{
+		{"classic", rfProtocolMifare, "A1B2C3D4", nil, nil, TagClassic},
+		{"ntag", hal.RFProtocolT2T, "04AABBCCDDEEFF", ntag215, nil, TagNTAG},
+		{"ultralight", hal.RFProtocolT2T, "04AABBCCDDEEFF", make(memoryTag, 64), nil, TagUltralight},
+		{"other type 2", hal.RFProtocolT2T, "05AABBCCDDEEFF", ntag215, nil, TagType2},
+		{"desfire", hal.RFProtocolISODEP, "04AABBCCDDEEFF", nil, desfire, TagDESFire},
+		{"iso-dep", hal.RFProtocolISODEP, "08AABBCC", nil, javaCard, TagISODEP},
+		{"unknown", hal.RFProtocolUnknown, "AABBCCDD", nil, nil, TagUnknown},
+	}
+	for _, tt := range tests {
+		if got := DetectTagType(tt.protocol, tt.uid, tt.mem, tt.t); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	types, err := ParseTagTypes("mifare-classic, type2")
+	if err != nil || len(types) != 2 {
+		t.Fatalf("ParseTagTypes failed: %v %v", types, err)
+	}
+	if _, err := ParseTagTypes("felica"); err == nil {
+		t.Error("expected unknown tag type to be rejected")
+	}
+
+	am, _ := NewAuthManager(t.TempDir())
+	am.AddAuthorized("A1B2C3D4")
+	policy := Policies{TechPolicy{Deny: types}, DefaultPolicy(am)}
+	if d := policy.Decide(&TapContext{UID: "A1B2C3D4", Tech: TagClassic}); d.Action != ActionDeny || d.Event != EventTechDenied {
+		t.Errorf("expected Classic card to be denied, got %+v", d)
+	}
+	if d := policy.Decide(&TapContext{UID: "A1B2C3D4", Tech: TagNTAG}); d.Action != ActionGrant {
+		t.Errorf("expected NTAG card to be granted, got %+v", d)
+	}
+}
@@ -0,0 +1,127 @@
+package keycard
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process from root to the named user, with
+// its primary and supplementary groups, once the devices are open. The
+// reader and the LP5662 keep working through their open descriptors;
+// anything opened later, such as the TPM or the sysfs files written by the
+// LED scripts, must be accessible to the user, e.g. through its groups.
+func dropPrivileges(name, dataDir string, logger *slog.Logger) error {
+	u, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid UID of user %s: %w", name, err)
+	}
+	gids, err := userGroups(u)
+	if err != nil {
+		return err
+	}
+
+	if euid := os.Geteuid(); euid != 0 {
+		if euid == uid {
+			return nil
+		}
+		return fmt.Errorf("cannot switch to user %s without root", name)
+	}
+
+	if err := prepareDataDir(dataDir, uid, gids[0]); err != nil {
+		return err
+	}
+
+	// The syscall package applies these to all threads of the process
+	if err := syscall.Setgroups(gids); err != nil {
+		return fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setresgid(gids[0], gids[0], gids[0]); err != nil {
+		return fmt.Errorf("failed to set group: %w", err)
+	}
+	if err := syscall.Setresuid(uid, uid, uid); err != nil {
+		return fmt.Errorf("failed to set user: %w", err)
+	}
+	if syscall.Setresuid(0, 0, 0) == nil {
+		return errors.New("root privileges could be regained")
+	}
+
+	// Scripts started from now on cannot gain privileges through setuid
+	// binaries or file capabilities either. Not possible in builds with
+	// cgo, which is not needed for it to be safe.
+	if err := setNoNewPrivs(); err != nil {
+		logger.Debug("Failed to set no_new_privs", "error", err)
+	}
+
+	logger.Info("Dropped privileges", "user", u.Username, "uid", uid, "gid", gids[0])
+	return nil
+}
+
+// lookupUser finds a user by name or numeric UID
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, perr := strconv.Atoi(name); perr == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to look up user %s: %w", name, err)
+}
+
+// userGroups returns the GIDs of the user, its primary group first
+func userGroups(u *user.User) ([]int, error) {
+	ids, err := u.GroupIds()
+	if err != nil {
+		// Supplementary groups unknown, e.g. without /etc/group
+		ids = nil
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GID of user %s: %w", u.Username, err)
+	}
+	gids := []int{gid}
+	for _, id := range ids {
+		if g, err := strconv.Atoi(id); err == nil && g != gid {
+			gids = append(gids, g)
+		}
+	}
+	return gids, nil
+}
+
+// prepareDataDir hands the data directory over to the user the service
+// drops to, so files created while it still ran as root stay writable, and
+// verifies no one else can write to it
+func prepareDataDir(dataDir string, uid, gid int) error {
+	return filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink == 0 && info.Mode().Perm()&0o002 != 0 {
+			return fmt.Errorf("%s is writable by everyone", path)
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) == uid {
+			return nil
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to hand %s over: %w", path, err)
+		}
+		return nil
+	})
+}
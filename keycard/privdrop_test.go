@@ -0,0 +1,44 @@
+package keycard
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareDataDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cards.json"), []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareDataDir(dir, os.Getuid(), os.Getgid()); err != nil {
+		t.Fatalf("expected a private data directory to pass, got %v", err)
+	}
+
+	path := filepath.Join(dir, "revoked.json")
+	if err := os.WriteFile(path, []byte("[]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+	err := prepareDataDir(dir, os.Getuid(), os.Getgid())
+	if err == nil || !strings.Contains(err.Error(), "revoked.json") {
+		t.Errorf("expected a world-writable file to be refused, got %v", err)
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	u, err := lookupUser("0")
+	if err != nil {
+		t.Skipf("no user database: %v", err)
+	}
+	gids, err := userGroups(u)
+	if err != nil || len(gids) == 0 || gids[0] != 0 {
+		t.Errorf("expected root's primary group first, got %v, %v", gids, err)
+	}
+	if _, err := lookupUser("no-such-user-keycard"); err == nil {
+		t.Error("expected an unknown user to fail")
+	}
+}
@@ -0,0 +1,161 @@
+package keycard
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	bundleExt         = ".bundle"
+	bundleAppliedExt  = ".applied"
+	bundleRejectedExt = ".rejected"
+)
+
+// Bundle provisions a scooter's cards and settings in one step
+type Bundle struct {
+	Master     string    `json:"master,omitempty"`
+	Authorized []string  `json:"authorized"`
+	Settings   *Settings `json:"settings,omitempty"`
+}
+
+// signedEnvelope wraps signed messages; the signature covers the decoded payload
+type signedEnvelope struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// openEnvelope verifies a signed envelope and returns its payload
+func openEnvelope(data []byte, key ed25519.PublicKey) ([]byte, error) {
+	var env signedEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("missing or malformed signature")
+	}
+	if !ed25519.Verify(key, payload, sig) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return payload, nil
+}
+
+// sealEnvelope signs payload into an envelope
+func sealEnvelope(payload []byte, key ed25519.PrivateKey) ([]byte, error) {
+	return json.MarshalIndent(signedEnvelope{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	}, "", "  ")
+}
+
+// ParseBundle verifies a signed bundle file against the operator key
+func ParseBundle(data []byte, key ed25519.PublicKey) (*Bundle, error) {
+	payload, err := openEnvelope(data, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundle Bundle
+	if err := json.Unmarshal(payload, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	return &bundle, nil
+}
+
+// SignBundle produces a bundle file signed with the operator key
+func SignBundle(bundle *Bundle, key ed25519.PrivateKey) ([]byte, error) {
+	payload, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	return sealEnvelope(payload, key)
+}
+
+// ProvisionWatcher picks up bundles dropped into a directory
+type ProvisionWatcher struct {
+	dir      string
+	key      ed25519.PublicKey
+	interval time.Duration
+	logger   *slog.Logger
+	bundles  chan *Bundle
+}
+
+func NewProvisionWatcher(dir string, key ed25519.PublicKey, interval time.Duration, logger *slog.Logger) *ProvisionWatcher {
+	return &ProvisionWatcher{
+		dir:      dir,
+		key:      key,
+		interval: interval,
+		logger:   logger,
+		bundles:  make(chan *Bundle),
+	}
+}
+
+// Bundles returns the channel verified bundles are delivered on
+func (w *ProvisionWatcher) Bundles() <-chan *Bundle {
+	return w.bundles
+}
+
+// Run scans the directory on every interval until ctx is cancelled. With an
+// interval of 0 it only scans once.
+func (w *ProvisionWatcher) Run(ctx context.Context) {
+	if w.interval <= 0 {
+		w.scan(ctx)
+		return
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.scan(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *ProvisionWatcher) scan(ctx context.Context) {
+	paths, err := filepath.Glob(filepath.Join(w.dir, "*"+bundleExt))
+	if err != nil {
+		w.logger.Warn("Failed to scan provisioning directory", "error", err)
+		return
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			w.logger.Warn("Failed to read bundle", "path", path, "error", err)
+			continue
+		}
+
+		bundle, err := ParseBundle(data, w.key)
+		if err != nil {
+			w.logger.Error("Rejected provisioning bundle", "path", path, "error", err)
+			os.Rename(path, path+bundleRejectedExt)
+			continue
+		}
+
+		select {
+		case w.bundles <- bundle:
+		case <-ctx.Done():
+			return
+		}
+
+		w.logger.Info("Provisioning bundle accepted", "path", path)
+		os.Rename(path, path+bundleAppliedExt)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package keycard
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,20 @@
+package keycard
+
+import (
+	hal "github.com/librescoot/pn7150"
+)
+
+// NFCReader is the NFC controller as the service drives it, implemented by
+// the PN7150 HAL and by ReplayReader. Optional capabilities such as
+// Transceiver is found by type assertion.
+type NFCReader interface {
+	TagWriter
+	Initialize() error
+	Deinitialize()
+	FullReinitialize() error
+	StartDiscovery(pollPeriod uint) error
+	StopDiscovery() error
+	GetState() hal.State
+	GetTagEventChannel() <-chan hal.TagEvent
+	SetTagEventReaderEnabled(enabled bool)
+}
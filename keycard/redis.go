@@ -1,21 +1,37 @@
 package keycard
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"time"
 
 	ipc "github.com/librescoot/redis-ipc"
+	"github.com/redis/go-redis/v9"
 )
 
 const (
 	keycardHashKey = "keycard"
+	eventHashKey   = "keycard:event"
+	learnHashKey   = "keycard:learn"
 	keycardExpiry  = 10 * time.Second
+	keycardType    = "scooter"
+	serviceType    = "service" // type of grants to service cards
 )
 
 type RedisClient struct {
-	client *ipc.Client
-	logger *slog.Logger
+	client   *ipc.Client
+	logger   *slog.Logger
+	authTags map[string]func(payload []byte) ([]byte, error)
+	bootID   string
+	seq      sequencer
+
+	expiry   time.Duration     // expiry of the keycard hash
+	authType string            // published as "type" with every auth
+	static   map[string]string // added to every auth
+	dryRun   bool              // writes are logged instead, see SetDryRun
+	clock    Clock             // times commands sent with Call
 }
 
 func NewRedisClient(addr string, logger *slog.Logger) (*RedisClient, error) {
@@ -27,29 +43,331 @@ func NewRedisClient(addr string, logger *slog.Logger) (*RedisClient, error) {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
+	bootID, err := readBootID()
+	if err != nil {
+		logger.Warn("Auth events will carry no boot ID", "error", err)
+	}
+
 	return &RedisClient{
-		client: client,
-		logger: logger,
+		client:   client,
+		logger:   logger,
+		bootID:   bootID,
+		expiry:   keycardExpiry,
+		authType: keycardType,
+		clock:    SystemClock,
 	}, nil
 }
 
+// ConfigureAuth sets the expiry of the keycard hash, the type published with
+// every auth, and static fields added to every auth. Zero values keep the
+// defaults.
+func (r *RedisClient) ConfigureAuth(expiry time.Duration, authType string, static map[string]string) {
+	if expiry > 0 {
+		r.expiry = expiry
+	}
+	if authType != "" {
+		r.authType = authType
+	}
+	r.static = static
+}
+
+// UseClock makes the commands sent with Call carry the time of the clock.
+// Call it before the client is shared.
+func (r *RedisClient) UseClock(clock Clock) {
+	r.clock = clock
+}
+
+// SetDryRun makes the client log what it would publish, push or refresh
+// instead of writing to Redis. Reads and subscriptions are unaffected.
+func (r *RedisClient) SetDryRun() {
+	r.dryRun = true
+}
+
+// skip reports whether a write is skipped in a dry run, logging it
+func (r *RedisClient) skip(what string, args ...any) bool {
+	if r.dryRun {
+		r.logger.Info("Dry run, not publishing "+what, args...)
+	}
+	return r.dryRun
+}
+
 func (r *RedisClient) Close() error {
 	return r.client.Close()
 }
 
-func (r *RedisClient) PublishAuth(uid string) error {
-	err := r.client.Hash(keycardHashKey).SetManyPublishOne(map[string]any{
-		"authentication": "passed",
-		"type":           "scooter",
-		"uid":            uid,
-	}, "authentication")
-	if err != nil {
+// SetAuthTag makes PublishAuth add field holding the hex output of tag over
+// the published fields, such as a MAC or a signature, see VerifyAuthMAC
+func (r *RedisClient) SetAuthTag(field string, tag func(payload []byte) ([]byte, error)) {
+	if r.authTags == nil {
+		r.authTags = make(map[string]func(payload []byte) ([]byte, error))
+	}
+	r.authTags[field] = tag
+}
+
+// PublishAuth publishes a successful authentication; fields are added to the
+// keycard hash alongside the standard ones
+func (r *RedisClient) PublishAuth(uid string, fields map[string]any) error {
+	values := make(map[string]any, len(r.static)+len(fields)+5)
+	for k, v := range r.static {
+		values[k] = v
+	}
+	values["authentication"] = "passed"
+	values["code"] = int(EventGranted)
+	values["type"] = r.authType
+	values["uid"] = uid
+	values[authSeqField] = r.seq.next()
+	values[authBootIDField] = r.bootID
+	for k, v := range fields {
+		values[k] = v
+	}
+
+	if len(r.authTags) > 0 {
+		payload := coverFields(values)
+		for field, tag := range r.authTags {
+			value, err := tag(payload)
+			if err != nil {
+				r.logger.Error("Failed to authenticate auth payload", "field", field, "error", err)
+				return fmt.Errorf("failed to authenticate auth payload: %w", err)
+			}
+			values[field] = hex.EncodeToString(value)
+		}
+	}
+
+	if r.skip("authentication", "uid", uid, "fields", values) {
+		return nil
+	}
+
+	// Replaced as a whole, so no field of an earlier grant is left over
+	if err := r.replaceHash(keycardHashKey, values, "authentication"); err != nil {
 		r.logger.Error("Failed to publish auth", "error", err)
 		return fmt.Errorf("failed to publish auth: %w", err)
 	}
 
-	r.client.Expire(keycardHashKey, keycardExpiry)
-
 	r.logger.Info("Published authentication", "uid", uid)
 	return nil
 }
+
+// RefreshAuth extends the expiry of the keycard hash while the granted card
+// is still present
+func (r *RedisClient) RefreshAuth() error {
+	if r.dryRun {
+		return nil
+	}
+	if _, err := r.client.Expire(keycardHashKey, r.expiry); err != nil {
+		r.logger.Error("Failed to refresh auth", "error", err)
+		return fmt.Errorf("failed to refresh auth: %w", err)
+	}
+	return nil
+}
+
+// ClearAuth deletes the keycard hash once the granted card has left, so
+// its presence means the card is on the reader
+func (r *RedisClient) ClearAuth() error {
+	if r.skip("departure") {
+		return nil
+	}
+	ctx := r.client.Context()
+	_, err := r.client.Raw().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keycardHashKey)
+		pipe.Publish(ctx, keycardHashKey, "cleared")
+		return nil
+	})
+	if err != nil {
+		r.logger.Error("Failed to clear auth", "error", err)
+		return fmt.Errorf("failed to clear auth: %w", err)
+	}
+	return nil
+}
+
+// PublishEvent records a keycard event that is not an authentication
+// grant in its own hash, leaving the keycard hash and its expiry alone
+func (r *RedisClient) PublishEvent(event Event, fields map[string]any) error {
+	values := map[string]any{"event": event.String(), "code": int(event)}
+	for k, v := range fields {
+		values[k] = v
+	}
+
+	if r.skip("event", "event", event.String(), "fields", values) {
+		return nil
+	}
+
+	if err := r.replaceHash(eventHashKey, values, "event"); err != nil {
+		r.logger.Error("Failed to publish event", "event", event.String(), "error", err)
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+
+	r.logger.Info("Published event", "event", event.String(), "code", int(event))
+	return nil
+}
+
+// replaceHash replaces the fields of a hash and its expiry in one
+// transaction, then publishes notification on the channel named like it
+func (r *RedisClient) replaceHash(key string, fields map[string]any, notification string) error {
+	args := make([]any, 0, 2*len(fields))
+	for k, v := range fields {
+		args = append(args, k, fmt.Sprint(v))
+	}
+	ctx := r.client.Context()
+	_, err := r.client.Raw().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, args...)
+		pipe.Expire(ctx, key, r.expiry)
+		pipe.Publish(ctx, key, notification)
+		return nil
+	})
+	return err
+}
+
+// ReplayEvent publishes an event from the outbox that was not published in
+// time, marked as replayed and carrying its original time in Unix
+// milliseconds
+func (r *RedisClient) ReplayEvent(e OutboxEvent) error {
+	fields := make(map[string]any, len(e.Fields)+2)
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	fields["time"] = e.Time
+	fields["replayed"] = true
+	return r.PublishEvent(e.Code, fields)
+}
+
+// PublishDiagnostics replaces the reader diagnostics hash
+func (r *RedisClient) PublishDiagnostics(fields map[string]any) error {
+	if r.dryRun {
+		return nil
+	}
+	if err := r.client.Hash(diagHashKey).SetManyPublishOne(fields, "diagnostics"); err != nil {
+		return fmt.Errorf("failed to publish diagnostics: %w", err)
+	}
+	return nil
+}
+
+// PublishSelfTest replaces the startup self-test report
+func (r *RedisClient) PublishSelfTest(fields map[string]any) error {
+	if r.skip("self-test", "fields", fields) {
+		return nil
+	}
+	if err := r.client.Hash(selfTestHashKey).SetManyPublishOne(fields, "selftest"); err != nil {
+		return fmt.Errorf("failed to publish self-test: %w", err)
+	}
+	return nil
+}
+
+// PublishLearnState records the current learn mode and the number of cards
+// added since it was entered, with the fields of the learning session if
+// given
+func (r *RedisClient) PublishLearnState(mode string, added int, session map[string]any) error {
+	fields := map[string]any{
+		"mode":  mode,
+		"added": added,
+	}
+	for k, v := range session {
+		fields[k] = v
+	}
+	if r.skip("learn state", "fields", fields) {
+		return nil
+	}
+	err := r.client.Hash(learnHashKey).SetManyPublishOne(fields, "learn")
+	if err != nil {
+		return fmt.Errorf("failed to publish learn state: %w", err)
+	}
+	return nil
+}
+
+// GetHash reads all fields of a hash, which is empty if it does not exist
+func (r *RedisClient) GetHash(key string) (map[string]string, error) {
+	fields, err := r.client.HGetAll(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return fields, nil
+}
+
+// Connected reports whether the connection to Redis is up
+func (r *RedisClient) Connected() bool {
+	return r.client.Connected()
+}
+
+// Ping checks the connection to Redis
+func (r *RedisClient) Ping() error {
+	return r.client.Ping()
+}
+
+// Get reads a string key
+func (r *RedisClient) Get(key string) (string, error) {
+	n, err := r.client.Exists(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	if n == 0 {
+		return "", fmt.Errorf("key %s not set", key)
+	}
+	value, err := r.client.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// HandleRevocationDeltas calls handler for every message pushed to the
+// revocation queue until the returned handler is stopped
+func (r *RedisClient) HandleRevocationDeltas(handler func([]byte) error) *ipc.QueueHandler[json.RawMessage] {
+	return ipc.HandleRequests(r.client, revocationQueue, func(msg json.RawMessage) error {
+		return handler(msg)
+	})
+}
+
+// HandleCommands calls handler for every command pushed to the command
+// queue until the returned handler is stopped
+func (r *RedisClient) HandleCommands(handler func(Command) error) *ipc.QueueHandler[Command] {
+	return ipc.HandleRequests(r.client, commandQueue, handler)
+}
+
+// Reply pushes a JSON reply to a command's reply key, which expires unless
+// the client picks it up in time. Keys outside replyPrefix are refused.
+func (r *RedisClient) Reply(key string, reply any) error {
+	if !isReplyKey(key) {
+		return fmt.Errorf("%w: %q", ErrReplyKey, key)
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	if r.skip("reply", "key", key, "reply", string(data)) {
+		return nil
+	}
+	if _, err := r.client.LPush(key, data); err != nil {
+		return fmt.Errorf("failed to reply to %s: %w", key, err)
+	}
+	r.client.Expire(key, replyExpiry)
+	return nil
+}
+
+// RequestHibernate asks the power manager to put the scooter into
+// hibernation
+func (r *RedisClient) RequestHibernate() error {
+	if r.skip("hibernation request") {
+		return nil
+	}
+	if _, err := r.client.LPush(powerCommandQueue, "hibernate-manual"); err != nil {
+		r.logger.Error("Failed to request hibernation", "error", err)
+		return fmt.Errorf("failed to request hibernation: %w", err)
+	}
+
+	r.logger.Info("Requested hibernation")
+	return nil
+}
+
+// RequestLock asks the vehicle service to lock the scooter
+func (r *RedisClient) RequestLock() error {
+	if r.skip("lock request") {
+		return nil
+	}
+	if _, err := r.client.LPush(vehicleCommandQueue, "lock"); err != nil {
+		r.logger.Error("Failed to request lock", "error", err)
+		return fmt.Errorf("failed to request lock: %w", err)
+	}
+
+	r.logger.Info("Requested lock")
+	return nil
+}
@@ -0,0 +1,182 @@
+package keycard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const enrollTimeout = 60 * time.Second
+
+// enrollment is a card waiting to be captured from the next unknown tap
+type enrollment struct {
+	card Card
+	done chan enrollOutcome
+}
+
+type enrollOutcome struct {
+	result EnrollResult
+	err    error
+}
+
+func (s *Service) registerCommands() {
+	s.rpc.Handle(CommandLearnStart, s.inLoop(s.remoteLearnStart))
+	s.rpc.Handle(CommandLearnStop, s.inLoop(s.remoteLearnStop))
+	s.rpc.Handle(CommandListCards, func(ctx context.Context, c *Command) (any, error) {
+		return CardList{Cards: s.auth.Records()}, nil
+	})
+	s.rpc.Handle(CommandRevoke, s.inLoop(s.remoteRevoke))
+	s.rpc.HandleTimeout(CommandEnroll, enrollTimeout, s.remoteEnroll)
+}
+
+// inLoop wraps h to run on the event loop, which owns the service state
+func (s *Service) inLoop(h RPCHandler) RPCHandler {
+	return func(ctx context.Context, c *Command) (any, error) {
+		type result struct {
+			value any
+			err   error
+		}
+		done := make(chan result, 1)
+		call := func() {
+			value, err := h(ctx, c)
+			done <- result{value, err}
+		}
+
+		select {
+		case s.calls <- call:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("service busy: %w", ctx.Err())
+		}
+		select {
+		case r := <-done:
+			return r.value, r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Service) remoteLearnStart(ctx context.Context, c *Command) (any, error) {
+	if s.masterLearningMode {
+		return nil, errors.New("no master card learned yet")
+	}
+	if !s.learnMode {
+		s.enterLearnMode("")
+	}
+	return nil, nil
+}
+
+func (s *Service) remoteLearnStop(ctx context.Context, c *Command) (any, error) {
+	if s.learnMode {
+		s.exitLearnMode()
+	}
+	return nil, nil
+}
+
+// remoteRevoke drops an enrolled card and confirms it with an event
+func (s *Service) remoteRevoke(ctx context.Context, c *Command) (any, error) {
+	var params UIDParams
+	if err := json.Unmarshal(c.Params, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+
+	removed, err := s.auth.Remove(params.UID)
+	if err != nil {
+		return nil, err
+	}
+	result := RemoveResult{Removed: removed, Authorized: s.auth.GetAuthorizedCount()}
+	if !removed {
+		return result, nil
+	}
+
+	s.logger.Info("Card removed", "uid", params.UID, "totalAuthorized", result.Authorized)
+	s.publishEvent(EventCardRevoked, map[string]any{
+		"uid":        params.UID,
+		"authorized": result.Authorized,
+	})
+	return result, nil
+}
+
+// remoteEnroll waits for the next unknown card and enrolls it with the
+// requested label
+func (s *Service) remoteEnroll(ctx context.Context, c *Command) (any, error) {
+	var params EnrollParams
+	if err := json.Unmarshal(c.Params, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+	if params.Role == "" {
+		params.Role = RoleAuthorized
+	}
+
+	e := &enrollment{
+		card: Card{Role: params.Role, Label: params.Label, Uses: params.Uses, Group: params.Group},
+		done: make(chan enrollOutcome, 1),
+	}
+	if err := checkEnrollable(e.card); err != nil {
+		return nil, err
+	}
+	start := s.inLoop(func(ctx context.Context, c *Command) (any, error) {
+		switch {
+		case s.masterLearningMode:
+			return nil, errors.New("no master card learned yet")
+		case s.enrollment != nil:
+			return nil, errors.New("another enrollment is in progress")
+		}
+		s.enrollment = e
+		s.led.Play(BlinkAnimation(s.rgbLed.On, 0, blinkInterval))
+		s.logger.Info("Waiting for card to enroll", "label", params.Label)
+		return nil, nil
+	})
+	if _, err := start(ctx, c); err != nil {
+		return nil, err
+	}
+
+	select {
+	case out := <-e.done:
+		return out.result, out.err
+	case <-ctx.Done():
+	}
+
+	cancel := s.inLoop(func(ctx context.Context, c *Command) (any, error) {
+		if s.enrollment == e {
+			s.enrollment = nil
+			s.led.StopLoop()
+		}
+		return nil, nil
+	})
+	cancel(context.Background(), c)
+
+	// The card may have been enrolled just before the cancellation
+	select {
+	case out := <-e.done:
+		return out.result, out.err
+	default:
+		return nil, errors.New("no card presented")
+	}
+}
+
+// completeEnrollment enrolls an unknown card for the pending enrollment
+func (s *Service) completeEnrollment(uid string) {
+	e := s.enrollment
+	s.enrollment = nil
+	s.led.StopLoop()
+
+	card := e.card
+	card.UID = uid
+	if normalized, err := NormalizeUID(uid); err == nil {
+		card.UID = normalized
+	}
+	if _, err := s.auth.AddCard(card); err != nil {
+		s.logger.Error("Failed to enroll card", "uid", uid, "error", err)
+		s.feedback(CueDenied)
+		e.done <- enrollOutcome{err: err}
+		return
+	}
+
+	s.writeCardMAC(uid)
+	s.logger.Info("Card enrolled", "uid", card.UID, "label", card.Label, "role", card.Role, "group", card.Group)
+	s.feedback(CueGranted)
+	e.done <- enrollOutcome{result: EnrollResult{UID: card.UID, Label: card.Label}}
+}
@@ -0,0 +1,92 @@
+package keycard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+	authSeqField    = "seq"
+	authBootIDField = "boot-id"
+)
+
+var (
+	ErrReplayed = errors.New("auth event replayed")
+	ErrStale    = errors.New("auth event from another boot")
+)
+
+func readBootID() (string, error) {
+	data, err := os.ReadFile(bootIDFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read boot ID: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// sequencer hands out increasing sequence numbers for the current boot.
+// They start from the milliseconds since boot, so they keep increasing
+// across service restarts without being persisted.
+type sequencer struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+func (s *sequencer) next() uint64 {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts)
+	now := uint64(ts.Nano() / 1e6)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now <= s.last {
+		now = s.last + 1
+	}
+	s.last = now
+	return now
+}
+
+// ReplayGuard lets consumers of auth events reject replayed and stale ones.
+// It accepts an event only if it comes from the current boot and carries a
+// higher sequence number than the last accepted one.
+type ReplayGuard struct {
+	mu     sync.Mutex
+	bootID string
+	last   uint64
+}
+
+// NewReplayGuard returns a guard for events from the running boot
+func NewReplayGuard() (*ReplayGuard, error) {
+	bootID, err := readBootID()
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayGuard{bootID: bootID}, nil
+}
+
+// Check validates the boot ID and sequence number of a keycard hash and
+// records the sequence number if it is accepted
+func (g *ReplayGuard) Check(hash map[string]string) error {
+	if hash[authBootIDField] != g.bootID {
+		return ErrStale
+	}
+	seq, err := strconv.ParseUint(hash[authSeqField], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sequence number %q", hash[authSeqField])
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if seq <= g.last {
+		return fmt.Errorf("%w: sequence %d, last %d", ErrReplayed, seq, g.last)
+	}
+	g.last = seq
+	return nil
+}
@@ -0,0 +1,44 @@
+package keycard
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+)
+
+// revocationQueue receives signed revocation deltas pushed by the fleet
+// backend (LPUSH)
+const revocationQueue = "scooter:keycard:revocations"
+
+// RevocationDelta incrementally updates the fleet revocation list
+type RevocationDelta struct {
+	Version  int64    `json:"version"`
+	Revoke   []string `json:"revoke,omitempty"`
+	Unrevoke []string `json:"unrevoke,omitempty"`
+}
+
+// ParseRevocationDelta verifies a signed delta against the backend key
+func ParseRevocationDelta(data []byte, key ed25519.PublicKey) (*RevocationDelta, error) {
+	payload, err := openEnvelope(data, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var delta RevocationDelta
+	if err := json.Unmarshal(payload, &delta); err != nil {
+		return nil, fmt.Errorf("invalid revocation delta: %w", err)
+	}
+	if delta.Version <= 0 {
+		return nil, fmt.Errorf("revocation delta without version")
+	}
+	return &delta, nil
+}
+
+// SignRevocationDelta produces a delta message signed with the backend key
+func SignRevocationDelta(delta *RevocationDelta, key ed25519.PrivateKey) ([]byte, error) {
+	payload, err := json.Marshal(delta)
+	if err != nil {
+		return nil, err
+	}
+	return sealEnvelope(payload, key)
+}
@@ -0,0 +1,162 @@
+package keycard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	revocationRedisPrefix = "redis:"
+	revocationRetryMin    = 10 * time.Second
+)
+
+// RevocationFetcher periodically pulls the fleet revocation list from an
+// HTTP(S) URL or, with a "redis:<key>" source, from a Redis string key
+type RevocationFetcher struct {
+	source   string
+	interval time.Duration
+	auth     *AuthManager
+	redis    *RedisClient
+	logger   *slog.Logger
+	client   *http.Client
+}
+
+// NewRevocationFetcher creates a fetcher; redis is only used for redis: sources
+func NewRevocationFetcher(source string, interval time.Duration, auth *AuthManager, redis *RedisClient, logger *slog.Logger) *RevocationFetcher {
+	return &RevocationFetcher{
+		source:   source,
+		interval: interval,
+		auth:     auth,
+		redis:    redis,
+		logger:   logger,
+		client:   &http.Client{Timeout: syncTimeout},
+	}
+}
+
+// Run fetches immediately and then on every interval until ctx is cancelled.
+// Failed fetches are retried with jittered exponential backoff, capped at the
+// interval; the cached list stays in effect meanwhile. With an interval of 0
+// it stops after the first successful fetch.
+func (f *RevocationFetcher) Run(ctx context.Context) {
+	retry := revocationRetryMin
+	for {
+		delay := f.interval
+		if err := f.Fetch(ctx); err != nil {
+			f.logger.Warn("Revocation list fetch failed", "error", err, "retry", retry)
+			delay = retry
+			retry = min(retry*2, max(f.interval, revocationRetryMin))
+		} else if f.interval <= 0 {
+			return
+		} else {
+			retry = revocationRetryMin
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(delay)):
+		}
+	}
+}
+
+// jitter spreads d by ±25% so a fleet does not hit the backend in lockstep
+func jitter(d time.Duration) time.Duration {
+	return d - d/4 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Fetch retrieves and applies the revocation list once
+func (f *RevocationFetcher) Fetch(ctx context.Context) error {
+	current := f.auth.RevocationList()
+
+	var list *RevocationList
+	var err error
+	if key, ok := strings.CutPrefix(f.source, revocationRedisPrefix); ok {
+		list, err = f.fetchRedis(key)
+	} else {
+		list, err = f.fetchHTTP(ctx, current.ETag)
+	}
+	if err != nil || list == nil {
+		return err
+	}
+
+	if list.Version == current.Version && list.Version != 0 {
+		f.logger.Debug("Revocation list unchanged", "version", list.Version)
+		return nil
+	}
+	if err := f.auth.SetRevocationList(*list); err != nil {
+		if errors.Is(err, ErrRevocationRollback) {
+			f.logger.Debug("Ignoring stale revocation list", "error", err)
+			return nil
+		}
+		return err
+	}
+
+	f.logger.Info("Revocation list updated", "version", list.Version, "revoked", len(list.UIDs))
+	return nil
+}
+
+// fetchHTTP returns nil if the server reports the cached list is current
+func (f *RevocationFetcher) fetchHTTP(ctx context.Context, etag string) (*RevocationList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		f.logger.Debug("Revocation list not modified")
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, syncMaxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	list, err := parseRevocationList(body)
+	if err != nil {
+		return nil, err
+	}
+	list.ETag = resp.Header.Get("ETag")
+	return list, nil
+}
+
+func (f *RevocationFetcher) fetchRedis(key string) (*RevocationList, error) {
+	if f.redis == nil {
+		return nil, fmt.Errorf("no Redis connection")
+	}
+	value, err := f.redis.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return parseRevocationList([]byte(value))
+}
+
+func parseRevocationList(data []byte) (*RevocationList, error) {
+	var list RevocationList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid revocation list: %w", err)
+	}
+	list.ETag = ""
+	return &list, nil
+}
@@ -0,0 +1,236 @@
+package keycard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	revokedFileName       = "revoked.json"
+	remoteRevokedFileName = "revoked_remote.json"
+)
+
+// revokedFile is the on-disk denylist
+type revokedFile struct {
+	UIDs []string `json:"uids"`
+}
+
+// readRevoked loads the denylist from the data directory
+func readRevoked(dataDir string, repair bool) (map[string]bool, bool, error) {
+	content, recovered, err := loadStoreFile(filepath.Join(dataDir, revokedFileName), repair)
+	if err != nil || content == nil {
+		return map[string]bool{}, recovered, err
+	}
+
+	var file revokedFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, recovered, fmt.Errorf("invalid %s: %w", revokedFileName, err)
+	}
+
+	return uidSet(file.UIDs), recovered, nil
+}
+
+// ErrRevocationRollback is returned for revocation updates that are not
+// newer than the current list
+var ErrRevocationRollback = errors.New("revocation list version rollback")
+
+// RevocationList is the fleet-wide denylist fetched from the backend. It is
+// cached in the data directory so revocations apply while offline.
+type RevocationList struct {
+	Version int64    `json:"version"`
+	ETag    string   `json:"etag,omitempty"`
+	UIDs    []string `json:"uids"`
+}
+
+// uidSet builds a set of normalized UIDs, skipping invalid ones
+func uidSet(uids []string) map[string]bool {
+	set := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		if uid, err := NormalizeUID(uid); err == nil {
+			set[uid] = true
+		}
+	}
+	return set
+}
+
+// readRemoteRevoked loads the cached fleet revocation list
+func readRemoteRevoked(dataDir string, repair bool) (*RevocationList, bool, error) {
+	list := &RevocationList{}
+	content, recovered, err := loadStoreFile(filepath.Join(dataDir, remoteRevokedFileName), repair)
+	if err != nil || content == nil {
+		return list, recovered, err
+	}
+	if err := json.Unmarshal(content, list); err != nil {
+		return nil, recovered, fmt.Errorf("invalid %s: %w", remoteRevokedFileName, err)
+	}
+	return list, recovered, nil
+}
+
+// saveRevoked publishes a snapshot with a changed denylist and writes the
+// denylist
+func (am *AuthManager) saveRevoked(s *authSnapshot) error {
+	am.publish(s)
+	if am.inMemory {
+		return nil
+	}
+
+	uids := make([]string, 0, len(s.revoked))
+	for uid := range s.revoked {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	data, err := json.MarshalIndent(revokedFile{UIDs: uids}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStoreFile(filepath.Join(am.dataDir, revokedFileName), append(data, '\n'))
+}
+
+// IsRevoked reports whether the UID is on the denylist. Revocation
+// overrides every role except master.
+func (am *AuthManager) IsRevoked(uid string) bool {
+	s := am.snap.Load()
+
+	uid = canonicalUID(uid)
+	if s.revoked[uid] || s.remoteRevoked[uid] {
+		i := s.find(uid)
+		return i < 0 || s.cards[i].Role != RoleMaster
+	}
+	return false
+}
+
+// Revoke adds UIDs to the denylist. Their enrollment is kept so a card
+// reported stolen and found again can simply be unrevoked.
+func (am *AuthManager) Revoke(uids ...string) error {
+	normalized, err := normalizeUIDs(uids)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := am.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s := am.edit()
+
+	for _, uid := range normalized {
+		s.revoked[uid] = true
+	}
+	return am.saveRevoked(s)
+}
+
+// Unrevoke removes UIDs from the denylist
+func (am *AuthManager) Unrevoke(uids ...string) error {
+	normalized, err := normalizeUIDs(uids)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := am.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s := am.edit()
+
+	for _, uid := range normalized {
+		delete(s.revoked, uid)
+	}
+	return am.saveRevoked(s)
+}
+
+// RevokedUIDs returns the denylist in sorted order
+func (am *AuthManager) RevokedUIDs() []string {
+	s := am.snap.Load()
+
+	uids := make([]string, 0, len(s.revoked))
+	for uid := range s.revoked {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	return uids
+}
+
+// RevocationList returns the cached fleet revocation list
+func (am *AuthManager) RevocationList() RevocationList {
+	s := am.snap.Load()
+
+	list := *s.remote
+	list.UIDs = append([]string(nil), s.remote.UIDs...)
+	return list
+}
+
+// SetRevocationList replaces the fleet revocation list and caches it. Lists
+// older than the current one are refused so a stale copy cannot lift
+// revocations.
+func (am *AuthManager) SetRevocationList(list RevocationList) error {
+	unlock, err := am.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s := am.snap.Load()
+
+	if list.Version < s.remote.Version {
+		return fmt.Errorf("%w: %d is older than %d", ErrRevocationRollback, list.Version, s.remote.Version)
+	}
+	return am.saveRemoteRevoked(&list)
+}
+
+// ApplyRevocationDelta updates the fleet revocation list incrementally. The
+// delta must carry a higher version than the current list.
+func (am *AuthManager) ApplyRevocationDelta(delta *RevocationDelta) error {
+	unlock, err := am.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s := am.snap.Load()
+
+	if delta.Version <= s.remote.Version {
+		return fmt.Errorf("%w: %d is not newer than %d", ErrRevocationRollback, delta.Version, s.remote.Version)
+	}
+
+	set := uidSet(s.remote.UIDs)
+	for uid := range uidSet(delta.Revoke) {
+		set[uid] = true
+	}
+	for uid := range uidSet(delta.Unrevoke) {
+		delete(set, uid)
+	}
+
+	uids := make([]string, 0, len(set))
+	for uid := range set {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	// The ETag is kept: until the backend publishes a list at least as new
+	// as this delta, its unchanged list stays superseded by ours
+	return am.saveRemoteRevoked(&RevocationList{Version: delta.Version, ETag: s.remote.ETag, UIDs: uids})
+}
+
+// saveRemoteRevoked caches a new fleet revocation list and publishes a
+// snapshot with it. The caller holds mu.
+func (am *AuthManager) saveRemoteRevoked(list *RevocationList) error {
+	if !am.inMemory {
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeStoreFile(filepath.Join(am.dataDir, remoteRevokedFileName), append(data, '\n')); err != nil {
+			return err
+		}
+	}
+
+	s := *am.snap.Load()
+	s.remote = list
+	s.remoteRevoked = uidSet(list.UIDs)
+	am.publish(&s)
+	return nil
+}
@@ -0,0 +1,278 @@
+package keycard
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRevocationFetcher_ETag(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v7"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v7"`)
+		io.WriteString(w, `{"version": 7, "uids": ["04aabbccddeeff"]}`)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.AddAuthorized("04AABBCCDDEEFF")
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	f := NewRevocationFetcher(srv.URL, 0, am, nil, logger)
+
+	for i := 0; i < 2; i++ {
+		if err := f.Fetch(context.Background()); err != nil {
+			t.Fatalf("Fetch %d failed: %v", i, err)
+		}
+	}
+	if requests != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+	if !am.IsRevoked("04AABBCCDDEEFF") {
+		t.Error("expected fetched UID to be revoked")
+	}
+
+	// The cached list applies after a restart without network
+	am2, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if !am2.IsRevoked("04AABBCCDDEEFF") || am2.RevocationList().ETag != `"v7"` {
+		t.Error("expected revocation list to be cached")
+	}
+
+	// Stale lists are refused
+	if err := am2.SetRevocationList(RevocationList{Version: 6}); err == nil {
+		t.Error("expected older revocation list to be refused")
+	}
+}
+
+func TestSyncClient(t *testing.T) {
+	const scooter = "3f2a9c0d"
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(syncSignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(priv, body)))
+		w.Write(body)
+	}))
+	defer srv.Close()
+	serve := func(version int64, scooter, uid string) {
+		body, _ = json.Marshal(SyncList{Version: version, Scooter: scooter, Authorized: []string{uid}})
+	}
+
+	dir := t.TempDir()
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c, err := NewSyncClient(srv.URL, pub, " 3F2A9C0D\n", time.Minute, dir, am, logger)
+	if err != nil {
+		t.Fatalf("NewSyncClient failed: %v", err)
+	}
+
+	serve(0, scooter, "04000000000001")
+	if err := c.Sync(context.Background()); !errors.Is(err, ErrSyncRollback) {
+		t.Errorf("expected version 0 to be refused, got %v", err)
+	}
+	serve(2, "77aa0000", "04000000000001")
+	if err := c.Sync(context.Background()); !errors.Is(err, ErrSyncScooter) {
+		t.Errorf("expected a list for another scooter to be refused, got %v", err)
+	}
+	if am.IsAuthorized("04000000000001") {
+		t.Fatal("expected refused lists not to be applied")
+	}
+
+	serve(2, scooter, "04000000000002")
+	if err := c.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if err := c.Sync(context.Background()); err != nil {
+		t.Errorf("expected the same list again to be accepted, got %v", err)
+	}
+	if !am.IsAuthorized("04000000000002") {
+		t.Fatal("expected the list to be applied")
+	}
+
+	// The version applied last survives a restart
+	c, err = NewSyncClient(srv.URL, pub, scooter, time.Minute, dir, am, logger)
+	if err != nil {
+		t.Fatalf("NewSyncClient failed: %v", err)
+	}
+	serve(1, scooter, "04000000000001")
+	if err := c.Sync(context.Background()); !errors.Is(err, ErrSyncRollback) {
+		t.Errorf("expected an older list to be refused after a restart, got %v", err)
+	}
+	if am.IsAuthorized("04000000000001") {
+		t.Error("expected the older list not to be applied")
+	}
+
+	// An interval of 0 syncs once instead of panicking
+	c, err = NewSyncClient(srv.URL, pub, scooter, 0, dir, am, logger)
+	if err != nil {
+		t.Fatalf("NewSyncClient failed: %v", err)
+	}
+	serve(3, scooter, "04000000000003")
+	done := make(chan struct{})
+	go func() {
+		c.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return after one sync")
+	}
+	if !am.IsAuthorized("04000000000003") {
+		t.Error("expected the list to be synced once")
+	}
+}
+
+func TestRevocationDelta(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.SetRevocationList(RevocationList{Version: 42, UIDs: []string{"11223344"}})
+
+	msg, err := SignRevocationDelta(&RevocationDelta{Version: 43, Revoke: []string{"04AABBCCDDEEFF"}, Unrevoke: []string{"11223344"}}, priv)
+	if err != nil {
+		t.Fatalf("SignRevocationDelta failed: %v", err)
+	}
+	delta, err := ParseRevocationDelta(msg, pub)
+	if err != nil {
+		t.Fatalf("ParseRevocationDelta failed: %v", err)
+	}
+	if err := am.ApplyRevocationDelta(delta); err != nil {
+		t.Fatalf("ApplyRevocationDelta failed: %v", err)
+	}
+	if !am.IsRevoked("04AABBCCDDEEFF") || am.IsRevoked("11223344") {
+		t.Error("expected delta to update the revocation list")
+	}
+
+	// Replaying the same or an older version is a rollback
+	if err := am.ApplyRevocationDelta(delta); !errors.Is(err, ErrRevocationRollback) {
+		t.Errorf("expected rollback error on replay, got %v", err)
+	}
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	forged, _ := SignRevocationDelta(&RevocationDelta{Version: 44, Unrevoke: []string{"04AABBCCDDEEFF"}}, other)
+	if _, err := ParseRevocationDelta(forged, pub); err == nil {
+		t.Error("expected delta signed with another key to be rejected")
+	}
+}
+
+func TestTelemetryUploader(t *testing.T) {
+	fail := true
+	var got []TelemetryRecord
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	u := NewTelemetryUploader(srv.URL, 0, logger)
+	u.Record(EventDeparted.String(), int(EventDeparted), map[string]any{"uid": "04aabbccddeeff", "dwell": 1200})
+
+	if err := u.Upload(context.Background()); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+	fail = false
+	if err := u.Upload(context.Background()); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if len(got) != 1 || got[0].Event != "departed" || got[0].Code != 300 {
+		t.Fatalf("unexpected upload %+v", got)
+	}
+	if _, ok := got[0].Fields["uid"]; ok {
+		t.Error("expected UID to be stripped")
+	}
+	if got[0].Fields["dwell"] != float64(1200) {
+		t.Errorf("expected dwell to be kept, got %v", got[0].Fields)
+	}
+
+	// Uploaded records are not sent again
+	got = nil
+	if err := u.Upload(context.Background()); err != nil || got != nil {
+		t.Errorf("expected empty queue, got %+v, %v", got, err)
+	}
+}
+
+func TestWebhookSender(t *testing.T) {
+	key := []byte("webhook secret")
+	sign := func(body []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		return mac.Sum(nil), nil
+	}
+
+	var attempts int
+	var got WebhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mac, _ := sign(body)
+		if r.Header.Get(webhookSignatureHeader) != "sha256="+hex.EncodeToString(mac) {
+			t.Errorf("bad signature %q", r.Header.Get(webhookSignatureHeader))
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer srv.Close()
+
+	w := NewWebhookSender(srv.URL, sign, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	w.retry = time.Millisecond
+	p := WebhookPayload{Event: "unauthorized", Code: 200, Fields: map[string]any{"uid": "04AABBCC"}}
+	if err := w.deliver(context.Background(), p); err != nil {
+		t.Fatalf("deliver failed: %v", err)
+	}
+	if attempts != 2 || got.Event != "unauthorized" || got.Fields["uid"] != "04AABBCC" {
+		t.Errorf("expected delivery on retry, got %d attempts, %+v", attempts, got)
+	}
+
+	// Client errors are not retried
+	attempts = 0
+	w.url = srv.URL + "/gone"
+	if err := w.deliver(context.Background(), p); err == nil || attempts != 1 {
+		t.Errorf("expected a single failed attempt, got %d, %v", attempts, err)
+	}
+}
@@ -0,0 +1,331 @@
+package keycard
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	ipc "github.com/librescoot/redis-ipc"
+)
+
+const (
+	commandQueue  = "scooter:keycard"
+	commandKeyID  = "command"
+	commandWindow = 5 * time.Minute
+	replyPrefix   = "scooter:keycard:reply:"
+	replyExpiry   = 30 * time.Second
+	rpcTimeout    = 5 * time.Second
+)
+
+// Remote commands accepted on the command queue
+const (
+	CommandLearnStart = "learn-start" // enter learn mode as if the master card was presented
+	CommandLearnStop  = "learn-stop"  // leave learn mode
+	CommandListCards  = "list-cards"  // reply with the enrolled cards
+	CommandRevoke     = "revoke"      // remove the card given in the params
+	CommandEnroll     = "enroll"      // enroll the next unknown card with the given label
+)
+
+var (
+	ErrCommandToken = errors.New("invalid command token")
+	ErrReplyKey     = errors.New("reply key outside " + replyPrefix)
+)
+
+// Command is a remote command pushed as JSON to scooter:keycard. Token is
+// the hex HMAC-SHA256 of all other fields under the shared key "command",
+// see SignCommand.
+type Command struct {
+	Command string          `json:"command"`
+	ID      string          `json:"id,omitempty"`       // correlation ID echoed in the response
+	Time    int64           `json:"time"`               // Unix seconds
+	ReplyTo string          `json:"reply-to,omitempty"` // list the response is pushed to, under replyPrefix
+	Params  json.RawMessage `json:"params,omitempty"`
+	Token   string          `json:"token"`
+}
+
+// Response is pushed to a command's reply key
+type Response struct {
+	ID     string          `json:"id,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// CardList is the result of CommandListCards
+type CardList struct {
+	Cards []CardRecord `json:"cards"`
+}
+
+// UIDParams are the params of commands acting on one card
+type UIDParams struct {
+	UID string `json:"uid"`
+}
+
+// RemoveResult is the result of CommandRevoke
+type RemoveResult struct {
+	Removed    bool `json:"removed"`
+	Authorized int  `json:"authorized"`
+}
+
+// EnrollParams are the params of CommandEnroll. Role defaults to
+// authorized; guest cards need Uses.
+type EnrollParams struct {
+	Label string `json:"label"`
+	Role  string `json:"role,omitempty"`
+	Uses  int    `json:"uses,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// EnrollResult is the result of CommandEnroll
+type EnrollResult struct {
+	UID   string `json:"uid"`
+	Label string `json:"label"`
+}
+
+func (c *Command) payload() []byte {
+	fields := []string{c.Command, strconv.FormatInt(c.Time, 10), c.ID, c.ReplyTo, string(c.Params)}
+	var payload []byte
+	for i, f := range fields {
+		if i > 0 {
+			payload = append(payload, 0)
+		}
+		payload = append(payload, f...)
+	}
+	return payload
+}
+
+// SignCommand sets the token of c for the given key
+func SignCommand(c *Command, key []byte) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(c.payload())
+	c.Token = hex.EncodeToString(mac.Sum(nil))
+}
+
+// commandAuth verifies command tokens. A token is accepted only once and
+// only if its time is within commandWindow of now; tokens are remembered
+// for as long as they would be accepted.
+type commandAuth struct {
+	se   SecureElement
+	seen map[string]time.Time
+}
+
+func (a *commandAuth) verify(c *Command, now time.Time) error {
+	token, err := hex.DecodeString(c.Token)
+	if err != nil {
+		return ErrCommandToken
+	}
+	want, err := a.se.MAC(commandKeyID, c.payload())
+	if err != nil {
+		return fmt.Errorf("failed to check command token: %w", err)
+	}
+	if !hmac.Equal(token, want) {
+		return ErrCommandToken
+	}
+
+	t := time.Unix(c.Time, 0)
+	if t.Before(now.Add(-commandWindow)) || t.After(now.Add(commandWindow)) {
+		return fmt.Errorf("%w: time %s outside window", ErrCommandToken, t.Format(time.RFC3339))
+	}
+
+	for token, expiry := range a.seen {
+		if now.After(expiry) {
+			delete(a.seen, token)
+		}
+	}
+	seen := hex.EncodeToString(token)
+	if _, ok := a.seen[seen]; ok {
+		return fmt.Errorf("%w: replayed", ErrCommandToken)
+	}
+	if a.seen == nil {
+		a.seen = make(map[string]time.Time)
+	}
+	a.seen[seen] = t.Add(commandWindow)
+	return nil
+}
+
+// RPCHandler executes a command and returns its result, which is encoded
+// as JSON in the response. It should give up when ctx is done.
+type RPCHandler func(ctx context.Context, c *Command) (any, error)
+
+type rpcMethod struct {
+	handler RPCHandler
+	timeout time.Duration
+}
+
+// RPCServer authenticates commands from the command queue, dispatches them
+// to the registered handlers and replies with their result or error.
+// Commands run concurrently, each with its own timeout.
+type RPCServer struct {
+	redis   *RedisClient
+	logger  *slog.Logger
+	clock   Clock // checks the time of command tokens
+	auth    commandAuth
+	methods map[string]rpcMethod
+	queue   *ipc.QueueHandler[Command]
+}
+
+func NewRPCServer(redis *RedisClient, se SecureElement, clock Clock, logger *slog.Logger) *RPCServer {
+	return &RPCServer{
+		redis:   redis,
+		logger:  logger,
+		clock:   clock,
+		auth:    commandAuth{se: se},
+		methods: make(map[string]rpcMethod),
+	}
+}
+
+// Handle registers the handler for a command
+func (r *RPCServer) Handle(command string, h RPCHandler) {
+	r.HandleTimeout(command, rpcTimeout, h)
+}
+
+// HandleTimeout registers the handler for a command that may take longer
+// than usual, such as one waiting for a tap
+func (r *RPCServer) HandleTimeout(command string, timeout time.Duration, h RPCHandler) {
+	r.methods[command] = rpcMethod{handler: h, timeout: timeout}
+}
+
+// Start serves commands until Stop is called
+func (r *RPCServer) Start() {
+	r.queue = r.redis.HandleCommands(r.serve)
+}
+
+func (r *RPCServer) Stop() {
+	if r.queue != nil {
+		r.queue.Stop()
+	}
+}
+
+// serve authenticates c in the queue's goroutine, then runs it in its own.
+// Commands failing authentication are only logged: their reply key is
+// anyone's choice, so replying would let any Redis client push to any list.
+// A command that panics fails with the panic instead of taking the service
+// down.
+func (r *RPCServer) serve(c Command) error {
+	if err := r.authenticate(&c); err != nil {
+		r.logger.Warn("Rejected remote command", "command", c.Command, "id", c.ID, "error", err)
+		return nil
+	}
+	m, err := r.lookup(&c)
+	if err != nil {
+		r.reply(&c, nil, err)
+		return nil
+	}
+	go func() {
+		var result any
+		err := recovered("command "+c.Command, func() (err error) {
+			result, err = r.run(&c, m)
+			return err
+		})
+		r.reply(&c, result, err)
+	}()
+	return nil
+}
+
+func (r *RPCServer) reply(c *Command, result any, err error) {
+	if err != nil {
+		r.logger.Warn("Remote command failed", "command", c.Command, "id", c.ID, "error", err)
+	}
+	if c.ReplyTo == "" {
+		return
+	}
+
+	resp := Response{ID: c.ID}
+	if err != nil {
+		resp.Error = err.Error()
+	} else if result != nil {
+		resp.Result, err = json.Marshal(result)
+		if err != nil {
+			resp.Error = fmt.Sprintf("failed to encode result: %v", err)
+		}
+	}
+	if err := r.redis.Reply(c.ReplyTo, resp); err != nil {
+		r.logger.Error("Failed to reply to remote command", "command", c.Command, "id", c.ID, "error", err)
+	}
+}
+
+// authenticate checks the token of c and that it replies to a reply key
+func (r *RPCServer) authenticate(c *Command) error {
+	if err := r.auth.verify(c, r.clock.Now()); err != nil {
+		return err
+	}
+	if c.ReplyTo != "" && !isReplyKey(c.ReplyTo) {
+		return fmt.Errorf("%w: %q", ErrReplyKey, c.ReplyTo)
+	}
+	return nil
+}
+
+// isReplyKey reports whether key is a reply key, i.e. replies cannot touch
+// other services' keys
+func isReplyKey(key string) bool {
+	return len(key) > len(replyPrefix) && strings.HasPrefix(key, replyPrefix)
+}
+
+// lookup finds the handler of an authenticated command
+func (r *RPCServer) lookup(c *Command) (rpcMethod, error) {
+	m, ok := r.methods[c.Command]
+	if !ok {
+		return rpcMethod{}, fmt.Errorf("unknown command %q", c.Command)
+	}
+	return m, nil
+}
+
+func (r *RPCServer) run(c *Command, m rpcMethod) (any, error) {
+	r.logger.Info("Remote command", "command", c.Command, "id", c.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	return m.handler(ctx, c)
+}
+
+// Call sends a command and waits up to timeout for its response, decoding
+// the result into result unless it is nil. The command's ID, time, reply
+// key and token are filled in.
+func (r *RedisClient) Call(c Command, key []byte, timeout time.Duration, result any) error {
+	id := make([]byte, 8)
+	rand.Read(id)
+	c.ID = hex.EncodeToString(id)
+	c.Time = r.clock.Now().Unix()
+	c.ReplyTo = replyPrefix + c.ID
+	if c.Params != nil {
+		// Params are sent compacted, so sign them that way
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, c.Params); err != nil {
+			return fmt.Errorf("invalid params: %w", err)
+		}
+		c.Params = buf.Bytes()
+	}
+	SignCommand(&c, key)
+
+	if err := ipc.SendRequest(r.client, commandQueue, c); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+
+	reply, err := r.client.BRPop(timeout, c.ReplyTo)
+	if err != nil || len(reply) != 2 {
+		return fmt.Errorf("no response to %s within %s", c.Command, timeout)
+	}
+
+	var resp Response
+	if err := json.Unmarshal([]byte(reply[1]), &resp); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.ID != c.ID {
+		return fmt.Errorf("response for %q, expected %q", resp.ID, c.ID)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s: %s", c.Command, resp.Error)
+	}
+	if result != nil && resp.Result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package keycard
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Landlock rights by ABI version, see landlock(7)
+const (
+	landlockFSv1 = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+	landlockFSv2 = landlockFSv1 | unix.LANDLOCK_ACCESS_FS_REFER
+	landlockFSv3 = landlockFSv2 | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+
+	landlockRuleNetPort = 2 // LANDLOCK_RULE_NET_PORT, ABI 4
+
+	// Rights granted beneath a path
+	landlockRead  = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockExec  = landlockRead | unix.LANDLOCK_ACCESS_FS_EXECUTE
+	landlockWrite = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	landlockOwn   = landlockFSv3 &^ (unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK | unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK)
+)
+
+// landlockNetPortAttr is struct landlock_net_port_attr
+type landlockNetPortAttr struct {
+	allowedAccess uint64
+	port          uint64
+}
+
+// sandboxPath is a path and the Landlock rights granted beneath it
+type sandboxPath struct {
+	path   string
+	access uint64
+}
+
+const sysfsLEDDir = "/sys/class/leds"
+
+// sandboxPaths returns what the service may access on the file system once
+// initialized: its own directories, the devices it uses, the programs the
+// LED and TPM scripts run, the configuration needed for DNS, TLS and local
+// time, and the LED class devices in sysfs the LED scripts write. The policy
+// script is read from the data directory and evaluated in the service, so
+// nothing there needs to be executable.
+func sandboxPaths(config *Config) []sandboxPath {
+	paths := []sandboxPath{
+		{config.DataDir, landlockOwn},
+		{"/bin", landlockExec},
+		{"/sbin", landlockExec},
+		{"/usr", landlockExec},
+		{"/lib", landlockExec},
+		{"/lib64", landlockExec},
+		{"/etc/ld.so.cache", landlockRead},
+		{"/etc/localtime", landlockRead},
+		{"/etc/resolv.conf", landlockRead},
+		{"/etc/hosts", landlockRead},
+		{"/etc/nsswitch.conf", landlockRead},
+		{"/etc/ssl", landlockRead},
+		{"/etc/pki", landlockRead},
+		{"/dev/null", landlockRead | landlockWrite},
+		{"/dev/urandom", landlockRead},
+		{sysfsLEDDir, landlockRead},
+	}
+	// The HAL opens the reader again when it reinitializes
+	if config.Device != "" && config.Reader == nil && config.Replay == "" {
+		paths = append(paths, sandboxPath{config.Device, landlockRead | landlockWrite})
+	}
+	if config.LEDDevice != "" {
+		paths = append(paths, sandboxPath{config.LEDDevice, landlockRead | landlockWrite})
+	}
+	// Rules follow the class links to the LED devices themselves
+	if leds, err := os.ReadDir(sysfsLEDDir); err == nil {
+		for _, led := range leds {
+			paths = append(paths, sandboxPath{filepath.Join(sysfsLEDDir, led.Name()), landlockRead | landlockWrite})
+		}
+	}
+	for _, path := range config.SandboxAllow {
+		paths = append(paths, sandboxPath{path, landlockRead | landlockWrite})
+	}
+	if config.ProvisionDir != "" {
+		paths = append(paths, sandboxPath{config.ProvisionDir, landlockOwn})
+	}
+	kind, arg, _ := strings.Cut(config.SecureElement, ":")
+	switch {
+	case kind == "file" && arg != "":
+		paths = append(paths, sandboxPath{arg, landlockOwn})
+	case kind == "tpm2":
+		// The TPM tools exchange keys through a temporary directory
+		paths = append(paths,
+			sandboxPath{tpmDevice, landlockRead | landlockWrite},
+			sandboxPath{os.TempDir(), landlockOwn})
+	}
+	return paths
+}
+
+// sandboxPorts returns the TCP ports the service may connect to: Redis, the
+// configured backends, and DNS over TCP
+func sandboxPorts(config *Config) []uint16 {
+	ports := []uint16{53}
+	add := func(port string) {
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			ports = append(ports, uint16(p))
+		}
+	}
+	if _, port, err := net.SplitHostPort(config.RedisAddr); err == nil {
+		add(port)
+	}
+	for _, raw := range []string{config.SyncURL, config.RevocationURL, config.TelemetryURL, config.WebhookURL} {
+		u, err := url.Parse(raw)
+		if raw == "" || err != nil || u.Host == "" {
+			continue
+		}
+		switch {
+		case u.Port() != "":
+			add(u.Port())
+		case u.Scheme == "https":
+			add("443")
+		case u.Scheme == "http":
+			add("80")
+		}
+	}
+	return ports
+}
+
+// applySandbox confines the process once initialized, so that an exploit
+// of the NCI parser or the Redis client can do little beyond what the
+// service does anyway. Devices and connections already open are kept.
+//
+// Landlock limits the files and TCP ports that can be opened from now on;
+// kernels without it only log a warning. A seccomp filter only allows the
+// system calls the service and its scripts make, leaving out e.g. ptrace,
+// mount, namespaces or loading kernel modules. Both apply to all threads
+// and to the scripts started.
+func applySandbox(config *Config, logger *slog.Logger) error {
+	if err := setNoNewPrivs(); errors.Is(err, syscall.ENOTSUP) {
+		// Threads started by C code cannot be reached from Go
+		return fmt.Errorf("sandboxing needs a build with CGO_ENABLED=0: %w", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+
+	abi, err := applyLandlock(config)
+	switch {
+	case errors.Is(err, unix.ENOSYS), errors.Is(err, unix.EOPNOTSUPP):
+		logger.Warn("Landlock not supported by the kernel, file system and network not confined")
+	case err != nil:
+		return fmt.Errorf("failed to apply Landlock rules: %w", err)
+	default:
+		logger.Info("Landlock rules applied", "abi", abi, "network", abi >= 4)
+	}
+
+	if seccompArch == 0 {
+		logger.Warn("No seccomp filter for this architecture")
+		return nil
+	}
+	if err := applySeccomp(); err != nil {
+		return fmt.Errorf("failed to apply seccomp filter: %w", err)
+	}
+	logger.Info("Seccomp filter applied", "allowed", len(seccompAllowed)+len(seccompArchAllowed))
+	return nil
+}
+
+// setNoNewPrivs keeps all threads, and the programs they start, from
+// gaining privileges through setuid binaries or file capabilities
+func setNoNewPrivs() error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// applyLandlock restricts all threads to the sandbox paths and ports with
+// the rights the kernel supports, returning its Landlock ABI version
+func applyLandlock(config *Config) (int, error) {
+	v, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0, errno
+	}
+	abi := int(v)
+
+	attr := unix.LandlockRulesetAttr{Access_fs: landlockFSv1}
+	switch {
+	case abi >= 3:
+		attr.Access_fs = landlockFSv3
+	case abi == 2:
+		attr.Access_fs = landlockFSv2
+	}
+	if abi >= 4 {
+		attr.Access_net = unix.LANDLOCK_ACCESS_NET_BIND_TCP | unix.LANDLOCK_ACCESS_NET_CONNECT_TCP
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return abi, errno
+	}
+	defer unix.Close(int(fd))
+
+	for _, p := range sandboxPaths(config) {
+		if err := landlockAllowPath(int(fd), p.path, p.access&attr.Access_fs); err != nil {
+			return abi, err
+		}
+	}
+	if abi >= 4 {
+		for _, port := range sandboxPorts(config) {
+			if err := landlockAllowPort(int(fd), unix.LANDLOCK_ACCESS_NET_CONNECT_TCP, port); err != nil {
+				return abi, err
+			}
+		}
+		if _, port, err := net.SplitHostPort(config.HTTPListen); err == nil {
+			if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+				if err := landlockAllowPort(int(fd), unix.LANDLOCK_ACCESS_NET_BIND_TCP, uint16(p)); err != nil {
+					return abi, err
+				}
+			}
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return abi, errno
+	}
+	return abi, nil
+}
+
+func landlockAllowPath(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer unix.Close(fd)
+
+	// Rights on directories only apply to what is beneath them
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= unix.LANDLOCK_ACCESS_FS_EXECUTE | landlockWrite | unix.LANDLOCK_ACCESS_FS_READ_FILE
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to allow %s: %w", filepath.Clean(path), errno)
+	}
+	return nil
+}
+
+func landlockAllowPort(ruleset int, access uint64, port uint16) error {
+	attr := landlockNetPortAttr{allowedAccess: access, port: uint64(port)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), landlockRuleNetPort,
+		uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to allow port %d: %w", port, errno)
+	}
+	return nil
+}
+
+// seccompCloneNamespaces are the clone flags creating namespaces, refused
+// with EPERM like unshare
+const seccompCloneNamespaces = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS |
+	unix.CLONE_NEWIPC | unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+// Offsets into struct seccomp_data
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArg0 = 16 // lower half on little-endian architectures
+)
+
+// seccompFilter returns the BPF program allowing seccompAllowed and
+// seccompArchAllowed, and clone without new namespaces. System calls of
+// another architecture kill the process, as their numbers mean something
+// else; x32 system calls of x86-64 are not on the list.
+func seccompFilter() []unix.SockFilter {
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	allow := stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW)
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompArch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+
+		// clone is allowed unless it creates namespaces
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_CLONE, 0, 4),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArg0),
+		jump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, seccompCloneNamespaces, 0, 1),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM)),
+		allow,
+	}
+
+	// Each allowed call returns right after its check, keeping the jumps
+	// short however long the list
+	for _, nr := range append(seccompAllowed[:len(seccompAllowed):len(seccompAllowed)], seccompArchAllowed...) {
+		if nr == unix.SYS_CLONE {
+			continue
+		}
+		prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, 1), allow)
+	}
+	return append(prog, stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ERRNO|uint32(unix.ENOSYS)))
+}
+
+// applySeccomp installs the filter on all threads
+func applySeccomp() error {
+	filter := seccompFilter()
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
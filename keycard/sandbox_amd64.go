@@ -0,0 +1,22 @@
+package keycard
+
+import "golang.org/x/sys/unix"
+
+const (
+	seccompArch   = unix.AUDIT_ARCH_X86_64
+	seccompX32Bit = 0x40000000
+)
+
+// seccompArchAllowed are the allowed system calls only x86-64 has, mostly
+// the older forms programs built against older kernels still make
+var seccompArchAllowed = []uintptr{
+	unix.SYS_OPEN, unix.SYS_CREAT, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_NEWFSTATAT,
+	unix.SYS_ACCESS, unix.SYS_READLINK, unix.SYS_GETDENTS, unix.SYS_MKDIR,
+	unix.SYS_RMDIR, unix.SYS_UNLINK, unix.SYS_RENAME, unix.SYS_LINK, unix.SYS_SYMLINK,
+	unix.SYS_CHMOD, unix.SYS_CHOWN, unix.SYS_LCHOWN, unix.SYS_UTIMES, unix.SYS_FUTIMESAT,
+	unix.SYS_UTIME, unix.SYS_FADVISE64, unix.SYS_DUP2, unix.SYS_PIPE, unix.SYS_MMAP,
+	unix.SYS_FORK, unix.SYS_VFORK, unix.SYS_ARCH_PRCTL, unix.SYS_GETPGRP,
+	unix.SYS_GETRLIMIT, unix.SYS_POLL, unix.SYS_SELECT, unix.SYS_EPOLL_CREATE,
+	unix.SYS_EPOLL_WAIT, unix.SYS_EVENTFD, unix.SYS_SIGNALFD, unix.SYS_INOTIFY_INIT,
+	unix.SYS_ALARM, unix.SYS_PAUSE, unix.SYS_TIME,
+}
@@ -0,0 +1,36 @@
+package keycard
+
+import "golang.org/x/sys/unix"
+
+const (
+	seccompArch   = unix.AUDIT_ARCH_ARM
+	seccompX32Bit = 0
+
+	// ARM private system calls, see arch/arm/include/uapi/asm/unistd.h
+	armNRCacheflush = 0x0f0002
+	armNRSetTLS     = 0x0f0005
+)
+
+// seccompArchAllowed are the allowed system calls only 32-bit ARM has: the
+// older forms, 64-bit file offsets and IDs, and 64-bit time
+var seccompArchAllowed = []uintptr{
+	unix.SYS_OPEN, unix.SYS_CREAT, unix.SYS_STAT64, unix.SYS_LSTAT64, unix.SYS_FSTAT64,
+	unix.SYS_FSTATAT64, unix.SYS_ACCESS, unix.SYS_READLINK, unix.SYS_GETDENTS,
+	unix.SYS_MKDIR, unix.SYS_RMDIR, unix.SYS_UNLINK, unix.SYS_RENAME, unix.SYS_LINK,
+	unix.SYS_SYMLINK, unix.SYS_CHMOD, unix.SYS_CHOWN32, unix.SYS_LCHOWN32,
+	unix.SYS_FCHOWN32, unix.SYS_UTIMES, unix.SYS_FCNTL64, unix.SYS__LLSEEK,
+	unix.SYS_TRUNCATE64, unix.SYS_FTRUNCATE64, unix.SYS_STATFS64, unix.SYS_FSTATFS64,
+	unix.SYS_SENDFILE64, unix.SYS_ARM_FADVISE64_64, unix.SYS_DUP2, unix.SYS_PIPE,
+	unix.SYS_MMAP2, unix.SYS_FORK, unix.SYS_VFORK, unix.SYS_GETPGRP,
+	unix.SYS_UGETRLIMIT, unix.SYS_GETUID32, unix.SYS_GETEUID32, unix.SYS_GETGID32,
+	unix.SYS_GETEGID32, unix.SYS_GETGROUPS32, unix.SYS_GETRESUID32, unix.SYS_GETRESGID32,
+	unix.SYS_SIGRETURN, unix.SYS_POLL, unix.SYS__NEWSELECT, unix.SYS_EPOLL_CREATE,
+	unix.SYS_EPOLL_WAIT, unix.SYS_EVENTFD, unix.SYS_SIGNALFD, unix.SYS_INOTIFY_INIT,
+	unix.SYS_PAUSE, unix.SYS_SEND, unix.SYS_RECV,
+	unix.SYS_CLOCK_GETTIME64, unix.SYS_CLOCK_GETRES_TIME64, unix.SYS_CLOCK_NANOSLEEP_TIME64,
+	unix.SYS_FUTEX_TIME64, unix.SYS_PPOLL_TIME64, unix.SYS_PSELECT6_TIME64,
+	unix.SYS_RECVMMSG_TIME64, unix.SYS_TIMER_SETTIME64, unix.SYS_TIMER_GETTIME64,
+	unix.SYS_TIMERFD_SETTIME64, unix.SYS_TIMERFD_GETTIME64, unix.SYS_UTIMENSAT_TIME64,
+	unix.SYS_RT_SIGTIMEDWAIT_TIME64,
+	armNRCacheflush, armNRSetTLS,
+}
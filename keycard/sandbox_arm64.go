@@ -0,0 +1,13 @@
+package keycard
+
+import "golang.org/x/sys/unix"
+
+const (
+	seccompArch   = unix.AUDIT_ARCH_AARCH64
+	seccompX32Bit = 0
+)
+
+// seccompArchAllowed are the allowed system calls not all architectures have
+var seccompArchAllowed = []uintptr{
+	unix.SYS_NEWFSTATAT, unix.SYS_FADVISE64, unix.SYS_MMAP, unix.SYS_GETRLIMIT,
+}
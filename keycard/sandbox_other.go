@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64 && !arm
+
+package keycard
+
+// No seccomp filter without the architecture's system call numbers
+const (
+	seccompArch   = 0
+	seccompX32Bit = 0
+)
+
+var seccompAllowed, seccompArchAllowed []uintptr
@@ -0,0 +1,171 @@
+package keycard
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runSeccomp evaluates the filter for a system call with its first
+// argument, supporting the instructions seccompFilter uses
+func runSeccomp(t *testing.T, prog []unix.SockFilter, arch, nr, arg0 uint32) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = map[uint32]uint32{seccompDataNr: nr, seccompDataArch: arch, seccompDataArg0: arg0}[ins.K]
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K:
+			if acc&ins.K != 0 {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %+v at %d", ins, pc)
+		}
+	}
+	t.Fatal("filter ended without returning")
+	return 0
+}
+
+func TestSeccompFilter(t *testing.T) {
+	if seccompArch == 0 {
+		t.Skip("no seccomp filter for this architecture")
+	}
+	prog := seccompFilter()
+	unlisted := unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)
+
+	for _, nr := range append(seccompAllowed, seccompArchAllowed...) {
+		if got := runSeccomp(t, prog, seccompArch, uint32(nr), 0); got != unix.SECCOMP_RET_ALLOW {
+			t.Errorf("system call %d: expected it to be allowed, got %#x", nr, got)
+		}
+	}
+	for _, nr := range []uintptr{
+		unix.SYS_PTRACE, unix.SYS_MOUNT, unix.SYS_UNSHARE, unix.SYS_SETNS, unix.SYS_CLONE3,
+		unix.SYS_FINIT_MODULE, unix.SYS_REBOOT, unix.SYS_BPF, unix.SYS_KEYCTL,
+		unix.SYS_IO_URING_SETUP, unix.SYS_CLOCK_SETTIME, unix.SYS_SETUID, unix.SYS_CAPSET,
+	} {
+		if got := runSeccomp(t, prog, seccompArch, uint32(nr), 0); got != unlisted {
+			t.Errorf("system call %d: expected ENOSYS, got %#x", nr, got)
+		}
+	}
+
+	thread := uint32(unix.CLONE_VM | unix.CLONE_FS | unix.CLONE_FILES | unix.CLONE_SIGHAND | unix.CLONE_THREAD)
+	if got := runSeccomp(t, prog, seccompArch, unix.SYS_CLONE, thread); got != unix.SECCOMP_RET_ALLOW {
+		t.Errorf("expected clone of a thread to be allowed, got %#x", got)
+	}
+	if got := runSeccomp(t, prog, seccompArch, unix.SYS_CLONE, unix.CLONE_NEWUSER); got != unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM) {
+		t.Errorf("expected clone into a new namespace to be refused, got %#x", got)
+	}
+
+	if got := runSeccomp(t, prog, seccompArch^1, unix.SYS_READ, 0); got != unix.SECCOMP_RET_KILL_PROCESS {
+		t.Errorf("expected a foreign architecture to be killed, got %#x", got)
+	}
+	if seccompX32Bit != 0 {
+		if got := runSeccomp(t, prog, seccompArch, seccompX32Bit|unix.SYS_READ, 0); got != unlisted {
+			t.Errorf("expected x32 system calls to be refused, got %#x", got)
+		}
+	}
+}
+
+func TestSandboxPorts(t *testing.T) {
+	config := &Config{
+		RedisAddr:     "localhost:6379",
+		SyncURL:       "https://fleet.example.com/cards",
+		RevocationURL: "redis:keycard:revoked",
+		TelemetryURL:  "http://collector.example.com:8080/batch",
+		WebhookURL:    "http://hooks.example.com/keycard",
+	}
+	want := []uint16{53, 6379, 443, 8080, 80}
+	if got := sandboxPorts(config); !slices.Equal(got, want) {
+		t.Errorf("expected ports %v, got %v", want, got)
+	}
+}
+
+// TestApplySandbox confines a child process, since the sandbox cannot be
+// lifted again. The child exits with 2 if sandboxing is not available, e.g.
+// in a build with cgo, 3 if the sandbox does not hold, and 4 or 5 if it
+// keeps scripts or the policy script from working.
+func TestApplySandbox(t *testing.T) {
+	if os.Getenv("KEYCARD_SANDBOX_CHILD") == "1" {
+		dataDir, outside := os.Getenv("KEYCARD_DATA_DIR"), os.Getenv("KEYCARD_OUTSIDE")
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		if err := applySandbox(&Config{DataDir: dataDir}, logger); err != nil {
+			os.Exit(2)
+		}
+		if err := unix.Unshare(unix.CLONE_NEWUTS); err != unix.ENOSYS {
+			os.Exit(3)
+		}
+		if err := os.WriteFile(filepath.Join(dataDir, "cards.json"), []byte("{}\n"), 0644); err != nil {
+			os.Exit(3)
+		}
+		if _, err := os.ReadFile(outside); err == nil && landlockABI() > 0 {
+			os.Exit(3)
+		}
+		script := exec.Command("/bin/sh", "-c", `echo ok > "$0"`, filepath.Join(dataDir, "script"))
+		if err := script.Run(); err != nil {
+			os.Exit(4)
+		}
+		policy := "def decide(tap):\n    return {\"decision\": \"grant\"}\n"
+		if err := os.WriteFile(filepath.Join(dataDir, policyScriptName), []byte(policy), 0644); err != nil {
+			os.Exit(5)
+		}
+		if d := LoadPolicyScript(dataDir, logger).Review(&TapContext{UID: "04A1B2C3"}, Decision{Action: ActionDeny}); d.Action != ActionGrant {
+			os.Exit(5)
+		}
+		os.Exit(0)
+	}
+	if seccompArch == 0 {
+		t.Skip("no seccomp filter for this architecture")
+	}
+
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestApplySandbox$")
+	cmd.Env = append(os.Environ(),
+		"KEYCARD_SANDBOX_CHILD=1",
+		"KEYCARD_DATA_DIR="+t.TempDir(),
+		"KEYCARD_OUTSIDE="+outside)
+	err := cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		switch exit.ExitCode() {
+		case 2:
+			t.Skip("sandboxing not available")
+		case 3:
+			t.Fatal("expected the sandbox to refuse unshare and files outside the data directory")
+		case 4:
+			t.Fatal("expected the sandbox to let scripts run")
+		case 5:
+			t.Fatal("expected the policy script to load and decide in the sandbox")
+		}
+	}
+	if err != nil {
+		t.Fatalf("child failed: %v", err)
+	}
+}
+
+// landlockABI returns the kernel's Landlock ABI version, 0 without Landlock
+func landlockABI() int {
+	v, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
@@ -0,0 +1,329 @@
+package keycard
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+const (
+	policyScriptName = "policy.star"
+	// policyScriptSteps bounds the work of one run of the script
+	policyScriptSteps = 100000
+)
+
+// policyScriptOutput is the dict the script's decide function returns.
+// Anything left out keeps the built-in decision.
+type policyScriptOutput struct {
+	Decision string         // "grant" or "deny"
+	Event    string         // event name of a denial
+	Fields   map[string]any // added to the grant or event
+}
+
+// PolicyScript is a Starlark script in the data directory that reviews the
+// decisions of the built-in policies, for fleet rules that cannot be
+// configured. The script is compiled when loaded and again when Reload is
+// called after the file changed, so a tap only calls its decide function.
+type PolicyScript struct {
+	path   string
+	logger *slog.Logger
+	decide atomic.Pointer[starlark.Function] // nil without a script
+}
+
+// LoadPolicyScript loads the policy script from the data directory if there
+// is one
+func LoadPolicyScript(dataDir string, logger *slog.Logger) *PolicyScript {
+	p := &PolicyScript{
+		path:   filepath.Join(dataDir, policyScriptName),
+		logger: logger,
+	}
+	p.Reload()
+	return p
+}
+
+// Reload loads the script again after it changed on disk. A script that
+// fails to load is logged and the one loaded before stays in effect.
+func (p *PolicyScript) Reload() {
+	src, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if p.decide.Swap(nil) != nil {
+			p.logger.Info("Policy script removed")
+		}
+		return
+	}
+
+	var fn *starlark.Function
+	if err == nil {
+		fn, err = p.load(src)
+	}
+	if err != nil {
+		p.logger.Error("Failed to load policy script, keeping current one", "path", p.path, "error", err)
+		return
+	}
+	p.decide.Store(fn)
+	p.logger.Info("Policy script loaded", "path", p.path)
+}
+
+func (p *PolicyScript) load(src []byte) (*starlark.Function, error) {
+	// Globals are frozen once executed, so taps can call decide concurrently
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, p.thread(time.Now()), p.path, src,
+		starlark.StringDict{"time": startime.Module})
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals["decide"].(*starlark.Function)
+	if !ok {
+		return nil, fmt.Errorf("script defines no decide function")
+	}
+	if fn.NumParams() != 1 {
+		return nil, fmt.Errorf("decide takes %d parameters, not 1", fn.NumParams())
+	}
+	return fn, nil
+}
+
+// thread returns a thread for one run of the script, on which time.now()
+// is the time of the tap
+func (p *PolicyScript) thread(now time.Time) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: policyScriptName,
+		Print: func(_ *starlark.Thread, msg string) {
+			p.logger.Info("Policy script", "message", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(policyScriptSteps)
+	startime.SetNow(thread, func() (time.Time, error) { return now, nil })
+	return thread
+}
+
+// Review returns the decision on a tap as changed by the script. Without a
+// script, or if the script fails, the decision stands.
+func (p *PolicyScript) Review(tap *TapContext, d Decision) Decision {
+	fn := p.decide.Load()
+	if fn == nil {
+		return d
+	}
+
+	out, err := p.run(fn, tap, d)
+	if err != nil {
+		p.logger.Warn("Policy script failed, keeping decision", "uid", tap.UID, "error", err)
+		return d
+	}
+	overridden, err := applyScriptOutput(d, out)
+	if err != nil {
+		p.logger.Warn("Invalid policy script output, keeping decision", "uid", tap.UID, "error", err)
+		return d
+	}
+	if overridden.Action != d.Action {
+		p.logger.Info("Policy script overrode decision", "uid", tap.UID, "decision", out.Decision)
+	}
+	return overridden
+}
+
+func (p *PolicyScript) run(fn *starlark.Function, tap *TapContext, d Decision) (*policyScriptOutput, error) {
+	fields, err := toStarlarkFields(d.Fields)
+	if err != nil {
+		return nil, err
+	}
+	in := starlark.StringDict{
+		"uid":           starlark.String(tap.UID),
+		"protocol":      starlark.String(protocolName(tap.Protocol)),
+		"tech":          starlark.String(tap.Tech),
+		"time":          starlark.MakeInt64(tap.Time.UnixMilli()),
+		"vehicle_state": starlark.String(tap.VehicleState),
+		"random_uid":    starlark.Bool(tap.RandomUID),
+		"decision":      starlark.String("deny"),
+		"event":         starlark.None,
+		"fields":        fields,
+	}
+	if d.Action == ActionGrant {
+		in["decision"] = starlark.String("grant")
+	} else {
+		in["event"] = starlark.String(denialEvent(d).String())
+	}
+
+	tapValue := starlarkstruct.FromStringDict(starlarkstruct.Default, in)
+	v, err := starlark.Call(p.thread(tap.Time), fn, starlark.Tuple{tapValue}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseScriptOutput(v)
+}
+
+// parseScriptOutput reads the value decide returned, None or a dict
+func parseScriptOutput(v starlark.Value) (*policyScriptOutput, error) {
+	out := &policyScriptOutput{}
+	if v == starlark.None {
+		return out, nil
+	}
+	dict, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("decide returned a %s, not a dict", v.Type())
+	}
+
+	for _, item := range dict.Items() {
+		key, _ := starlark.AsString(item[0])
+		var err error
+		switch key {
+		case "decision":
+			out.Decision, err = scriptString(key, item[1])
+		case "event":
+			out.Event, err = scriptString(key, item[1])
+		case "fields":
+			out.Fields, err = fromStarlarkFields(item[1])
+		default:
+			err = fmt.Errorf("unknown key %s", item[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func scriptString(key string, v starlark.Value) (string, error) {
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return "", fmt.Errorf("%s is a %s, not a string", key, v.Type())
+	}
+	return s, nil
+}
+
+// toStarlarkFields converts decision fields for the script
+func toStarlarkFields(fields map[string]any) (*starlark.Dict, error) {
+	dict := starlark.NewDict(len(fields))
+	for k, v := range fields {
+		var value starlark.Value
+		switch v := v.(type) {
+		case string:
+			value = starlark.String(v)
+		case bool:
+			value = starlark.Bool(v)
+		case int:
+			value = starlark.MakeInt(v)
+		case int64:
+			value = starlark.MakeInt64(v)
+		case float64:
+			value = starlark.Float(v)
+		default:
+			value = starlark.String(fmt.Sprint(v))
+		}
+		if err := dict.SetKey(starlark.String(k), value); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+// fromStarlarkFields converts the fields the script returned
+func fromStarlarkFields(v starlark.Value) (map[string]any, error) {
+	dict, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("fields is a %s, not a dict", v.Type())
+	}
+
+	fields := make(map[string]any, dict.Len())
+	for _, item := range dict.Items() {
+		key, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("field name %s is not a string", item[0])
+		}
+		switch value := item[1].(type) {
+		case starlark.String:
+			fields[key] = string(value)
+		case starlark.Bool:
+			fields[key] = bool(value)
+		case starlark.Int:
+			n, ok := value.Int64()
+			if !ok {
+				return nil, fmt.Errorf("field %s is out of range", key)
+			}
+			fields[key] = n
+		case starlark.Float:
+			fields[key] = float64(value)
+		default:
+			return nil, fmt.Errorf("field %s is a %s", key, item[1].Type())
+		}
+	}
+	return fields, nil
+}
+
+// ScriptPolicy lets the policy script review the decisions of a built-in
+// policy
+type ScriptPolicy struct {
+	Base   AuthPolicy
+	Script *PolicyScript
+}
+
+func NewScriptPolicy(base AuthPolicy, script *PolicyScript) *ScriptPolicy {
+	return &ScriptPolicy{Base: base, Script: script}
+}
+
+func (p *ScriptPolicy) Decide(tap *TapContext) Decision {
+	return p.Script.Review(tap, p.Base.Decide(tap))
+}
+
+// applyScriptOutput returns the decision as changed by the script
+func applyScriptOutput(d Decision, out *policyScriptOutput) (Decision, error) {
+	switch out.Decision {
+	case "":
+	case "grant":
+		d.Action = ActionGrant
+		d.Event = 0
+	case "deny":
+		d.Action = ActionDeny
+	default:
+		return d, fmt.Errorf("unknown decision %q", out.Decision)
+	}
+
+	if out.Event != "" {
+		event, ok := eventByName(out.Event)
+		if !ok || event < EventUnauthorized || event >= EventDeparted {
+			return d, fmt.Errorf("%q is not a denial event", out.Event)
+		}
+		d.Event = event
+	}
+	if d.Action == ActionDeny {
+		d.Event = denialEvent(d)
+	}
+
+	if len(out.Fields) > 0 {
+		fields := make(map[string]any, len(d.Fields)+len(out.Fields))
+		for k, v := range d.Fields {
+			fields[k] = v
+		}
+		for k, v := range out.Fields {
+			fields[k] = v
+		}
+		d.Fields = fields
+	}
+	return d, nil
+}
+
+// denialEvent is the event a denial is published with
+func denialEvent(d Decision) Event {
+	if d.Event == 0 {
+		return EventUnauthorized
+	}
+	return d.Event
+}
+
+// protocolName names an RF protocol for scripts
+func protocolName(p hal.RFProtocol) string {
+	switch p {
+	case hal.RFProtocolT2T:
+		return "t2t"
+	case hal.RFProtocolISODEP:
+		return "iso-dep"
+	}
+	return fmt.Sprintf("0x%02x", uint8(p))
+}
@@ -0,0 +1,57 @@
+package keycard
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+// TestSdListeners passes a socket to a child as systemd would. The child
+// exits with 3 if it does not find it.
+func TestSdListeners(t *testing.T) {
+	if addr := os.Getenv("KEYCARD_SD_CHILD"); addr != "" {
+		// systemd sets the PID of the service, known only now
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		listeners, err := sdListeners()
+		ln := listeners[httpSocketName]
+		if err != nil || len(listeners) != 1 || ln == nil || ln.Addr().String() != addr {
+			os.Exit(3)
+		}
+		if os.Getenv("LISTEN_FDS") != "" {
+			os.Exit(3)
+		}
+		os.Exit(0)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("failed to get socket: %v", err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSdListeners$")
+	cmd.ExtraFiles = []*os.File{f} // descriptor 3
+	cmd.Env = append(os.Environ(),
+		"KEYCARD_SD_CHILD="+ln.Addr().String(),
+		"LISTEN_FDS=1",
+		"LISTEN_FDNAMES="+httpSocketName)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("expected the child to find the socket: %v", err)
+	}
+}
+
+func TestSdListeners_NotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := sdListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("expected no sockets meant for another process, got %v, %v", listeners, err)
+	}
+}
@@ -0,0 +1,185 @@
+package keycard
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	keyDirName = "keys"
+	keyFileExt = ".key"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// SecureElement holds the service's secret keys and performs operations
+// with them, so that callers never handle key material. Keys are named by
+// an ID such as "device".
+type SecureElement interface {
+	// PublicKey returns the public half of an Ed25519 key
+	PublicKey(id string) (ed25519.PublicKey, error)
+	// Sign signs msg with an Ed25519 key
+	Sign(id string, msg []byte) ([]byte, error)
+	// MAC returns the HMAC-SHA256 of msg under a symmetric key
+	MAC(id string, msg []byte) ([]byte, error)
+	Close() error
+}
+
+// OpenSecureElement opens the backend named by spec: "" or "file:<dir>" for
+// key files (default <dataDir>/keys), "tpm2[:<pcrs>]" for key files sealed
+// to the TPM
+func OpenSecureElement(spec, dataDir string) (SecureElement, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "file":
+		if arg == "" {
+			arg = filepath.Join(dataDir, keyDirName)
+		}
+		return NewFileElement(arg), nil
+	case "tpm2":
+		if _, err := os.Stat(tpmDevice); err != nil {
+			return nil, fmt.Errorf("no TPM found: %w", err)
+		}
+		return NewTPMElement(filepath.Join(dataDir, keyDirName), arg), nil
+	default:
+		return nil, fmt.Errorf("unknown secure element %q", spec)
+	}
+}
+
+// softElement performs key operations in software on raw key material
+// returned by load
+type softElement struct {
+	load func(id string) ([]byte, error)
+}
+
+func (e softElement) signingKey(id string) (ed25519.PrivateKey, error) {
+	seed, err := e.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("key %s is not an Ed25519 seed", id)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func (e softElement) PublicKey(id string) (ed25519.PublicKey, error) {
+	key, err := e.signingKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+func (e softElement) Sign(id string, msg []byte) ([]byte, error) {
+	key, err := e.signingKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(key, msg), nil
+}
+
+func (e softElement) MAC(id string, msg []byte) ([]byte, error) {
+	key, err := e.load(id)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+// FileElement keeps keys as hex or base64 files named <id>.key. It offers
+// no protection beyond file permissions and is the fallback for boards
+// without a secure element. Ed25519 keys are stored as 32-byte seeds.
+type FileElement struct {
+	softElement
+	dir string
+	tpm *TPMSealer
+
+	mu       sync.Mutex
+	unsealed map[string][]byte // keys unsealed by the TPM, see loadFile
+}
+
+func NewFileElement(dir string) *FileElement {
+	f := &FileElement{dir: dir}
+	f.softElement.load = f.loadFile
+	return f
+}
+
+// NewTPMElement returns a FileElement reading keys sealed to the TPM with
+// SealKey instead of plain key files. Each key is unsealed once and then
+// kept in memory, as running the TPM tools takes far longer than a tap.
+func NewTPMElement(dir, pcrs string) *FileElement {
+	f := NewFileElement(dir)
+	f.tpm = NewTPMSealer(pcrs)
+	f.unsealed = make(map[string][]byte)
+	return f
+}
+
+func (f *FileElement) loadFile(id string) ([]byte, error) {
+	if err := validKeyID(id); err != nil {
+		return nil, err
+	}
+	if f.tpm != nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if key, ok := f.unsealed[id]; ok {
+			return key, nil
+		}
+		key, err := f.tpm.Unseal(filepath.Join(f.dir, id))
+		if err != nil {
+			return nil, err
+		}
+		f.unsealed[id] = key
+		return key, nil
+	}
+	data, err := os.ReadFile(filepath.Join(f.dir, id+keyFileExt))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(data)
+}
+
+func (f *FileElement) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, key := range f.unsealed {
+		clear(key)
+		delete(f.unsealed, id)
+	}
+	return nil
+}
+
+func validKeyID(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return fmt.Errorf("invalid key ID %q", id)
+	}
+	return nil
+}
+
+// SealKey seals the key file <id>.key in dir to the TPM and removes the
+// plain file unless keep is set
+func SealKey(dir, id, pcrs string, keep bool) error {
+	key, err := NewFileElement(dir).loadFile(id)
+	if err != nil {
+		return err
+	}
+	if err := NewTPMSealer(pcrs).Seal(key, filepath.Join(dir, id)); err != nil {
+		return fmt.Errorf("failed to seal key %s: %w", id, err)
+	}
+	if keep {
+		return nil
+	}
+	return os.Remove(filepath.Join(dir, id+keyFileExt))
+}
@@ -0,0 +1,332 @@
+package keycard
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileElement(t *testing.T) {
+	dir := t.TempDir()
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 1
+	os.WriteFile(filepath.Join(dir, "device.key"), []byte(hex.EncodeToString(seed)+"\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "redis.key"), []byte("c2VjcmV0"), 0600)
+
+	se, err := OpenSecureElement("file:"+dir, "")
+	if err != nil {
+		t.Fatalf("OpenSecureElement failed: %v", err)
+	}
+	defer se.Close()
+
+	pub, err := se.PublicKey("device")
+	if err != nil {
+		t.Fatalf("PublicKey failed: %v", err)
+	}
+	sig, err := se.Sign("device", []byte("hello"))
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if !ed25519.Verify(pub, []byte("hello"), sig) {
+		t.Error("expected signature to verify")
+	}
+
+	mac, err := se.MAC("redis", []byte("hello"))
+	if err != nil || len(mac) != 32 {
+		t.Errorf("MAC = %x, %v", mac, err)
+	}
+
+	if _, err := se.Sign("missing", nil); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := se.MAC("../redis", nil); err == nil {
+		t.Error("expected key ID with path to be rejected")
+	}
+}
+
+func TestDerivedElement(t *testing.T) {
+	dir := t.TempDir()
+	fleet := []byte("fleet secret")
+	os.WriteFile(filepath.Join(dir, "fleet.key"), []byte(hex.EncodeToString(fleet)), 0600)
+
+	a := NewDerivedElement(NewFileElement(dir), "scooter-a")
+	b := NewDerivedElement(NewFileElement(dir), "scooter-b")
+
+	pubA, err := a.PublicKey("device")
+	if err != nil {
+		t.Fatalf("PublicKey failed: %v", err)
+	}
+	pubB, _ := b.PublicKey("device")
+	if pubA.Equal(pubB) {
+		t.Error("expected different keys for different devices")
+	}
+
+	want := ed25519.NewKeyFromSeed(DeriveKey(fleet, "device", "scooter-a")).Public().(ed25519.PublicKey)
+	if !pubA.Equal(want) {
+		t.Error("expected DeriveKey to match the derived element")
+	}
+
+	if _, err := a.MAC("fleet", nil); err == nil {
+		t.Error("expected fleet key to be unusable directly")
+	}
+}
+
+func TestAuthMAC(t *testing.T) {
+	key := []byte("shared")
+	values := map[string]any{"authentication": "passed", "uid": "04AABBCCDDEEFF", "uses": 3}
+	payload := coverFields(values)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	hash := map[string]string{"event": "left-over", "mac": hex.EncodeToString(mac.Sum(nil))}
+	for k, v := range values {
+		hash[k] = fmt.Sprint(v)
+	}
+
+	if err := VerifyAuthMAC(hash, key); err != nil {
+		t.Fatalf("VerifyAuthMAC failed: %v", err)
+	}
+
+	hash["uid"] = "11223344"
+	if err := VerifyAuthMAC(hash, key); !errors.Is(err, ErrAuthMAC) {
+		t.Errorf("expected ErrAuthMAC for tampered UID, got %v", err)
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	g := &ReplayGuard{bootID: "boot-a"}
+	event := func(boot string, seq uint64) map[string]string {
+		return map[string]string{"boot-id": boot, "seq": fmt.Sprint(seq)}
+	}
+
+	if err := g.Check(event("boot-a", 100)); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if err := g.Check(event("boot-a", 100)); !errors.Is(err, ErrReplayed) {
+		t.Errorf("expected ErrReplayed, got %v", err)
+	}
+	if err := g.Check(event("boot-b", 200)); !errors.Is(err, ErrStale) {
+		t.Errorf("expected ErrStale, got %v", err)
+	}
+	if err := g.Check(event("boot-a", 101)); err != nil {
+		t.Errorf("Check failed: %v", err)
+	}
+
+	var s sequencer
+	if a, b := s.next(), s.next(); b <= a {
+		t.Errorf("expected increasing sequence, got %d then %d", a, b)
+	}
+}
+
+func TestAuthSignature(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	values := map[string]any{"authentication": "passed", "uid": "04AABBCCDDEEFF"}
+	payload := coverFields(values)
+
+	hash := map[string]string{"signature": hex.EncodeToString(ed25519.Sign(priv, payload))}
+	for k, v := range values {
+		hash[k] = fmt.Sprint(v)
+	}
+
+	if err := VerifyAuthSignature(hash, pub); err != nil {
+		t.Fatalf("VerifyAuthSignature failed: %v", err)
+	}
+
+	hash["fields"] = "authentication,fields"
+	if err := VerifyAuthSignature(hash, pub); !errors.Is(err, ErrAuthSignature) {
+		t.Errorf("expected ErrAuthSignature for changed field list, got %v", err)
+	}
+}
+
+func TestCommandToken(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte("command secret")
+	os.WriteFile(filepath.Join(dir, "command.key"), []byte(hex.EncodeToString(key)), 0600)
+	auth := &commandAuth{se: NewFileElement(dir)}
+	now := time.Unix(1760000000, 0)
+
+	cmd := Command{Command: CommandLearnStart, Time: now.Unix()}
+	SignCommand(&cmd, key)
+	if err := auth.verify(&cmd, now); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if err := auth.verify(&cmd, now); !errors.Is(err, ErrCommandToken) {
+		t.Errorf("expected replayed command to be rejected, got %v", err)
+	}
+
+	forged := Command{Command: CommandLearnStop, Time: now.Unix() + 1, Token: cmd.Token}
+	if err := auth.verify(&forged, now); !errors.Is(err, ErrCommandToken) {
+		t.Errorf("expected forged command to be rejected, got %v", err)
+	}
+
+	old := Command{Command: CommandLearnStop, Time: now.Add(-time.Hour).Unix()}
+	SignCommand(&old, key)
+	if err := auth.verify(&old, now); !errors.Is(err, ErrCommandToken) {
+		t.Errorf("expected old command to be rejected, got %v", err)
+	}
+}
+
+func TestRPCServer(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte("command secret")
+	os.WriteFile(filepath.Join(dir, "command.key"), []byte(hex.EncodeToString(key)), 0600)
+
+	// Tokens are checked against the server's clock, not the wall clock
+	clock := newFakeClock()
+	clock.Advance(time.Hour)
+	r := NewRPCServer(nil, NewFileElement(dir), clock, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	r.Handle("echo", func(ctx context.Context, c *Command) (any, error) {
+		var p UIDParams
+		return p, json.Unmarshal(c.Params, &p)
+	})
+
+	cmd := Command{Command: "echo", ID: "1", Time: clock.Now().Unix(), Params: json.RawMessage(`{"uid":"11223344"}`)}
+	SignCommand(&cmd, key)
+	if err := r.authenticate(&cmd); err != nil {
+		t.Fatalf("authenticate failed: %v", err)
+	}
+	m, err := r.lookup(&cmd)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	result, err := r.run(&cmd, m)
+	if err != nil || result.(UIDParams).UID != "11223344" {
+		t.Fatalf("run = %v, %v", result, err)
+	}
+
+	cmd = Command{Command: "missing", Time: clock.Now().Unix() + 1}
+	SignCommand(&cmd, key)
+	if _, err := r.lookup(&cmd); err == nil {
+		t.Error("expected unknown command to fail")
+	}
+
+	cmd = Command{Command: "echo", Time: clock.Now().Unix() + 2, ReplyTo: "scooter:state"}
+	SignCommand(&cmd, key)
+	if err := r.authenticate(&cmd); !errors.Is(err, ErrReplyKey) {
+		t.Errorf("expected a reply key outside %s to be rejected, got %v", replyPrefix, err)
+	}
+}
+
+func TestRPCServer_NoReplyUnauthenticated(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte("command secret")
+	os.WriteFile(filepath.Join(dir, "command.key"), []byte(hex.EncodeToString(key)), 0600)
+	m := newFakeRedis(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	redis, err := NewRedisClient(m.addr, logger)
+	if err != nil {
+		t.Fatalf("NewRedisClient failed: %v", err)
+	}
+	defer redis.Close()
+	r := NewRPCServer(redis, NewFileElement(dir), SystemClock, logger)
+
+	for _, c := range []Command{
+		{Command: CommandListCards, Time: time.Now().Unix(), ReplyTo: "scooter:state", Token: "00"},
+		{Command: CommandListCards, Time: time.Now().Unix(), ReplyTo: replyPrefix + "1", Token: "00"},
+	} {
+		r.serve(c)
+		if list := m.List(c.ReplyTo); len(list) != 0 {
+			t.Errorf("expected no reply to an unauthenticated command, %s holds %v", c.ReplyTo, list)
+		}
+		if ttl := m.TTL(c.ReplyTo); ttl != 0 {
+			t.Errorf("expected %s to keep its TTL, got %s", c.ReplyTo, ttl)
+		}
+	}
+
+	signed := Command{Command: "missing", ID: "2", Time: time.Now().Unix(), ReplyTo: replyPrefix + "2"}
+	SignCommand(&signed, key)
+	r.serve(signed)
+	if list := m.List(signed.ReplyTo); len(list) != 1 || !strings.Contains(list[0], "unknown command") {
+		t.Errorf("expected an authenticated command to get its error, got %v", list)
+	}
+	if err := redis.Reply("scooter:state", Response{}); !errors.Is(err, ErrReplyKey) {
+		t.Errorf("expected Reply to refuse other keys, got %v", err)
+	}
+}
+
+func FuzzCommand(f *testing.F) {
+	dir := f.TempDir()
+	key := []byte("command secret")
+	os.WriteFile(filepath.Join(dir, "command.key"), []byte(hex.EncodeToString(key)), 0600)
+	now := time.Unix(1760000000, 0)
+
+	signed := Command{Command: CommandRevoke, ID: "1", Time: now.Unix(), ReplyTo: replyPrefix + "1", Params: json.RawMessage(`{"uid":"11223344"}`)}
+	SignCommand(&signed, key)
+	data, _ := json.Marshal(signed)
+	f.Add(data)
+	f.Add([]byte(`{"command":"learn-start","time":1760000000,"token":"zz"}`))
+	f.Add([]byte(`{"command":"enroll","params":{"label":"\u0000"},"token":""}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var c Command
+		if err := json.Unmarshal(data, &c); err != nil {
+			return
+		}
+		auth := &commandAuth{se: NewFileElement(dir)}
+		if err := auth.verify(&c, now); err != nil {
+			return
+		}
+		// Only a command signed with the key is accepted, and only once
+		want := c
+		SignCommand(&want, key)
+		if !strings.EqualFold(c.Token, want.Token) {
+			t.Fatalf("accepted command %+v with a token other than %s", c, want.Token)
+		}
+		if err := auth.verify(&c, now); !errors.Is(err, ErrCommandToken) {
+			t.Fatalf("accepted command %+v twice", c)
+		}
+	})
+}
+
+func TestSealedStore(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "store.key"), []byte(hex.EncodeToString([]byte("store secret"))), 0600)
+	key, err := StoreKey(NewFileElement(dir))
+	if err != nil {
+		t.Fatalf("StoreKey failed: %v", err)
+	}
+
+	am, err := NewAuthManager(dir)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	am.AddAuthorized("04AABBCCDDEEFF")
+
+	// A plain store is sealed when opened with the key
+	if am, err = NewSealedAuthManager(dir, key); err != nil {
+		t.Fatalf("NewSealedAuthManager failed: %v", err)
+	}
+	am.AddAuthorized("04112233445566")
+	data, _ := os.ReadFile(filepath.Join(dir, storeFileName))
+	if bytes.Contains(data, []byte("04AABBCCDDEEFF")) || bytes.Contains(data, []byte("04112233445566")) {
+		t.Error("expected the UIDs not to be stored in plain")
+	}
+
+	if _, err := NewAuthManager(dir); !errors.Is(err, ErrStoreSealed) {
+		t.Errorf("expected ErrStoreSealed without the key, got %v", err)
+	}
+	if _, err := NewSealedAuthManager(dir, make([]byte, 32)); err == nil {
+		t.Error("expected the store to be refused under another key")
+	}
+	am, err = NewSealedAuthManager(dir, key)
+	if err != nil {
+		t.Fatalf("NewSealedAuthManager failed: %v", err)
+	}
+	if !am.IsAuthorized("04AABBCCDDEEFF") || !am.IsAuthorized("04112233445566") {
+		t.Error("expected the sealed cards to be read back")
+	}
+}
@@ -0,0 +1,134 @@
+package keycard
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+const (
+	selfTestHashKey       = "keycard:selftest"
+	selfTestRetryInterval = 10 * time.Second
+)
+
+// SelfTestResult is the outcome of one startup check. The service only
+// reports readiness once all mandatory checks pass.
+type SelfTestResult struct {
+	Name      string
+	Mandatory bool
+	Err       error
+}
+
+type selfTestCheck struct {
+	name      string
+	mandatory bool
+	run       func() error
+}
+
+// runSelfTest runs all checks and reports whether the mandatory ones passed
+func runSelfTest(checks []selfTestCheck) ([]SelfTestResult, bool) {
+	results := make([]SelfTestResult, 0, len(checks))
+	passed := true
+	for _, c := range checks {
+		err := c.run()
+		if err != nil && c.mandatory {
+			passed = false
+		}
+		results = append(results, SelfTestResult{Name: c.name, Mandatory: c.mandatory, Err: err})
+	}
+	return results, passed
+}
+
+// selfTestFields returns the keycard:selftest hash: result is pass or fail,
+// and each check is pass, fail (mandatory) or warn, followed by its error
+func selfTestFields(results []SelfTestResult, passed bool) map[string]any {
+	fields := map[string]any{
+		"result": "fail",
+		"time":   time.Now().Unix(),
+	}
+	if passed {
+		fields["result"] = "pass"
+	}
+	for _, r := range results {
+		switch {
+		case r.Err == nil:
+			fields[r.Name] = "pass"
+		case r.Mandatory:
+			fields[r.Name] = "fail: " + r.Err.Error()
+		default:
+			fields[r.Name] = "warn: " + r.Err.Error()
+		}
+	}
+	return fields
+}
+
+func (s *Service) selfTestChecks() []selfTestCheck {
+	return []selfTestCheck{
+		{name: "nfc", mandatory: true, run: s.checkNFC},
+		{name: "led", run: s.checkLED},
+		{name: "redis", mandatory: true, run: s.redis.Ping},
+		{name: "data-dir", mandatory: true, run: func() error { return checkWritable(s.config.DataDir) }},
+	}
+}
+
+// checkNFC verifies the reader was initialized and is discovering
+func (s *Service) checkNFC() error {
+	switch state := s.nfc.GetState(); state {
+	case hal.StateDiscovering, hal.StatePresent:
+		return nil
+	default:
+		return fmt.Errorf("reader is %s", strings.ToLower(state.String()))
+	}
+}
+
+// checkLED writes to the LP5662 over I2C, or checks the LED scripts exist
+func (s *Service) checkLED() error {
+	if s.ledErr != nil {
+		return s.ledErr
+	}
+	if _, ok := s.rgbLed.(*LP5662); ok {
+		return s.led.Refresh()
+	}
+	_, err := os.Stat(greenLedScript)
+	return err
+}
+
+// selfTest runs the startup checks, publishes the report, and tells systemd
+// the service is ready once the mandatory checks pass
+func (s *Service) selfTest() bool {
+	results, passed := runSelfTest(s.selfTestChecks())
+
+	var failed []string
+	for _, r := range results {
+		if r.Err == nil {
+			continue
+		}
+		failed = append(failed, r.Name)
+		if r.Mandatory {
+			s.logger.Error("Self-test failed", "check", r.Name, "error", r.Err)
+		} else {
+			s.logger.Warn("Self-test failed", "check", r.Name, "error", r.Err)
+		}
+	}
+
+	if err := s.redis.PublishSelfTest(selfTestFields(results, passed)); err != nil {
+		s.logger.Error("Failed to publish self-test to Redis", "error", err)
+	}
+
+	status := "Ready"
+	if len(failed) > 0 {
+		status = "Self-test failed: " + strings.Join(failed, ", ")
+	}
+	state := "STATUS=" + status
+	if passed {
+		state = "READY=1\n" + state
+		s.logger.Info("Self-test passed", "warnings", len(failed))
+	}
+	if err := sdNotify(state); err != nil {
+		s.logger.Warn("Failed to notify systemd", "error", err)
+	}
+	return passed
+}
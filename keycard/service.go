@@ -2,72 +2,461 @@ package keycard
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	hal "github.com/librescoot/pn7150"
+	ipc "github.com/librescoot/redis-ipc"
 )
 
 const (
-	blinkInterval = 500 * time.Millisecond
-	flashDuration = 500 * time.Millisecond
+	blinkInterval     = 500 * time.Millisecond
+	flashDuration     = 500 * time.Millisecond
+	warnBlinkInterval = 150 * time.Millisecond
+	warnBlinkCount    = 3
+	alertBlinkCount   = 6
+	unlockedBlinks    = 2
+
+	provisionScanInterval = 5 * time.Second
+	presenceCheckInterval = 50 * time.Millisecond
+
+	defaultPollPeriod      = 100 // ms
+	defaultLockoutDuration = time.Minute
+	shortFlashDuration     = 150 * time.Millisecond
+)
+
+// LED feedback profiles for tap outcomes
+const (
+	FeedbackNormal = "normal" // flash for half a second
+	FeedbackShort  = "short"  // brief flashes
+	FeedbackSilent = "silent" // no flashes or blinks; learn mode still blinks
+)
+
+// Learn modes published in the keycard:learn hash
+const (
+	LearnModeOff    = "off"
+	LearnModeMaster = "master" // waiting for the master card
+	LearnModeCards  = "cards"  // enrolling cards until the master card is presented again
+)
+
+// Policies for random UIDs, see IsRandomUID
+const (
+	RandomUIDIgnore = "ignore" // ignore the tap
+	RandomUIDToken  = "token"  // only accept an NDEF access token
+	RandomUIDAllow  = "allow"  // treat like any other UID
 )
 
 type Config struct {
-	Device      string
-	DataDir     string
-	RedisAddr   string
-	Debug       bool
-	LogLevel    int
-	LEDDevice   string // I2C device for LP5662, empty for shell scripts
-	LEDAddress  uint8  // I2C address for LP5662
+	Device       string
+	DataDir      string
+	RedisAddr    string
+	Debug        bool
+	LogLevel     int
+	LEDDevice    string   // I2C device for LP5662, empty for shell scripts
+	LEDAddress   uint8    // I2C address for LP5662
+	User         string   // User to switch to from root once the devices are open, empty to keep running as started
+	Sandbox      bool     // Confine the process with Landlock and seccomp once initialized
+	SandboxAllow []string // Further files or directories the LED scripts may read and write in the sandbox, e.g. GPIOs
+	LockFile     string   // Lock file keeping a second instance from using the reader, empty for one in /run/lock named after Device
+	DryRun       bool     // Evaluate taps and show them on the LED without publishing to Redis or persisting anything
+
+	Reader      NFCReader // Reader used instead of the PN7150 on Device, nil to open the device
+	Clock       Clock     // Time source of the tap handling and the LED, nil for SystemClock
+	Replay      string    // Recording of tag events played back instead of using the reader, empty to use the reader
+	ReplaySpeed float64   // Speed-up of the playback, 1 for the recorded timing, 0 for no pauses
+	Record      string    // File the tag events from the reader are appended to, empty to disable
+
+	Capture       string // File the NCI packets and tag events of the reader are appended to, empty to disable
+	CaptureRedact bool   // Replace UIDs in the capture by pseudonyms
+
+	RequireParked bool       // Only grant access while the scooter is parked
+	ToggleLock    bool       // Request a lock when an authorized card is presented to an unlocked scooter
+	GuestUses     int        // Cards learned in learn mode become guest cards with this many uses (0 = unlimited)
+	TokenKeyFile  string     // Ed25519 public key verifying NDEF access tokens, empty to disable
+	LearnOneTime  bool       // Cards learned in learn mode become one-time cards
+	RandomUIDs    string     // Policy for random UIDs: RandomUIDIgnore, RandomUIDToken, or RandomUIDAllow
+	CloneAction   string     // Action for cards in a clone range: CloneWarn or CloneDeny
+	CardMACPage   int        // First of the four Type 2 Tag pages the CardMAC is written to at enrollment, 0 to disable
+	DenyTech      []TagType  // Card types always denied, e.g. TagClassic
+	Policy        AuthPolicy // Decides whether taps grant access, DefaultPolicy if nil
+
+	PollPeriod      uint             // Discovery poll period in milliseconds
+	Feedback        string           // LED feedback profile: FeedbackNormal, FeedbackShort, or FeedbackSilent
+	LockoutAttempts int              // Unknown taps in a row before taps are ignored for LockoutDuration, 0 to disable
+	LockoutDuration time.Duration    // How long taps are ignored after too many unknown ones
+	DebounceWindow  time.Duration    // A card leaving and returning within this is still the same tap
+	RearmAfter      time.Duration    // A card present this long arrives again, 0 to disable
+	GrantCooldown   time.Duration    // Taps after a grant are ignored this long, 0 to disable
+	HibernateTaps   int              // Master card taps within HibernateWindow requesting hibernation, 0 to disable
+	HibernateWindow time.Duration    // Time window of the hibernation gesture
+	Gestures        []Gesture        // Tap patterns triggering actions
+	Groups          map[string]Group // Grant handling of the card groups by name
+
+	SyncURL      string        // Fleet backend URL serving the authorized list, empty to disable
+	SyncKeyFile  string        // Ed25519 public key verifying the backend's signature
+	SyncDeviceID string        // Device ID source of the scooter ID the list must name: soc, machine-id, or vin
+	SyncInterval time.Duration // How often to pull the authorized list, 0 to pull it only at startup
+	BloomFilter  bool          // Pre-check UIDs with a Bloom filter, for lists of hundreds of thousands of UIDs
+
+	RevocationURL      string        // HTTP(S) URL or redis:<key> serving the fleet revocation list, empty to disable
+	RevocationInterval time.Duration // How often to fetch the revocation list, 0 to fetch it only at startup
+	RevocationKeyFile  string        // Ed25519 public key verifying revocation deltas pushed via Redis, empty to disable
+
+	SecureElement string // Backend holding secret keys, see OpenSecureElement
+	SealStore     bool   // Encrypt the card store under the "store" key of the secure element
+	DeriveKeys    string // Device ID source for deriving keys from the fleet secret, empty to use keys as stored
+	AuthMAC       bool   // MAC auth payloads published to Redis with the shared "redis" key
+	SignAuth      bool   // Sign auth payloads published to Redis with the Ed25519 "device" key
+
+	AuthExpiry time.Duration     // Expiry of the keycard hash, 0 for the default
+	AuthType   string            // Published as "type" with every auth, empty for "scooter"
+	AuthFields map[string]string // Static fields added to every auth
+
+	RemoteCommands bool // Accept commands on scooter:keycard authenticated with the shared "command" key
+
+	TelemetryURL      string        // HTTPS endpoint receiving anonymized event batches, empty to disable
+	WebhookURL        string        // URL receiving signed grant, denial and learn notifications, empty to disable
+	HTTPListen        string        // Address of the HTTP listener serving /healthz, /readyz and /metrics, empty to disable
+	LatencyBudget     time.Duration // Grants taking longer from tag arrival to publish are logged, 0 to disable
+	StageTimeouts     StageTimeouts // Deadlines of the tap pipeline stages, zero for the defaults
+	IntakeSize        int           // Tag events buffered for the event loop, 0 for the default
+	ShutdownTimeout   time.Duration // How long Stop waits for publishes and LED animations to finish, 0 for the default
+	TelemetryInterval time.Duration // How often to upload telemetry
+
+	ProvisionDir     string // Directory watched for signed provisioning bundles, empty to disable
+	ProvisionKeyFile string // Ed25519 public key of the operator signing bundles
 }
 
 type Service struct {
 	config *Config
 	logger *slog.Logger
+	clock  Clock
+
+	nfc           NFCReader
+	auth          *AuthManager
+	policy        AuthPolicy
+	randomPolicy  AuthPolicy     // decides random UIDs by their credentials alone
+	script        *PolicyScript  // reviews the decisions of both policies
+	rgbLed        RGBLed         // RGB LED for feedback (LP5662 or script-based)
+	led           *Animator      // the only writer of rgbLed, all feedback goes through it
+	ledErr        error          // why the LP5662 is not used despite being configured
+	linearLed     *LEDController // Linear LEDs for learn mode indicators
+	redis         *RedisClient
+	vehicle       *VehicleMonitor
+	toggle        *Toggle
+	tokenKey      ed25519.PublicKey
+	sync          *SyncClient
+	revFetch      *RevocationFetcher
+	revKey        ed25519.PublicKey
+	revQueue      *ipc.QueueHandler[json.RawMessage]
+	rpc           *RPCServer
+	bus           *Bus
+	diag          *Diagnostics
+	intake        *TagIntake
+	recorder      *TagRecorder
+	capture       *NCICapture
+	latency       *LatencyMetrics
+	telemetry     *TelemetryUploader
+	webhook       *WebhookSender
+	outbox        *Outbox
+	calls         chan func()
+	clones        *CloneRanges
+	se            SecureElement
+	provision     *ProvisionWatcher
+	storeWatch    *StoreWatcher
+	settingsWatch *SettingsWatcher
+	http          *http.Server
+	activated     map[string]net.Listener // sockets passed by systemd socket activation
+	lock          *instanceLock
+
+	ready     atomic.Bool  // the self-test passed
+	cardIO    sync.Mutex   // held by the read of the present card, see identify
+	loopAlive atomic.Int64 // Unix milliseconds of the last event loop iteration
 
-	nfc       *hal.PN7150
-	auth      *AuthManager
-	rgbLed    RGBLed         // RGB LED for feedback (LP5662 or script-based)
-	linearLed *LEDController // Linear LEDs for learn mode indicators
-	redis     *RedisClient
+	// Shutdown
+	stopOnce sync.Once
+	quit     chan struct{}  // closed by Stop to end the event loop
+	running  atomic.Bool    // Run was called
+	started  atomic.Bool    // Start was called
+	loopDone chan struct{}  // closed when Run returns
+	runErr   error          // returned by Run, read after loopDone
+	inflight sync.WaitGroup // publishes, including those past their deadline
+
+	crashes chan *crash // recovered panics to publish from the event loop
+	events  eventSinks  // channels returned by Events
 
 	masterLearningMode bool
 	learnMode          bool
-	newUIDs            []string
+	learnSession       *LearnSession // the current learning session, nil outside learn mode
+	enrollment         *enrollment   // pending enrollment requested remotely
+
+	// Lockout after repeated unknown taps
+	failedTaps  int       // unknown taps since the last grant
+	lockedUntil time.Time // taps other than the master card are ignored until then
+
+	cooldownUntil time.Time // taps other than the master card are ignored after a grant until then
+
+	gestures *GestureRecognizer
 
 	// Card presence tracking
-	currentCardUID string    // UID of currently present card ("" if none)
-	lastSeenTime   time.Time // Last time current card was detected
-	emptyPollCount int       // Consecutive polls with no card detected
+	currentCardUID string         // UID of currently present card ("" if none)
+	currentProto   hal.RFProtocol // RF protocol of the card that arrived last
+	currentTech    TagType        // technology of the card that arrived last
+	arrivalTime    time.Time      // When the current card arrived
+	granted        bool           // Current card was granted access, its auth is kept fresh
+	lastSeenTime   time.Time      // Last time current card was detected
+	departing      bool           // Current card left, its departure is pending the debounce window
+	departedAt     time.Time      // When the current card left
+	emptyPollCount int            // Consecutive polls with no card detected
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
+// NewService opens the reader, the LED and Redis for a configuration,
+// DefaultConfig if nil. Without a logger it logs to slog.Default().
 func NewService(config *Config, logger *slog.Logger) (*Service, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &Service{
 		config:         config,
 		logger:         logger,
+		clock:          config.Clock,
 		ctx:            ctx,
 		cancel:         cancel,
 		currentCardUID: "",
 		emptyPollCount: 0,
+		bus:            NewBus(),
+		diag:           NewDiagnostics(),
+		intake:         NewTagIntake(config.IntakeSize),
+		latency:        NewLatencyMetrics(),
+		quit:           make(chan struct{}),
+		loopDone:       make(chan struct{}),
+		crashes:        make(chan *crash, 8),
+	}
+	if s.clock == nil {
+		s.clock = SystemClock
+	}
+	s.events.subscribe(s.bus)
+
+	switch config.RandomUIDs {
+	case "":
+		config.RandomUIDs = RandomUIDToken
+	case RandomUIDIgnore, RandomUIDToken, RandomUIDAllow:
+	default:
+		s.abort()
+		return nil, fmt.Errorf("invalid random UID policy %q", config.RandomUIDs)
+	}
+
+	switch config.CloneAction {
+	case "":
+		config.CloneAction = CloneWarn
+	case CloneWarn, CloneDeny:
+	default:
+		s.abort()
+		return nil, fmt.Errorf("invalid clone action %q", config.CloneAction)
+	}
+	if config.CardMACPage != 0 && config.CardMACPage < t2tUserStart {
+		s.abort()
+		return nil, fmt.Errorf("card MAC page %d is not in user memory", config.CardMACPage)
+	}
+
+	if config.PollPeriod == 0 {
+		config.PollPeriod = defaultPollPeriod
+	}
+	config.StageTimeouts = config.StageTimeouts.withDefaults()
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if config.LockoutDuration == 0 {
+		config.LockoutDuration = defaultLockoutDuration
+	}
+	switch config.Feedback {
+	case "":
+		config.Feedback = FeedbackNormal
+	case FeedbackNormal, FeedbackShort, FeedbackSilent:
+	default:
+		s.abort()
+		return nil, fmt.Errorf("invalid feedback profile %q", config.Feedback)
 	}
 
 	var err error
 
-	s.auth, err = NewAuthManager(config.DataDir)
+	// Before touching the reader or the data directory
+	lockFile := config.LockFile
+	if lockFile == "" {
+		lockFile = defaultLockPath(config.Device)
+	}
+	s.lock, err = lockInstance(lockFile)
+	if err != nil {
+		s.abort()
+		return nil, err
+	}
+
+	s.activated, err = sdListeners()
+	if err != nil {
+		s.abort()
+		return nil, err
+	}
+	for name := range s.activated {
+		logger.Info("Using socket passed by systemd", "name", name)
+	}
+
+	s.se, err = OpenSecureElement(config.SecureElement, config.DataDir)
+	if err != nil {
+		s.abort()
+		return nil, fmt.Errorf("failed to open secure element: %w", err)
+	}
+
+	s.redis, err = NewRedisClient(config.RedisAddr, logger)
+	if err != nil {
+		s.abort()
+		return nil, fmt.Errorf("failed to create redis client: %w", err)
+	}
+	s.redis.UseClock(s.clock)
+	if config.DryRun {
+		s.redis.SetDryRun()
+		logger.Warn("Dry run, taps are evaluated but nothing is published or persisted")
+	}
+
+	// Before the store key, which is derived too
+	if config.DeriveKeys != "" {
+		deviceID, err := ReadDeviceID(config.DeriveKeys, s.redis)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to derive keys: %w", err)
+		}
+		s.se = NewDerivedElement(s.se, deviceID)
+		logger.Info("Deriving keys from device identity", "source", config.DeriveKeys)
+	}
+
+	var storeKey []byte
+	if config.SealStore {
+		if storeKey, err = StoreKey(s.se); err != nil {
+			s.abort()
+			return nil, err
+		}
+	}
+	s.auth, err = openAuthManager(config.DataDir, storeKey, false)
 	if err != nil {
-		cancel()
+		s.abort()
 		return nil, fmt.Errorf("failed to create auth manager: %w", err)
 	}
+	if !config.DryRun {
+		if err := s.auth.sealStore(); err != nil {
+			s.abort()
+			return nil, err
+		}
+	}
+	s.auth.UseClock(s.clock)
+	if config.BloomFilter {
+		s.auth.EnableBloomFilter()
+	}
+	if config.DryRun {
+		s.auth.KeepInMemory()
+	}
+	s.policy = config.Policy
+	if s.policy == nil {
+		s.policy = DefaultPolicy(s.auth)
+	}
+	if len(config.DenyTech) > 0 {
+		s.policy = Policies{TechPolicy{Deny: config.DenyTech}, s.policy}
+	}
+	s.script = LoadPolicyScript(config.DataDir, logger)
+	s.policy = NewScriptPolicy(s.policy, s.script)
+	s.randomPolicy = NewScriptPolicy(randomUIDPolicy(s.auth), s.script)
+
+	s.clones, err = LoadCloneRanges(config.DataDir)
+	if err != nil {
+		s.abort()
+		return nil, fmt.Errorf("failed to load clone ranges: %w", err)
+	}
+
+	if config.RevocationKeyFile != "" {
+		s.revKey, err = LoadPublicKey(config.RevocationKeyFile)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load revocation key: %w", err)
+		}
+	}
+
+	if config.TokenKeyFile != "" {
+		s.tokenKey, err = LoadPublicKey(config.TokenKeyFile)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load token key: %w", err)
+		}
+	}
+
+	if !config.DryRun {
+		// A dry run leaves events queued by earlier runs for the next one
+		s.outbox, err = NewOutbox(config.DataDir)
+		if err != nil {
+			logger.Warn("Events will be lost if they cannot be published", "error", err)
+			s.outbox = nil
+		} else if n := s.outbox.Pending(); n > 0 {
+			logger.Info("Unpublished events in outbox", "events", n)
+		}
+	}
+
+	settings, err := LoadSettings(config.DataDir)
+	if err != nil {
+		logger.Warn("Ignoring persisted settings", "error", err)
+	} else {
+		settings.Apply(config)
+	}
+
+	if config.HibernateTaps == 1 || config.HibernateTaps < 0 {
+		s.abort()
+		return nil, fmt.Errorf("hibernate taps must be at least 2")
+	}
+	for i := range config.Gestures {
+		if err := config.Gestures[i].validate(); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("invalid gesture: %w", err)
+		}
+	}
+	for name, g := range config.Groups {
+		if err := g.validate(name); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("invalid group: %w", err)
+		}
+	}
+	s.resetGestures()
+
+	if config.ProvisionDir != "" {
+		key, err := LoadPublicKey(config.ProvisionKeyFile)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load provisioning key: %w", err)
+		}
+		if config.DryRun {
+			logger.Warn("Dry run, not applying provisioning bundles")
+		} else {
+			s.provision = NewProvisionWatcher(config.ProvisionDir, key, provisionScanInterval, logger)
+		}
+	}
+
+	s.storeWatch, err = NewStoreWatcher(config.DataDir, logger)
+	if err != nil {
+		logger.Warn("External changes to the card store and policy script will need a restart", "error", err)
+	}
 
 	// Initialize LED controllers
 	s.linearLed = NewLEDController(logger)
@@ -78,6 +467,7 @@ func NewService(config *Config, logger *slog.Logger) (*Service, error) {
 		if err != nil {
 			logger.Warn("Failed to initialize LP5662, falling back to script-based LED", "error", err)
 			s.rgbLed = s.linearLed
+			s.ledErr = err
 		} else {
 			s.rgbLed = lp5662
 		}
@@ -85,14 +475,127 @@ func NewService(config *Config, logger *slog.Logger) (*Service, error) {
 		// Use script-based LED control
 		s.rgbLed = s.linearLed
 	}
+	s.led = NewAnimator(s.rgbLed, s.clock)
 
-	s.redis, err = NewRedisClient(config.RedisAddr, logger)
-	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("failed to create redis client: %w", err)
+	if recovered := s.auth.Recovered(); len(recovered) > 0 {
+		logger.Error("UID store was corrupted, restored from last-known-good copy", "files", recovered)
+		if err := s.redis.PublishEvent(EventStorageDegraded, map[string]any{
+			"files": strings.Join(recovered, ","),
+		}); err != nil {
+			logger.Error("Failed to publish event to Redis", "error", err)
+		}
+	}
+
+	if config.SyncURL != "" {
+		key, err := LoadPublicKey(config.SyncKeyFile)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load sync key: %w", err)
+		}
+		scooter, err := ReadDeviceID(config.SyncDeviceID, s.redis)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to read scooter ID for sync: %w", err)
+		}
+		s.sync, err = NewSyncClient(config.SyncURL, key, scooter, config.SyncInterval, config.DataDir, s.auth, logger)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to create sync client: %w", err)
+		}
+	}
+
+	s.redis.ConfigureAuth(config.AuthExpiry, config.AuthType, config.AuthFields)
+
+	if config.AuthMAC {
+		if _, err := s.se.MAC(authMACKeyID, nil); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load auth MAC key: %w", err)
+		}
+		s.redis.SetAuthTag(authMACField, func(payload []byte) ([]byte, error) {
+			return s.se.MAC(authMACKeyID, payload)
+		})
+	}
+
+	if config.SignAuth {
+		pub, err := s.se.PublicKey(authSignKeyID)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load device key: %w", err)
+		}
+		s.redis.SetAuthTag(authSignatureField, func(payload []byte) ([]byte, error) {
+			return s.se.Sign(authSignKeyID, payload)
+		})
+		logger.Info("Signing auth events", "key", hex.EncodeToString(pub))
+	}
+
+	if config.RevocationURL != "" {
+		s.revFetch = NewRevocationFetcher(config.RevocationURL, config.RevocationInterval, s.auth, s.redis, logger)
+	}
+
+	if config.DryRun && (config.TelemetryURL != "" || config.WebhookURL != "" || s.revKey != nil || config.RemoteCommands) {
+		logger.Warn("Dry run, telemetry, webhooks, revocation deltas and remote commands are disabled")
+	}
+
+	if config.TelemetryURL != "" && !config.DryRun {
+		s.telemetry = NewTelemetryUploader(config.TelemetryURL, config.TelemetryInterval, logger)
+	}
+
+	if config.WebhookURL != "" && !config.DryRun {
+		if _, err := s.se.MAC(webhookKeyID, nil); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load webhook key: %w", err)
+		}
+		s.webhook = NewWebhookSender(config.WebhookURL, func(body []byte) ([]byte, error) {
+			return s.se.MAC(webhookKeyID, body)
+		}, logger)
+	}
+
+	if s.revKey != nil && !config.DryRun {
+		s.revQueue = s.redis.HandleRevocationDeltas(s.applyRevocationDelta)
+	}
+
+	if config.RemoteCommands && !config.DryRun {
+		if _, err := s.se.MAC(commandKeyID, nil); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load command key: %w", err)
+		}
+		s.calls = make(chan func())
+		s.rpc = NewRPCServer(s.redis, s.se, s.clock, logger)
+		s.registerCommands()
+		s.rpc.Start()
+	}
+
+	if config.CardMACPage != 0 {
+		if _, err := s.se.MAC(cardMACKeyID, nil); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load card key: %w", err)
+		}
+	}
+
+	s.settingsWatch = NewSettingsWatcher(s.redis, logger)
+	if err := s.settingsWatch.Start(); err != nil {
+		logger.Warn("Failed to subscribe to settings", "error", err)
+	}
+
+	s.vehicle = NewVehicleMonitor(s.redis, logger)
+	if err := s.vehicle.Start(); err != nil {
+		logger.Warn("Failed to subscribe to vehicle state", "error", err)
+	}
+	s.toggle = NewToggle(s.vehicle.IsUnlocked())
+
+	if config.Capture != "" {
+		if s.capture, err = OpenNCICapture(config.Capture, config.CaptureRedact); err != nil {
+			s.abort()
+			return nil, err
+		}
+		logger.Info("Capturing NCI traffic", "file", config.Capture, "redact", config.CaptureRedact)
 	}
 
 	logCallback := func(level hal.LogLevel, message string) {
+		// The HAL logs packets in debug mode, which a capture turns on
+		if s.capture != nil && s.capture.LogMessage(message) && !config.Debug {
+			return
+		}
 		if int(level) > config.LogLevel {
 			return
 		}
@@ -108,28 +611,152 @@ func NewService(config *Config, logger *slog.Logger) (*Service, error) {
 		}
 	}
 
-	s.nfc, err = hal.NewPN7150(config.Device, logCallback, nil, true, false, config.Debug)
-	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("failed to create NFC HAL: %w", err)
+	switch {
+	case config.Reader != nil:
+		s.nfc = config.Reader
+	case config.Replay != "":
+		records, err := LoadTagRecords(config.Replay)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to load replay: %w", err)
+		}
+		s.nfc = NewReplayReader(records, config.ReplaySpeed)
+		logger.Info("Replaying tag events instead of using the reader", "file", config.Replay, "events", len(records), "speed", config.ReplaySpeed)
+	default:
+		pn7150, err := hal.NewPN7150(config.Device, logCallback, nil, true, false, config.Debug || s.capture != nil)
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to create NFC HAL: %w", err)
+		}
+		s.nfc = pn7150
 	}
 
 	if err := s.nfc.Initialize(); err != nil {
-		cancel()
+		s.abort()
 		return nil, fmt.Errorf("failed to initialize NFC HAL: %w", err)
 	}
 
+	if config.Record != "" {
+		if s.recorder, err = OpenTagRecorder(config.Record); err != nil {
+			s.abort()
+			return nil, err
+		}
+		logger.Info("Recording tag events", "file", config.Record)
+	}
+	if s.recorder != nil || s.capture != nil {
+		s.intake.RecordTo(s.recordTagEvent)
+	}
+
+	// All devices are open
+	if config.User != "" {
+		if err := dropPrivileges(config.User, config.DataDir, logger); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to drop privileges: %w", err)
+		}
+	} else if os.Geteuid() == 0 {
+		logger.Warn("Running as root, consider dropping privileges with a dedicated user")
+	}
+	if config.Sandbox {
+		if err := applySandbox(config, logger); err != nil {
+			s.abort()
+			return nil, fmt.Errorf("failed to apply sandbox: %w", err)
+		}
+	}
+
+	s.subscribe()
 	return s, nil
 }
 
-func (s *Service) Run() error {
+// subscribe connects the consumers of the internal bus
+func (s *Service) subscribe() {
+	Subscribe(s.bus, func(TagArrived) { s.led.Play(SolidAnimation(s.rgbLed.Amber)) }) // during lookup
+	Subscribe(s.bus, s.handleTagArrival)
+	Subscribe(s.bus, s.showFeedback)
+	Subscribe(s.bus, s.recordLatency)
+	Subscribe(s.bus, func(TagDeparted) { s.gestures.Depart() })
+
+	if s.telemetry != nil {
+		Subscribe(s.bus, func(e EventPublished) {
+			s.telemetry.Record(e.Event.String(), int(e.Event), e.Fields)
+		})
+		Subscribe(s.bus, func(a AuthPublished) {
+			s.telemetry.Record(EventGranted.String(), int(EventGranted), a.Fields)
+		})
+	}
+
+	if s.webhook != nil {
+		Subscribe(s.bus, func(e EventPublished) {
+			// Grants and denials, not presence or service events
+			if e.Event >= EventGranted && e.Event < EventDeparted {
+				s.webhook.Send(e.Event.String(), int(e.Event), e.Fields)
+			}
+		})
+		Subscribe(s.bus, func(a AuthPublished) {
+			fields := map[string]any{"uid": a.UID}
+			for k, v := range a.Fields {
+				fields[k] = v
+			}
+			s.webhook.Send(EventGranted.String(), int(EventGranted), fields)
+		})
+		Subscribe(s.bus, func(l LearnStateChanged) {
+			s.webhook.Send("learn", 0, map[string]any{"mode": l.Mode, "added": l.Added})
+		})
+	}
+}
+
+func (s *Service) Run() (err error) {
+	s.running.Store(true)
+	defer close(s.loopDone)
+	defer s.events.close()
+	defer func() { s.runErr = err }()
+
 	s.logger.Info("Keycard service starting",
 		"device", s.config.Device,
 		"dataDir", s.config.DataDir,
 		"hasMaster", s.auth.HasMaster())
 
+	resumed := s.resumeLearnMode()
 	if !s.auth.HasMaster() {
 		s.enterMasterLearningMode()
+	} else if !resumed {
+		s.publishLearnState(0, nil)
+	}
+
+	if s.sync != nil {
+		s.supervise("fleet sync", s.sync.Run)
+	}
+	if s.revFetch != nil {
+		s.supervise("revocation fetcher", s.revFetch.Run)
+	}
+	if s.telemetry != nil {
+		s.supervise("telemetry", s.telemetry.Run)
+	}
+	if s.webhook != nil {
+		s.supervise("webhooks", s.webhook.Run)
+	}
+
+	var bundles <-chan *Bundle
+	if s.provision != nil {
+		bundles = s.provision.Bundles()
+		s.supervise("provisioning", s.provision.Run)
+	}
+
+	var storeChanges, policyChanges chan struct{}
+	if s.storeWatch != nil {
+		storeChanges = make(chan struct{}, 1)
+		policyChanges = make(chan struct{}, 1)
+		s.supervise("store watcher", func(ctx context.Context) {
+			s.storeWatch.Run(ctx, func(file string) {
+				changes := storeChanges
+				if file == policyScriptName {
+					changes = policyChanges
+				}
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			})
+		})
 	}
 
 	// Enable event-driven detection
@@ -137,13 +764,15 @@ func (s *Service) Run() error {
 	defer s.nfc.SetTagEventReaderEnabled(false)
 
 	// Start continuous discovery with short period
-	if err := s.nfc.StartDiscovery(100); err != nil {
+	if err := s.nfc.StartDiscovery(s.config.PollPeriod); err != nil {
+		s.diag.RecordError(err)
 		if strings.Contains(err.Error(), "status: 06") {
 			s.logger.Warn("Discovery failed with semantic error, reinitializing")
+			s.diag.Reinitialized()
 			if err := s.nfc.FullReinitialize(); err != nil {
 				return fmt.Errorf("reinitialization failed: %w", err)
 			}
-			if err := s.nfc.StartDiscovery(100); err != nil {
+			if err := s.nfc.StartDiscovery(s.config.PollPeriod); err != nil {
 				return fmt.Errorf("discovery failed after reinit: %w", err)
 			}
 		} else {
@@ -154,52 +783,388 @@ func (s *Service) Run() error {
 
 	s.logger.Info("Event-driven tag detection enabled")
 
-	// Event loop
-	eventChan := s.nfc.GetTagEventChannel()
+	refresh := s.clock.NewTicker(s.redis.expiry / 2)
+	defer refresh.Stop()
+
+	diag := s.clock.NewTicker(diagInterval)
+	defer diag.Stop()
+
+	presence := s.clock.NewTicker(presenceCheckInterval)
+	defer presence.Stop()
+
+	var selfTest <-chan time.Time
+	if s.selfTest() {
+		s.ready.Store(true)
+	} else {
+		retry := s.clock.NewTicker(selfTestRetryInterval)
+		defer retry.Stop()
+		selfTest = retry.C()
+	}
+
+	replay := s.clock.NewTicker(outboxReplayInterval)
+	defer replay.Stop()
+	s.replayOutbox()
+	s.publishDiagnostics()
+
+	if s.config.HTTPListen != "" || s.activatedListener(httpSocketName) != nil {
+		if err := s.startHTTP(s.config.HTTPListen); err != nil {
+			return fmt.Errorf("failed to start HTTP listener: %w", err)
+		}
+		defer s.stopHTTP()
+	}
+
+	s.supervise("tag intake", func(ctx context.Context) {
+		s.intake.Run(ctx, s.nfc.GetTagEventChannel())
+	})
+
+	// Event loop, restarted if handling an event panics
+	src := &loopSources{
+		bundles:       bundles,
+		storeChanges:  storeChanges,
+		policyChanges: policyChanges,
+		refresh:       refresh.C(),
+		diag:          diag.C(),
+		presence:      presence.C(),
+		replay:        replay.C(),
+		selfTest:      selfTest,
+	}
+	restarted := false
+	return s.restartOnPanic("event loop", s.quit, func() error {
+		if restarted {
+			// Whatever the crashed handler showed is stale
+			s.led.Off()
+		}
+		restarted = true
+		return s.loop(src)
+	})
+}
+
+// loopSources are the event sources of the event loop that Run sets up
+type loopSources struct {
+	bundles       <-chan *Bundle
+	storeChanges  chan struct{}
+	policyChanges chan struct{}
+	refresh       <-chan time.Time
+	diag          <-chan time.Time
+	presence      <-chan time.Time
+	replay        <-chan time.Time
+	selfTest      <-chan time.Time // nil once the self-test passed
+}
+
+// loop handles events until the service stops
+func (s *Service) loop(src *loopSources) error {
 	for {
+		s.loopAlive.Store(s.clock.Now().UnixMilli())
 		select {
-		case <-s.ctx.Done():
+		case <-s.quit:
 			s.logger.Info("Service shutting down")
 			return nil
-		case event, ok := <-eventChan:
-			if !ok {
+		case <-s.ctx.Done():
+			return nil
+		case <-s.intake.Ready():
+			events, closed := s.intake.Take()
+			for _, event := range events {
+				if event.Error != nil {
+					s.logger.Warn("Tag event error", "error", event.Error)
+					s.diag.RecordError(event.Error)
+					continue
+				}
+				s.handleTagEvent(event)
+			}
+			if closed && s.config.Replay != "" {
+				s.logger.Info("Replay finished")
+				return nil
+			}
+			if closed {
 				s.logger.Error("Event channel closed unexpectedly")
 				return fmt.Errorf("event channel closed")
 			}
-			if event.Error != nil {
-				s.logger.Warn("Tag event error", "error", event.Error)
-				continue
+		case c := <-s.crashes:
+			s.publishCrash(c)
+		case bundle := <-src.bundles:
+			s.applyBundle(bundle)
+		case <-src.storeChanges:
+			s.reloadStore()
+		case <-src.policyChanges:
+			s.script.Reload()
+		case update := <-s.settingsWatch.Changes():
+			s.applyRemoteSettings(update)
+		case call := <-s.calls:
+			call()
+		case <-src.refresh:
+			if s.granted {
+				s.publish(s.redis.RefreshAuth)
+			}
+		case <-src.diag:
+			s.publishDiagnostics()
+		case <-src.presence:
+			s.checkPresence()
+		case state := <-s.vehicle.StateChanges():
+			s.followVehicle(state)
+		case <-src.replay:
+			s.replayOutbox()
+		case <-src.selfTest:
+			if s.selfTest() {
+				s.ready.Store(true)
+				src.selfTest = nil
 			}
-			s.handleTagEvent(event)
 		}
 	}
 }
 
-func (s *Service) Stop() {
-	s.cancel()
-	if s.rgbLed != nil {
-		s.rgbLed.Close()
+// publishEvent publishes an event to Redis through the outbox and passes
+// it on to the bus
+func (s *Service) publishEvent(event Event, fields map[string]any) {
+	fields = s.withTech(fields)
+	id := s.addToOutbox(event, fields)
+	err := s.publish(func() error { return s.redis.PublishEvent(event, fields) })
+	if err != nil {
+		s.logger.Error("Failed to publish event to Redis", "error", err)
+	}
+	s.outboxDone(id, err == nil)
+	s.bus.Publish(EventPublished{Event: event, Fields: fields, Err: err})
+}
+
+// withTech adds the technology of the card on the reader to the fields of
+// an event or grant about it
+func (s *Service) withTech(fields map[string]any) map[string]any {
+	if s.currentTech == "" || s.currentCardUID == "" || fields["uid"] != s.currentCardUID {
+		return fields
+	}
+	fields["tech"] = s.currentTech
+	return fields
+}
+
+// addToOutbox records an event before it is published and returns its
+// outbox ID, or 0 without an outbox
+func (s *Service) addToOutbox(event Event, fields map[string]any) uint64 {
+	if s.outbox == nil {
+		return 0
+	}
+	id, err := s.outbox.Add(event, fields)
+	if err != nil {
+		s.logger.Error("Failed to record event in outbox", "event", event.String(), "error", err)
+	}
+	return id
+}
+
+func (s *Service) outboxDone(id uint64, published bool) {
+	if id == 0 {
+		return
+	}
+	if err := s.outbox.Done(id, published); err != nil {
+		s.logger.Error("Failed to update outbox", "error", err)
+	}
+}
+
+// replayOutbox publishes events that could not be published before, e.g.
+// while Redis was unreachable or because the service crashed
+func (s *Service) replayOutbox() {
+	if s.outbox == nil || s.outbox.Pending() == 0 {
+		return
+	}
+	n, err := s.outbox.Replay(s.redis.ReplayEvent)
+	if n > 0 {
+		s.logger.Info("Replayed events from outbox", "events", n, "pending", s.outbox.Pending())
+	}
+	if err != nil {
+		s.logger.Debug("Outbox replay stopped", "error", err)
+	}
+}
+
+func (s *Service) publishDiagnostics() {
+	fields := s.diag.Fields(s.nfc.GetState())
+	fields["events-dropped"] = s.intake.Dropped()
+	fields["events-coalesced"] = s.intake.Coalesced()
+	if err := s.redis.PublishDiagnostics(fields); err != nil {
+		s.logger.Error("Failed to publish diagnostics to Redis", "error", err)
+	}
+	// Diagnostics only go to telemetry when something went wrong since the
+	// last report
+	if s.telemetry != nil && s.diag.Changed() {
+		s.telemetry.Record("diagnostics", 0, fields)
+	}
+}
+
+// reloadStore picks up changes made to the card store by other processes
+func (s *Service) reloadStore() {
+	changed, err := s.auth.Reload()
+	if err != nil {
+		s.logger.Error("Failed to reload card store, keeping current cards", "error", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	s.logger.Info("Card store changed on disk, reloaded",
+		"hasMaster", s.auth.HasMaster(),
+		"authorized", s.auth.GetAuthorizedCount())
+
+	if s.masterLearningMode && s.auth.HasMaster() {
+		s.exitMasterLearningMode()
+	}
+}
+
+// applyBundle provisions cards and settings from a verified bundle
+func (s *Service) applyBundle(bundle *Bundle) {
+	if bundle.Master != "" {
+		if err := s.auth.SetMaster(bundle.Master); err != nil {
+			s.logger.Error("Failed to provision master UID", "error", err)
+			return
+		}
+		if s.masterLearningMode {
+			s.exitMasterLearningMode()
+		}
+	}
+
+	if err := s.auth.ApplySync(bundle.Authorized, nil); err != nil {
+		s.logger.Error("Failed to provision authorized UIDs", "error", err)
+		return
+	}
+
+	if bundle.Settings != nil {
+		if err := SaveSettings(s.config.DataDir, bundle.Settings); err != nil {
+			s.logger.Error("Failed to save provisioned settings", "error", err)
+		}
+		bundle.Settings.Apply(s.config)
+		s.resetGestures()
+	}
+
+	s.logger.Info("Provisioning bundle applied",
+		"master", bundle.Master != "",
+		"authorized", s.auth.GetAuthorizedCount())
+}
+
+// applyRevocationDelta verifies and applies a delta pushed via Redis
+func (s *Service) applyRevocationDelta(data []byte) error {
+	delta, err := ParseRevocationDelta(data, s.revKey)
+	if err != nil {
+		s.logger.Warn("Rejected revocation delta", "error", err)
+		return nil
 	}
-	if s.nfc != nil {
-		s.nfc.Deinitialize()
+	if err := s.auth.ApplyRevocationDelta(delta); err != nil {
+		s.logger.Warn("Rejected revocation delta", "version", delta.Version, "error", err)
+		return nil
 	}
-	if s.redis != nil {
-		s.redis.Close()
+
+	s.logger.Info("Revocation delta applied",
+		"version", delta.Version,
+		"revoked", len(delta.Revoke),
+		"unrevoked", len(delta.Unrevoke))
+	s.publishEvent(EventRevocationUpdated, map[string]any{"version": delta.Version})
+	return nil
+}
+
+// applyRemoteSettings applies settings from the keycard:settings hash on
+// top of the current config, restarting discovery if the poll period changed.
+// They are not persisted; the hash is read again on start.
+func (s *Service) applyRemoteSettings(update SettingsUpdate) {
+	if update.Err != nil {
+		s.logger.Error("Rejected settings from Redis", "error", update.Err)
+		s.publishEvent(EventSettingsRejected, map[string]any{
+			"error":     update.Err.Error(),
+			"supported": SettingsVersion,
+		})
+		return
+	}
+
+	pollPeriod := s.config.PollPeriod
+	update.Settings.Apply(s.config)
+	s.resetGestures()
+	s.logger.Info("Settings applied from Redis",
+		"requireParked", s.config.RequireParked,
+		"toggleLock", s.config.ToggleLock,
+		"guestUses", s.config.GuestUses,
+		"pollPeriod", s.config.PollPeriod,
+		"feedback", s.config.Feedback,
+		"lockoutAttempts", s.config.LockoutAttempts,
+		"lockoutDuration", s.config.LockoutDuration)
+
+	if s.config.PollPeriod == pollPeriod {
+		return
+	}
+	if err := s.nfc.StopDiscovery(); err != nil {
+		s.logger.Warn("Failed to stop discovery", "error", err)
+	}
+	if err := s.nfc.StartDiscovery(s.config.PollPeriod); err != nil {
+		s.logger.Error("Failed to restart discovery with new poll period", "error", err)
+		s.diag.RecordError(err)
 	}
 }
 
+// showFeedback shows a cue on the RGB LED according to the feedback profile
+func (s *Service) showFeedback(f Feedback) {
+	// The script-based LED only knows its fixed colors
+	color := func(setColor func() error) func() error {
+		led, ok := s.rgbLed.(interface{ SetColor(RGB) error })
+		if f.Color == nil || !ok {
+			return setColor
+		}
+		return func() error { return led.SetColor(*f.Color) }
+	}
+
+	switch f.Cue {
+	case CueOff:
+		s.led.Off()
+	case CueGranted:
+		s.flashLED(color(s.rgbLed.Green), flashDuration)
+	case CueDenied:
+		s.flashLED(color(s.rgbLed.Red), flashDuration)
+	case CueLock:
+		s.flashLED(color(s.rgbLed.Amber), flashDuration)
+	case CueLearned:
+		if f.Color != nil {
+			s.flashLED(color(s.rgbLed.On), flashDuration)
+		} else {
+			s.led.Play(FlashAnimation(s.rgbLed.On, flashDuration))
+		}
+	case CueWarn:
+		s.blinkLED(color(s.rgbLed.Amber), warnBlinkCount)
+	case CueAlert:
+		s.blinkLED(color(s.rgbLed.Red), alertBlinkCount)
+	case CueUnlocked:
+		s.blinkLED(color(s.rgbLed.Green), unlockedBlinks)
+	}
+}
+
+// feedback asks the LED for a cue
+func (s *Service) feedback(cue Cue) {
+	s.bus.Publish(Feedback{Cue: cue})
+}
+
 func (s *Service) flashLED(setColor func() error, duration time.Duration) {
-	setColor()
-	time.AfterFunc(duration, func() {
-		s.rgbLed.Off()
-	})
+	switch s.config.Feedback {
+	case FeedbackSilent:
+		s.led.Off()
+		return
+	case FeedbackShort:
+		duration = min(duration, shortFlashDuration)
+	}
+	s.led.Play(FlashAnimation(setColor, duration))
+}
+
+func (s *Service) blinkLED(setColor func() error, count int) {
+	if s.config.Feedback == FeedbackSilent {
+		s.led.Off()
+		return
+	}
+	s.led.Play(BlinkAnimation(setColor, count, warnBlinkInterval))
+}
+
+// denyRevoked rejects a card on the denylist, also in learn mode
+func (s *Service) denyRevoked(uid string) {
+	s.logger.Warn("Revoked UID presented", "uid", uid)
+	s.feedback(CueAlert)
+	s.publishEvent(EventRevoked, map[string]any{"uid": uid})
 }
 
 func (s *Service) handleTagEvent(event hal.TagEvent) {
 	switch event.Type {
 	case hal.TagArrival:
-		uid := strings.ToUpper(hex.EncodeToString(event.Tag.ID))
+		uid := tagUID(event.Tag)
 		s.logger.Debug("Tag event: arrival", "uid", uid)
+		s.currentProto = event.Tag.RFProtocol
 		s.handleTagDetection(uid)
 
 	case hal.TagDeparture:
@@ -208,50 +1173,152 @@ func (s *Service) handleTagEvent(event hal.TagEvent) {
 	}
 }
 
+// tagUID returns the UID of a tag in upper-case hex
+func tagUID(tag *hal.Tag) string {
+	return strings.ToUpper(hex.EncodeToString(tag.ID))
+}
 
 func (s *Service) handleTagDetection(uid string) {
 	// Check if this is a NEW card arrival
 	s.logger.Debug("handleTagDetection", "detected_uid", uid, "current_uid", s.currentCardUID, "is_new", s.currentCardUID != uid)
+	if s.departing && s.currentCardUID != uid {
+		s.finishDeparture()
+	}
 	if s.currentCardUID != uid {
 		// Different card - this is a new arrival
-		s.logger.Info("Tag arrived", "uid", uid)
-		s.currentCardUID = uid
-		s.lastSeenTime = time.Now()
-		s.emptyPollCount = 0
-		s.handleTagArrival(uid) // Trigger actual arrival logic
+		s.currentTech = identify(s, s.card(uid), func(c presentCard) TagType {
+			return DetectTagType(c.proto, c.uid, c.mem, c.apdu())
+		})
+		if s.currentTech == "" {
+			s.currentTech = TagUnknown
+		}
+		s.logger.Info("Tag arrived", "uid", uid, "tech", s.currentTech)
+		s.arrive(uid)
 	} else {
 		// Same card still present - just update tracking
-		s.lastSeenTime = time.Now()
+		if s.departing {
+			s.logger.Debug("Tag returned within debounce window", "uid", uid)
+			s.departing = false
+		}
+		s.lastSeenTime = s.clock.Now()
 		s.emptyPollCount = 0
 		s.logger.Debug("Tag still present", "uid", uid)
 	}
 }
 
+// arrive starts a new presence of the card and looks it up
+func (s *Service) arrive(uid string) {
+	s.currentCardUID = uid
+	s.granted = false
+	s.arrivalTime = s.clock.Now()
+	s.lastSeenTime = s.arrivalTime
+	s.emptyPollCount = 0
+	s.bus.Publish(TagArrived{UID: uid, Protocol: s.currentProto, Tech: s.currentTech, Time: s.arrivalTime})
+}
+
+// handleTagDeparture ends the card's presence, or with a debounce window,
+// leaves it pending in case the card returns
 func (s *Service) handleTagDeparture() {
-	if s.currentCardUID != "" {
-		s.logger.Info("Tag departed", "uid", s.currentCardUID)
-		s.currentCardUID = ""
-		s.emptyPollCount = 0
+	if s.currentCardUID == "" || s.departing {
+		return
+	}
+	s.departedAt = s.clock.Now()
+	if s.config.DebounceWindow > 0 {
+		s.departing = true
+		return
+	}
+	s.finishDeparture()
+}
+
+func (s *Service) finishDeparture() {
+	dwell := s.departedAt.Sub(s.arrivalTime)
+	s.logger.Info("Tag departed", "uid", s.currentCardUID, "dwell", dwell)
+	if s.granted {
+		if err := s.publish(s.redis.ClearAuth); err != nil {
+			s.logger.Error("Failed to clear auth in Redis", "error", err)
+		}
+	}
+	s.publishEvent(EventDeparted, map[string]any{
+		"uid":   s.currentCardUID,
+		"dwell": dwell.Milliseconds(),
+	})
+	s.bus.Publish(TagDeparted{UID: s.currentCardUID, Dwell: dwell})
+	s.currentCardUID = ""
+	s.departing = false
+	s.granted = false
+	s.emptyPollCount = 0
+}
+
+// checkPresence completes departures once the debounce window passed,
+// makes a card that stayed present for RearmAfter arrive again, and
+// recognizes hold gestures
+func (s *Service) checkPresence() {
+	if s.currentCardUID != "" && !s.departing {
+		if action, ok := s.gestures.Held(s.clock.Now()); ok {
+			s.runGesture(action, s.currentCardUID)
+		}
+	}
+
+	switch {
+	case s.departing:
+		if s.clock.Now().Sub(s.departedAt) >= s.config.DebounceWindow {
+			s.finishDeparture()
+		}
+	case s.currentCardUID != "" && s.config.RearmAfter > 0 && s.clock.Now().Sub(s.arrivalTime) >= s.config.RearmAfter:
+		s.logger.Info("Tag still present, arriving again", "uid", s.currentCardUID)
+		s.arrive(s.currentCardUID)
 	}
 }
 
-func (s *Service) handleTagArrival(uid string) {
-	// Set LED to amber during lookup
-	s.rgbLed.Amber()
+func (s *Service) handleTagArrival(tag TagArrived) {
+	uid := tag.UID
+	tap := s.tapContext(tag)
+
+	if IsRandomUID(uid) && s.config.RandomUIDs != RandomUIDAllow {
+		s.handleRandomUID(tap)
+		return
+	}
+
+	if s.clones.Contains(uid) && s.suspectClone(uid, "range", s.config.CloneAction) {
+		return
+	}
+	if s.macMismatch(uid) && s.suspectClone(uid, "mac", CloneDeny) {
+		return
+	}
+
+	if s.auth.IsOverride(uid) && !s.auth.IsRevoked(uid) {
+		s.grantOverride(uid)
+		return
+	}
 
 	if s.masterLearningMode {
 		s.learnMasterUID(uid)
 		return
 	}
 
+	// Gestures see taps during a lockout or cooldown, and take the tap
+	// completing them
+	if !s.auth.IsRevoked(uid) {
+		if action, ok := s.gestures.Tap(s.auth.Role(uid), tag.Time); ok {
+			s.runGesture(action, uid)
+			return
+		}
+	}
+
+	if s.lockedOut(uid) || s.coolingDown(uid) {
+		return
+	}
+
+	if s.auth.IsRevoked(uid) {
+		s.denyRevoked(uid)
+		return
+	}
+
 	if !s.learnMode {
 		if s.auth.IsMaster(uid) {
-			s.enterLearnMode()
-		} else if s.auth.IsAuthorized(uid) {
-			s.grantAccess(uid)
+			s.enterLearnMode(uid)
 		} else {
-			s.logger.Info("Unauthorized UID", "uid", uid)
-			s.flashLED(s.rgbLed.Red, flashDuration)
+			s.authorize(tap)
 		}
 	} else {
 		if s.auth.IsMaster(uid) {
@@ -262,10 +1329,265 @@ func (s *Service) handleTagArrival(uid string) {
 	}
 }
 
+// tapContext describes a tap to the policy, reading credentials from the
+// card on demand
+func (s *Service) tapContext(tag TagArrived) *TapContext {
+	// The policy reads from the authorize stage, off the event loop
+	c := s.card(tag.UID)
+	return &TapContext{
+		UID:          tag.UID,
+		Protocol:     tag.Protocol,
+		Tech:         tag.Tech,
+		Time:         tag.Time,
+		VehicleState: s.vehicle.State(),
+		RandomUID:    IsRandomUID(tag.UID),
+		token:        func() *AccessToken { return identify(s, c, s.readAccessToken) },
+	}
+}
+
+// authorize acts on the policy's decision on a tap. Unknown cards complete
+// a pending enrollment.
+func (s *Service) authorize(tap *TapContext) {
+	uid := tap.UID
+	d, err := runStage(s.ctx, StageAuthorize, s.config.StageTimeouts.Authorize, func(context.Context) (Decision, error) {
+		return s.policy.Decide(tap), nil
+	})
+	if err != nil {
+		s.logger.Warn("Access denied", "uid", uid, "reason", EventTimedOut.String(), "error", err)
+		s.diag.RecordError(err)
+		s.feedback(CueDenied)
+		s.publishEvent(EventTimedOut, map[string]any{"uid": uid, "stage": string(StageAuthorize)})
+		return
+	}
+	if d.Action == ActionGrant {
+		name, g := s.cardGroup(uid)
+		switch {
+		case g == nil:
+			s.grantAccess(uid, d.Fields)
+		case g.Action == GroupDeny:
+			s.logger.Info("Access denied", "uid", uid, "reason", EventGroupDenied.String(), "group", name)
+			s.feedback(CueDenied)
+			s.publishEvent(EventGroupDenied, map[string]any{"uid": uid, "group": name})
+		default:
+			s.grantAccess(uid, g.grantFields(name, d.Fields))
+		}
+		return
+	}
+
+	d.Event = denialEvent(d)
+	if d.Event == EventUnauthorized && s.enrollment != nil {
+		s.completeEnrollment(uid)
+		return
+	}
+
+	s.logger.Info("Access denied", "uid", uid, "reason", d.Event.String())
+	s.feedback(CueDenied)
+	fields := map[string]any{"uid": uid}
+	for k, v := range d.Fields {
+		fields[k] = v
+	}
+	s.publishEvent(d.Event, fields)
+	if d.Event == EventUnauthorized {
+		s.countFailedTap()
+	}
+}
+
+// cardGroup returns the group of a card and its configuration, nil if the
+// card is in no configured group
+func (s *Service) cardGroup(uid string) (string, *Group) {
+	name := s.auth.Group(uid)
+	g, ok := s.config.Groups[name]
+	if name == "" || !ok {
+		return name, nil
+	}
+	return name, &g
+}
+
+// grantFeedback returns the LED feedback for a grant, set by the card's group
+func (s *Service) grantFeedback(uid string) Feedback {
+	if _, g := s.cardGroup(uid); g != nil {
+		return g.feedback()
+	}
+	return Feedback{Cue: CueGranted}
+}
+
+// resetGestures starts recognizing the configured gestures afresh
+func (s *Service) resetGestures() {
+	gestures := s.config.Gestures
+	if s.config.HibernateTaps > 0 {
+		gestures = append(gestures[:len(gestures):len(gestures)], Gesture{
+			Action: GestureHibernate,
+			Role:   RoleMaster,
+			Taps:   s.config.HibernateTaps,
+			Within: Duration(s.config.HibernateWindow),
+		})
+	}
+	s.gestures = NewGestureRecognizer(gestures)
+}
+
+// runGesture performs the action of a recognized gesture, leaving learning
+// mode the taps may have entered
+func (s *Service) runGesture(action, uid string) {
+	if s.learnMode {
+		s.exitLearnMode()
+	}
+	s.logger.Info("Gesture recognized", "action", action, "uid", uid)
+	s.feedback(CueLock)
+
+	if action != GestureHibernate {
+		s.publishEvent(EventGesture, map[string]any{"uid": uid, "action": action})
+		return
+	}
+	if err := s.redis.RequestHibernate(); err != nil {
+		s.logger.Error("Failed to request hibernation via Redis", "error", err)
+		return
+	}
+	s.publishEvent(EventHibernate, map[string]any{"uid": uid})
+}
+
+// lockedOut ignores taps during a lockout, except for the master card
+func (s *Service) lockedOut(uid string) bool {
+	if s.lockedUntil.IsZero() || s.auth.IsMaster(uid) {
+		return false
+	}
+	if s.clock.Now().After(s.lockedUntil) {
+		s.lockedUntil = time.Time{}
+		return false
+	}
+	s.logger.Info("Tap ignored during lockout", "uid", uid, "until", s.lockedUntil)
+	s.feedback(CueWarn)
+	return true
+}
+
+// coolingDown ignores taps right after a grant, which riders tend to
+// repeat out of habit, except for the master card
+func (s *Service) coolingDown(uid string) bool {
+	if s.cooldownUntil.IsZero() || s.auth.IsMaster(uid) {
+		return false
+	}
+	if s.clock.Now().After(s.cooldownUntil) {
+		s.cooldownUntil = time.Time{}
+		return false
+	}
+	s.logger.Info("Tap ignored during grant cooldown", "uid", uid)
+	s.feedback(CueUnlocked)
+	return true
+}
+
+// countFailedTap locks the reader out once there were too many unknown taps
+// in a row
+func (s *Service) countFailedTap() {
+	s.failedTaps++
+	if s.config.LockoutAttempts == 0 || s.failedTaps < s.config.LockoutAttempts {
+		return
+	}
+	s.lockedUntil = s.clock.Now().Add(s.config.LockoutDuration)
+	s.logger.Warn("Too many unknown taps, locking out", "attempts", s.failedTaps, "until", s.lockedUntil)
+	s.publishEvent(EventLockedOut, map[string]any{
+		"attempts": s.failedTaps,
+		"until":    s.lockedUntil.Unix(),
+	})
+	s.failedTaps = 0
+}
+
+// suspectClone warns about a card from a clone range or not matching its
+// enrollment, denies it if the action says so and reports whether it did
+func (s *Service) suspectClone(uid, reason, action string) bool {
+	deny := action == CloneDeny
+	s.logger.Warn("Suspected clone presented", "uid", uid, "reason", reason, "denied", deny)
+	s.publishEvent(EventCloneSuspected, map[string]any{
+		"uid":    uid,
+		"reason": reason,
+		"denied": deny,
+	})
+
+	if deny {
+		s.feedback(CueAlert)
+	}
+	return deny
+}
+
+// macMismatch reports whether a card enrolled with a CardMAC does not
+// carry it. Cards that cannot be read are treated as not carrying it.
+func (s *Service) macMismatch(uid string) bool {
+	if s.config.CardMACPage == 0 || !s.auth.HasMAC(uid) {
+		return false
+	}
+	mac, err := CardMAC(s.se, canonicalUID(uid))
+	if err != nil {
+		s.logger.Error("Failed to compute card MAC", "uid", uid, "error", err)
+		return false
+	}
+	ok := identify(s, s.card(uid), func(c presentCard) bool {
+		ok, err := VerifyCardMAC(c.mem, s.config.CardMACPage, mac)
+		if err != nil {
+			s.logger.Warn("Failed to read card MAC", "uid", uid, "error", err)
+		}
+		return ok
+	})
+	return !ok
+}
+
+// writeCardMAC writes the CardMAC to a Type 2 Tag just enrolled
+func (s *Service) writeCardMAC(uid string) {
+	if s.config.CardMACPage == 0 || s.config.DryRun || s.currentProto != hal.RFProtocolT2T || uid != s.currentCardUID {
+		return
+	}
+	mac, err := CardMAC(s.se, canonicalUID(uid))
+	if err != nil {
+		s.logger.Warn("Failed to write card MAC, card is identified by its UID only", "uid", uid, "error", err)
+		return
+	}
+	// Not written if the card does not answer in time
+	written := identify(s, s.card(uid), func(c presentCard) bool {
+		err := WriteCardMAC(c.mem, s.config.CardMACPage, mac)
+		if err != nil {
+			s.logger.Warn("Failed to write card MAC, card is identified by its UID only", "uid", uid, "error", err)
+		}
+		return err == nil
+	})
+	if !written {
+		return
+	}
+	if err := s.auth.SetMAC(uid); err != nil {
+		s.logger.Warn("Failed to write card MAC, card is identified by its UID only", "uid", uid, "error", err)
+		return
+	}
+	s.logger.Info("Card MAC written", "uid", uid, "page", s.config.CardMACPage)
+}
+
+// handleRandomUID deals with a tag whose UID changes on every tap, which
+// can neither be enrolled nor looked up
+func (s *Service) handleRandomUID(tap *TapContext) {
+	uid := tap.UID
+	if s.masterLearningMode || s.learnMode {
+		s.logger.Info("Random UID cannot be enrolled", "uid", uid)
+		s.feedback(CueWarn)
+		return
+	}
+
+	if s.config.RandomUIDs == RandomUIDToken {
+		if d := s.randomPolicy.Decide(tap); d.Action == ActionGrant {
+			s.grantAccess(uid, d.Fields)
+			return
+		}
+	}
+
+	s.logger.Debug("Ignoring random UID", "uid", uid)
+	s.feedback(CueOff)
+}
+
 func (s *Service) enterMasterLearningMode() {
 	s.logger.Info("Entering master learning mode - present master card")
 	s.masterLearningMode = true
-	s.rgbLed.StartBlink(blinkInterval)
+	s.led.Play(BlinkAnimation(s.rgbLed.On, 0, blinkInterval))
+	s.publishLearnState(0, nil)
+}
+
+func (s *Service) exitMasterLearningMode() {
+	s.masterLearningMode = false
+	s.led.StopLoop()
+	s.publishLearnState(0, nil)
 }
 
 func (s *Service) learnMasterUID(uid string) {
@@ -276,53 +1598,281 @@ func (s *Service) learnMasterUID(uid string) {
 		return
 	}
 
-	s.masterLearningMode = false
-	s.rgbLed.StopBlink()
-	s.rgbLed.Flash(flashDuration)
+	s.exitMasterLearningMode()
+	s.feedback(CueLearned)
 
 	s.logger.Info("Master UID learned successfully", "uid", uid)
 }
 
-func (s *Service) enterLearnMode() {
+// enterLearnMode starts a learning session, by the master card or
+// remotely if master is empty
+func (s *Service) enterLearnMode(master string) {
 	s.logger.Info("Entering learn mode - present cards to authorize")
 	s.learnMode = true
-	s.newUIDs = nil
+	s.learnSession = &LearnSession{Since: s.clock.Now(), Master: master}
+	s.saveLearnSession()
 	s.linearLed.LedLinearOn(Led3)
 	s.linearLed.LedLinearOn(Led7)
+	s.publishLearnState(0, s.learnSession.fields(time.Time{}, false))
 }
 
 func (s *Service) exitLearnMode() {
+	session := s.learnSession
 	s.logger.Info("Exiting learn mode",
-		"newUIDs", len(s.newUIDs),
+		"newUIDs", len(session.Added),
 		"totalAuthorized", s.auth.GetAuthorizedCount())
 
 	s.learnMode = false
+	s.learnSession = nil
+	// Cleared first: a session ended is never resumed, even if the crash
+	// came before its summary went out
+	s.clearLearnSession()
 	s.linearLed.LedLinearOff(Led3)
 	s.linearLed.LedLinearOff(Led7)
-	s.newUIDs = nil
+	s.publishLearnState(len(session.Added), session.fields(s.clock.Now(), false))
+}
+
+// addToLearnSession records a card enrolled in the current session
+func (s *Service) addToLearnSession(uid string) {
+	s.learnSession.Added = append(s.learnSession.Added, uid)
+	s.saveLearnSession()
+	s.publishLearnState(len(s.learnSession.Added), s.learnSession.fields(time.Time{}, false))
+}
+
+// publishLearnState tells the dashboard which learn mode is active and how
+// many cards were added in it, with the summary of the current or last
+// learning session if it changed
+func (s *Service) publishLearnState(added int, session map[string]any) {
+	mode := LearnModeOff
+	switch {
+	case s.masterLearningMode:
+		mode = LearnModeMaster
+	case s.learnMode:
+		mode = LearnModeCards
+	}
+	if err := s.redis.PublishLearnState(mode, added, session); err != nil {
+		s.logger.Error("Failed to publish learn state to Redis", "error", err)
+	}
+	s.bus.Publish(LearnStateChanged{Mode: mode, Added: added})
 }
 
 func (s *Service) learnUID(uid string) {
-	added, err := s.auth.AddAuthorized(uid)
+	var added bool
+	var err error
+	switch {
+	case s.config.LearnOneTime:
+		added, err = s.auth.AddOneTime(uid)
+	case s.config.GuestUses > 0:
+		added, err = s.auth.AddGuest(uid, s.config.GuestUses)
+	default:
+		added, err = s.auth.AddAuthorized(uid)
+	}
 	if err != nil {
 		s.logger.Error("Failed to add authorized UID", "uid", uid, "error", err)
 		return
 	}
 
 	if added {
-		s.newUIDs = append(s.newUIDs, uid)
-		s.rgbLed.Flash(flashDuration)
-		s.logger.Info("UID authorized", "uid", uid)
+		s.writeCardMAC(uid)
+		s.feedback(CueLearned)
+		s.addToLearnSession(uid)
+		s.logger.Info("UID authorized", "uid", uid, "guestUses", s.config.GuestUses)
 	} else {
 		s.logger.Info("UID already authorized", "uid", uid)
 	}
 }
 
-func (s *Service) grantAccess(uid string) {
+// readAccessToken returns a valid NDEF access token from the presented card, or nil
+func (s *Service) readAccessToken(c presentCard) *AccessToken {
+	if s.tokenKey == nil || c.mem == nil {
+		return nil
+	}
+
+	uid := c.uid
+	msg, err := ReadNDEF(c.mem)
+	if err != nil {
+		s.logger.Debug("No NDEF message read", "uid", uid, "error", err)
+		return nil
+	}
+	records, err := ParseNDEF(msg)
+	if err != nil {
+		s.logger.Debug("Invalid NDEF message", "uid", uid, "error", err)
+		return nil
+	}
+	data, ok := FindAccessToken(records)
+	if !ok {
+		return nil
+	}
+
+	token, err := ParseAccessToken(data, s.tokenKey)
+	if err != nil {
+		s.logger.Warn("Rejected access token", "uid", uid, "error", err)
+		return nil
+	}
+	id, _ := hex.DecodeString(uid)
+	if err := token.Validate(id, s.clock.Now()); err != nil {
+		s.logger.Info("Rejected access token", "uid", uid, "error", err)
+		return nil
+	}
+	return token
+}
+
+func (s *Service) grantAccess(uid string, fields map[string]any) {
+	// Diagnostics mode is not an unlock and leaves the lock state alone
+	if fields["type"] == serviceType {
+		s.publishGrant(uid, fields)
+		return
+	}
+
+	switch s.toggle.Tap(s.clock.Now(), s.config.ToggleLock) {
+	case ToggleLock:
+		s.requestLock(uid)
+		return
+	case ToggleNone:
+		state := s.toggle.State(s.clock.Now())
+		s.logger.Info("Tap ignored, scooter not locked", "uid", uid, "state", state.String())
+		if state == StateLocking {
+			s.feedback(CueWarn)
+		} else {
+			s.feedback(CueUnlocked)
+		}
+		return
+	}
+
+	if s.config.RequireParked && !s.vehicle.IsParked() {
+		s.logger.Warn("Access withheld, scooter not parked", "uid", uid, "state", s.vehicle.State())
+		s.toggle.Failed()
+		s.feedback(CueWarn)
+		s.publishEvent(EventNotParked, map[string]any{"uid": uid})
+		return
+	}
+
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	guest, oneTime := s.auth.IsGuest(uid), s.auth.IsOneTime(uid)
+	if guest {
+		fields["remaining"] = s.auth.GuestUses(uid) - 1
+	} else if oneTime {
+		fields["remaining"] = 0
+	}
+
+	// A use is only taken once the grant is out, so a failed publish leaves
+	// the card for the next tap
+	if !s.publishGrant(uid, fields) {
+		return
+	}
+	if guest {
+		remaining, err := s.auth.ConsumeGuestUse(uid)
+		if err != nil {
+			s.logger.Error("Failed to update guest uses", "uid", uid, "error", err)
+		} else if remaining == 0 {
+			s.logger.Info("Guest card exhausted and revoked", "uid", uid)
+		}
+	} else if oneTime {
+		if err := s.auth.ConsumeOneTime(uid); err != nil {
+			s.logger.Error("Failed to consume one-time card", "uid", uid, "error", err)
+		}
+	}
+}
+
+// grantOverride grants an emergency override card regardless of lockout,
+// cooldown, lock state and parking, and raises an alert
+func (s *Service) grantOverride(uid string) {
+	s.logger.Error("Emergency override card used", "uid", uid,
+		"lockedOut", !s.lockedUntil.IsZero(), "state", s.vehicle.State())
+	s.publishEvent(EventOverride, map[string]any{
+		"uid":   uid,
+		"state": s.vehicle.State(),
+	})
+	s.publishGrant(uid, map[string]any{"override": true})
+}
+
+// publishGrant publishes a grant the checks were passed for and reports
+// whether it was published
+func (s *Service) publishGrant(uid string, fields map[string]any) bool {
+	// A grant that is not published is replayed as an event for the audit
+	// trail rather than as an auth, which would unlock the scooter later
+	if uid == s.currentCardUID && s.currentTech != "" {
+		if fields == nil {
+			fields = map[string]any{}
+		}
+		fields["tech"] = s.currentTech
+	}
+	audit := map[string]any{"uid": uid}
+	for k, v := range fields {
+		audit[k] = v
+	}
+	id := s.addToOutbox(EventGranted, audit)
+	grant := AccessGranted{UID: uid, Fields: fields, Arrived: s.arrivalTime, Decided: s.clock.Now()}
+	s.bus.Publish(grant)
+
 	s.logger.Info("Access granted", "uid", uid)
-	s.flashLED(s.rgbLed.Green, flashDuration)
+	s.bus.Publish(s.grantFeedback(uid))
 
-	if err := s.redis.PublishAuth(uid); err != nil {
+	err := s.publish(func() error { return s.redis.PublishAuth(uid, fields) })
+	s.outboxDone(id, err == nil)
+	s.bus.Publish(AuthPublished{AccessGranted: grant, Published: s.clock.Now(), Err: err})
+	if err != nil {
 		s.logger.Error("Failed to publish auth to Redis", "error", err)
+		s.toggle.Failed()
+		return false
+	}
+	s.granted = true
+	s.failedTaps = 0
+	if s.config.GrantCooldown > 0 {
+		s.cooldownUntil = s.clock.Now().Add(s.config.GrantCooldown)
+	}
+	return true
+}
+
+// recordLatency times a grant from the tag's arrival, warning if it took
+// longer than the budget
+func (s *Service) recordLatency(a AuthPublished) {
+	lookup := a.Decided.Sub(a.Arrived)
+	publish := a.Published.Sub(a.Decided)
+	total := a.Published.Sub(a.Arrived)
+	s.latency.Lookup.Observe(lookup)
+	s.latency.Publish.Observe(publish)
+	s.latency.Total.Observe(total)
+
+	if s.config.LatencyBudget > 0 && total > s.config.LatencyBudget {
+		s.logger.Warn("Grant exceeded latency budget",
+			"uid", a.UID,
+			"total", total,
+			"lookup", lookup,
+			"publish", publish,
+			"budget", s.config.LatencyBudget)
+	}
+}
+
+// followVehicle updates the lock state from the vehicle state
+func (s *Service) followVehicle(state string) {
+	before := s.toggle.State(s.clock.Now())
+	s.toggle.Vehicle(vehicleUnlocked(state), s.clock.Now())
+	if after := s.toggle.State(s.clock.Now()); after != before {
+		s.logger.Info("Lock state changed", "from", before.String(), "to", after.String(), "vehicle", state)
+	}
+}
+
+func (s *Service) requestLock(uid string) {
+	// Without a vehicle service publishing its state there is nothing to
+	// tell riding from parked, so the lock is requested as before
+	if s.vehicle.Published() && !s.vehicle.IsParked() {
+		s.logger.Warn("Lock withheld, scooter not parked", "uid", uid, "state", s.vehicle.State())
+		s.toggle.Failed()
+		s.feedback(CueWarn)
+		s.publishEvent(EventNotParked, map[string]any{"uid": uid})
+		return
+	}
+
+	s.logger.Info("Lock requested", "uid", uid)
+	s.feedback(CueLock)
+
+	if err := s.redis.RequestLock(); err != nil {
+		s.logger.Error("Failed to request lock via Redis", "error", err)
+		s.toggle.Failed()
+		return
 	}
+	s.publishEvent(EventLockRequested, map[string]any{"uid": uid})
 }
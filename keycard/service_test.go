@@ -0,0 +1,194 @@
+package keycard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// tapAllocBudget is the number of allocations a granted tap may make from
+// the tag's arrival until its auth is published, Redis client included.
+// Raise it only for features that are worth the latency on the scooter.
+const tapAllocBudget = 200
+
+// raceEnabled is set when testing with the race detector, which allocates
+// on its own
+var raceEnabled bool
+
+// newTapService wires a service for taps as NewService does, without the
+// NFC reader and with n authorized cards, two of which are returned
+func newTapService(tb testing.TB, n int) (*Service, [2]string) {
+	dir := tb.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	config := &Config{
+		DataDir:     dir,
+		RandomUIDs:  RandomUIDToken,
+		CloneAction: CloneWarn,
+		PollPeriod:  defaultPollPeriod,
+		Feedback:    FeedbackNormal,
+	}
+	config.StageTimeouts = config.StageTimeouts.withDefaults()
+	config.ShutdownTimeout = defaultShutdownTimeout
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tb.Cleanup(cancel)
+	s := &Service{
+		ctx:       ctx,
+		cancel:    cancel,
+		config:    config,
+		logger:    logger,
+		clock:     SystemClock,
+		bus:       NewBus(),
+		diag:      NewDiagnostics(),
+		latency:   NewLatencyMetrics(),
+		linearLed: NewLEDController(logger),
+		rgbLed:    nopLED{},
+		quit:      make(chan struct{}),
+		loopDone:  make(chan struct{}),
+		crashes:   make(chan *crash, 8),
+	}
+	s.led = NewAnimator(s.rgbLed, s.clock)
+	tb.Cleanup(func() { s.led.Close() })
+	var err error
+	if s.auth, err = NewAuthManager(dir); err != nil {
+		tb.Fatalf("NewAuthManager failed: %v", err)
+	}
+	uids := make([]string, n)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("%08X", 0x10000000+i)
+	}
+	if err := s.auth.ApplySync(uids, nil); err != nil {
+		tb.Fatalf("ApplySync failed: %v", err)
+	}
+	s.script = LoadPolicyScript(dir, logger)
+	s.policy = NewScriptPolicy(DefaultPolicy(s.auth), s.script)
+	s.randomPolicy = NewScriptPolicy(randomUIDPolicy(s.auth), s.script)
+	if s.se, err = OpenSecureElement("", dir); err != nil {
+		tb.Fatalf("OpenSecureElement failed: %v", err)
+	}
+	if s.clones, err = LoadCloneRanges(dir); err != nil {
+		tb.Fatalf("LoadCloneRanges failed: %v", err)
+	}
+	if s.outbox, err = NewOutbox(dir); err != nil {
+		tb.Fatalf("NewOutbox failed: %v", err)
+	}
+	if s.redis, err = NewRedisClient(newDiscardingRedis(tb).addr, logger); err != nil {
+		tb.Fatalf("NewRedisClient failed: %v", err)
+	}
+	tb.Cleanup(func() { s.redis.Close() })
+	s.vehicle = NewVehicleMonitor(s.redis, logger)
+	s.toggle = NewToggle(false)
+	s.resetGestures()
+	s.subscribe()
+
+	s.currentProto = rfProtocolMifare
+	return s, [2]string{uids[0], uids[n-1]}
+}
+
+// nopLED is an RGB LED that is not there
+type nopLED struct{}
+
+func (nopLED) On() error    { return nil }
+func (nopLED) Off() error   { return nil }
+func (nopLED) Close() error { return nil }
+func (nopLED) Red() error   { return nil }
+func (nopLED) Green() error { return nil }
+func (nopLED) Amber() error { return nil }
+
+// tap presents one of the cards, alternating so each tap is a new arrival,
+// and checks it was granted
+func tap(tb testing.TB, s *Service, uids [2]string, i int) {
+	s.handleTagDetection(uids[i%2])
+	if !s.granted {
+		tb.Fatalf("expected tap %d to be granted", i)
+	}
+	// Back to locked, as if the scooter had been locked in between
+	s.toggle.Failed()
+}
+
+func BenchmarkTap(b *testing.B) {
+	for _, n := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprintf("cards=%d", n), func(b *testing.B) {
+			s, uids := newTapService(b, n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tap(b, s, uids, i)
+			}
+		})
+	}
+}
+
+func TestTap_AllocationBudget(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not counted with the race detector")
+	}
+	sizes := []int{10, 100000}
+	if testing.Short() {
+		sizes = sizes[:1]
+	}
+	for _, n := range sizes {
+		s, uids := newTapService(t, n)
+		i := 0
+		allocs := testing.AllocsPerRun(50, func() {
+			tap(t, s, uids, i)
+			i++
+		})
+		t.Logf("%d cards: %.0f allocations per tap", n, allocs)
+		if allocs > tapAllocBudget {
+			t.Errorf("%d cards: tap made %.0f allocations, budget is %d", n, allocs, tapAllocBudget)
+		}
+	}
+}
+
+func TestTap_LockWithoutVehicleState(t *testing.T) {
+	s, uids := newTapService(t, 2)
+	s.config.ToggleLock = true
+
+	// Nothing published by the vehicle service: the lock is requested
+	s.toggle = NewToggle(true)
+	s.handleTagDetection(uids[0])
+	if state := s.toggle.State(s.clock.Now()); state != StateLocking {
+		t.Errorf("expected a lock request without vehicle state, got %v", state)
+	}
+
+	// Riding: the lock is withheld
+	s.vehicle.state = VehicleStateReadyToDrive
+	s.toggle = NewToggle(true)
+	s.handleTagDetection(uids[1])
+	if state := s.toggle.State(s.clock.Now()); state != StateUnlocked {
+		t.Errorf("expected the lock to be withheld while riding, got %v", state)
+	}
+}
+
+func TestTap_UsesTakenOnPublish(t *testing.T) {
+	const guest, oneTime = "04AABBCCDDEEFF", "04112233445566"
+	s, _ := newTapService(t, 2)
+	if _, err := s.auth.AddCard(Card{UID: guest, Role: RoleGuest, Uses: 3}); err != nil {
+		t.Fatalf("AddCard failed: %v", err)
+	}
+	if _, err := s.auth.AddCard(Card{UID: oneTime, Role: RoleOneTime}); err != nil {
+		t.Fatalf("AddCard failed: %v", err)
+	}
+
+	tap(t, s, [2]string{guest, guest}, 0)
+	if uses := s.auth.GuestUses(guest); uses != 2 {
+		t.Fatalf("expected a published grant to take a use, %d left", uses)
+	}
+
+	// Nothing can be published once Redis is gone
+	s.redis.Close()
+	s.handleTagDetection(oneTime)
+	s.handleTagDetection(guest)
+	if s.granted {
+		t.Fatal("expected the grants to fail")
+	}
+	if uses := s.auth.GuestUses(guest); uses != 2 {
+		t.Errorf("expected a failed grant to leave the guest uses, %d left", uses)
+	}
+	if !s.auth.IsOneTime(oneTime) {
+		t.Error("expected a failed grant to leave the one-time card unused")
+	}
+}
@@ -0,0 +1,378 @@
+package keycard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	ipc "github.com/librescoot/redis-ipc"
+)
+
+const (
+	settingsFileName = "settings.json"
+	settingsHashKey  = "keycard:settings"
+	maxPollPeriod    = 2750 // ms, limit of the PN7150
+
+	// SettingsVersion is the settings schema written by this service. Settings
+	// of the same major version are accepted, keeping keys added by newer minor
+	// versions; older major versions are migrated, newer ones rejected.
+	SettingsVersion     = "2.0"
+	settingsSchemaMajor = 2
+)
+
+var ErrSettingsVersion = errors.New("incompatible settings version")
+
+// settingsMigrations upgrade raw settings from the major version they are
+// indexed by to the next one. Settings without a version are version 1.
+var settingsMigrations = map[int]func(raw map[string]json.RawMessage) error{
+	1: migrateSettingsV1,
+}
+
+// migrateSettingsV1 replaces lockout_seconds by lockout_duration, which takes
+// a duration like the command line
+func migrateSettingsV1(raw map[string]json.RawMessage) error {
+	secs, ok := raw["lockout_seconds"]
+	if !ok {
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(secs, &n); err != nil {
+		return fmt.Errorf("lockout_seconds: %w", err)
+	}
+	raw["lockout_duration"], _ = json.Marshal((time.Duration(n) * time.Second).String())
+	delete(raw, "lockout_seconds")
+	return nil
+}
+
+// Settings are options that can be provisioned at runtime and persist in the
+// data directory, overriding the command line. Unset fields keep the
+// command line value.
+type Settings struct {
+	Version         string           `json:"version,omitempty"`
+	RequireParked   *bool            `json:"require_parked,omitempty"`
+	ToggleLock      *bool            `json:"toggle_lock,omitempty"`
+	GuestUses       *int             `json:"guest_uses,omitempty"`
+	PollPeriod      *uint            `json:"poll_period,omitempty"`
+	Feedback        *string          `json:"feedback,omitempty"`
+	LockoutAttempts *int             `json:"lockout_attempts,omitempty"`
+	LockoutDuration *Duration        `json:"lockout_duration,omitempty"`
+	Gestures        []Gesture        `json:"gestures,omitempty"`
+	Groups          map[string]Group `json:"groups,omitempty"`
+
+	// Extra holds keys unknown to this version, kept when the settings are saved
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// Duration is a time.Duration encoded like "90s" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// settingsKeys are the JSON keys known to this version
+var settingsKeys = func() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(Settings{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
+}()
+
+// Apply overrides the config with all fields set in s
+func (s *Settings) Apply(c *Config) {
+	if s.RequireParked != nil {
+		c.RequireParked = *s.RequireParked
+	}
+	if s.ToggleLock != nil {
+		c.ToggleLock = *s.ToggleLock
+	}
+	if s.GuestUses != nil {
+		c.GuestUses = *s.GuestUses
+	}
+	if s.PollPeriod != nil {
+		c.PollPeriod = *s.PollPeriod
+	}
+	if s.Feedback != nil {
+		c.Feedback = *s.Feedback
+	}
+	if s.LockoutAttempts != nil {
+		c.LockoutAttempts = *s.LockoutAttempts
+	}
+	if s.LockoutDuration != nil {
+		c.LockoutDuration = time.Duration(*s.LockoutDuration)
+	}
+	if s.Gestures != nil {
+		c.Gestures = s.Gestures
+	}
+	if s.Groups != nil {
+		c.Groups = s.Groups
+	}
+}
+
+// UnmarshalJSON migrates and validates settings of any supported version
+func (s *Settings) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	return s.decode(raw)
+}
+
+// MarshalJSON writes the settings with their version and any extra keys
+func (s Settings) MarshalJSON() ([]byte, error) {
+	type plain Settings
+	if s.Version == "" {
+		s.Version = SettingsVersion
+	}
+	data, err := json.Marshal(plain(s))
+	if err != nil || len(s.Extra) == 0 {
+		return data, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	for k, v := range s.Extra {
+		if !settingsKeys[k] {
+			raw[k] = v
+		}
+	}
+	return json.Marshal(raw)
+}
+
+func (s *Settings) decode(raw map[string]json.RawMessage) error {
+	version := "1"
+	if v, ok := raw["version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return fmt.Errorf("invalid settings version: %w", err)
+		}
+	}
+	major, err := settingsMajor(version)
+	if err != nil {
+		return err
+	}
+	if major > settingsSchemaMajor {
+		return fmt.Errorf("%w %s, this service supports %d.x", ErrSettingsVersion, version, settingsSchemaMajor)
+	}
+	for ; major < settingsSchemaMajor; major++ {
+		if err := settingsMigrations[major](raw); err != nil {
+			return fmt.Errorf("failed to migrate settings from version %d: %w", major, err)
+		}
+		version = SettingsVersion
+	}
+	raw["version"], _ = json.Marshal(version)
+
+	known := make(map[string]json.RawMessage)
+	var extra map[string]json.RawMessage
+	for k, v := range raw {
+		if settingsKeys[k] {
+			known[k] = v
+		} else {
+			if extra == nil {
+				extra = make(map[string]json.RawMessage)
+			}
+			extra[k] = v
+		}
+	}
+	data, err := json.Marshal(known)
+	if err != nil {
+		return err
+	}
+
+	type plain Settings
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*s = Settings(p)
+	s.Extra = extra
+	return s.validate()
+}
+
+// settingsMajor returns the major version of a "major.minor" version
+func settingsMajor(version string) (int, error) {
+	majorStr, minorStr, hasMinor := strings.Cut(version, ".")
+	major, err := strconv.Atoi(majorStr)
+	if err == nil && hasMinor {
+		_, err = strconv.Atoi(minorStr)
+	}
+	if err != nil || major < 1 {
+		return 0, fmt.Errorf("%w %q", ErrSettingsVersion, version)
+	}
+	return major, nil
+}
+
+func (s *Settings) validate() error {
+	switch {
+	case s.GuestUses != nil && *s.GuestUses < 0:
+		return fmt.Errorf("guest_uses must not be negative")
+	case s.PollPeriod != nil && (*s.PollPeriod == 0 || *s.PollPeriod > maxPollPeriod):
+		return fmt.Errorf("poll_period must be 1-%d", maxPollPeriod)
+	case s.LockoutAttempts != nil && *s.LockoutAttempts < 0:
+		return fmt.Errorf("lockout_attempts must not be negative")
+	case s.LockoutDuration != nil && *s.LockoutDuration <= 0:
+		return fmt.Errorf("lockout_duration must be positive")
+	}
+	for i := range s.Gestures {
+		if err := s.Gestures[i].validate(); err != nil {
+			return err
+		}
+	}
+	for name, g := range s.Groups {
+		if err := g.validate(name); err != nil {
+			return err
+		}
+	}
+	if s.Feedback != nil {
+		switch *s.Feedback {
+		case FeedbackNormal, FeedbackShort, FeedbackSilent:
+		default:
+			return fmt.Errorf("unknown feedback profile %q", *s.Feedback)
+		}
+	}
+	return nil
+}
+
+// ParseSettingsHash reads settings from the keycard:settings hash, whose
+// fields are named like the JSON keys with dashes. Values are taken as JSON
+// if they parse as such and as strings otherwise. Settings are rejected as
+// a whole if any field is invalid.
+func ParseSettingsHash(fields map[string]string) (*Settings, error) {
+	raw := make(map[string]json.RawMessage, len(fields))
+	for field, value := range fields {
+		key := strings.ReplaceAll(field, "-", "_")
+		if key != "version" && json.Valid([]byte(value)) {
+			raw[key] = json.RawMessage(value)
+		} else {
+			raw[key], _ = json.Marshal(value)
+		}
+	}
+
+	s := &Settings{}
+	if err := s.decode(raw); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func settingsFilePath(dataDir string) string {
+	return filepath.Join(dataDir, settingsFileName)
+}
+
+// LoadSettings reads the persisted settings, returning empty settings if none exist
+func LoadSettings(dataDir string) (*Settings, error) {
+	settings := &Settings{}
+
+	data, err := os.ReadFile(settingsFilePath(dataDir))
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	return settings, nil
+}
+
+// SaveSettings persists the settings to the data directory
+func SaveSettings(dataDir string, settings *Settings) error {
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(settingsFilePath(dataDir), append(data, '\n'), 0644)
+}
+
+// SettingsUpdate is the content of the keycard:settings hash, or why it was
+// rejected
+type SettingsUpdate struct {
+	Settings *Settings
+	Err      error
+}
+
+// SettingsWatcher delivers the keycard:settings hash whenever a field of it
+// is published
+type SettingsWatcher struct {
+	logger  *slog.Logger
+	watcher *ipc.HashWatcher
+	changes chan SettingsUpdate
+}
+
+func NewSettingsWatcher(r *RedisClient, logger *slog.Logger) *SettingsWatcher {
+	w := &SettingsWatcher{
+		logger:  logger,
+		watcher: r.client.NewHashWatcher(settingsHashKey),
+		changes: make(chan SettingsUpdate, 1),
+	}
+	w.watcher.OnAny(func(field, value string) error {
+		w.reload()
+		return nil
+	})
+	return w
+}
+
+// Changes delivers the latest settings; settings not picked up yet are
+// replaced by newer ones
+func (w *SettingsWatcher) Changes() <-chan SettingsUpdate {
+	return w.changes
+}
+
+// Start subscribes to changes and delivers the current settings
+func (w *SettingsWatcher) Start() error {
+	if err := w.watcher.Start(); err != nil {
+		return err
+	}
+	w.reload()
+	return nil
+}
+
+// Stop unsubscribes from changes
+func (w *SettingsWatcher) Stop() error {
+	return w.watcher.Stop()
+}
+
+func (w *SettingsWatcher) reload() {
+	fields, err := w.watcher.FetchAll()
+	if err != nil {
+		w.logger.Warn("Failed to read settings from Redis", "error", err)
+		return
+	}
+	if len(fields) == 0 {
+		return
+	}
+	settings, err := ParseSettingsHash(fields)
+
+	select {
+	case <-w.changes:
+	default:
+	}
+	w.changes <- SettingsUpdate{Settings: settings, Err: err}
+}
@@ -0,0 +1,112 @@
+package keycard
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettings_Versions(t *testing.T) {
+	// Unversioned settings are migrated
+	var s Settings
+	if err := json.Unmarshal([]byte(`{"require_parked": true, "lockout_seconds": 90}`), &s); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if s.Version != SettingsVersion || s.LockoutDuration == nil || time.Duration(*s.LockoutDuration) != 90*time.Second {
+		t.Errorf("expected migrated lockout duration, got %+v", s)
+	}
+	if s.Extra != nil {
+		t.Errorf("expected migrated key to be consumed, got %v", s.Extra)
+	}
+
+	// Newer minor versions keep their unknown keys when saved
+	dir := t.TempDir()
+	if err := json.Unmarshal([]byte(`{"version": "2.3", "feedback": "short", "haptics": {"level": 2}}`), &s); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if err := SaveSettings(dir, &s); err != nil {
+		t.Fatalf("SaveSettings failed: %v", err)
+	}
+	loaded, err := LoadSettings(dir)
+	if err != nil {
+		t.Fatalf("LoadSettings failed: %v", err)
+	}
+	var haptics struct{ Level int }
+	json.Unmarshal(loaded.Extra["haptics"], &haptics)
+	if loaded.Version != "2.3" || *loaded.Feedback != FeedbackShort || haptics.Level != 2 {
+		t.Errorf("expected settings to round-trip, got %+v", loaded)
+	}
+
+	// Newer major versions and invalid values are rejected
+	err = json.Unmarshal([]byte(`{"version": "3.0", "feedback": "short"}`), &s)
+	if !errors.Is(err, ErrSettingsVersion) {
+		t.Errorf("expected ErrSettingsVersion, got %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"version": "2.0", "poll_period": 5000}`), &s); err == nil {
+		t.Error("expected invalid poll period to be rejected")
+	}
+}
+
+func TestParseSettingsHash(t *testing.T) {
+	s, err := ParseSettingsHash(map[string]string{
+		"poll-period":      "250",
+		"feedback":         "silent",
+		"toggle-lock":      "true",
+		"lockout-duration": "2m",
+	})
+	if err != nil {
+		t.Fatalf("ParseSettingsHash failed: %v", err)
+	}
+
+	var c Config
+	s.Apply(&c)
+	if c.PollPeriod != 250 || c.Feedback != FeedbackSilent || !c.ToggleLock || c.LockoutDuration != 2*time.Minute {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	_, err = ParseSettingsHash(map[string]string{"version": "9", "feedback": "short"})
+	if !errors.Is(err, ErrSettingsVersion) || !strings.Contains(err.Error(), "2.x") {
+		t.Errorf("expected version error naming the supported version, got %v", err)
+	}
+	if _, err := ParseSettingsHash(map[string]string{"feedback": "loud"}); err == nil {
+		t.Error("expected unknown feedback profile to be rejected")
+	}
+}
+
+func TestGroup_Settings(t *testing.T) {
+	s, err := ParseSettingsHash(map[string]string{
+		"groups": `{"staff": {"fields": {"fleet": "staff"}, "feedback": "unlocked", "color": "blue"}, "test": {"action": "deny", "color": "#FF8000"}}`,
+	})
+	if err != nil {
+		t.Fatalf("ParseSettingsHash failed: %v", err)
+	}
+	staff, test := s.Groups["staff"], s.Groups["test"]
+	if f := staff.feedback(); f.Cue != CueUnlocked || f.Color == nil || *f.Color != ColorBlue {
+		t.Errorf("unexpected staff feedback %+v", f)
+	}
+	if f := test.feedback(); test.Action != GroupDeny || f.Cue != CueGranted || *f.Color != (RGB{255, 128, 0}) {
+		t.Errorf("unexpected test group %+v", test)
+	}
+	fields := staff.grantFields("staff", map[string]any{"remaining": 2})
+	if fields["fleet"] != "staff" || fields["group"] != "staff" || fields["remaining"] != 2 || fields["type"] != nil {
+		t.Errorf("unexpected grant fields %v", fields)
+	}
+	service := Group{Action: GroupService}
+	if service.grantFields("mechanics", nil)["type"] != serviceType {
+		t.Error("expected service group grants to have type service")
+	}
+
+	for _, invalid := range []string{
+		`{"staff": {"action": "open"}}`,
+		`{"staff": {"feedback": "purple"}}`,
+		`{"staff": {"color": "purple"}}`,
+		`{"staff": {"color": "#FF80"}}`,
+		`{"staff": {"fields": {"uid": "none"}}}`,
+	} {
+		if _, err := ParseSettingsHash(map[string]string{"groups": invalid}); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
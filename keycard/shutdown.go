@@ -0,0 +1,108 @@
+package keycard
+
+import (
+	"context"
+	"time"
+)
+
+const defaultShutdownTimeout = 5 * time.Second
+
+// Stop shuts the service down in order: commands are no longer accepted,
+// the event loop returns and stops discovery, publishes in flight and the
+// LED's current animation are given until the shutdown timeout to finish,
+// and only then are Redis and the reader closed. Safe to call more than
+// once and without Run.
+func (s *Service) Stop() {
+	s.stopOnce.Do(s.shutdown)
+}
+
+func (s *Service) shutdown() {
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+
+	if s.rpc != nil {
+		s.rpc.Stop()
+	}
+	if s.revQueue != nil {
+		s.revQueue.Stop()
+	}
+
+	close(s.quit)
+	if s.running.Load() && !closedBefore(ctx, s.loopDone) {
+		s.logger.Warn("Event loop did not stop in time")
+	}
+
+	inflight := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(inflight)
+	}()
+	if !closedBefore(ctx, inflight) {
+		s.logger.Warn("Publishes still in flight at shutdown, left to the outbox")
+	}
+	if s.led != nil && !s.led.Settle(ctx) {
+		s.logger.Warn("LED animation did not finish in time")
+	}
+
+	s.release()
+	s.logger.Info("Service stopped")
+}
+
+// abort releases what NewService opened before it failed
+func (s *Service) abort() {
+	if s.rpc != nil {
+		s.rpc.Stop()
+	}
+	if s.revQueue != nil {
+		s.revQueue.Stop()
+	}
+	if s.storeWatch != nil {
+		s.storeWatch.Close()
+	}
+	for _, l := range s.activated {
+		l.Close()
+	}
+	s.release()
+}
+
+// release closes the watchers, devices and connections and frees the
+// instance lock
+func (s *Service) release() {
+	s.cancel()
+	if s.vehicle != nil {
+		s.vehicle.Stop()
+	}
+	if s.settingsWatch != nil {
+		s.settingsWatch.Stop()
+	}
+	if s.led != nil {
+		s.led.Close()
+	}
+	if s.se != nil {
+		s.se.Close()
+	}
+	if s.redis != nil {
+		s.redis.Close()
+	}
+	if s.nfc != nil {
+		s.nfc.Deinitialize()
+	}
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+	if s.capture != nil {
+		s.capture.Close()
+	}
+	s.lock.Release()
+}
+
+// closedBefore reports whether done was closed before ctx
+func closedBefore(ctx context.Context, done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
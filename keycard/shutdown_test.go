@@ -0,0 +1,49 @@
+package keycard
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStop_WaitsForInFlightPublish(t *testing.T) {
+	s, _ := newTapService(t, 10)
+	s.config.StageTimeouts.Publish = 10 * time.Millisecond
+
+	release := make(chan struct{})
+	var sent atomic.Bool
+	err := s.publish(func() error {
+		<-release
+		sent.Store(true)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected the publish to miss its deadline")
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	s.Stop()
+	if !sent.Load() {
+		t.Error("expected Stop to wait for the publish before closing Redis")
+	}
+	s.Stop() // again, without effect
+}
+
+func TestStop_GivesUpAfterTimeout(t *testing.T) {
+	s, _ := newTapService(t, 10)
+	s.config.StageTimeouts.Publish = 10 * time.Millisecond
+	s.config.ShutdownTimeout = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+	s.publish(func() error {
+		<-release
+		return nil
+	})
+
+	start := time.Now()
+	s.Stop()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected Stop to give up after the shutdown timeout, took %s", d)
+	}
+}
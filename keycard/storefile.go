@@ -0,0 +1,89 @@
+package keycard
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	checksumPrefix = "# sha256:"
+	backupSuffix   = ".bak"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// writeStoreFile atomically writes content followed by a checksum line and
+// refreshes the last-known-good copy next to it
+func writeStoreFile(path string, content []byte) error {
+	sum := sha256.Sum256(content)
+	data := make([]byte, 0, len(content)+len(checksumPrefix)+sha256.Size*2+1)
+	data = append(data, content...)
+	data = append(data, checksumPrefix...)
+	data = append(data, hex.EncodeToString(sum[:])...)
+	data = append(data, '\n')
+
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+backupSuffix, data, 0644)
+}
+
+// readStoreFile reads and verifies a store file, falling back to its
+// last-known-good copy if the file is unreadable or fails its checksum.
+// recovered is true when the copy was used; the file is then repaired from
+// it. Missing files read as empty.
+func readStoreFile(path string) (content []byte, recovered bool, err error) {
+	return loadStoreFile(path, true)
+}
+
+// loadStoreFile is readStoreFile, leaving the file as it is unless repair
+// is set
+func loadStoreFile(path string, repair bool) (content []byte, recovered bool, err error) {
+	content, err = readVerified(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err == nil {
+		return content, false, nil
+	}
+
+	backup, backupErr := readVerified(path + backupSuffix)
+	if backupErr != nil {
+		return nil, false, fmt.Errorf("%w (backup: %v)", err, backupErr)
+	}
+	if !repair {
+		return backup, true, nil
+	}
+
+	if err := writeStoreFile(path, backup); err != nil {
+		return nil, true, fmt.Errorf("failed to repair from backup: %w", err)
+	}
+	return backup, true, nil
+}
+
+// readVerified returns the file content without its checksum line. Files
+// without a checksum line (edited by hand) are accepted as is.
+func readVerified(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimRight(data, "\n")
+	idx := bytes.LastIndexByte(trimmed, '\n') + 1
+	last := trimmed[idx:]
+	if !bytes.HasPrefix(last, []byte(checksumPrefix)) {
+		return data, nil
+	}
+
+	content := data[:idx]
+	sum := sha256.Sum256(content)
+	if string(last[len(checksumPrefix):]) != hex.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("%s: %w", path, errChecksumMismatch)
+	}
+	return content, nil
+}
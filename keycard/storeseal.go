@@ -0,0 +1,111 @@
+package keycard
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// storeKeyID is the secure element key the card store key is derived
+	// from; it never leaves the secure element
+	storeKeyID      = "store"
+	storeKeyContext = "librescoot-keycard-store-v1"
+)
+
+// ErrStoreSealed is returned when a sealed card store is opened without
+// its key
+var ErrStoreSealed = errors.New("card store is sealed, open it with the secure element")
+
+// StoreKey derives the card store key from the "store" key of the secure
+// element. With the TPM backend, a copy of the data directory is of no use
+// on another board.
+func StoreKey(se SecureElement) ([]byte, error) {
+	key, err := se.MAC(storeKeyID, []byte(storeKeyContext))
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive store key: %w", err)
+	}
+	return key, nil
+}
+
+// NewSealedAuthManager creates an AuthManager keeping the card store
+// encrypted under key. A plain store is sealed when it is opened.
+func NewSealedAuthManager(dataDir string, key []byte) (*AuthManager, error) {
+	am, err := openAuthManager(dataDir, key, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := am.sealStore(); err != nil {
+		return nil, err
+	}
+	return am, nil
+}
+
+// sealStore writes a plain card store sealed
+func (am *AuthManager) sealStore() error {
+	unlock, err := am.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if am.sealed || am.storeKey == nil {
+		return nil
+	}
+	if err := writeStore(am.dataDir, am.snap.Load().cards, am.storeKey); err != nil {
+		return fmt.Errorf("failed to seal card store: %w", err)
+	}
+	am.sealed = true
+	return nil
+}
+
+// sealCards encrypts the cards with AES-256-GCM, the nonce first
+func sealCards(cards []Card, key []byte) ([]byte, error) {
+	aead, err := storeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(cards)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, []byte(storeFileName)), nil
+}
+
+// openCards decrypts cards sealed by sealCards
+func openCards(sealed, key []byte) ([]Card, error) {
+	if key == nil {
+		return nil, ErrStoreSealed
+	}
+	aead, err := storeAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed %s is truncated", storeFileName)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(storeFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal %s: wrong key or corrupted file", storeFileName)
+	}
+	var cards []Card
+	if err := json.Unmarshal(plain, &cards); err != nil {
+		return nil, fmt.Errorf("invalid sealed %s: %w", storeFileName, err)
+	}
+	return cards, nil
+}
+
+func storeAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,112 @@
+package keycard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	restartBackoffMin = 100 * time.Millisecond
+	restartBackoffMax = 30 * time.Second
+)
+
+// crash is a panic recovered from the event loop or a background goroutine
+type crash struct {
+	component string
+	value     any
+	stack     []byte
+	restarts  int // restarts of the component in a row, this one included
+}
+
+func (c *crash) Error() string {
+	return fmt.Sprintf("%s panicked: %v", c.component, c.value)
+}
+
+// recovered runs fn, returning a panic as a *crash
+func recovered(component string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &crash{component: component, value: r, stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// restartBackoff returns the wait before the nth restart in a row,
+// doubling from restartBackoffMin up to restartBackoffMax
+func restartBackoff(n int) time.Duration {
+	d := restartBackoffMin
+	for i := 1; i < n && d < restartBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, restartBackoffMax)
+}
+
+// supervise runs fn on its own goroutine, restarting it when it panics
+func (s *Service) supervise(component string, fn func(ctx context.Context)) {
+	go s.restartOnPanic(component, nil, func() error {
+		fn(s.ctx)
+		return nil
+	})
+}
+
+// restartOnPanic runs fn and restarts it with backoff when it panics, until
+// it returns, stop is closed or the service stops. A run lasting longer
+// than the longest backoff starts the count of restarts over.
+func (s *Service) restartOnPanic(component string, stop <-chan struct{}, fn func() error) error {
+	restarts := 0
+	for {
+		started := time.Now()
+		err := recovered(component, fn)
+		var c *crash
+		if !errors.As(err, &c) {
+			return err
+		}
+		if s.ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(started) > restartBackoffMax {
+			restarts = 0
+		}
+		restarts++
+		c.restarts = restarts
+		s.reportCrash(c)
+
+		select {
+		case <-stop:
+			return nil
+		case <-s.ctx.Done():
+			return nil
+		case <-time.After(restartBackoff(restarts)):
+		}
+	}
+}
+
+// reportCrash logs a crash and queues its event for the event loop, which
+// may be the one that crashed
+func (s *Service) reportCrash(c *crash) {
+	s.logger.Error("Recovered from panic, restarting",
+		"component", c.component,
+		"panic", fmt.Sprint(c.value),
+		"restarts", c.restarts,
+		"stack", string(c.stack))
+	s.diag.RecordError(c)
+
+	select {
+	case s.crashes <- c:
+	default:
+		// Crashing faster than the loop publishes, the log has them all
+	}
+}
+
+// publishCrash publishes the event of a crash
+func (s *Service) publishCrash(c *crash) {
+	s.publishEvent(EventCrashed, map[string]any{
+		"component": c.component,
+		"panic":     fmt.Sprint(c.value),
+		"restarts":  c.restarts,
+	})
+}
@@ -0,0 +1,63 @@
+package keycard
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	for n, want := range map[int]time.Duration{
+		1:  restartBackoffMin,
+		2:  2 * restartBackoffMin,
+		4:  8 * restartBackoffMin,
+		50: restartBackoffMax,
+	} {
+		if got := restartBackoff(n); got != want {
+			t.Errorf("restart %d: expected %s, got %s", n, want, got)
+		}
+	}
+}
+
+func TestRestartOnPanic(t *testing.T) {
+	s, _ := newTapService(t, 10)
+	errDone := errors.New("done")
+
+	runs := 0
+	err := s.restartOnPanic("test", nil, func() error {
+		runs++
+		if runs < 3 {
+			panic("bad event")
+		}
+		return errDone
+	})
+	if err != errDone || runs != 3 {
+		t.Fatalf("expected 3 runs ending in errDone, got %d runs and %v", runs, err)
+	}
+
+	for want := 1; want <= 2; want++ {
+		select {
+		case c := <-s.crashes:
+			if c.component != "test" || c.value != "bad event" || c.restarts != want || len(c.stack) == 0 {
+				t.Errorf("unexpected crash %+v", c)
+			}
+		default:
+			t.Fatalf("expected crash %d to be queued for the event loop", want)
+		}
+	}
+}
+
+func TestRestartOnPanic_Stop(t *testing.T) {
+	s, _ := newTapService(t, 10)
+	stop := make(chan struct{})
+	close(stop)
+
+	runs := 0
+	err := s.restartOnPanic("test", stop, func() error {
+		runs++
+		panic("bad event")
+	})
+	if err != nil || runs != 1 {
+		t.Errorf("expected to give up after the first crash once stopped, got %d runs and %v", runs, err)
+	}
+}
@@ -0,0 +1,192 @@
+package keycard
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+const (
+	syncSignatureHeader = "X-Signature"
+	syncTimeout         = 30 * time.Second
+	syncMaxBodySize     = 4 << 20
+	syncStateFileName   = "sync.json"
+)
+
+var (
+	// ErrSyncRollback is returned for lists older than the one applied last
+	ErrSyncRollback = errors.New("authorized list version rollback")
+	// ErrSyncScooter is returned for lists signed for another scooter
+	ErrSyncScooter = errors.New("authorized list is for another scooter")
+)
+
+// SyncList is the authorized list served by the fleet backend. Version
+// counts up from 1, and Scooter is the device ID of the scooter the list
+// is signed for.
+type SyncList struct {
+	Version    int64    `json:"version"`
+	Scooter    string   `json:"scooter"`
+	Authorized []string `json:"authorized"`
+	Revoked    []string `json:"revoked"`
+}
+
+// syncState is the version of the list applied last, kept in the data
+// directory so a restart cannot roll it back
+type syncState struct {
+	Version int64 `json:"version"`
+}
+
+// SyncClient periodically pulls the authorized list from the fleet backend
+type SyncClient struct {
+	url      string
+	key      ed25519.PublicKey
+	scooter  string
+	interval time.Duration
+	path     string
+	auth     *AuthManager
+	logger   *slog.Logger
+	client   *http.Client
+
+	version int64
+}
+
+// NewSyncClient creates a sync client; responses must be signed with key
+// and name scooter. The version applied last is kept in dataDir.
+func NewSyncClient(url string, key ed25519.PublicKey, scooter string, interval time.Duration, dataDir string, auth *AuthManager, logger *slog.Logger) (*SyncClient, error) {
+	c := &SyncClient{
+		url:      url,
+		key:      key,
+		scooter:  normalizeDeviceID(scooter),
+		interval: interval,
+		path:     filepath.Join(dataDir, syncStateFileName),
+		auth:     auth,
+		logger:   logger,
+		client:   &http.Client{Timeout: syncTimeout},
+	}
+	if c.scooter == "" {
+		return nil, fmt.Errorf("missing scooter ID")
+	}
+
+	content, recovered, err := readStoreFile(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", syncStateFileName, err)
+	}
+	if recovered {
+		logger.Warn("Sync state was corrupted, restored from last-known-good copy")
+	}
+	if content != nil {
+		var state syncState
+		if err := json.Unmarshal(content, &state); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", syncStateFileName, err)
+		}
+		c.version = state.Version
+	}
+	return c, nil
+}
+
+// Run syncs immediately and then on every interval until ctx is cancelled.
+// With an interval of 0 it only syncs once.
+func (c *SyncClient) Run(ctx context.Context) {
+	if c.interval <= 0 {
+		if err := c.Sync(ctx); err != nil {
+			c.logger.Warn("Authorized list sync failed", "error", err)
+		}
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Sync(ctx); err != nil {
+			c.logger.Warn("Authorized list sync failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync fetches, verifies, and applies the authorized list once
+func (c *SyncClient) Sync(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, syncMaxBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	list, err := VerifySyncList(body, resp.Header.Get(syncSignatureHeader), c.key)
+	if err != nil {
+		return err
+	}
+	if normalizeDeviceID(list.Scooter) != c.scooter {
+		return fmt.Errorf("%w: %q", ErrSyncScooter, list.Scooter)
+	}
+
+	if list.Version == c.version && c.version > 0 {
+		c.logger.Debug("Authorized list unchanged", "version", list.Version)
+		return nil
+	}
+	if list.Version <= c.version {
+		return fmt.Errorf("%w: %d is not newer than %d", ErrSyncRollback, list.Version, c.version)
+	}
+
+	if err := c.auth.ApplySync(list.Authorized, list.Revoked); err != nil {
+		return fmt.Errorf("failed to apply list: %w", err)
+	}
+	data, err := json.MarshalIndent(syncState{Version: list.Version}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeStoreFile(c.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %w", syncStateFileName, err)
+	}
+	c.version = list.Version
+
+	c.logger.Info("Authorized list synced",
+		"version", list.Version,
+		"authorized", len(list.Authorized),
+		"revoked", len(list.Revoked))
+	return nil
+}
+
+// VerifySyncList checks the base64 ed25519 signature over body and decodes it
+func VerifySyncList(body []byte, signature string, key ed25519.PublicKey) (*SyncList, error) {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("missing or malformed signature")
+	}
+	if !ed25519.Verify(key, body, sig) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	var list SyncList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("invalid list: %w", err)
+	}
+	return &list, nil
+}
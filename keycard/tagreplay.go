@@ -0,0 +1,245 @@
+package keycard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// Tag record types
+const (
+	TagRecordArrival   = "arrival"
+	TagRecordDeparture = "departure"
+	TagRecordError     = "error"
+)
+
+var errNotRecorded = errors.New("tag memory is not recorded")
+
+// TagRecord is a tag event from the reader as recorded with --record and
+// replayed with --replay, one JSON object per line. ID is the tag ID in
+// hex as the reader sent it and Protocol the NCI RF protocol.
+type TagRecord struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	ID       string    `json:"id,omitempty"`
+	Protocol uint8     `json:"protocol,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newTagRecord(e hal.TagEvent, t time.Time) TagRecord {
+	rec := TagRecord{Time: t.UTC(), Type: TagRecordArrival}
+	switch {
+	case e.Error != nil:
+		rec.Type, rec.Error = TagRecordError, e.Error.Error()
+	case e.Type == hal.TagDeparture:
+		rec.Type = TagRecordDeparture
+	}
+	if e.Tag != nil {
+		rec.ID = hex.EncodeToString(e.Tag.ID)
+		rec.Protocol = uint8(e.Tag.RFProtocol)
+	}
+	return rec
+}
+
+// Event returns the tag event the record was taken from
+func (rec TagRecord) Event() (hal.TagEvent, error) {
+	var e hal.TagEvent
+	switch rec.Type {
+	case TagRecordArrival:
+		e.Type = hal.TagArrival
+	case TagRecordDeparture:
+		e.Type = hal.TagDeparture
+	case TagRecordError:
+		e.Error = errors.New(rec.Error)
+		return e, nil
+	default:
+		return e, fmt.Errorf("unknown tag record type %q", rec.Type)
+	}
+
+	if rec.ID != "" {
+		id, err := hex.DecodeString(rec.ID)
+		if err != nil {
+			return e, fmt.Errorf("invalid tag ID %q: %w", rec.ID, err)
+		}
+		e.Tag = &hal.Tag{RFProtocol: hal.RFProtocol(rec.Protocol), ID: id}
+	} else if e.Type == hal.TagArrival {
+		return e, fmt.Errorf("arrival without tag ID")
+	}
+	return e, nil
+}
+
+// ReadTagRecords reads a recording, skipping blank lines and the NCI
+// packets of a capture, see NCICapture
+func ReadTagRecords(r io.Reader) ([]TagRecord, error) {
+	var records []TagRecord
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		data := bytes.TrimSpace(sc.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var rec TagRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if rec.Type == CaptureTX || rec.Type == CaptureRX {
+			continue
+		}
+		if _, err := rec.Event(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, sc.Err()
+}
+
+// LoadTagRecords reads a recording from a file
+func LoadTagRecords(path string) ([]TagRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTagRecords(f)
+}
+
+// TagRecorder appends tag events to a recording
+type TagRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	err error // first write error, later ones are not reported
+}
+
+func OpenTagRecorder(path string) (*TagRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tag recording: %w", err)
+	}
+	return &TagRecorder{f: f}, nil
+}
+
+// Record appends an event taken now. It returns the first write error
+// once, so a full disk is not reported for every event.
+func (r *TagRecorder) Record(e hal.TagEvent) error {
+	data, err := json.Marshal(newTagRecord(e, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil
+	}
+	if _, err := r.f.Write(append(data, '\n')); err != nil {
+		r.err = err
+		return fmt.Errorf("failed to record tag event: %w", err)
+	}
+	return nil
+}
+
+func (r *TagRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// ReplayReader is an NFC reader playing back a recording once discovery
+// starts, with the recorded pauses between events divided by speed, or
+// without pauses if speed is 0. Its event channel closes after the last
+// event. Tag memory cannot be read, so cards are identified by UID and
+// protocol only.
+type ReplayReader struct {
+	records []TagRecord
+	speed   float64
+	events  chan hal.TagEvent
+	state   atomic.Int32
+	start   sync.Once
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+func NewReplayReader(records []TagRecord, speed float64) *ReplayReader {
+	return &ReplayReader{
+		records: records,
+		speed:   speed,
+		events:  make(chan hal.TagEvent),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (r *ReplayReader) run() {
+	defer close(r.events)
+	for i, rec := range r.records {
+		if i > 0 && r.speed > 0 {
+			pause := time.Duration(float64(rec.Time.Sub(r.records[i-1].Time)) / r.speed)
+			if pause > 0 {
+				select {
+				case <-time.After(pause):
+				case <-r.stop:
+					return
+				}
+			}
+		}
+		e, _ := rec.Event() // checked by ReadTagRecords
+		select {
+		case r.events <- e:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *ReplayReader) Initialize() error {
+	r.state.Store(int32(hal.StateIdle))
+	return nil
+}
+
+func (r *ReplayReader) Deinitialize() {
+	r.stopped.Do(func() { close(r.stop) })
+	r.state.Store(int32(hal.StateUninitialized))
+}
+
+func (r *ReplayReader) FullReinitialize() error {
+	return nil
+}
+
+// StartDiscovery starts the playback the first time it is called
+func (r *ReplayReader) StartDiscovery(pollPeriod uint) error {
+	r.state.Store(int32(hal.StateDiscovering))
+	r.start.Do(func() { go r.run() })
+	return nil
+}
+
+func (r *ReplayReader) StopDiscovery() error {
+	r.state.Store(int32(hal.StateIdle))
+	return nil
+}
+
+func (r *ReplayReader) GetState() hal.State {
+	return hal.State(r.state.Load())
+}
+
+func (r *ReplayReader) GetTagEventChannel() <-chan hal.TagEvent {
+	return r.events
+}
+
+func (r *ReplayReader) SetTagEventReaderEnabled(enabled bool) {}
+
+func (r *ReplayReader) ReadBinary(address uint16) ([]byte, error) {
+	return nil, errNotRecorded
+}
+
+func (r *ReplayReader) WriteBinary(address uint16, data []byte) error {
+	return errNotRecorded
+}
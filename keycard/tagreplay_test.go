@@ -0,0 +1,145 @@
+package keycard
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+func TestTagRecorder_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	rec, err := OpenTagRecorder(path)
+	if err != nil {
+		t.Fatalf("OpenTagRecorder failed: %v", err)
+	}
+	events := []hal.TagEvent{
+		{Type: hal.TagArrival, Tag: &hal.Tag{RFProtocol: hal.RFProtocolT2T, ID: []byte{0x04, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF}}},
+		{Type: hal.TagDeparture},
+		{Error: errors.New("RF field error")},
+	}
+	for _, e := range events {
+		if err := rec.Record(e); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+	rec.Close()
+
+	records, err := LoadTagRecords(path)
+	if err != nil {
+		t.Fatalf("LoadTagRecords failed: %v", err)
+	}
+	if len(records) != len(events) {
+		t.Fatalf("expected %d records, got %d", len(events), len(records))
+	}
+	for i, r := range records {
+		e, err := r.Event()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		want := events[i]
+		if e.Type != want.Type || (e.Error == nil) != (want.Error == nil) || (e.Tag == nil) != (want.Tag == nil) {
+			t.Errorf("record %d: expected %+v, got %+v", i, want, e)
+			continue
+		}
+		if e.Tag != nil && (e.Tag.RFProtocol != want.Tag.RFProtocol || !bytes.Equal(e.Tag.ID, want.Tag.ID)) {
+			t.Errorf("record %d: expected tag %+v, got %+v", i, want.Tag, e.Tag)
+		}
+	}
+	if uid := tagUID(mustEvent(t, records[0]).Tag); uid != "04AABBCCDDEEFF" {
+		t.Errorf("expected the UID to survive replay, got %s", uid)
+	}
+}
+
+func TestReadTagRecords_Invalid(t *testing.T) {
+	for _, input := range []string{
+		`{"type":"arrival"}`,
+		`{"type":"arrival","id":"zz"}`,
+		`{"type":"wobble","id":"04112233"}`,
+		`not json`,
+	} {
+		if _, err := ReadTagRecords(strings.NewReader(input)); err == nil {
+			t.Errorf("expected %s to be rejected", input)
+		}
+	}
+}
+
+func mustEvent(t *testing.T, rec TagRecord) hal.TagEvent {
+	t.Helper()
+	e, err := rec.Event()
+	if err != nil {
+		t.Fatalf("Event failed: %v", err)
+	}
+	return e
+}
+
+// tapRecords records taps of uids, each present for hold
+func tapRecords(start time.Time, hold time.Duration, uids ...string) []TagRecord {
+	var records []TagRecord
+	for i, uid := range uids {
+		at := start.Add(time.Duration(i) * 2 * hold)
+		records = append(records,
+			TagRecord{Time: at, Type: TagRecordArrival, ID: strings.ToLower(uid), Protocol: uint8(rfProtocolMifare)},
+			TagRecord{Time: at.Add(hold), Type: TagRecordDeparture})
+	}
+	return records
+}
+
+func TestReplayReader_Timing(t *testing.T) {
+	records := tapRecords(time.Now(), 100*time.Millisecond, "04112233", "04445566")
+
+	for _, tc := range []struct {
+		speed    float64
+		min, max time.Duration
+	}{
+		{speed: 10, min: 30 * time.Millisecond, max: 250 * time.Millisecond},
+		{speed: 0, max: 50 * time.Millisecond},
+	} {
+		r := NewReplayReader(records, tc.speed)
+		r.Initialize()
+		select {
+		case <-r.GetTagEventChannel():
+			t.Fatal("expected no events before discovery starts")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		start := time.Now()
+		r.StartDiscovery(defaultPollPeriod)
+		n := 0
+		for range r.GetTagEventChannel() {
+			n++
+		}
+		d := time.Since(start)
+		if n != len(records) {
+			t.Errorf("speed %g: expected %d events, got %d", tc.speed, len(records), n)
+		}
+		if d < tc.min || d > tc.max {
+			t.Errorf("speed %g: expected playback to take %s to %s, took %s", tc.speed, tc.min, tc.max, d)
+		}
+		r.Deinitialize()
+	}
+}
+
+func TestReplayReader_Taps(t *testing.T) {
+	s, uids := newTapService(t, 10)
+	r := NewReplayReader(tapRecords(time.Now(), time.Millisecond, uids[0], "04AABBCCDDEEFF"), 0)
+	s.nfc = r
+	r.Initialize()
+	r.StartDiscovery(defaultPollPeriod)
+
+	var granted []bool
+	for e := range r.GetTagEventChannel() {
+		s.handleTagEvent(e)
+		if e.Type == hal.TagArrival {
+			granted = append(granted, s.granted)
+			s.toggle.Failed()
+		}
+	}
+	if len(granted) != 2 || !granted[0] || granted[1] {
+		t.Errorf("expected the enrolled card to be granted and the other not, got %v", granted)
+	}
+}
@@ -0,0 +1,109 @@
+package keycard
+
+import (
+	"fmt"
+	"strings"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+// TagType is the technology of a card as far as it can be told from its
+// protocol, UID and a few harmless reads
+type TagType string
+
+const (
+	TagUnknown    TagType = "unknown"
+	TagClassic    TagType = "mifare-classic"
+	TagUltralight TagType = "mifare-ultralight"
+	TagNTAG       TagType = "ntag"
+	TagType2      TagType = "type2" // Type 2 Tag not made by NXP
+	TagDESFire    TagType = "mifare-desfire"
+	TagISODEP     TagType = "iso-dep" // other ISO 14443-4 cards, e.g. JavaCards and phones
+)
+
+var tagTypes = []TagType{TagUnknown, TagClassic, TagUltralight, TagNTAG, TagType2, TagDESFire, TagISODEP}
+
+// ParseTagType checks a tag type name
+func ParseTagType(s string) (TagType, error) {
+	for _, t := range tagTypes {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown tag type %q", s)
+}
+
+// ParseTagTypes parses a comma-separated list of tag types
+func ParseTagTypes(s string) ([]TagType, error) {
+	var types []TagType
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		t, err := ParseTagType(name)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+const (
+	// rfProtocolMifare is the NXP proprietary NCI protocol of MIFARE Classic
+	rfProtocolMifare hal.RFProtocol = 0x80
+
+	manufacturerNXP = "04" // first UID byte of NXP cards
+
+	t2tCCOffset = 12   // capability container in page 3
+	t2tCCMagic  = 0xE1 // NDEF formatted
+)
+
+// t2tSizes maps the data area size in the capability container of NXP Type
+// 2 Tags, in units of 8 bytes, to their family. The MIFARE Ultralight C has
+// the size of an NTAG213 and is reported as such.
+var t2tSizes = map[byte]TagType{
+	0x06: TagUltralight, // Ultralight, Ultralight EV1 MF0UL11
+	0x10: TagUltralight, // Ultralight EV1 MF0UL21
+	0x12: TagNTAG,       // NTAG213
+	0x3E: TagNTAG,       // NTAG215
+	0x6D: TagNTAG,       // NTAG216
+}
+
+// DetectTagType tells the technology of the card in the field. Type 2 Tags
+// are told apart by their capability container read from mem, ISO-DEP cards
+// by the DESFire GetVersion command sent over t. Either may be nil.
+func DetectTagType(protocol hal.RFProtocol, uid string, mem TagMemory, t Transceiver) TagType {
+	switch protocol {
+	case rfProtocolMifare:
+		return TagClassic
+
+	case hal.RFProtocolT2T:
+		if !strings.HasPrefix(uid, manufacturerNXP) {
+			return TagType2
+		}
+		if mem == nil {
+			return TagUltralight
+		}
+		block, err := mem.ReadBinary(0)
+		if err != nil || len(block) < t2tCCOffset+4 || block[t2tCCOffset] != t2tCCMagic {
+			return TagUltralight
+		}
+		if t, ok := t2tSizes[block[t2tCCOffset+2]]; ok {
+			return t
+		}
+		return TagUltralight
+
+	case hal.RFProtocolISODEP:
+		if t == nil {
+			return TagISODEP
+		}
+		// DESFire answers its native GetVersion, wrapped in an APDU, with
+		// "additional frame"
+		if _, sw, err := transceive(t, []byte{0x90, 0x60, 0x00, 0x00, 0x00}); err == nil && sw == 0x91AF {
+			return TagDESFire
+		}
+		return TagISODEP
+	}
+	return TagUnknown
+}
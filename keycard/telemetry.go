@@ -0,0 +1,166 @@
+package keycard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	telemetryRetryMin  = 10 * time.Second
+	telemetryMaxBatch  = 100  // upload early once this many records are queued
+	telemetryMaxQueued = 1000 // drop the oldest records beyond this
+)
+
+// telemetryFields are the only fields passed on from events; UIDs, keys and
+// error messages never leave the scooter
+var telemetryFields = map[string]bool{
+	"dwell":      true,
+	"remaining":  true,
+	"denied":     true,
+	"version":    true,
+	"authorized": true,
+	"state":      true,
+	"errors":     true,
+	"i2c-errors": true,
+	"reinits":    true,
+	"error-code": true,
+	"attempts":   true,
+	"group":      true,
+	"tech":       true,
+}
+
+// TelemetryRecord is one anonymized event in an upload
+type TelemetryRecord struct {
+	Time   int64          `json:"time"`
+	Event  string         `json:"event"`
+	Code   int            `json:"code,omitempty"`
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+// TelemetryUploader batches anonymized tap and diagnostic records and POSTs
+// them as a JSON array to an HTTPS endpoint
+type TelemetryUploader struct {
+	url      string
+	interval time.Duration
+	logger   *slog.Logger
+	client   *http.Client
+	flush    chan struct{}
+
+	mu      sync.Mutex
+	queue   []TelemetryRecord
+	dropped int // records dropped from the front of queue so far
+	failed  bool
+}
+
+func NewTelemetryUploader(url string, interval time.Duration, logger *slog.Logger) *TelemetryUploader {
+	return &TelemetryUploader{
+		url:      url,
+		interval: interval,
+		logger:   logger,
+		client:   &http.Client{Timeout: syncTimeout},
+		flush:    make(chan struct{}, 1),
+	}
+}
+
+// Record queues an event, keeping only the allowed fields
+func (t *TelemetryUploader) Record(event string, code int, fields map[string]any) {
+	rec := TelemetryRecord{Time: time.Now().Unix(), Event: event, Code: code}
+	for k, v := range fields {
+		if telemetryFields[k] {
+			if rec.Fields == nil {
+				rec.Fields = make(map[string]any)
+			}
+			rec.Fields[k] = v
+		}
+	}
+
+	t.mu.Lock()
+	t.queue = append(t.queue, rec)
+	if n := len(t.queue) - telemetryMaxQueued; n > 0 {
+		t.queue = t.queue[n:]
+		t.dropped += n
+	}
+	full := len(t.queue) >= telemetryMaxBatch && !t.failed
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run uploads the queued records on every interval, or earlier once a batch
+// is full, until ctx is cancelled. Failed uploads are retried with jittered
+// exponential backoff, capped at the interval.
+func (t *TelemetryUploader) Run(ctx context.Context) {
+	retry := telemetryRetryMin
+	delay := t.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(delay)):
+		case <-t.flush:
+		}
+
+		delay = t.interval
+		err := t.Upload(ctx)
+		t.mu.Lock()
+		t.failed = err != nil
+		t.mu.Unlock()
+		if err != nil {
+			t.logger.Warn("Telemetry upload failed", "error", err, "retry", retry)
+			delay = retry
+			retry = min(retry*2, t.interval)
+		} else {
+			retry = telemetryRetryMin
+		}
+	}
+}
+
+// Upload sends the queued records; they stay queued if the upload fails
+func (t *TelemetryUploader) Upload(ctx context.Context) error {
+	t.mu.Lock()
+	batch := t.queue[:min(len(t.queue), telemetryMaxBatch)]
+	dropped := t.dropped
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	t.mu.Lock()
+	// Some of the batch may have been dropped while uploading
+	sent := max(len(batch)-(t.dropped-dropped), 0)
+	t.queue = t.queue[sent:]
+	t.mu.Unlock()
+
+	t.logger.Debug("Telemetry uploaded", "records", len(batch))
+	return nil
+}
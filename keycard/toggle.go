@@ -0,0 +1,118 @@
+package keycard
+
+import "time"
+
+// toggleConfirmTimeout is how long an unlock or lock may take to be
+// confirmed by the vehicle before it is considered to have failed
+const toggleConfirmTimeout = 10 * time.Second
+
+// LockState is the scooter's lock state as seen by the reader
+type LockState int
+
+const (
+	StateLocked    LockState = iota
+	StateUnlocking           // grant published, waiting for the vehicle
+	StateUnlocked
+	StateLocking // lock requested, waiting for the vehicle
+)
+
+func (s LockState) String() string {
+	switch s {
+	case StateUnlocking:
+		return "unlocking"
+	case StateUnlocked:
+		return "unlocked"
+	case StateLocking:
+		return "locking"
+	}
+	return "locked"
+}
+
+// ToggleAction is what an authorized tap should do
+type ToggleAction int
+
+const (
+	ToggleNone   ToggleAction = iota // nothing, the scooter is unlocked or changing
+	ToggleUnlock                     // publish the grant
+	ToggleLock                       // request a lock
+)
+
+// Toggle tracks the lock state through authorized taps and the vehicle
+// state, so a tap unlocks a locked scooter, locks an unlocked one if
+// locking by tap is enabled, and is ignored while the vehicle has not
+// caught up with the previous one. It is not safe for concurrent use.
+type Toggle struct {
+	state   LockState
+	since   time.Time // when the current transition started
+	timeout time.Duration
+}
+
+// NewToggle starts in the state the vehicle is in
+func NewToggle(unlocked bool) *Toggle {
+	t := &Toggle{timeout: toggleConfirmTimeout}
+	if unlocked {
+		t.state = StateUnlocked
+	}
+	return t
+}
+
+// State returns the lock state at now
+func (t *Toggle) State(now time.Time) LockState {
+	t.expire(now)
+	return t.state
+}
+
+// Tap returns the action for an authorized tap and moves to the transition
+// it starts. lock is whether taps lock an unlocked scooter.
+func (t *Toggle) Tap(now time.Time, lock bool) ToggleAction {
+	t.expire(now)
+	switch t.state {
+	case StateLocked:
+		t.begin(StateUnlocking, now)
+		return ToggleUnlock
+	case StateUnlocked:
+		if lock {
+			t.begin(StateLocking, now)
+			return ToggleLock
+		}
+	}
+	return ToggleNone
+}
+
+// Failed reverts the transition started by the last tap, whose grant or
+// lock request could not be published
+func (t *Toggle) Failed() {
+	switch t.state {
+	case StateUnlocking:
+		t.state = StateLocked
+	case StateLocking:
+		t.state = StateUnlocked
+	}
+}
+
+// Vehicle updates the state from the vehicle, which has the final say:
+// it confirms transitions and follows unlocks and locks by other means
+func (t *Toggle) Vehicle(unlocked bool, now time.Time) {
+	t.expire(now)
+	switch {
+	case unlocked && t.state != StateUnlocked:
+		t.state = StateUnlocked
+	case !unlocked && t.state != StateLocked:
+		// A locked vehicle does not confirm an unlock still in progress
+		if t.state != StateUnlocking {
+			t.state = StateLocked
+		}
+	}
+}
+
+func (t *Toggle) begin(state LockState, now time.Time) {
+	t.state = state
+	t.since = now
+}
+
+// expire gives up on a transition the vehicle did not confirm in time
+func (t *Toggle) expire(now time.Time) {
+	if (t.state == StateUnlocking || t.state == StateLocking) && now.Sub(t.since) >= t.timeout {
+		t.Failed()
+	}
+}
@@ -0,0 +1,142 @@
+package keycard
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToggle_Unlock(t *testing.T) {
+	now := time.Now()
+	tg := NewToggle(false)
+
+	// locked -> unlocking
+	if a := tg.Tap(now, true); a != ToggleUnlock || tg.State(now) != StateUnlocking {
+		t.Fatalf("expected unlock from locked, got %v in %v", a, tg.State(now))
+	}
+	// Taps are ignored while unlocking, and a still locked vehicle does not
+	// cancel the unlock
+	if a := tg.Tap(now.Add(time.Second), true); a != ToggleNone {
+		t.Errorf("expected tap to be ignored while unlocking, got %v", a)
+	}
+	tg.Vehicle(false, now.Add(time.Second))
+	if tg.State(now.Add(time.Second)) != StateUnlocking {
+		t.Errorf("expected to stay unlocking, got %v", tg.State(now))
+	}
+	// unlocking -> unlocked
+	tg.Vehicle(true, now.Add(2*time.Second))
+	if tg.State(now.Add(2*time.Second)) != StateUnlocked {
+		t.Errorf("expected unlocked, got %v", tg.State(now))
+	}
+}
+
+func TestToggle_Lock(t *testing.T) {
+	now := time.Now()
+	tg := NewToggle(true)
+
+	// Without locking by tap, an unlocked scooter stays unlocked
+	if a := tg.Tap(now, false); a != ToggleNone || tg.State(now) != StateUnlocked {
+		t.Fatalf("expected no action, got %v in %v", a, tg.State(now))
+	}
+	// unlocked -> locking
+	if a := tg.Tap(now, true); a != ToggleLock || tg.State(now) != StateLocking {
+		t.Fatalf("expected lock from unlocked, got %v in %v", a, tg.State(now))
+	}
+	if a := tg.Tap(now, true); a != ToggleNone {
+		t.Errorf("expected tap to be ignored while locking, got %v", a)
+	}
+	// locking -> locked
+	tg.Vehicle(false, now.Add(time.Second))
+	if tg.State(now.Add(time.Second)) != StateLocked {
+		t.Errorf("expected locked, got %v", tg.State(now))
+	}
+}
+
+func TestToggle_Failed(t *testing.T) {
+	now := time.Now()
+
+	// unlocking -> locked when the grant is not published
+	tg := NewToggle(false)
+	tg.Tap(now, true)
+	tg.Failed()
+	if tg.State(now) != StateLocked {
+		t.Errorf("expected locked after failed unlock, got %v", tg.State(now))
+	}
+
+	// locking -> unlocked when the lock is not requested
+	tg = NewToggle(true)
+	tg.Tap(now, true)
+	tg.Failed()
+	if tg.State(now) != StateUnlocked {
+		t.Errorf("expected unlocked after failed lock, got %v", tg.State(now))
+	}
+}
+
+func TestToggle_Timeout(t *testing.T) {
+	now := time.Now()
+
+	// unlocking -> locked when the vehicle never confirms
+	tg := NewToggle(false)
+	tg.Tap(now, true)
+	later := now.Add(toggleConfirmTimeout)
+	if tg.State(later) != StateLocked {
+		t.Errorf("expected unconfirmed unlock to time out, got %v", tg.State(later))
+	}
+	if a := tg.Tap(later, true); a != ToggleUnlock {
+		t.Errorf("expected a new unlock after the timeout, got %v", a)
+	}
+
+	// locking -> unlocked when the vehicle never confirms
+	tg = NewToggle(true)
+	tg.Tap(now, true)
+	if tg.State(later) != StateUnlocked {
+		t.Errorf("expected unconfirmed lock to time out, got %v", tg.State(later))
+	}
+}
+
+func TestToggle_External(t *testing.T) {
+	now := time.Now()
+
+	// locked -> unlocked by other means, e.g. the app
+	tg := NewToggle(false)
+	tg.Vehicle(true, now)
+	if tg.State(now) != StateUnlocked {
+		t.Errorf("expected to follow an external unlock, got %v", tg.State(now))
+	}
+	// unlocked -> locked by other means
+	tg.Vehicle(false, now)
+	if tg.State(now) != StateLocked {
+		t.Errorf("expected to follow an external lock, got %v", tg.State(now))
+	}
+	// locking -> unlocked if the vehicle reports being unlocked
+	tg = NewToggle(true)
+	tg.Tap(now, true)
+	tg.Vehicle(true, now)
+	if tg.State(now) != StateUnlocked {
+		t.Errorf("expected vehicle to have the final say, got %v", tg.State(now))
+	}
+}
+
+func TestIsParked(t *testing.T) {
+	tests := []struct {
+		kickstand, state string
+		want             bool
+	}{
+		{KickstandDown, VehicleStateReadyToDrive, true},
+		{KickstandDown, "", true},
+		{KickstandUp, VehicleStateParked, false},
+		{KickstandUp, VehicleStateStandBy, false},
+		{"", VehicleStateParked, true},
+		{"", VehicleStateStandBy, true},
+		{"", VehicleStateReadyToDrive, false},
+		{"", "", false},
+		{"", "hibernating", false},
+		{"unknown", VehicleStateParked, true},
+		{"unknown", "", false},
+	}
+	for _, tt := range tests {
+		v := &VehicleMonitor{kickstand: tt.kickstand, state: tt.state}
+		if got := v.IsParked(); got != tt.want {
+			t.Errorf("IsParked with kickstand %q and state %q = %v, want %v", tt.kickstand, tt.state, got, tt.want)
+		}
+	}
+}
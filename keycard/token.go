@@ -0,0 +1,142 @@
+package keycard
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenRecordType is the NDEF external type carrying an access token
+	TokenRecordType = "librescoot.org:keycard"
+
+	tokenVersion = 1
+)
+
+var (
+	ErrTokenSignature = errors.New("invalid token signature")
+	ErrTokenExpired   = errors.New("token expired")
+	ErrTokenNotYet    = errors.New("token not yet valid")
+	ErrTokenUID       = errors.New("token issued for a different card")
+)
+
+// AccessToken grants temporary access without prior enrollment.
+//
+// Wire format (big endian):
+//
+//	version(1) | uid length(1) | uid | not before(8, unix) | not after(8, unix) | ed25519 signature(64)
+//
+// The signature covers all preceding bytes. An empty UID makes the token
+// valid on any card.
+type AccessToken struct {
+	UID       []byte
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Marshal encodes the token and signs it with the issuer's key
+func (t *AccessToken) Marshal(key ed25519.PrivateKey) []byte {
+	buf := t.body()
+	return append(buf, ed25519.Sign(key, buf)...)
+}
+
+func (t *AccessToken) body() []byte {
+	buf := []byte{tokenVersion, byte(len(t.UID))}
+	buf = append(buf, t.UID...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.NotBefore.Unix()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.NotAfter.Unix()))
+	return buf
+}
+
+// ParseAccessToken decodes a token and verifies its signature
+func ParseAccessToken(data []byte, key ed25519.PublicKey) (*AccessToken, error) {
+	if len(data) < 2 || data[0] != tokenVersion {
+		return nil, errors.New("unsupported token version")
+	}
+	uidLen := int(data[1])
+	bodyLen := 2 + uidLen + 16
+	if len(data) != bodyLen+ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid token length %d", len(data))
+	}
+
+	if !ed25519.Verify(key, data[:bodyLen], data[bodyLen:]) {
+		return nil, ErrTokenSignature
+	}
+
+	t := &AccessToken{
+		UID:       append([]byte(nil), data[2:2+uidLen]...),
+		NotBefore: time.Unix(int64(binary.BigEndian.Uint64(data[2+uidLen:])), 0),
+		NotAfter:  time.Unix(int64(binary.BigEndian.Uint64(data[10+uidLen:])), 0),
+	}
+	return t, nil
+}
+
+// Validate checks the validity window and card binding of a verified token
+func (t *AccessToken) Validate(uid []byte, now time.Time) error {
+	if now.Before(t.NotBefore) {
+		return ErrTokenNotYet
+	}
+	if !now.Before(t.NotAfter) {
+		return ErrTokenExpired
+	}
+	if len(t.UID) > 0 && !bytes.Equal(t.UID, uid) {
+		return ErrTokenUID
+	}
+	return nil
+}
+
+// FindAccessToken returns the token payload from an NDEF message
+func FindAccessToken(records []NDEFRecord) ([]byte, bool) {
+	for _, rec := range records {
+		if rec.TNF == ndefTNFExternal && string(rec.Type) == TokenRecordType {
+			return rec.Payload, true
+		}
+	}
+	return nil, false
+}
+
+// decodeKey decodes key file contents given in hex or base64
+func decodeKey(data []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(data))
+
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("key is neither hex nor base64")
+		}
+	}
+	return key, nil
+}
+
+// LoadPublicKey reads an ed25519 public key stored as hex or base64
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// LoadSecretKey reads a symmetric key stored as hex or base64
+func LoadSecretKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(data)
+}
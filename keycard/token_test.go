@@ -0,0 +1,132 @@
+package keycard
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+// memoryTag serves Type 2 Tag reads from a byte slice
+type memoryTag []byte
+
+func (m memoryTag) ReadBinary(address uint16) ([]byte, error) {
+	block := make([]byte, t2tReadSize+1) // trailing NCI status byte
+	copy(block, m[address:])
+	return block, nil
+}
+
+func tokenTag(payload []byte) memoryTag {
+	recordType := []byte(TokenRecordType)
+	record := append([]byte{0xD4, byte(len(recordType)), byte(len(payload))}, recordType...)
+	record = append(record, payload...)
+
+	mem := make([]byte, t2tDataStart, 256)
+	mem = append(mem, tlvNDEF, byte(len(record)))
+	mem = append(mem, record...)
+	mem = append(mem, tlvTerminator)
+	return memoryTag(mem[:cap(mem)])
+}
+
+func TestAccessToken_FromNDEF(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	uid := []byte{0x04, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF}
+	token := &AccessToken{
+		UID:       uid,
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(time.Hour),
+	}
+
+	msg, err := ReadNDEF(tokenTag(token.Marshal(priv)))
+	if err != nil {
+		t.Fatalf("ReadNDEF failed: %v", err)
+	}
+	records, err := ParseNDEF(msg)
+	if err != nil {
+		t.Fatalf("ParseNDEF failed: %v", err)
+	}
+	data, ok := FindAccessToken(records)
+	if !ok {
+		t.Fatal("expected token record")
+	}
+
+	parsed, err := ParseAccessToken(data, pub)
+	if err != nil {
+		t.Fatalf("ParseAccessToken failed: %v", err)
+	}
+
+	if err := parsed.Validate(uid, now); err != nil {
+		t.Errorf("expected token to be valid, got %v", err)
+	}
+	if err := parsed.Validate(uid, now.Add(2*time.Hour)); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+	if err := parsed.Validate(uid, now.Add(-2*time.Hour)); !errors.Is(err, ErrTokenNotYet) {
+		t.Errorf("expected ErrTokenNotYet, got %v", err)
+	}
+	if err := parsed.Validate([]byte{1, 2, 3, 4}, now); !errors.Is(err, ErrTokenUID) {
+		t.Errorf("expected ErrTokenUID, got %v", err)
+	}
+}
+
+func TestAccessToken_RejectsForgery(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	token := &AccessToken{NotAfter: time.Now().Add(time.Hour)}
+	data := token.Marshal(other)
+
+	if _, err := ParseAccessToken(data, pub); !errors.Is(err, ErrTokenSignature) {
+		t.Errorf("expected ErrTokenSignature, got %v", err)
+	}
+
+	// Tampering with the validity window breaks the signature
+	data = token.Marshal(priv)
+	data[len(data)-ed25519.SignatureSize-1]++
+	if _, err := ParseAccessToken(data, pub); !errors.Is(err, ErrTokenSignature) {
+		t.Errorf("expected ErrTokenSignature after tampering, got %v", err)
+	}
+}
+
+func FuzzNDEF(f *testing.F) {
+	record := []byte{0xD4, byte(len(TokenRecordType)), 3}
+	record = append(append(record, TokenRecordType...), 1, 2, 3)
+	f.Add(append(append([]byte{tlvNDEF, byte(len(record))}, record...), tlvTerminator))
+	f.Add([]byte{tlvNull, 0x01, 0x03, 0xA0, 0x0C, 0x34, tlvNDEF, 0xFF, 0x00, 0x03, 0xD1, 0x00, 0x00})
+	f.Add([]byte{tlvNDEF, 0x05, 0x91, 0x01, 0x00, 0x54, 0x51, 0x00, 0x00, 0x00, 0x00, 0x01})
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		f.Fatalf("GenerateKey failed: %v", err)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Memory beyond the fuzzed data reads as zeros, the NULL TLV
+		mem := make(memoryTag, t2tDataStart+t2tMaxRead+t2tReadSize)
+		copy(mem[t2tDataStart:], data)
+
+		msg, err := ReadNDEF(mem)
+		if err != nil {
+			msg = data
+		}
+		records, err := ParseNDEF(msg)
+		if err != nil {
+			return
+		}
+		size := 0
+		for _, r := range records {
+			size += len(r.Type) + len(r.ID) + len(r.Payload)
+		}
+		if len(records) == 0 || size > len(msg) {
+			t.Fatalf("ParseNDEF returned %d records of %d bytes from a %d byte message", len(records), size, len(msg))
+		}
+		if token, ok := FindAccessToken(records); ok {
+			if _, err := ParseAccessToken(token, pub); err == nil {
+				t.Fatal("expected a token not signed by the key to be rejected")
+			}
+		}
+	})
+}
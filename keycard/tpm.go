@@ -0,0 +1,96 @@
+package keycard
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	tpmDevice      = "/dev/tpmrm0"
+	tpmDefaultPCRs = "sha256:0,7"
+
+	tpmPublicExt  = ".tpm.pub"
+	tpmPrivateExt = ".tpm.priv"
+)
+
+// TPMSealer seals secrets to the TPM's storage hierarchy under a PCR policy,
+// so that the sealed blobs can only be unsealed on the same board while it
+// measures the same boot state. It drives the tpm2-tools binaries.
+type TPMSealer struct {
+	PCRs string // PCR selection, e.g. "sha256:0,7"
+}
+
+func NewTPMSealer(pcrs string) *TPMSealer {
+	if pcrs == "" {
+		pcrs = tpmDefaultPCRs
+	}
+	return &TPMSealer{PCRs: pcrs}
+}
+
+// Seal seals secret to the current PCR values and writes the blobs to
+// base.tpm.pub and base.tpm.priv
+func (t *TPMSealer) Seal(secret []byte, base string) error {
+	tmp, err := os.MkdirTemp("", "keycard-tpm")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	primary := filepath.Join(tmp, "primary.ctx")
+	policy := filepath.Join(tmp, "policy.digest")
+
+	if _, err := tpm2(nil, "tpm2_createprimary", "-Q", "-C", "o", "-c", primary); err != nil {
+		return err
+	}
+	if _, err := tpm2(nil, "tpm2_createpolicy", "-Q", "--policy-pcr", "-l", t.PCRs, "-L", policy); err != nil {
+		return err
+	}
+	_, err = tpm2(secret, "tpm2_create", "-Q", "-C", primary, "-L", policy, "-i", "-",
+		"-u", base+tpmPublicExt, "-r", base+tpmPrivateExt)
+	return err
+}
+
+// Unseal loads the blobs written by Seal and unseals them. It fails if the
+// PCRs no longer match or the blobs were sealed by another TPM.
+func (t *TPMSealer) Unseal(base string) ([]byte, error) {
+	if _, err := os.Stat(base + tpmPrivateExt); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, filepath.Base(base))
+	}
+
+	tmp, err := os.MkdirTemp("", "keycard-tpm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	primary := filepath.Join(tmp, "primary.ctx")
+	object := filepath.Join(tmp, "object.ctx")
+
+	if _, err := tpm2(nil, "tpm2_createprimary", "-Q", "-C", "o", "-c", primary); err != nil {
+		return nil, err
+	}
+	if _, err := tpm2(nil, "tpm2_load", "-Q", "-C", primary,
+		"-u", base+tpmPublicExt, "-r", base+tpmPrivateExt, "-c", object); err != nil {
+		return nil, err
+	}
+	return tpm2(nil, "tpm2_unseal", "-c", object, "-p", "pcr:"+t.PCRs)
+}
+
+// tpm2 runs a tpm2-tools command, feeding it stdin if given
+func tpm2(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,140 @@
+package keycard
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// randomUIDPrefix marks a 4-byte UID as random (ISO 14443-3 "RID"), as
+// sent by phones emulating cards and some clone cards
+const randomUIDPrefix = 0x08
+
+// cascadeTag precedes the UID bytes of a cascade level that is followed by
+// another one in ISO 14443-3 anticollision
+const cascadeTag = 0x88
+
+var ErrInvalidUID = errors.New("invalid UID")
+
+// uidSeparators are stripped from UIDs typed by hand or copied from tools
+var uidSeparators = strings.NewReplacer(" ", "", ":", "", "-", "")
+
+// NormalizeUID returns the canonical upper-case hex form of a 4-, 7- or
+// 10-byte UID. Separators are stripped and cascade tags copied along from
+// raw anticollision data (88 + 3 UID bytes per level) are removed.
+func NormalizeUID(s string) (string, error) {
+	clean := uidSeparators.Replace(strings.TrimSpace(s))
+	if len(clean)%2 != 0 {
+		return "", fmt.Errorf("%w %q: odd number of hex digits", ErrInvalidUID, s)
+	}
+	b, err := hex.DecodeString(clean)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: not hex", ErrInvalidUID, s)
+	}
+
+	switch {
+	case len(b) == 8 && b[0] == cascadeTag:
+		b = b[1:]
+	case len(b) == 12 && b[0] == cascadeTag && b[4] == cascadeTag:
+		b = append(b[1:4:4], b[5:]...)
+	}
+
+	switch len(b) {
+	case 4, 7, 10:
+	default:
+		return "", fmt.Errorf("%w %q: %d bytes, expected 4, 7 or 10", ErrInvalidUID, s, len(b))
+	}
+	return strings.ToUpper(hex.EncodeToString(b)), nil
+}
+
+// normalizeUIDRule is NormalizeUID that also accepts prefix rules ending in
+// UIDWildcard
+func normalizeUIDRule(s string) (string, error) {
+	prefix, ok := strings.CutSuffix(strings.TrimSpace(s), UIDWildcard)
+	if !ok {
+		return NormalizeUID(s)
+	}
+
+	clean := strings.ToUpper(uidSeparators.Replace(prefix))
+	if clean == "" || len(clean) >= 20 {
+		return "", fmt.Errorf("%w %q: invalid prefix length", ErrInvalidUID, s)
+	}
+	if strings.Trim(clean, "0123456789ABCDEF") != "" {
+		return "", fmt.Errorf("%w %q: not hex", ErrInvalidUID, s)
+	}
+	return clean + UIDWildcard, nil
+}
+
+// normalizeUIDs normalizes all UIDs, failing on the first invalid one
+func normalizeUIDs(uids []string) ([]string, error) {
+	normalized := make([]string, len(uids))
+	for i, uid := range uids {
+		var err error
+		if normalized[i], err = NormalizeUID(uid); err != nil {
+			return nil, err
+		}
+	}
+	return normalized, nil
+}
+
+// canonicalUID normalizes a UID for lookups; invalid UIDs match nothing
+func canonicalUID(s string) string {
+	uid, err := NormalizeUID(s)
+	if err != nil {
+		return ""
+	}
+	return uid
+}
+
+// IsRandomUID reports whether uid is a random ID that changes on every
+// activation and therefore cannot identify a card
+func IsRandomUID(uid string) bool {
+	b, err := hex.DecodeString(uid)
+	return err == nil && len(b) == 4 && b[0] == randomUIDPrefix
+}
+
+// maxUIDSize is the longest UID NormalizeUID accepts
+const maxUIDSize = 10
+
+// uidKey holds a UID in a fixed-size array. Unlike hex strings it contains
+// no pointers, so maps keyed by it take no separate allocation per entry
+// and are skipped by the garbage collector.
+type uidKey struct {
+	n uint8
+	b [maxUIDSize]byte
+}
+
+// makeUIDKey converts a hex UID; prefix rules and invalid UIDs have no key
+func makeUIDKey(uid string) (uidKey, bool) {
+	var k uidKey
+	if uid == "" || len(uid) > 2*maxUIDSize || len(uid)%2 != 0 {
+		return k, false
+	}
+	for i := 0; i < len(uid); i += 2 {
+		hi, ok1 := fromHexChar(uid[i])
+		lo, ok2 := fromHexChar(uid[i+1])
+		if !ok1 || !ok2 {
+			return k, false
+		}
+		k.b[i/2] = hi<<4 | lo
+	}
+	k.n = uint8(len(uid) / 2)
+	return k, true
+}
+
+func (k uidKey) bytes() []byte {
+	return k.b[:k.n]
+}
+
+func fromHexChar(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,213 @@
+package keycard
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		// Single size (4 bytes)
+		{"aabbccdd", "AABBCCDD"},
+		{"AA BB CC DD", "AABBCCDD"},
+		{"aa:bb:cc:dd", "AABBCCDD"},
+		{"AA-BB-CC-DD", "AABBCCDD"},
+		{" aabbccdd\n", "AABBCCDD"},
+		// Double size (7 bytes)
+		{"04aabbccddeeff", "04AABBCCDDEEFF"},
+		{"04:AA:BB:CC:DD:EE:FF", "04AABBCCDDEEFF"},
+		// Double size with the cascade tag of CL1
+		{"88 04 AA BB CC DD EE FF", "04AABBCCDDEEFF"},
+		// Triple size (10 bytes)
+		{"04AABBCCDDEEFF001122", "04AABBCCDDEEFF001122"},
+		// Triple size with the cascade tags of CL1 and CL2
+		{"88 04 AA BB 88 CC DD EE FF 00 11 22", "04AABBCCDDEEFF001122"},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeUID(tt.in)
+		if err != nil {
+			t.Errorf("NormalizeUID(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("NormalizeUID(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeUID_Invalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"AABBCCD",            // odd length
+		"AABBCCDDE",          // odd length
+		"GGBBCCDD",           // not hex
+		"AABBCC",             // 3 bytes
+		"AABBCCDDEE",         // 5 bytes
+		"04AABBCCDDEEFF00",   // 8 bytes without cascade tag
+		"04AABBCCDDEEFF0011", // 9 bytes
+		"AABB*",              // prefix rules are not UIDs
+	} {
+		if _, err := NormalizeUID(in); !errors.Is(err, ErrInvalidUID) {
+			t.Errorf("NormalizeUID(%q) = %v, want ErrInvalidUID", in, err)
+		}
+	}
+}
+
+func TestNormalizeUIDRule(t *testing.T) {
+	if got, err := normalizeUIDRule("04:aa:bb*"); err != nil || got != "04AABB*" {
+		t.Errorf("normalizeUIDRule = %q, %v", got, err)
+	}
+	if got, err := normalizeUIDRule("aa bb cc dd"); err != nil || got != "AABBCCDD" {
+		t.Errorf("normalizeUIDRule = %q, %v", got, err)
+	}
+	for _, in := range []string{"*", "XY*", "04AABBCCDDEEFF001122*"} {
+		if _, err := normalizeUIDRule(in); err == nil {
+			t.Errorf("normalizeUIDRule(%q) should fail", in)
+		}
+	}
+}
+
+func TestAuthManager_RejectsInvalidUID(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if err := am.SetMaster("MASTER01"); !errors.Is(err, ErrInvalidUID) {
+		t.Errorf("SetMaster with invalid UID = %v, want ErrInvalidUID", err)
+	}
+	if _, err := am.AddAuthorized("AABBCC"); !errors.Is(err, ErrInvalidUID) {
+		t.Errorf("AddAuthorized with invalid UID = %v, want ErrInvalidUID", err)
+	}
+	if err := am.Import([]CardRecord{{UID: "AABBC", Role: RoleAuthorized}}, false); !errors.Is(err, ErrInvalidUID) {
+		t.Errorf("Import with invalid UID = %v, want ErrInvalidUID", err)
+	}
+}
+
+func TestIsRandomUID(t *testing.T) {
+	if !IsRandomUID("08A1B2C3") {
+		t.Error("expected 4-byte UID starting with 08 to be random")
+	}
+	for _, uid := range []string{"04A1B2C3", "08A1B2C3D4E5F6", "AABBCCDD"} {
+		if IsRandomUID(uid) {
+			t.Errorf("expected %s not to be random", uid)
+		}
+	}
+}
+
+func TestCloneRanges(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, cloneRangesFileName), []byte(
+		"# magic card batch\n"+
+			"04AA0000-04AA00FF\n"+
+			"0412*\n"), 0644)
+
+	c, err := LoadCloneRanges(dir)
+	if err != nil {
+		t.Fatalf("LoadCloneRanges failed: %v", err)
+	}
+
+	for _, uid := range []string{"01020304", "04AA0042", "04123456789ABC"} {
+		if !c.Contains(uid) {
+			t.Errorf("expected %s to be in a clone range", uid)
+		}
+	}
+	for _, uid := range []string{"04AA0100", "04AA00420000AA", "04A1B2C3"} {
+		if c.Contains(uid) {
+			t.Errorf("expected %s not to be in a clone range", uid)
+		}
+	}
+
+	os.WriteFile(filepath.Join(dir, cloneRangesFileName), []byte("04AA00FF-04AA0000\n"), 0644)
+	if _, err := LoadCloneRanges(dir); err == nil {
+		t.Error("expected inverted range to be rejected")
+	}
+}
+
+// fakeT2T is the memory of a Type 2 Tag, read four pages at a time
+type fakeT2T struct {
+	pages [][]byte
+}
+
+func (f *fakeT2T) ReadBinary(address uint16) ([]byte, error) {
+	var block []byte
+	for p := int(address) / t2tPageSize; p < int(address)/t2tPageSize+4; p++ {
+		block = append(block, f.pages[p]...)
+	}
+	return append(block, 0x00), nil
+}
+
+func (f *fakeT2T) WriteBinary(address uint16, data []byte) error {
+	f.pages[address/t2tPageSize] = append([]byte{}, data...)
+	return nil
+}
+
+func TestCardMAC(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "card.key"), []byte("c2VjcmV0"), 0600)
+	se, err := OpenSecureElement("file:"+dir, "")
+	if err != nil {
+		t.Fatalf("OpenSecureElement failed: %v", err)
+	}
+	defer se.Close()
+
+	tag := &fakeT2T{pages: make([][]byte, 45)}
+	for i := range tag.pages {
+		tag.pages[i] = make([]byte, t2tPageSize)
+	}
+	mac, err := CardMAC(se, "04A1B2C3D4E5F6")
+	if err != nil {
+		t.Fatalf("CardMAC failed: %v", err)
+	}
+	if err := WriteCardMAC(tag, 36, mac); err != nil {
+		t.Fatalf("WriteCardMAC failed: %v", err)
+	}
+	if ok, err := VerifyCardMAC(tag, 36, mac); !ok || err != nil {
+		t.Errorf("expected MAC to verify, got %v, %v", ok, err)
+	}
+
+	// A card with the same memory but another UID has another MAC
+	other, _ := CardMAC(se, "04A1B2C3D4E5F7")
+	if ok, _ := VerifyCardMAC(tag, 36, other); ok {
+		t.Error("expected MAC of another UID not to verify")
+	}
+
+	am, _ := NewAuthManager(t.TempDir())
+	am.AddAuthorized("04A1B2C3D4E5F6")
+	if am.HasMAC("04A1B2C3D4E5F6") {
+		t.Error("expected card without MAC")
+	}
+	am.SetMAC("04A1B2C3D4E5F6")
+	if !am.HasMAC("04A1B2C3D4E5F6") {
+		t.Error("expected card with MAC")
+	}
+}
+
+func FuzzNormalizeUID(f *testing.F) {
+	for _, s := range []string{"aabbccdd", "88 04 AA BB CC DD EE FF", "88 04 AA BB 88 CC DD EE FF 00 11 22", "E0:04:01:50:12:34:56:78", "04AA*", "zz", ""} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		normalizeUIDRule(s)
+		uid, err := NormalizeUID(s)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidUID) {
+				t.Fatalf("NormalizeUID(%q) failed without ErrInvalidUID: %v", s, err)
+			}
+			return
+		}
+		if again, err := NormalizeUID(uid); err != nil || again != uid {
+			t.Fatalf("NormalizeUID(%q) = %q, which normalizes to %q, %v", s, uid, again, err)
+		}
+		k, ok := makeUIDKey(uid)
+		if !ok || hex.EncodeToString(k.bytes()) != strings.ToLower(uid) {
+			t.Fatalf("NormalizeUID(%q) = %q has no matching key", s, uid)
+		}
+	})
+}
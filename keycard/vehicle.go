@@ -0,0 +1,125 @@
+package keycard
+
+import (
+	"log/slog"
+	"sync"
+
+	ipc "github.com/librescoot/redis-ipc"
+)
+
+const (
+	vehicleHashKey      = "vehicle"
+	vehicleCommandQueue = "scooter:state"
+	powerCommandQueue   = "scooter:power"
+
+	VehicleStateStandBy      = "stand-by"
+	VehicleStateParked       = "parked"
+	VehicleStateReadyToDrive = "ready-to-drive"
+
+	KickstandDown = "down"
+	KickstandUp   = "up"
+)
+
+// VehicleMonitor tracks the vehicle state published by the vehicle service
+type VehicleMonitor struct {
+	mu        sync.RWMutex
+	logger    *slog.Logger
+	watcher   *ipc.HashWatcher
+	state     string
+	kickstand string
+	changes   chan string
+}
+
+// NewVehicleMonitor creates a monitor for the vehicle hash
+func NewVehicleMonitor(r *RedisClient, logger *slog.Logger) *VehicleMonitor {
+	v := &VehicleMonitor{
+		logger:  logger,
+		changes: make(chan string, 1),
+	}
+
+	v.watcher = r.client.NewHashWatcher(vehicleHashKey)
+	v.watcher.OnField("state", func(value string) error {
+		v.mu.Lock()
+		v.state = value
+		v.mu.Unlock()
+		v.logger.Debug("Vehicle state changed", "state", value)
+
+		select {
+		case <-v.changes:
+		default:
+		}
+		v.changes <- value
+		return nil
+	})
+	v.watcher.OnField("kickstand", func(value string) error {
+		v.mu.Lock()
+		v.kickstand = value
+		v.mu.Unlock()
+		v.logger.Debug("Kickstand changed", "kickstand", value)
+		return nil
+	})
+
+	return v
+}
+
+// Start subscribes to vehicle updates and fetches the current state
+func (v *VehicleMonitor) Start() error {
+	return v.watcher.StartWithSync()
+}
+
+// Stop unsubscribes from vehicle updates
+func (v *VehicleMonitor) Stop() error {
+	return v.watcher.Stop()
+}
+
+// StateChanges delivers the latest vehicle state; states not picked up yet
+// are replaced by newer ones
+func (v *VehicleMonitor) StateChanges() <-chan string {
+	return v.changes
+}
+
+// State returns the last known vehicle state ("" if unknown)
+func (v *VehicleMonitor) State() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.state
+}
+
+// IsParked reports whether the scooter is standing on its kickstand.
+// The kickstand field is authoritative; without it the vehicle state is used.
+// Anything the vehicle service has not published, or that is not known to be
+// parked, counts as not parked.
+func (v *VehicleMonitor) IsParked() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return isParked(v.kickstand, v.state)
+}
+
+func isParked(kickstand, state string) bool {
+	switch kickstand {
+	case KickstandDown:
+		return true
+	case KickstandUp:
+		return false
+	}
+	return state == VehicleStateParked || state == VehicleStateStandBy
+}
+
+// Published reports whether the vehicle service has published a state or
+// kickstand position yet
+func (v *VehicleMonitor) Published() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.state != "" || v.kickstand != ""
+}
+
+// IsUnlocked reports whether the vehicle service considers the scooter unlocked
+func (v *VehicleMonitor) IsUnlocked() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return vehicleUnlocked(v.state)
+}
+
+func vehicleUnlocked(state string) bool {
+	return state == VehicleStateParked || state == VehicleStateReadyToDrive
+}
@@ -0,0 +1,106 @@
+package keycard
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const storeWatchPollMs = 500
+
+// StoreWatcher reports changes to the card store and the policy script made
+// by other processes, e.g. a provisioning script editing the data directory
+// over SSH
+type StoreWatcher struct {
+	fd     int
+	logger *slog.Logger
+}
+
+// NewStoreWatcher sets up an inotify watch on the data directory. The
+// directory is watched rather than the file since atomic writes replace it.
+func NewStoreWatcher(dataDir string, logger *slog.Logger) (*StoreWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+	if _, err := unix.InotifyAddWatch(fd, dataDir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %w", dataDir, err)
+	}
+	return &StoreWatcher{fd: fd, logger: logger}, nil
+}
+
+// Close releases a watcher that is not run
+func (w *StoreWatcher) Close() error {
+	return unix.Close(w.fd)
+}
+
+// Run calls onChange with storeFileName whenever the card store or the
+// denylist is written, and with policyScriptName whenever the policy script
+// is, until ctx is cancelled
+func (w *StoreWatcher) Run(ctx context.Context, onChange func(file string)) {
+	defer unix.Close(w.fd)
+
+	buf := make([]byte, 4096)
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	for ctx.Err() == nil {
+		n, err := unix.Poll(fds, storeWatchPollMs)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			w.logger.Error("Store watch failed", "error", err)
+			return
+		}
+
+		n, err = unix.Read(w.fd, buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			w.logger.Error("Store watch failed", "error", err)
+			return
+		}
+
+		store, policy := changedFiles(buf[:n])
+		if store {
+			onChange(storeFileName)
+		}
+		if policy {
+			onChange(policyScriptName)
+		}
+	}
+}
+
+// changedFiles reports whether any of the inotify events concern the card
+// store or the denylist, and whether any concern the policy script
+func changedFiles(buf []byte) (store, policy bool) {
+	for len(buf) >= unix.SizeofInotifyEvent {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		end := unix.SizeofInotifyEvent + int(event.Len)
+		if end > len(buf) {
+			break
+		}
+		name := string(trimNul(buf[unix.SizeofInotifyEvent:end]))
+		switch name {
+		case storeFileName, revokedFileName:
+			store = true
+		case policyScriptName:
+			policy = true
+		}
+		buf = buf[end:]
+	}
+	return store, policy
+}
+
+func trimNul(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,135 @@
+package keycard
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookKeyID           = "webhook"
+	webhookSignatureHeader = "X-Keycard-Signature"
+	webhookMaxQueued       = 100 // later notifications are dropped while this many wait
+	webhookAttempts        = 5
+	webhookRetryMin        = time.Second
+)
+
+// WebhookPayload is the JSON body POSTed for a notification
+type WebhookPayload struct {
+	Event  string         `json:"event"`
+	Code   int            `json:"code,omitempty"`
+	Time   int64          `json:"time"` // Unix milliseconds
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+// webhookError is an HTTP status not worth retrying
+type webhookError struct {
+	status string
+}
+
+func (e *webhookError) Error() string {
+	return "unexpected status " + e.status
+}
+
+// WebhookSender POSTs notifications to a URL in order, signing each body
+// with the HMAC-SHA256 of the shared "webhook" key in the
+// X-Keycard-Signature header as "sha256=<hex>". Failed deliveries are
+// retried with jittered exponential backoff, then dropped.
+type WebhookSender struct {
+	url    string
+	sign   func([]byte) ([]byte, error)
+	logger *slog.Logger
+	client *http.Client
+	queue  chan WebhookPayload
+	retry  time.Duration // first retry delay
+}
+
+func NewWebhookSender(url string, sign func([]byte) ([]byte, error), logger *slog.Logger) *WebhookSender {
+	return &WebhookSender{
+		url:    url,
+		sign:   sign,
+		logger: logger,
+		client: &http.Client{Timeout: syncTimeout},
+		queue:  make(chan WebhookPayload, webhookMaxQueued),
+		retry:  webhookRetryMin,
+	}
+}
+
+// Send queues a notification without waiting for its delivery
+func (w *WebhookSender) Send(event string, code int, fields map[string]any) {
+	p := WebhookPayload{Event: event, Code: code, Time: time.Now().UnixMilli(), Fields: fields}
+	select {
+	case w.queue <- p:
+	default:
+		w.logger.Warn("Webhook queue full, dropping notification", "event", event)
+	}
+}
+
+// Run delivers queued notifications until ctx is cancelled
+func (w *WebhookSender) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-w.queue:
+			if err := w.deliver(ctx, p); err != nil && ctx.Err() == nil {
+				w.logger.Warn("Webhook delivery failed", "event", p.Event, "error", err)
+			}
+		}
+	}
+}
+
+// deliver POSTs a notification, retrying failures other than client errors
+func (w *WebhookSender) deliver(ctx context.Context, p WebhookPayload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	mac, err := w.sign(body)
+	if err != nil {
+		return fmt.Errorf("failed to sign webhook: %w", err)
+	}
+	signature := "sha256=" + hex.EncodeToString(mac)
+
+	retry := w.retry
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, body, signature)
+		if _, permanent := err.(*webhookError); err == nil || permanent || attempt == webhookAttempts {
+			return err
+		}
+		w.logger.Debug("Webhook delivery failed, retrying", "event", p.Event, "error", err, "retry", retry)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(retry)):
+		}
+		retry *= 2
+	}
+}
+
+func (w *WebhookSender) post(ctx context.Context, body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signature)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		return &webhookError{status: resp.Status}
+	}
+	return fmt.Errorf("unexpected status %s", resp.Status)
+}
@@ -0,0 +1,340 @@
+package keycard
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	hal "github.com/librescoot/pn7150"
+)
+
+var ErrWizardAborted = errors.New("provisioning aborted")
+
+// WizardOptions control how a Wizard enrolls rider cards
+type WizardOptions struct {
+	Role  string // role of rider cards, default authorized
+	Uses  int    // uses of guest cards
+	Group string
+	Reset bool // replace an enrolled master card and all cards
+}
+
+// WizardSummary lists what a Wizard enrolled
+type WizardSummary struct {
+	Master    string
+	NewMaster bool
+	Added     []CardRecord
+	Enrolled  int // cards enrolled in total, the master card included
+}
+
+// Wizard walks a technician through enrolling the master card and the
+// first rider cards on a bench. It prompts on a terminal and cues on the
+// LED: blinking while it waits for a card, green for a card enrolled, amber
+// for one already enrolled and red for one refused.
+type Wizard struct {
+	auth  *AuthManager
+	rgb   RGBLed
+	led   *Animator
+	lines chan string
+	out   io.Writer
+	opts  WizardOptions
+	flash time.Duration
+}
+
+func NewWizard(auth *AuthManager, led RGBLed, in io.Reader, out io.Writer, opts WizardOptions) *Wizard {
+	if opts.Role == "" {
+		opts.Role = RoleAuthorized
+	}
+	w := &Wizard{
+		auth:  auth,
+		rgb:   led,
+		led:   NewAnimator(led, SystemClock),
+		lines: make(chan string),
+		out:   out,
+		opts:  opts,
+		flash: flashDuration,
+	}
+	go func() {
+		defer close(w.lines)
+		sc := bufio.NewScanner(in)
+		for sc.Scan() {
+			w.lines <- strings.TrimSpace(sc.Text())
+		}
+	}()
+	return w
+}
+
+// Close turns the LED off
+func (w *Wizard) Close() error {
+	return w.led.Close()
+}
+
+// Run enrolls the master card unless one is kept, then rider cards until
+// the technician presses Enter. taps delivers the UIDs of arriving cards.
+// The summary holds what was enrolled even if Run fails.
+func (w *Wizard) Run(ctx context.Context, taps <-chan string) (*WizardSummary, error) {
+	sum := &WizardSummary{}
+	if err := checkEnrollable(Card{Role: w.opts.Role, Uses: w.opts.Uses}); err != nil {
+		return sum, err
+	}
+
+	err := w.enrollMaster(ctx, taps, sum)
+	if err == nil {
+		err = w.enrollRiders(ctx, taps, sum)
+	}
+	w.led.Off()
+	sum.Enrolled = len(w.auth.Records())
+	if ctx.Err() != nil {
+		err = ErrWizardAborted
+	}
+	return sum, err
+}
+
+func (w *Wizard) enrollMaster(ctx context.Context, taps <-chan string, sum *WizardSummary) error {
+	records := w.auth.Records()
+	if w.auth.HasMaster() {
+		for _, r := range records {
+			if r.Role == RoleMaster {
+				sum.Master = r.UID
+				break
+			}
+		}
+		if !w.opts.Reset {
+			fmt.Fprintf(w.out, "Master card %s is enrolled, keeping it and the enrolled cards\n", sum.Master)
+			return nil
+		}
+	}
+	if len(records) > 0 {
+		// As in master learning mode, a new master card starts a new store
+		fmt.Fprintf(w.out, "Enrolling a new master card removes all %d enrolled cards. Continue? [y/N] ", len(records))
+		answer, err := w.readLine(ctx)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if !strings.EqualFold(answer, "y") && !strings.EqualFold(answer, "yes") {
+			return ErrWizardAborted
+		}
+		sum.Master = ""
+	}
+
+	for {
+		fmt.Fprintf(w.out, "Step 1: tap the master card\n")
+		w.led.Play(BlinkAnimation(w.rgb.On, 0, blinkInterval))
+		uid, err := w.awaitTap(ctx, taps)
+		if err != nil {
+			return err
+		}
+		if reason := w.refuse(uid); reason != "" {
+			fmt.Fprintf(w.out, "  %s cannot be the master card: %s\n", uid, reason)
+			w.cue(ctx, w.rgb.Red)
+			continue
+		}
+
+		fmt.Fprintf(w.out, "  Tap %s again to confirm\n", uid)
+		again, err := w.awaitTap(ctx, taps)
+		if err != nil {
+			return err
+		}
+		if again != uid {
+			fmt.Fprintf(w.out, "  %s is a different card, starting over\n", again)
+			w.cue(ctx, w.rgb.Red)
+			continue
+		}
+
+		if err := w.auth.SetMaster(uid); err != nil {
+			return fmt.Errorf("failed to enroll master card: %w", err)
+		}
+		sum.Master, sum.NewMaster = uid, true
+		fmt.Fprintf(w.out, "  Master card %s enrolled\n", uid)
+		w.cue(ctx, w.rgb.Green)
+		return nil
+	}
+}
+
+func (w *Wizard) enrollRiders(ctx context.Context, taps <-chan string, sum *WizardSummary) error {
+	fmt.Fprintf(w.out, "Step 2: tap each %s card, then press Enter when done\n", w.opts.Role)
+	for {
+		w.led.Play(BlinkAnimation(w.rgb.On, 0, blinkInterval))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-w.lines:
+			// Enter, or the end of the input
+			return nil
+		case uid := <-taps:
+			if err := w.enrollRider(ctx, uid, sum); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *Wizard) enrollRider(ctx context.Context, uid string, sum *WizardSummary) error {
+	switch {
+	case w.auth.IsMaster(uid):
+		fmt.Fprintf(w.out, "  %s is the master card\n", uid)
+		w.cue(ctx, w.rgb.Red)
+		return nil
+	case w.auth.Role(uid) != "":
+		fmt.Fprintf(w.out, "  %s is already enrolled\n", uid)
+		w.cue(ctx, w.rgb.Amber)
+		return nil
+	}
+	if reason := w.refuse(uid); reason != "" {
+		fmt.Fprintf(w.out, "  %s cannot be enrolled: %s\n", uid, reason)
+		w.cue(ctx, w.rgb.Red)
+		return nil
+	}
+
+	w.led.Play(SolidAnimation(w.rgb.Amber))
+	fmt.Fprintf(w.out, "  Label for %s (Enter for none): ", uid)
+	label, err := w.readLine(ctx)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	card := Card{UID: uid, Role: w.opts.Role, Uses: w.opts.Uses, Label: label, Group: w.opts.Group}
+	if _, err := w.auth.AddCard(card); err != nil {
+		return fmt.Errorf("failed to enroll %s: %w", uid, err)
+	}
+	sum.Added = append(sum.Added, CardRecord{UID: uid, Label: label, Role: card.Role, Uses: card.Uses, Group: card.Group})
+	fmt.Fprintf(w.out, "  %s enrolled (%d so far)\n", uid, len(sum.Added))
+	w.cue(ctx, w.rgb.Green)
+	return nil
+}
+
+// refuse returns why a card cannot be enrolled, or ""
+func (w *Wizard) refuse(uid string) string {
+	switch {
+	case IsRandomUID(uid):
+		return "its UID changes with every tap"
+	case w.auth.IsRevoked(uid):
+		return "it is revoked"
+	}
+	return ""
+}
+
+// cue flashes a color and waits for the flash to end, so the next prompt's
+// cue does not cut it short
+func (w *Wizard) cue(ctx context.Context, color func() error) {
+	w.led.Play(FlashAnimation(color, w.flash))
+	w.led.Settle(ctx)
+}
+
+func (w *Wizard) awaitTap(ctx context.Context, taps <-chan string) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case uid, ok := <-taps:
+		if !ok {
+			return "", fmt.Errorf("reader closed")
+		}
+		return uid, nil
+	}
+}
+
+func (w *Wizard) readLine(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case line, ok := <-w.lines:
+		if !ok {
+			return "", io.EOF
+		}
+		return line, nil
+	}
+}
+
+// Print writes the summary
+func (sum *WizardSummary) Print(out io.Writer) {
+	fmt.Fprintf(out, "\nSummary:\n")
+	switch {
+	case sum.Master == "":
+		fmt.Fprintf(out, "  Master card: none\n")
+	case sum.NewMaster:
+		fmt.Fprintf(out, "  Master card: %s (new)\n", sum.Master)
+	default:
+		fmt.Fprintf(out, "  Master card: %s\n", sum.Master)
+	}
+	fmt.Fprintf(out, "  Cards added: %d\n", len(sum.Added))
+	for _, r := range sum.Added {
+		line := fmt.Sprintf("    %s %s", r.UID, r.Role)
+		if r.Role == RoleGuest {
+			line += fmt.Sprintf(" (%d uses)", r.Uses)
+		}
+		if r.Label != "" {
+			line += " " + r.Label
+		}
+		fmt.Fprintln(out, line)
+	}
+	fmt.Fprintf(out, "  Cards enrolled: %d\n", sum.Enrolled)
+}
+
+// TagReader delivers the UIDs of cards arriving at the PN7150, for tools
+// using the reader while the service is stopped
+type TagReader struct {
+	nfc  *hal.PN7150
+	uids chan string
+	stop chan struct{}
+	done chan struct{}
+}
+
+func OpenTagReader(device string) (*TagReader, error) {
+	nfc, err := hal.NewPN7150(device, nil, nil, true, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NFC HAL: %w", err)
+	}
+	if err := nfc.Initialize(); err != nil {
+		nfc.Deinitialize()
+		return nil, fmt.Errorf("failed to initialize NFC HAL: %w", err)
+	}
+	if err := nfc.StartDiscovery(defaultPollPeriod); err != nil {
+		nfc.Deinitialize()
+		return nil, fmt.Errorf("failed to start discovery: %w", err)
+	}
+
+	r := &TagReader{nfc: nfc, uids: make(chan string), stop: make(chan struct{}), done: make(chan struct{})}
+	go r.run()
+	return r, nil
+}
+
+func (r *TagReader) run() {
+	defer close(r.done)
+	defer close(r.uids)
+	events := r.nfc.GetTagEventChannel()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Type != hal.TagArrival || e.Error != nil || e.Tag == nil {
+				continue
+			}
+			select {
+			case r.uids <- tagUID(e.Tag):
+			case <-r.stop:
+				return
+			}
+		}
+	}
+}
+
+// UIDs delivers the UID of every card arriving
+func (r *TagReader) UIDs() <-chan string {
+	return r.uids
+}
+
+// Close stops discovery and shuts the reader down
+func (r *TagReader) Close() error {
+	close(r.stop)
+	<-r.done
+	r.nfc.StopDiscovery()
+	r.nfc.Deinitialize()
+	return nil
+}
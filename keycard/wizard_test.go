@@ -0,0 +1,151 @@
+package keycard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wizardRun drives a Wizard with taps and lines typed by a technician
+type wizardRun struct {
+	t     *testing.T
+	taps  chan string
+	input *io.PipeWriter
+	out   strings.Builder
+	done  chan struct{}
+	sum   *WizardSummary
+	err   error
+}
+
+func startWizard(t *testing.T, am *AuthManager, opts WizardOptions) *wizardRun {
+	in, input := io.Pipe()
+	r := &wizardRun{t: t, taps: make(chan string), input: input, done: make(chan struct{})}
+	w := NewWizard(am, nopLED{}, in, &r.out, opts)
+	w.flash = time.Millisecond
+	t.Cleanup(func() {
+		input.Close()
+		w.Close()
+	})
+
+	go func() {
+		defer close(r.done)
+		r.sum, r.err = w.Run(context.Background(), r.taps)
+	}()
+	return r
+}
+
+func (r *wizardRun) tap(uid string) {
+	select {
+	case r.taps <- uid:
+	case <-r.done:
+		r.t.Fatalf("wizard ended before tap of %s: %v", uid, r.err)
+	case <-time.After(5 * time.Second):
+		r.t.Fatalf("wizard did not wait for a tap of %s", uid)
+	}
+}
+
+func (r *wizardRun) typeLine(line string) {
+	if _, err := io.WriteString(r.input, line+"\n"); err != nil {
+		r.t.Fatalf("failed to type %q: %v", line, err)
+	}
+}
+
+func (r *wizardRun) wait() (*WizardSummary, error) {
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		r.t.Fatal("wizard did not finish")
+	}
+	return r.sum, r.err
+}
+
+func TestWizard(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	r := startWizard(t, am, WizardOptions{})
+	r.tap(testMasterUID)
+	r.tap("04112233445566") // not the same card
+	r.tap(testMasterUID)
+	r.tap(testMasterUID)
+	r.tap("04AABBCCDDEEFF")
+	r.typeLine("Alice")
+	r.tap(testMasterUID)    // refused
+	r.tap("04AABBCCDDEEFF") // already enrolled
+	r.tap("08123456")       // random
+	r.tap("11223344")
+	r.typeLine("")
+	r.typeLine("")
+	sum, err := r.wait()
+	if err != nil {
+		t.Fatalf("Run failed: %v\n%s", err, r.out.String())
+	}
+
+	if sum.Master != testMasterUID || !sum.NewMaster {
+		t.Errorf("expected master %s to be new, got %+v", testMasterUID, sum)
+	}
+	if len(sum.Added) != 2 || sum.Added[0].Label != "Alice" || sum.Added[1].UID != "11223344" || sum.Enrolled != 3 {
+		t.Errorf("expected two cards to be added, got %+v", sum)
+	}
+	if !am.IsMaster(testMasterUID) || !am.IsAuthorized("04AABBCCDDEEFF") || !am.IsAuthorized("11223344") || am.IsAuthorized("08123456") {
+		t.Errorf("unexpected store: %+v", am.Records())
+	}
+
+	var out strings.Builder
+	sum.Print(&out)
+	if !strings.Contains(out.String(), "04AABBCCDDEEFF authorized Alice") {
+		t.Errorf("expected the summary to list the labelled card, got:\n%s", out.String())
+	}
+}
+
+func TestWizard_KeepsMaster(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if err := am.SetMaster(testMasterUID); err != nil {
+		t.Fatalf("SetMaster failed: %v", err)
+	}
+
+	r := startWizard(t, am, WizardOptions{Role: RoleGuest, Uses: 3})
+	r.tap("04AABBCCDDEEFF")
+	r.typeLine("")
+	r.typeLine("")
+	sum, err := r.wait()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if sum.Master != testMasterUID || sum.NewMaster {
+		t.Errorf("expected the master card to be kept, got %+v", sum)
+	}
+	if !am.IsGuest("04AABBCCDDEEFF") {
+		t.Error("expected the card to be enrolled as a guest card")
+	}
+}
+
+func TestWizard_ResetDeclined(t *testing.T) {
+	am, err := NewAuthManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if err := am.SetMaster(testMasterUID); err != nil {
+		t.Fatalf("SetMaster failed: %v", err)
+	}
+	if _, err := am.AddAuthorized("04AABBCCDDEEFF"); err != nil {
+		t.Fatalf("AddAuthorized failed: %v", err)
+	}
+
+	r := startWizard(t, am, WizardOptions{Reset: true})
+	r.typeLine("n")
+	if _, err := r.wait(); !errors.Is(err, ErrWizardAborted) {
+		t.Fatalf("expected the wizard to abort, got %v", err)
+	}
+	if !am.IsMaster(testMasterUID) || !am.IsAuthorized("04AABBCCDDEEFF") {
+		t.Error("expected the store to be unchanged")
+	}
+}